@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//Account status values. Deactivation is permanent
+const ACCOUNT_ACTIVE string = "Active"
+const ACCOUNT_SUSPENDED string = "Suspended"
+const ACCOUNT_DEACTIVATED string = "Deactivated"
+
+//The statuses an account can be moved from, by the status it is moved to
+var accountTransitions = map[string][]string{
+	ACCOUNT_SUSPENDED:   []string{ACCOUNT_ACTIVE},
+	ACCOUNT_ACTIVE:      []string{ACCOUNT_SUSPENDED},
+	ACCOUNT_DEACTIVATED: []string{ACCOUNT_ACTIVE, ACCOUNT_SUSPENDED},
+}
+
+//Kinds of application a reassignment prompt is for
+const PROMPT_MORTGAGE_APPLICATION string = "mortgageApplication"
+const PROMPT_APPRAISER_APPLICATION string = "appraiserApplication"
+
+type AccountStatusChange struct {
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Reason    string `json:"reason"`
+	ChangedBy string `json:"changedBy"`
+	ChangedAt string `json:"changedAt"`
+}
+
+/**
+An open application held by a deactivated user, which an admin must hand to someone else
+**/
+type ReassignmentPrompt struct {
+	ApplicationType string `json:"applicationType"`
+	ApplicationId   string `json:"applicationId"`
+	Role            string `json:"role"`
+	Status          string `json:"status"`
+	CreatedAt       string `json:"createdAt"`
+}
+
+/**
+The status of a user's account and every change to it. Users without a record are active
+**/
+type AccountStatus struct {
+	UserId              string                `json:"userId"`
+	Status              string                `json:"status"`
+	History             []AccountStatusChange `json:"history"`
+	ReassignmentPrompts []ReassignmentPrompt  `json:"reassignmentPrompts"`
+}
+
+func LoadAccountStatus(stub *shim.ChaincodeStub, userId string) (AccountStatus, error) {
+	account := AccountStatus{UserId: userId, Status: ACCOUNT_ACTIVE, History: []AccountStatusChange{}, ReassignmentPrompts: []ReassignmentPrompt{}}
+
+	key, err := GetStateKey(userId, ACCOUNT)
+	if err != nil {
+		return account, err
+	}
+
+	bytes, err := stub.GetState(key)
+	if err != nil {
+		fmt.Println("LoadAccountStatus: Could not fetch account status of "+userId, err)
+		return account, err
+	}
+	if len(bytes) == 0 {
+		return account, nil
+	}
+
+	err = json.Unmarshal(bytes, &account)
+	if err != nil {
+		fmt.Println("LoadAccountStatus: Could not unmarshal account status of "+userId, err)
+		return account, err
+	}
+
+	return account, nil
+}
+
+func SaveAccountStatus(stub *shim.ChaincodeStub, account AccountStatus) ([]byte, error) {
+	fmt.Println("Entering SaveAccountStatus")
+
+	key, err := GetStateKey(account.UserId, ACCOUNT)
+	if err != nil {
+		return nil, err
+	}
+
+	bytes, _ := json.Marshal(&account)
+	err = stub.PutState(key, bytes)
+	if err != nil {
+		fmt.Println("SaveAccountStatus: Could not save account status ", err)
+		return nil, err
+	}
+	return bytes, nil
+}
+
+/**
+Returns an error unless the user's account is active
+**/
+func CheckAccountActive(stub *shim.ChaincodeStub, userId string) error {
+	account, err := LoadAccountStatus(stub, userId)
+	if err != nil {
+		return err
+	}
+	if account.Status != ACCOUNT_ACTIVE {
+		return errors.New("Account of user " + userId + " is " + account.Status)
+	}
+	return nil
+}
+
+/**
+Returns the appraisers on a panel whose accounts are not active, with the reason
+**/
+func inactiveAppraisers(stub *shim.ChaincodeStub, panel AppraiserPanel) map[string]string {
+	inactive := map[string]string{}
+	for _, a := range panel.Appraisers {
+		account, err := LoadAccountStatus(stub, a.AppraiserId)
+		if err == nil && account.Status != ACCOUNT_ACTIVE {
+			inactive[a.AppraiserId] = "account " + strings.ToLower(account.Status)
+		}
+	}
+	return inactive
+}
+
+/**
+Returns a prompt for each open mortgage or appraiser application the user reviews or
+appraises
+**/
+func reassignmentPromptsFor(userId string, mas []MortgageApplication, aas []AppraiserApplication, now string) []ReassignmentPrompt {
+	prompts := []ReassignmentPrompt{}
+
+	for _, ma := range mas {
+		if ma.ReviewerId == userId && ActionTaken(ma) == ACTION_PENDING {
+			prompts = append(prompts, ReassignmentPrompt{PROMPT_MORTGAGE_APPLICATION, ma.ID, REL_REVIEWER, ma.Status, now})
+		}
+	}
+	for _, aa := range aas {
+		if aa.Status == AA_COMPLETED {
+			continue
+		}
+		if aa.ReviewerId == userId {
+			prompts = append(prompts, ReassignmentPrompt{PROMPT_APPRAISER_APPLICATION, aa.ID, REL_REVIEWER, aa.Status, now})
+		} else if aa.AppraiserId == userId {
+			prompts = append(prompts, ReassignmentPrompt{PROMPT_APPRAISER_APPLICATION, aa.ID, REL_APPRAISER, aa.Status, now})
+		}
+	}
+	return prompts
+}
+
+/**
+Finds the open mortgage and appraiser applications the user reviews or appraises and
+logs a prompt on each to reassign it
+**/
+func reassignmentPrompts(stub *shim.ChaincodeStub, userId string, now string) ([]ReassignmentPrompt, error) {
+	keys, err := collectKeys(stub, []string{maKeysName, aaKeysName})
+	if err != nil {
+		return nil, err
+	}
+
+	mas := []MortgageApplication{}
+	aas := []AppraiserApplication{}
+	for _, key := range keys {
+		if strings.HasPrefix(key, typeMortgageApplication) {
+			ma, err := LoadMortgageApplication(stub, strings.TrimPrefix(key, typeMortgageApplication))
+			if err == nil {
+				mas = append(mas, ma)
+			}
+		} else if strings.HasPrefix(key, typeAppraiserApplication) {
+			aa, err := LoadAppraiserApplication(stub, strings.TrimPrefix(key, typeAppraiserApplication))
+			if err == nil {
+				aas = append(aas, aa)
+			}
+		}
+	}
+
+	prompts := reassignmentPromptsFor(userId, mas, aas, now)
+	for _, prompt := range prompts {
+		AppendMALog(stub, "ReassignmentPrompt", "The "+prompt.Role+" "+userId+" has been deactivated. This "+prompt.ApplicationType+" needs to be reassigned", prompt.Status, prompt.ApplicationId)
+	}
+	return prompts, nil
+}
+
+/**
+Moves an account to a new status on behalf of an admin and records the change
+**/
+func transitionAccount(account *AccountStatus, callerId string, callerAffiliation int, to string, reason string, now string) error {
+	if callerAffiliation != ADMIN_A {
+		return errors.New(callerId + " is not allowed to change account status")
+	}
+	if account.UserId == callerId {
+		return errors.New("Admins cannot change the status of their own account")
+	}
+	if len(reason) == 0 {
+		return errors.New("A change of account status needs a reason")
+	}
+	if !containsString(accountTransitions[to], account.Status) {
+		return errors.New("Account of user " + account.UserId + " is " + account.Status + " and cannot be changed to " + to)
+	}
+
+	account.History = append(account.History, AccountStatusChange{account.Status, to, reason, callerId, now})
+	account.Status = to
+	return nil
+}
+
+/**
+An admin moves a user's account to a new status
+**/
+func changeAccountStatus(stub *shim.ChaincodeStub, callerId string, callerAffiliation int, args []string, to string) ([]byte, error) {
+	if len(args) < 2 {
+		return nil, errors.New("Could not change account status. Expected a user id and a reason")
+	}
+
+	if callerAffiliation != ADMIN_A {
+		return nil, errors.New(callerId + " is not allowed to change account status")
+	}
+
+	userId := strings.TrimSpace(args[0])
+	reason := strings.TrimSpace(args[1])
+
+	_, err := GetUser(stub, userId)
+	if err != nil {
+		return nil, errors.New("User " + userId + " does not exist")
+	}
+
+	account, err := LoadAccountStatus(stub, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	txTime, err := GetTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	now := txTime.Format(dateLayout)
+
+	err = transitionAccount(&account, callerId, callerAffiliation, to, reason, now)
+	if err != nil {
+		return nil, err
+	}
+
+	if to == ACCOUNT_DEACTIVATED {
+		prompts, err := reassignmentPrompts(stub, userId, now)
+		if err != nil {
+			return nil, err
+		}
+		account.ReassignmentPrompts = append(account.ReassignmentPrompts, prompts...)
+	}
+
+	bytes, err := SaveAccountStatus(stub, account)
+	if err != nil {
+		return nil, err
+	}
+
+	key, _ := GetStateKey(userId, ACCOUNT)
+	AppendMALog(stub, "ChangeAccountStatus", callerId+" changed account of "+userId+" to "+to+": "+reason, to, key)
+
+	return bytes, nil
+}
+
+/**
+An admin suspends an active account until it is reactivated.
+args[0] is the user id and args[1] the reason
+**/
+func SuspendUser(stub *shim.ChaincodeStub, callerId string, callerAffiliation int, args []string) ([]byte, error) {
+	fmt.Println("Entering SuspendUser")
+	return changeAccountStatus(stub, callerId, callerAffiliation, args, ACCOUNT_SUSPENDED)
+}
+
+/**
+An admin reactivates a suspended account.
+args[0] is the user id and args[1] the reason
+**/
+func ReactivateUser(stub *shim.ChaincodeStub, callerId string, callerAffiliation int, args []string) ([]byte, error) {
+	fmt.Println("Entering ReactivateUser")
+	return changeAccountStatus(stub, callerId, callerAffiliation, args, ACCOUNT_ACTIVE)
+}
+
+/**
+An admin permanently deactivates an account. Open applications the user reviews or
+appraises get a reassignment prompt.
+args[0] is the user id and args[1] the reason
+**/
+func DeactivateUser(stub *shim.ChaincodeStub, callerId string, callerAffiliation int, args []string) ([]byte, error) {
+	fmt.Println("Entering DeactivateUser")
+	return changeAccountStatus(stub, callerId, callerAffiliation, args, ACCOUNT_DEACTIVATED)
+}
+
+/**
+Returns the status, history and reassignment prompts of an account to its user and admins.
+args[0] is the user id
+**/
+func GetAccountStatus(stub *shim.ChaincodeStub, callerId string, callerAffiliation int, args []string) ([]byte, error) {
+	fmt.Println("Entering GetAccountStatus")
+
+	if len(args) < 1 {
+		fmt.Println("GetAccountStatus: expected 1 argument")
+		return nil, errors.New("Could not get account status. Invalid input")
+	}
+
+	userId := strings.TrimSpace(args[0])
+	if userId != callerId && callerAffiliation != ADMIN_A {
+		return nil, errors.New("User " + callerId + " does not have rights to read the account status of " + userId)
+	}
+
+	account, err := LoadAccountStatus(stub, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	bytes, err := json.Marshal(&account)
+	if err != nil {
+		return nil, err
+	}
+	return bytes, nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import "testing"
+
+const accountTestNow = "2026-03-01 10:00:00"
+
+func TestAccountTransitions(t *testing.T) {
+	cases := []struct {
+		name   string
+		from   string
+		to     string
+		wantOk bool
+	}{
+		{"suspend an active account", ACCOUNT_ACTIVE, ACCOUNT_SUSPENDED, true},
+		{"reactivate a suspended account", ACCOUNT_SUSPENDED, ACCOUNT_ACTIVE, true},
+		{"deactivate an active account", ACCOUNT_ACTIVE, ACCOUNT_DEACTIVATED, true},
+		{"deactivate a suspended account", ACCOUNT_SUSPENDED, ACCOUNT_DEACTIVATED, true},
+		{"suspend a suspended account", ACCOUNT_SUSPENDED, ACCOUNT_SUSPENDED, false},
+		{"reactivate an active account", ACCOUNT_ACTIVE, ACCOUNT_ACTIVE, false},
+		{"reactivate a deactivated account", ACCOUNT_DEACTIVATED, ACCOUNT_ACTIVE, false},
+		{"suspend a deactivated account", ACCOUNT_DEACTIVATED, ACCOUNT_SUSPENDED, false},
+		{"deactivate a deactivated account", ACCOUNT_DEACTIVATED, ACCOUNT_DEACTIVATED, false},
+	}
+
+	for _, c := range cases {
+		account := AccountStatus{UserId: "bank1", Status: c.from, History: []AccountStatusChange{}}
+		err := transitionAccount(&account, "admin1", ADMIN_A, c.to, "review", accountTestNow)
+		if c.wantOk {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", c.name, err)
+				continue
+			}
+			if account.Status != c.to {
+				t.Errorf("%s: status is %s, want %s", c.name, account.Status, c.to)
+			}
+			if len(account.History) != 1 || account.History[0] != (AccountStatusChange{c.from, c.to, "review", "admin1", accountTestNow}) {
+				t.Errorf("%s: history is %v", c.name, account.History)
+			}
+		} else {
+			if err == nil {
+				t.Errorf("%s: expected an error", c.name)
+			}
+			if account.Status != c.from || len(account.History) != 0 {
+				t.Errorf("%s: account changed to %s with history %v", c.name, account.Status, account.History)
+			}
+		}
+	}
+}
+
+func TestAccountTransitionChecksCaller(t *testing.T) {
+	cases := []struct {
+		name        string
+		callerId    string
+		affiliation int
+		reason      string
+	}{
+		{"bank", "bank9", BANK_A, "review"},
+		{"regulator", "regulator1", REGULATOR_A, "review"},
+		{"admin changing their own account", "bank1", ADMIN_A, "review"},
+		{"admin without a reason", "admin1", ADMIN_A, ""},
+	}
+
+	for _, c := range cases {
+		account := AccountStatus{UserId: "bank1", Status: ACCOUNT_ACTIVE, History: []AccountStatusChange{}}
+		err := transitionAccount(&account, c.callerId, c.affiliation, ACCOUNT_SUSPENDED, c.reason, accountTestNow)
+		if err == nil {
+			t.Errorf("%s: expected an error", c.name)
+		}
+		if account.Status != ACCOUNT_ACTIVE || len(account.History) != 0 {
+			t.Errorf("%s: account changed to %s", c.name, account.Status)
+		}
+	}
+}
+
+func TestSuspendReactivateDeactivate(t *testing.T) {
+	account := AccountStatus{UserId: "appraiser1", Status: ACCOUNT_ACTIVE, History: []AccountStatusChange{}}
+
+	steps := []string{ACCOUNT_SUSPENDED, ACCOUNT_ACTIVE, ACCOUNT_SUSPENDED, ACCOUNT_DEACTIVATED}
+	for _, to := range steps {
+		err := transitionAccount(&account, "admin1", ADMIN_A, to, "step to "+to, accountTestNow)
+		if err != nil {
+			t.Fatalf("moving to %s: %v", to, err)
+		}
+	}
+
+	if account.Status != ACCOUNT_DEACTIVATED {
+		t.Errorf("status is %s, want %s", account.Status, ACCOUNT_DEACTIVATED)
+	}
+	if len(account.History) != len(steps) {
+		t.Fatalf("history has %d changes, want %d", len(account.History), len(steps))
+	}
+	from := ACCOUNT_ACTIVE
+	for i, change := range account.History {
+		if change.From != from || change.To != steps[i] {
+			t.Errorf("change %d is %s to %s, want %s to %s", i, change.From, change.To, from, steps[i])
+		}
+		from = change.To
+	}
+
+	//Deactivation is permanent
+	for _, to := range []string{ACCOUNT_ACTIVE, ACCOUNT_SUSPENDED} {
+		if transitionAccount(&account, "admin1", ADMIN_A, to, "undo", accountTestNow) == nil {
+			t.Errorf("a deactivated account was moved to %s", to)
+		}
+	}
+}
+
+func TestReassignmentPrompts(t *testing.T) {
+	mas := []MortgageApplication{
+		{ID: "ma-open", ReviewerId: "bank1", Status: "Submitted"},
+		{ID: "ma-approved", ReviewerId: "bank1", Status: MA_APPROVED},
+		{ID: "ma-denied", ReviewerId: "bank1", Status: MA_DENIED},
+		{ID: "ma-funded", ReviewerId: "bank1", Status: "Submitted", LoanId: "loan1"},
+		{ID: "ma-other", ReviewerId: "bank2", Status: "Submitted"},
+	}
+	aas := []AppraiserApplication{
+		{ID: "aa-open", ReviewerId: "bank1", AppraiserId: "appraiser1", Status: "Submitted"},
+		{ID: "aa-done", ReviewerId: "bank1", AppraiserId: "appraiser1", Status: AA_COMPLETED},
+		{ID: "aa-other", ReviewerId: "bank2", AppraiserId: "appraiser2", Status: "Submitted"},
+	}
+
+	cases := []struct {
+		userId string
+		want   []ReassignmentPrompt
+	}{
+		{"bank1", []ReassignmentPrompt{
+			{PROMPT_MORTGAGE_APPLICATION, "ma-open", REL_REVIEWER, "Submitted", accountTestNow},
+			{PROMPT_APPRAISER_APPLICATION, "aa-open", REL_REVIEWER, "Submitted", accountTestNow},
+		}},
+		{"appraiser1", []ReassignmentPrompt{
+			{PROMPT_APPRAISER_APPLICATION, "aa-open", REL_APPRAISER, "Submitted", accountTestNow},
+		}},
+		{"appraiser2", []ReassignmentPrompt{
+			{PROMPT_APPRAISER_APPLICATION, "aa-other", REL_APPRAISER, "Submitted", accountTestNow},
+		}},
+		{"buyer1", []ReassignmentPrompt{}},
+	}
+
+	for _, c := range cases {
+		got := reassignmentPromptsFor(c.userId, mas, aas, accountTestNow)
+		if len(got) != len(c.want) {
+			t.Errorf("%s: got %d prompts %v, want %v", c.userId, len(got), got, c.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != c.want[i] {
+				t.Errorf("%s: prompt %d is %v, want %v", c.userId, i, got[i], c.want[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+/**
+Everything a deployment sets up at Init. The first admin can only be created here, every
+other admin is registered by an existing one
+**/
+type InitSchema struct {
+	Admin    string          `json:"admin"`
+	Identity *IdentityConfig `json:"identity"`
+	Setup    bool            `json:"setup"`
+}
+
+/**
+Creates an admin. Like a regulator an admin cannot be created over an existing user
+**/
+func CreateAdmin(stub *shim.ChaincodeStub, key string, id string) (User, error) {
+	fmt.Println("Entering CreateAdmin")
+
+	admin := User{id, ADMIN_A}
+
+	bytes, err := stub.GetState(key)
+	if err != nil {
+		return admin, err
+	}
+	if len(bytes) > 0 {
+		return admin, errors.New("User " + id + " already exists")
+	}
+
+	bytes, _ = json.Marshal(&admin)
+	err = stub.PutState(key, bytes)
+	if err != nil {
+		fmt.Println("CreateAdmin: Could not save admin ", err)
+		return admin, err
+	}
+	return admin, nil
+}
+
+/**
+Initializes a deployment: creates the first admin, optionally chooses the identity
+provider and loads the sample records, and brings the state to SCHEMA_VERSION. Only
+called from Init.
+args[0] is an InitSchema json string
+**/
+func Initialize(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	fmt.Println("Entering Initialize")
+
+	if len(args) < 1 {
+		return nil, errors.New("Could not initialize. Expected an init config")
+	}
+
+	var input InitSchema
+	err := json.Unmarshal([]byte(args[0]), &input)
+	if err != nil {
+		fmt.Println("Initialize: Could not unmarshal init config ", err)
+		return nil, err
+	}
+
+	adminId := strings.TrimSpace(input.Admin)
+	if len(adminId) == 0 {
+		return nil, errors.New("Could not initialize. Expected the id of the first admin")
+	}
+
+	if input.Identity != nil {
+		_, err = saveIdentityConfig(stub, *input.Identity)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	key, _ := GetStateKey(adminId, USER)
+	_, err = CreateAdmin(stub, key, adminId)
+	if err != nil {
+		return nil, err
+	}
+
+	if input.Setup {
+		_, err = Setup(stub, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	//Stamps the schema version, migrating any records an earlier version left behind
+	_, err = migrateState(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(adminId), nil
+}
+
+/**
+An admin creates a user with a role that grants rights over other users' records. These
+roles cannot be taken through CreateUser.
+args[0] is the user id, args[1] the affiliation and, for a regulator or licensing
+authority, args[2] a comma separated list of jurisdictions
+**/
+func RegisterUser(stub *shim.ChaincodeStub, callerId string, callerAffiliation int, args []string) ([]byte, error) {
+	fmt.Println("Entering RegisterUser")
+
+	if len(args) < 2 {
+		fmt.Println("RegisterUser: Did not recieve enough parameters for registering a user")
+		return nil, errors.New("Could not register user. Expected a user id and an affiliation")
+	}
+
+	if callerAffiliation != ADMIN_A {
+		return nil, errors.New(callerId + " is not allowed to register users")
+	}
+
+	id := strings.TrimSpace(args[0])
+	if len(id) == 0 {
+		return nil, errors.New("Invalid user Id")
+	}
+	affiliation, err := strconv.Atoi(strings.TrimSpace(args[1]))
+	if err != nil {
+		return nil, errors.New("Invalid affiliation")
+	}
+
+	key, err := GetStateKey(id, USER)
+	if err != nil {
+		return nil, err
+	}
+
+	switch affiliation {
+	case ADMIN_A:
+		_, err = CreateAdmin(stub, key, id)
+	case REGULATOR_A:
+		if len(args) < 3 {
+			return nil, errors.New("A regulator needs a comma separated list of jurisdictions")
+		}
+		_, err = CreateRegulator(stub, key, id, ParseJurisdictions(args[2]))
+	case LICENSING_A:
+		if len(args) < 3 {
+			return nil, errors.New("A licensing authority needs a comma separated list of jurisdictions")
+		}
+		_, err = CreateLicensingAuthority(stub, key, id, ParseJurisdictions(args[2]))
+	case KYC_A:
+		_, err = CreateKycProvider(stub, key, id, callerId)
+	case ESCROW_A:
+		_, err = CreateEscrowAgent(stub, key, id, callerId)
+	default:
+		return nil, errors.New("Affiliation " + strconv.Itoa(affiliation) + " is created through CreateUser")
+	}
+	if err != nil {
+		fmt.Println("RegisterUser: Could not register user ", err)
+		return nil, err
+	}
+
+	AppendMALog(stub, "RegisterUser", callerId+" registered "+id+" with affiliation "+strconv.Itoa(affiliation), "", key)
+
+	fmt.Println("RegisterUser: Successfully registered user with ID: " + id)
+	return []byte(id), nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//Maximum number of co-applicants on one mortgage application
+const MAX_CO_APPLICANTS int = 4
+
+/**
+A borrower applying jointly with the primary applicant. The primary applicant stays in
+BuyerId, PersonalInfo and FinancialInfo on the mortgage application. A co-applicant only
+joins the application once they consent to it
+**/
+type CoApplicant struct {
+	BuyerId       string        `json:"buyerId"`
+	Relationship  string        `json:"relationship"`
+	PersonalInfo  PersonalInfo  `json:"personalInfo"`
+	FinancialInfo FinancialInfo `json:"financialInfo"`
+	Consented     bool          `json:"consented"`
+	ConsentedAt   string        `json:"consentedAt"`
+}
+
+/**
+Returns the ids of every applicant, primary applicant first
+**/
+func ApplicantIds(ma MortgageApplication) []string {
+	ids := []string{ma.BuyerId}
+	for _, co := range ma.CoApplicants {
+		ids = append(ids, co.BuyerId)
+	}
+	return ids
+}
+
+/**
+Returns true if the user is the primary applicant or a co-applicant who has consented
+**/
+func IsMortgageApplicant(ma MortgageApplication, id string) bool {
+	if len(id) == 0 {
+		return false
+	}
+	if id == ma.BuyerId {
+		return true
+	}
+	for _, co := range ma.CoApplicants {
+		if co.BuyerId == id && co.Consented {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+Returns the ids of the co-applicants who have not consented yet
+**/
+func PendingCoApplicants(ma MortgageApplication) []string {
+	var ids []string
+	for _, co := range ma.CoApplicants {
+		if !co.Consented {
+			ids = append(ids, co.BuyerId)
+		}
+	}
+	return ids
+}
+
+/**
+Checks that every co-applicant is an existing buyer identified once who is not the
+primary applicant. Users are only read, so an unknown id is never created as a buyer.
+Consent given in the input is cleared, co-applicants consent through
+ConsentToMortgageApplication
+**/
+func ValidateCoApplicants(stub *shim.ChaincodeStub, ma *MortgageApplication) error {
+	if len(ma.CoApplicants) > MAX_CO_APPLICANTS {
+		return errors.New("A mortgage application can have at most " + strconv.Itoa(MAX_CO_APPLICANTS) + " co-applicants")
+	}
+
+	seen := map[string]bool{ma.BuyerId: true}
+	for i := range ma.CoApplicants {
+		id := strings.TrimSpace(ma.CoApplicants[i].BuyerId)
+		if len(id) == 0 {
+			return errors.New("Co-applicant is missing a buyer id")
+		}
+		if seen[id] {
+			return errors.New("Applicant " + id + " is listed more than once")
+		}
+		seen[id] = true
+
+		user, err := GetUser(stub, id)
+		if err != nil || user.Affiliation != BUYER_A {
+			return errors.New("Co-applicant " + id + " is not a registered buyer")
+		}
+
+		ma.CoApplicants[i].BuyerId = id
+		ma.CoApplicants[i].Consented = false
+		ma.CoApplicants[i].ConsentedAt = ""
+	}
+	return nil
+}
+
+/**
+A co-applicant consents to a mortgage application they were named on. Only then is the
+application listed for them and can they see it.
+args[0] is the mortgage application id
+**/
+func ConsentToMortgageApplication(stub *shim.ChaincodeStub, callerId string, callerAffiliation int, args []string) ([]byte, error) {
+	fmt.Println("Entering ConsentToMortgageApplication")
+
+	if len(args) < 1 {
+		fmt.Println("ConsentToMortgageApplication: expected 1 argument")
+		return nil, errors.New("Could not consent to mortgage application. Invalid input")
+	}
+
+	ma, err := LoadMortgageApplication(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	var co *CoApplicant
+	for i := range ma.CoApplicants {
+		if ma.CoApplicants[i].BuyerId == callerId {
+			co = &ma.CoApplicants[i]
+		}
+	}
+	if co == nil {
+		return nil, errors.New("User with id " + callerId + " is not named as a co-applicant on mortgage application " + ma.ID)
+	}
+	if co.Consented {
+		return nil, errors.New("User with id " + callerId + " has already consented to mortgage application " + ma.ID)
+	}
+
+	txTime, err := GetTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	co.Consented = true
+	co.ConsentedAt = txTime.Format(dateLayout)
+
+	_, err = SaveMortgageApplication(stub, ma, ma.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	userKey, _ := GetStateKey(callerId, USER)
+	buyer, err := GetBuyer(stub, userKey)
+	if err != nil {
+		return nil, err
+	}
+	if !containsString(buyer.MortgageApplications, ma.ID) {
+		buyer.MortgageApplications = append(buyer.MortgageApplications, ma.ID)
+		err = SaveBuyer(stub, buyer, userKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	AppendMALog(stub, "ConsentToMortgageApplication", callerId+" consented to join as co-applicant", ma.Status, ma.ID)
+
+	bytes, err := json.Marshal(co)
+	if err != nil {
+		return nil, err
+	}
+	return bytes, nil
+}
+
+/**
+Adds up the financial info of every applicant so the application can be underwritten
+on household income and obligations
+**/
+func CombineFinancialInfo(ma MortgageApplication) (FinancialInfo, error) {
+	combined := ma.FinancialInfo
+
+	for _, co := range ma.CoApplicants {
+		pairs := []struct {
+			total *Money
+			add   Money
+		}{
+			{&combined.MonthlySalary, co.FinancialInfo.MonthlySalary},
+			{&combined.OtherIncome, co.FinancialInfo.OtherIncome},
+			{&combined.OtherExpenditure, co.FinancialInfo.OtherExpenditure},
+			{&combined.MonthlyRent, co.FinancialInfo.MonthlyRent},
+			{&combined.MonthlyLoanPayment, co.FinancialInfo.MonthlyLoanPayment},
+		}
+		for _, p := range pairs {
+			if p.add.IsZero() {
+				continue
+			}
+			sum, err := p.total.Add(p.add)
+			if err != nil {
+				return combined, errors.New("Co-applicant " + co.BuyerId + ": " + err.Error())
+			}
+			*p.total = sum
+		}
+	}
+
+	return combined, nil
+}
+
+/**
+Total monthly income of all applicants
+**/
+func CombinedMonthlyIncome(ma MortgageApplication) (Money, error) {
+	combined, err := CombineFinancialInfo(ma)
+	if err != nil {
+		return Money{}, err
+	}
+	return combined.MonthlySalary.Add(combined.OtherIncome)
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//Valuation approaches
+const APPROACH_SALES_COMPARISON string = "sales_comparison"
+const APPROACH_COST string = "cost"
+const APPROACH_INCOME string = "income"
+
+var appraisalApproaches = []string{APPROACH_SALES_COMPARISON, APPROACH_COST, APPROACH_INCOME}
+
+//Condition ratings from C1 (new) to C6 (severe damage)
+var conditionRatings = []string{"C1", "C2", "C3", "C4", "C5", "C6"}
+
+//A sales comparison needs at least this many closed sales
+const MIN_COMPARABLES int = 3
+
+//Appraiser application status once a report is submitted
+const AA_COMPLETED string = "Completed"
+
+type Adjustment struct {
+	Description string `json:"description"`
+	Amount      Money  `json:"amount"`
+}
+
+/**
+A closed sale used as a comparable. PropertyId and Price must match the sales contract.
+AdjustedPrice is computed by the chaincode from the adjustments
+**/
+type Comparable struct {
+	SalesContractId string       `json:"salesContractId"`
+	PropertyId      string       `json:"propertyId"`
+	Price           Money        `json:"price"`
+	Adjustments     []Adjustment `json:"adjustments"`
+	AdjustedPrice   Money        `json:"adjustedPrice"`
+}
+
+type AppraisalReport struct {
+	Approach        string       `json:"approach"`
+	Comparables     []Comparable `json:"comparables"`
+	ConditionRating string       `json:"conditionRating"`
+	EffectiveDate   string       `json:"effectiveDate"`
+	FairMarketValue Money        `json:"fairMarketValue"`
+	Notes           string       `json:"notes"`
+	SubmittedBy     string       `json:"submittedBy"`
+	SubmittedAt     string       `json:"submittedAt"`
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+Validates a comparable against its sales contract and computes the adjusted price
+**/
+func validateComparable(stub *shim.ChaincodeStub, c *Comparable, subjectPropertyId string, currency string) error {
+	c.SalesContractId = strings.TrimSpace(c.SalesContractId)
+	sc, err := LoadSalesContract(stub, c.SalesContractId)
+	if err != nil {
+		return errors.New("Comparable " + c.SalesContractId + ": " + err.Error())
+	}
+
+	return checkComparable(c, sc, subjectPropertyId, currency)
+}
+
+/**
+Checks a comparable against its loaded sales contract and computes the adjusted price
+**/
+func checkComparable(c *Comparable, sc SalesContract, subjectPropertyId string, currency string) error {
+	if sc.Status != SC_CLOSED {
+		return errors.New("Comparable " + sc.ID + " is not a completed sale")
+	}
+	if strings.TrimSpace(c.PropertyId) != sc.PropertyId {
+		return errors.New("Comparable " + sc.ID + " is for property " + sc.PropertyId + ", not " + c.PropertyId)
+	}
+	if sc.PropertyId == subjectPropertyId {
+		return errors.New("Comparable " + sc.ID + " is a sale of the subject property")
+	}
+	if c.Price != sc.Price {
+		return errors.New("Comparable " + sc.ID + " price " + c.Price.String() + " does not match the contract price " + sc.Price.String())
+	}
+	if sc.Price.Currency != currency {
+		return errors.New("Comparable " + sc.ID + " is in " + sc.Price.Currency + ", report is in " + currency)
+	}
+
+	var err error
+	adjusted := c.Price
+	for _, a := range c.Adjustments {
+		if len(strings.TrimSpace(a.Description)) == 0 {
+			return errors.New("Comparable " + sc.ID + " has an adjustment without a description")
+		}
+		adjusted, err = adjusted.Add(a.Amount)
+		if err != nil {
+			return errors.New("Comparable " + sc.ID + " adjustment: " + err.Error())
+		}
+	}
+	if adjusted.Amount <= 0 {
+		return errors.New("Comparable " + sc.ID + " adjusted price must be positive")
+	}
+	c.AdjustedPrice = adjusted
+
+	return nil
+}
+
+/**
+Validates an appraisal report for the subject property and fills in computed values
+**/
+func ValidateAppraisalReport(stub *shim.ChaincodeStub, report *AppraisalReport, subjectPropertyId string, txTime time.Time) error {
+	report.Approach = strings.ToLower(strings.TrimSpace(report.Approach))
+	if !containsString(appraisalApproaches, report.Approach) {
+		return errors.New("Invalid approach " + report.Approach + ". Expected one of " + strings.Join(appraisalApproaches, ", "))
+	}
+
+	report.ConditionRating = strings.ToUpper(strings.TrimSpace(report.ConditionRating))
+	if !containsString(conditionRatings, report.ConditionRating) {
+		return errors.New("Invalid condition rating " + report.ConditionRating + ". Expected one of " + strings.Join(conditionRatings, ", "))
+	}
+
+	effective, err := time.Parse(loanDateLayout, strings.TrimSpace(report.EffectiveDate))
+	if err != nil {
+		return errors.New("Invalid effective date " + report.EffectiveDate + ". Expected format " + loanDateLayout)
+	}
+	if effective.After(txTime) {
+		return errors.New("Effective date " + report.EffectiveDate + " is in the future")
+	}
+
+	if report.FairMarketValue.Amount <= 0 {
+		return errors.New("Fair market value must be greater than zero")
+	}
+	err = report.FairMarketValue.Validate()
+	if err != nil {
+		return err
+	}
+
+	if report.Approach == APPROACH_SALES_COMPARISON && len(report.Comparables) < MIN_COMPARABLES {
+		return errors.New("A sales comparison needs at least " + strconv.Itoa(MIN_COMPARABLES) + " comparable sales")
+	}
+
+	for i := range report.Comparables {
+		for j := 0; j < i; j++ {
+			if strings.TrimSpace(report.Comparables[j].SalesContractId) == strings.TrimSpace(report.Comparables[i].SalesContractId) {
+				return errors.New("Comparable " + report.Comparables[i].SalesContractId + " is listed more than once")
+			}
+		}
+		err = validateComparable(stub, &report.Comparables[i], subjectPropertyId, report.FairMarketValue.Currency)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/**
+Submits the appraisal report for an appraiser application. Only the assigned appraiser
+can submit the report and only once, later revisions go through reconsideration of
+value. The fair market value of the report is propagated to the
+linked mortgage application.
+args[0] is the appraiser application id and args[1] an AppraisalReport json string
+**/
+func SubmitAppraisalReport(stub *shim.ChaincodeStub, callerId string, callerAffiliation int, args []string) ([]byte, error) {
+	fmt.Println("Entering SubmitAppraisalReport")
+
+	if len(args) < 2 {
+		fmt.Println("SubmitAppraisalReport: expected two arguments")
+		return nil, errors.New("Could not submit appraisal report. Invalid input")
+	}
+
+	aa, _, err := GetAppraiserApplication(stub, callerId, callerAffiliation, []string{args[0]})
+	if err != nil {
+		return nil, err
+	}
+
+	err = Authorize(stub, callerId, callerAffiliation, APPRAISERAPPLICATION, OP_UPDATE, aa)
+	if err != nil {
+		return nil, err
+	}
+	if aa.Status == AA_COMPLETED {
+		return nil, errors.New("Appraisal report of appraiser application " + aa.ID + " was already submitted. Revisions go through reconsideration of value")
+	}
+
+	err = CheckAppraiserLicense(stub, aa)
+	if err != nil {
+		return nil, err
+	}
+
+	var report AppraisalReport
+	err = json.Unmarshal([]byte(args[1]), &report)
+	if err != nil {
+		fmt.Println("SubmitAppraisalReport: Could not unmarshal report ", err)
+		return nil, err
+	}
+
+	txTime, err := GetTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	now := txTime.Format(dateLayout)
+
+	err = ValidateAppraisalReport(stub, &report, aa.PropertyId, txTime)
+	if err != nil {
+		return nil, err
+	}
+	report.SubmittedBy = callerId
+	report.SubmittedAt = now
+
+	currentStatus := aa.Status
+	aa.Report = report
+	aa.FairMarketValue = report.FairMarketValue
+	aa.Status = AA_COMPLETED
+	aa.LastModifiedDate = now
+
+	err = IssueAppraisalInvoice(stub, &aa, txTime)
+	if err != nil {
+		return nil, err
+	}
+
+	bytes, err := SaveAppraiserApplication(stub, aa, aa.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	//A second appraisal's value is only used once the bank selects it
+	if len(aa.SecondAppraisalOf) == 0 {
+		ma, err := LoadMortgageApplication(stub, aa.MortgageApplicationId)
+		if err != nil {
+			return nil, err
+		}
+		err = checkAppraisedValueOpen(ma, aa)
+		if err != nil {
+			return nil, err
+		}
+		err = ApplyAppraisedValue(stub, ma, aa, VALUE_BASIS_APPRAISAL, callerId, now)
+		if err != nil {
+			fmt.Println("SubmitAppraisalReport: Could not update mortgage application ", err)
+			return nil, err
+		}
+	}
+
+	msg := callerId + " submitted " + report.Approach + " appraisal report with fair market value " + report.FairMarketValue.String() + ", condition " + report.ConditionRating + ", " + strconv.Itoa(len(report.Comparables)) + " comparables, effective " + report.EffectiveDate + ". Status changed from " + currentStatus + " to " + aa.Status
+	AppendMALog(stub, "SubmitAppraisalReport", msg, aa.Status, aa.ID)
+
+	return bytes, nil
+}
+
+/**
+Returns the appraisal report of an appraiser application to the appraiser, the
+reviewing bank and auditors.
+args[0] is the appraiser application id
+**/
+func GetAppraisalReport(stub *shim.ChaincodeStub, callerId string, callerAffiliation int, args []string) ([]byte, error) {
+	fmt.Println("Entering GetAppraisalReport")
+
+	aa, _, err := GetAppraiserApplication(stub, callerId, callerAffiliation, args)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(aa.Report.SubmittedAt) == 0 {
+		return nil, errors.New("Appraiser application " + aa.ID + " has no appraisal report")
+	}
+
+	bytes, err := json.Marshal(&aa.Report)
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes, nil
+}
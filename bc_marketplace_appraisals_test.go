@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestValidateAppraisalReport(t *testing.T) {
+	txTime := time.Date(2026, 6, 15, 12, 0, 0, 0, time.UTC)
+	report := func(approach string, rating string, effective string, value Money, comparables int) AppraisalReport {
+		r := AppraisalReport{Approach: approach, ConditionRating: rating, EffectiveDate: effective, FairMarketValue: value}
+		for i := 0; i < comparables; i++ {
+			r.Comparables = append(r.Comparables, Comparable{SalesContractId: "sc" + string(rune('1'+i))})
+		}
+		return r
+	}
+	value := Money{45000000, "USD"}
+
+	cases := []struct {
+		name   string
+		report AppraisalReport
+		wantOk bool
+	}{
+		{"cost approach", report(" Cost ", "c3", "2026-06-01", value, 0), true},
+		{"income approach effective today", report(APPROACH_INCOME, "C1", "2026-06-15", value, 0), true},
+		{"unknown approach", report("guess", "C3", "2026-06-01", value, 0), false},
+		{"unknown condition rating", report(APPROACH_COST, "C7", "2026-06-01", value, 0), false},
+		{"invalid effective date", report(APPROACH_COST, "C3", "06/01/2026", value, 0), false},
+		{"effective date in the future", report(APPROACH_COST, "C3", "2026-06-16", value, 0), false},
+		{"zero value", report(APPROACH_COST, "C3", "2026-06-01", Money{0, "USD"}, 0), false},
+		{"value without a currency", report(APPROACH_COST, "C3", "2026-06-01", Money{45000000, ""}, 0), false},
+		{"sales comparison with too few comparables", report(APPROACH_SALES_COMPARISON, "C3", "2026-06-01", value, MIN_COMPARABLES-1), false},
+	}
+
+	for _, c := range cases {
+		r := c.report
+		err := ValidateAppraisalReport(nil, &r, "property1", txTime)
+		if c.wantOk && err != nil {
+			t.Errorf("%s: unexpected error %v", c.name, err)
+		}
+		if !c.wantOk && err == nil {
+			t.Errorf("%s: expected an error", c.name)
+		}
+	}
+
+	r := report(" Cost ", "c3", "2026-06-01", value, 0)
+	ValidateAppraisalReport(nil, &r, "property1", txTime)
+	if r.Approach != APPROACH_COST || r.ConditionRating != "C3" {
+		t.Errorf("report was not normalized: %s %s", r.Approach, r.ConditionRating)
+	}
+}
+
+func TestCheckComparable(t *testing.T) {
+	sold := SalesContract{ID: "sc1", PropertyId: "property2", Status: SC_CLOSED, Price: Money{40000000, "USD"}}
+	adjust := func(amounts ...int64) []Adjustment {
+		var adjustments []Adjustment
+		for _, a := range amounts {
+			adjustments = append(adjustments, Adjustment{"size", Money{a, "USD"}})
+		}
+		return adjustments
+	}
+
+	cases := []struct {
+		name         string
+		comparable   Comparable
+		sc           SalesContract
+		wantOk       bool
+		wantAdjusted int64
+	}{
+		{"closed sale without adjustments", Comparable{"sc1", "property2", sold.Price, nil, Money{}}, sold, true, 40000000},
+		{"adjusted up and down", Comparable{"sc1", "property2", sold.Price, adjust(2000000, -500000), Money{}}, sold, true, 41500000},
+		{"sale not closed", Comparable{"sc1", "property2", sold.Price, nil, Money{}}, SalesContract{ID: "sc1", PropertyId: "property2", Status: "Submitted", Price: sold.Price}, false, 0},
+		{"another property than the contract", Comparable{"sc1", "property3", sold.Price, nil, Money{}}, sold, false, 0},
+		{"sale of the subject property", Comparable{"sc1", "property1", sold.Price, nil, Money{}}, SalesContract{ID: "sc1", PropertyId: "property1", Status: SC_CLOSED, Price: sold.Price}, false, 0},
+		{"price differs from the contract", Comparable{"sc1", "property2", Money{39000000, "USD"}, nil, Money{}}, sold, false, 0},
+		{"contract in another currency", Comparable{"sc1", "property2", Money{40000000, "EUR"}, nil, Money{}}, SalesContract{ID: "sc1", PropertyId: "property2", Status: SC_CLOSED, Price: Money{40000000, "EUR"}}, false, 0},
+		{"adjustment without a description", Comparable{"sc1", "property2", sold.Price, []Adjustment{{" ", Money{100, "USD"}}}, Money{}}, sold, false, 0},
+		{"adjustment in another currency", Comparable{"sc1", "property2", sold.Price, []Adjustment{{"size", Money{100, "EUR"}}}, Money{}}, sold, false, 0},
+		{"adjusted below zero", Comparable{"sc1", "property2", sold.Price, adjust(-40000000), Money{}}, sold, false, 0},
+	}
+
+	for _, c := range cases {
+		comparable := c.comparable
+		err := checkComparable(&comparable, c.sc, "property1", "USD")
+		if c.wantOk && err != nil {
+			t.Errorf("%s: unexpected error %v", c.name, err)
+		}
+		if !c.wantOk && err == nil {
+			t.Errorf("%s: expected an error", c.name)
+		}
+		if c.wantOk && comparable.AdjustedPrice != (Money{c.wantAdjusted, "USD"}) {
+			t.Errorf("%s: adjusted price is %v, want %d", c.name, comparable.AdjustedPrice, c.wantAdjusted)
+		}
+	}
+}
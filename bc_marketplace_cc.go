@@ -38,11 +38,6 @@ import (
 	"errors"
 	"fmt"
 	"time"
-	"crypto/x509"
-	"encoding/pem"
-	"net/http"
-	"net/url"
-    "io/ioutil"
     "strconv"
 	"strings"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
@@ -61,6 +56,10 @@ var maKeysName = "maKeys"
 var scKeysName = "scKeys"
 var aaKeysName = "aaKeys"
 var maLogKeysName = "maLogKeys"
+var offerKeysName = "offerKeys"
+var escrowKeysName = "escrowKeys"
+var loanKeysName = "loanKeys"
+var invoiceKeysName = "invoiceKeys"
 
 //Blockchain Log Key 
 var bcLogsKey = "bcLogsKey"
@@ -82,6 +81,19 @@ var typeAppraiser = "appraiser:"
 var typeUser = "user:"
 var typeAuditor = "auditor:"
 var typeMALog = "malog:"
+var typeIndex = "idx:"
+var typeOffer = "offer:"
+var typeEscrow = "escrow:"
+var typeLoan = "loan:"
+var typeRateSheet = "ratesheet:"
+var typePanel = "panel:"
+var typeInvoice = "invoice:"
+var typePersonalData = "personaldata:"
+var typeKyc = "kyc:"
+var typeKycPolicy = "kycpolicy:"
+var typeProfile = "profile:"
+var typeLicense = "license:"
+var typeAccount = "account:"
 
 //==============================================================================================================================
 //	 Object types - Each object type is mapped to an integer which we use to compare types
@@ -99,6 +111,19 @@ const   MORTGAGEAPPLICATION int =  10
 const   SALESCONTRACT int =  11
 const   APPRAISERAPPLICATION int =  12
 const   MALOG int =  13
+const   OFFER int =  14
+const   ESCROW int =  15
+const   LOAN int =  16
+const   RATESHEET int =  17
+const   PANEL int =  18
+const   INVOICE int =  19
+const   PERSONALDATA int =  20
+const   KYC int =  21
+const   KYCPOLICY int =  22
+const   PROFILE int =  23
+const   LICENSE int =  24
+const   ACCOUNT int =  25
+const   LENDINGREPORT int =  26
 
 //==============================================================================================================================
 //	 Affiliation types - Each object type is mapped to an integer which we use to compare affiliations
@@ -108,6 +133,11 @@ const   SELLER_A int  =  2
 const   BANK_A int =  3
 const   APPRAISER_A  int =  4
 const   AUDITOR_A int =  5
+const   ESCROW_A int =  6
+const   KYC_A int =  7
+const   REGULATOR_A int =  8
+const   ADMIN_A int =  9
+const   LICENSING_A int =  10
 
 
 
@@ -134,8 +164,9 @@ type Property struct {
 	PermitID string `json:"permitId"`
 	Description string `json:"description"`
 	Address string `json:"address"`
+	Jurisdiction string `json:"jurisdiction"`
 	OwnerId string `json:"ownerId"`
-	RegisteredPrice int `json:"registeredPrice"`
+	RegisteredPrice Money `json:"registeredPrice"`
 	LastModifiedDate string `json:"lastModifiedDate"`
 }
 
@@ -148,16 +179,18 @@ type PropertyAd struct {
 	Address string `json:"address"`
 	SellerID string `json:"sellerId"`
 	BankID string `json:"bankId"`
-	ListedPrice int `json:"listedPrice"`
+	ListedPrice Money `json:"listedPrice"`
+	City string `json:"city"`
+	Status string `json:"status"`
 	LastModifiedDate string `json:"lastModifiedDate"`
 }
 
 type FinancialInfo struct {
-	MonthlySalary int `json:"monthlySalary"`
-	OtherIncome int `json:"otherIncome"`
-	OtherExpenditure int `json:"otherExpenditure"`
-	MonthlyRent int  `json:"monthlyRent"`
-	MonthlyLoanPayment int `json:"monthlyLoanPayment"`
+	MonthlySalary Money `json:"monthlySalary"`
+	OtherIncome Money `json:"otherIncome"`
+	OtherExpenditure Money `json:"otherExpenditure"`
+	MonthlyRent Money  `json:"monthlyRent"`
+	MonthlyLoanPayment Money `json:"monthlyLoanPayment"`
 
 }
 
@@ -182,11 +215,22 @@ type MortgageApplication struct {
 	SalesContractId string `json:"salesContractId"`
 	PersonalInfo  PersonalInfo `json:"personalInfo"`
 	FinancialInfo  FinancialInfo `json:"financialInfo"`
+	CoApplicants  []CoApplicant `json:"coApplicants"`
+	CombinedFinancialInfo  FinancialInfo `json:"combinedFinancialInfo"`
 	Status  string `json:"status"`
-	RequestedAmount  int `json:"requestedAmount"`
-	FairMarketValue  int `json:"fairMarketValue"`
-	ApprovedAmount  int `json:"approvedAmount"`
+	RequestedAmount  Money `json:"requestedAmount"`
+	FairMarketValue  Money `json:"fairMarketValue"`
+	ApprovedAmount  Money `json:"approvedAmount"`
 	ReviewerId  string `json:"reviewerId"`
+	DeclineReasons  []string `json:"declineReasons"`
+	LoanId  string `json:"loanId"`
+	RateLock  RateLock `json:"rateLock"`
+	RequiredDocuments  []string `json:"requiredDocuments"`
+	Documents  []DocumentRecord `json:"documents"`
+	ValueSource  ValueSource `json:"valueSource"`
+	PersonalDataId  string `json:"personalDataId"`
+	ErasureRequests  []ErasureRequest `json:"erasureRequests"`
+	UnmaskGrants  []UnmaskGrant `json:"unmaskGrants"`
 	LastModifiedDate string `json:"lastModifiedDate"`
 }
 
@@ -199,7 +243,11 @@ type SalesContract struct {
 	BuyerSignature string `json:"buyerSignature"`
 	SellerSignature string `json:"sellerSignature"`
 	Status string `json:"status"`
-	Price int `json:"price"`
+	Price Money `json:"price"`
+	OfferId string `json:"offerId"`
+	Contingencies []Contingency `json:"contingencies"`
+	EscrowId string `json:"escrowId"`
+	CancellationRequestedBy string `json:"cancellationRequestedBy"`
 	LastModifiedDate string `json:"lastModifiedDate"`
 }
 
@@ -210,7 +258,15 @@ type AppraiserApplication struct {
 	ReviewerId string `json:"reviewerId"`
 	PropertyId string `json:"propertyId"`
 	Status string `json:"status"`
-	FairMarketValue int `json:"fairMarketValue"`
+	FairMarketValue Money `json:"fairMarketValue"`
+	Region string `json:"region"`
+	AssignmentRationale string `json:"assignmentRationale"`
+	Report AppraisalReport `json:"report"`
+	Reconsiderations []Reconsideration `json:"reconsiderations"`
+	SecondAppraisalOf string `json:"secondAppraisalOf"`
+	SecondAppraisalId string `json:"secondAppraisalId"`
+	FeeQuote Money `json:"feeQuote"`
+	InvoiceId string `json:"invoiceId"`
 	LastModifiedDate string `json:"lastModifiedDate"`
 
 }
@@ -258,27 +314,24 @@ type Appraiser struct {
 
 }
 
-type ECertResponse struct {
-	OK string `json:"OK"`
-}	
-
 type MAUpdateSchema struct {
 	Status string `json:"status"`
 	SalesContractId string `json:"salesContractId"`
-	FairMarketValue int `json:"fairMarketValue"`
-	ApprovedAmount int `json:"approvedAmount"`
+	FairMarketValue Money `json:"fairMarketValue"`
+	ApprovedAmount Money `json:"approvedAmount"`
+	DeclineReasons []string `json:"declineReasons"`
 }
 
 type AAUpdateSchema struct{
 	Status string `json:"status"`
-	FairMarketValue int `json:"fairMarketValue"`
+	FairMarketValue Money `json:"fairMarketValue"`
 }
 
 type SCUpdateSchema struct{
 	Status string `json:"status"`
 	BuyerSignature string `json:"buyerSignature"`
 	SellerSignature string `json:"sellerSignature"`
-	Price int `json:"price"`
+	Price Money `json:"price"`
 }
 
 
@@ -360,14 +413,14 @@ func generatePropertyList(stub *shim.ChaincodeStub)([8]Property, error){
 
 	var propertyList [8] Property
 
-	property1 := Property{"property1", "land1", "permit1",  "Residential House", "4305 22nd street, Flushing, New York, Ny", "jack24", 500000, nowTime.Format("2006-01-02 15:04:05")}
-	property2 := Property{"property2", "land2", "permit2",  "Residential House", "2156 Madison Ave, New York, Ny", "mark14", 500000, nowTime.Format("2006-01-02 15:04:05")}
-	property3 := Property{"property3", "land3", "permit3",  "Residential House", "660 Madison Ave, New York, Ny", "jane24",  500000, nowTime.Format("2006-01-02 15:04:05")}
-	property4 := Property{"property4", "land4", "permit4",  "Residential House", "200 Madison Ave, New York, Ny", "bill24",  500000, nowTime.Format("2006-01-02 15:04:05")}
-	property5 := Property{"property5", "land5", "permit5",  "Residential House", "4305 22nd street, Flushing, New York, Ny", "jack24", 500000, nowTime.Format("2006-01-02 15:04:05")}
-	property6 := Property{"property6", "land6", "permit6",  "Residential House", "2156 Madison Ave, New York, Ny", "mark14", 500000, nowTime.Format("2006-01-02 15:04:05")}
-	property7 := Property{"property7", "land7", "permit7",  "Residential House", "660 Madison Ave, New York, Ny", "jane24",  500000, nowTime.Format("2006-01-02 15:04:05")}
-	property8 := Property{"property8", "land8", "permit8",  "Residential House", "200 Madison Ave, New York, Ny", "bill24",  500000, nowTime.Format("2006-01-02 15:04:05")}
+	property1 := Property{"property1", "land1", "permit1",  "Residential House", "4305 22nd street, Flushing, New York, Ny", "NY", "jack24", WholeUnits(500000, "USD"), nowTime.Format("2006-01-02 15:04:05")}
+	property2 := Property{"property2", "land2", "permit2",  "Residential House", "2156 Madison Ave, New York, Ny", "NY", "mark14", WholeUnits(500000, "USD"), nowTime.Format("2006-01-02 15:04:05")}
+	property3 := Property{"property3", "land3", "permit3",  "Residential House", "660 Madison Ave, New York, Ny", "NY", "jane24",  WholeUnits(500000, "USD"), nowTime.Format("2006-01-02 15:04:05")}
+	property4 := Property{"property4", "land4", "permit4",  "Residential House", "200 Madison Ave, New York, Ny", "NY", "bill24",  WholeUnits(500000, "USD"), nowTime.Format("2006-01-02 15:04:05")}
+	property5 := Property{"property5", "land5", "permit5",  "Residential House", "4305 22nd street, Flushing, New York, Ny", "NY", "jack24", WholeUnits(500000, "USD"), nowTime.Format("2006-01-02 15:04:05")}
+	property6 := Property{"property6", "land6", "permit6",  "Residential House", "2156 Madison Ave, New York, Ny", "NY", "mark14", WholeUnits(500000, "USD"), nowTime.Format("2006-01-02 15:04:05")}
+	property7 := Property{"property7", "land7", "permit7",  "Residential House", "660 Madison Ave, New York, Ny", "NY", "jane24",  WholeUnits(500000, "USD"), nowTime.Format("2006-01-02 15:04:05")}
+	property8 := Property{"property8", "land8", "permit8",  "Residential House", "200 Madison Ave, New York, Ny", "NY", "bill24",  WholeUnits(500000, "USD"), nowTime.Format("2006-01-02 15:04:05")}
 
 
 	propertyList[0] = property1
@@ -417,14 +470,14 @@ func generatePropertyAdsList(stub *shim.ChaincodeStub)([8]PropertyAd, error){
 	var propertyAds [8] PropertyAd
 
 
-	propertyAd1 := PropertyAd{"propertyAd1", "land1", "permit1", "property1", "description", "704 Madison Ave, Apartment no: 402, New York, Ny", "jack24", "Bank Of America", 1000000, nowTime.Format("2006-01-02 15:04:05")}
-	propertyAd2 := PropertyAd{"propertyAd2", "land2", "permit2", "property2", "description", "2156 Madison Ave, Apartment no: 202, New York, Ny", "mark14", "Wells Fargo Mortgage", 1500000, nowTime.Format("2006-01-02 15:04:05")}
-	propertyAd3 := PropertyAd{"propertyAd3", "land3", "permit3", "property3", "description","660 Madison Ave, Apartment no: 302, New York, Ny", "jane24", "CitiMortgage", 2000000, nowTime.Format("2006-01-02 15:04:05")}
-	propertyAd4 := PropertyAd{"propertyAd4", "land4", "permit4", "property4", "description","200 Madison Ave, Apartment no: 402, New York, Ny", "bill24", "JP Morgan", 2500000, nowTime.Format("2006-01-02 15:04:05")}
-	propertyAd5 := PropertyAd{"propertyAd5", "land5", "permit5", "property5", "description", "704 Madison Ave, Apartment no: 402, New York, Ny", "jack24", "Bank Of America", 1000000, nowTime.Format("2006-01-02 15:04:05")}
-	propertyAd6 := PropertyAd{"propertyAd6", "land6", "permit6", "property6", "description", "2156 Madison Ave, Apartment no: 202, New York, Ny", "mark14", "Wells Fargo Mortgage", 1500000, nowTime.Format("2006-01-02 15:04:05")}
-	propertyAd7 := PropertyAd{"propertyAd7", "land7", "permit7", "property7", "description","660 Madison Ave, Apartment no: 302, New York, Ny", "jane24", "CitiMortgage", 2000000, nowTime.Format("2006-01-02 15:04:05")}
-	propertyAd8 := PropertyAd{"propertyAd8", "land1", "permit1", "property1", "description", "704 Madison Ave, Apartment no: 402, New York, Ny", "jack24", "CitiMortgage", 1000000, nowTime.Format("2006-01-02 15:04:05")}
+	propertyAd1 := PropertyAd{"propertyAd1", "land1", "permit1", "property1", "description", "704 Madison Ave, Apartment no: 402, New York, Ny", "jack24", "Bank Of America", WholeUnits(1000000, "USD"), "New York", "Active", nowTime.Format("2006-01-02 15:04:05")}
+	propertyAd2 := PropertyAd{"propertyAd2", "land2", "permit2", "property2", "description", "2156 Madison Ave, Apartment no: 202, New York, Ny", "mark14", "Wells Fargo Mortgage", WholeUnits(1500000, "USD"), "New York", "Active", nowTime.Format("2006-01-02 15:04:05")}
+	propertyAd3 := PropertyAd{"propertyAd3", "land3", "permit3", "property3", "description","660 Madison Ave, Apartment no: 302, New York, Ny", "jane24", "CitiMortgage", WholeUnits(2000000, "USD"), "New York", "Active", nowTime.Format("2006-01-02 15:04:05")}
+	propertyAd4 := PropertyAd{"propertyAd4", "land4", "permit4", "property4", "description","200 Madison Ave, Apartment no: 402, New York, Ny", "bill24", "JP Morgan", WholeUnits(2500000, "USD"), "New York", "Active", nowTime.Format("2006-01-02 15:04:05")}
+	propertyAd5 := PropertyAd{"propertyAd5", "land5", "permit5", "property5", "description", "704 Madison Ave, Apartment no: 402, New York, Ny", "jack24", "Bank Of America", WholeUnits(1000000, "USD"), "New York", "Active", nowTime.Format("2006-01-02 15:04:05")}
+	propertyAd6 := PropertyAd{"propertyAd6", "land6", "permit6", "property6", "description", "2156 Madison Ave, Apartment no: 202, New York, Ny", "mark14", "Wells Fargo Mortgage", WholeUnits(1500000, "USD"), "New York", "Active", nowTime.Format("2006-01-02 15:04:05")}
+	propertyAd7 := PropertyAd{"propertyAd7", "land7", "permit7", "property7", "description","660 Madison Ave, Apartment no: 302, New York, Ny", "jane24", "CitiMortgage", WholeUnits(2000000, "USD"), "New York", "Active", nowTime.Format("2006-01-02 15:04:05")}
+	propertyAd8 := PropertyAd{"propertyAd8", "land1", "permit1", "property1", "description", "704 Madison Ave, Apartment no: 402, New York, Ny", "jack24", "CitiMortgage", WholeUnits(1000000, "USD"), "New York", "Active", nowTime.Format("2006-01-02 15:04:05")}
 
 
 	propertyAds[0] = propertyAd1
@@ -448,6 +501,12 @@ func generatePropertyAdsList(stub *shim.ChaincodeStub)([8]PropertyAd, error){
       	return propertyAds, err
     	}
       paKeys[j] = typePropertyAd+propertyAds[j].ID;
+
+      err = IndexPropertyAd(stub, propertyAds[j])
+      if err!=nil{
+      	fmt.Println("generatePropertyAdsList: Could not index property ad ", err)
+      	return propertyAds, err
+      }
    }
 	
 	paKeyBytes, _ := json.Marshal(&paKeys)
@@ -482,102 +541,44 @@ func InitKeys(stub *shim.ChaincodeStub, keyType string)([]byte, error){
 
 
 //==============================================================================================================================
-//	 get_ecert - Takes the name passed and calls out to the REST API for HyperLedger to retrieve the ecert
-//				 for that user. Returns the ecert as retrived including html encoding.
-//==============================================================================================================================
-func GetEcert(stub *shim.ChaincodeStub, name string) ([]byte, error) {
-	
-	var cert ECertResponse
-	
-	peer_address, err := stub.GetState("Peer_Address")
-															if err != nil { return nil, errors.New("Error retrieving peer address") }
-
-	response, err := http.Get("http://"+string(peer_address)+"/registrar/"+name+"/ecert") 	// Calls out to the HyperLedger REST API to get the ecert of the user with that name
-    
-															if err != nil { return nil, errors.New("Error calling ecert API") }
-	
-	defer response.Body.Close()
-	contents, err := ioutil.ReadAll(response.Body)					// Read the response from the http callout into the variable contents
-	
-															if err != nil { return nil, errors.New("Could not read body") }
-	
-	err = json.Unmarshal(contents, &cert)
-	
-															if err != nil { return nil, errors.New("Could not retrieve ecert for user: "+name) }
-															
-	return []byte(string(cert.OK)), nil
-}
-
-//==============================================================================================================================
-//	 get_caller - Retrieves the username of the user who invoked the chaincode.
-//				  Returns the username as a string.
-//==============================================================================================================================
-
-
-func GetUsername(stub *shim.ChaincodeStub) (string, error) {
-
-	bytes, err := stub.GetCallerCertificate();
-															if err != nil { return "", errors.New("Couldn't retrieve caller certificate") }
-	x509Cert, err := x509.ParseCertificate(bytes);				// Extract Certificate from result of GetCallerCertificate						
-															if err != nil { return "", errors.New("Couldn't parse certificate")	}
-															
-	return x509Cert.Subject.CommonName, nil
-}
-
-//==============================================================================================================================
-//	 check_affiliation - Takes an ecert as a string, decodes it to remove html encoding then parses it and checks the
-// 				  		certificates common name. The affiliation is stored as part of the common name.
-//==============================================================================================================================
-
-func CheckAffiliation(stub *shim.ChaincodeStub, cert string) (int, error) {																																																					
-	
-	decodedCert, err := url.QueryUnescape(cert);    				// make % etc normal //
-	
-															if err != nil { return -1, errors.New("Could not decode certificate") }
-	
-	pem, _ := pem.Decode([]byte(decodedCert))           				// Make Plain text   //
-
-	x509Cert, err := x509.ParseCertificate(pem.Bytes);				// Extract Certificate from argument //
-														
-															if err != nil { return -1, errors.New("Couldn't parse certificate")	}
-
-	cn := x509Cert.Subject.CommonName
-	
-	res := strings.Split(cn,"\\")
-	
-	affiliation, _ := strconv.Atoi(res[2])
-	
-	return affiliation, nil
-}
-
-//==============================================================================================================================
-//	 get_caller_data - Calls the get_ecert and check_role functions and returns the ecert and role for the
-//					 name passed.
+//	 get_caller_data - Resolves the caller through the identity provider chosen at Init. When the provider does not
+//					 carry an affiliation the affiliation the user was created with is used. A caller who
+//					 has not been created as a user is rejected whatever affiliation the identity carries.
 //==============================================================================================================================
 
 func GetCallerMetadata(stub *shim.ChaincodeStub) (string, int, error){
 
 	fmt.Println("Entering GetCallerMetadata")
 
-	username, err := GetUsername(stub)
+	provider, err := GetIdentityProvider(stub)
+	if err != nil {
+		fmt.Println("GetCallerMetadata: Could not get identity provider ", err); 
+		return "", -1, err
+	}
+
+	identity, err := provider.Resolve(stub)
 		if err != nil {
-			fmt.Println("GetCallerMetadata: Could not get username %s", err); 
+			fmt.Println("GetCallerMetadata: Could not resolve caller with "+provider.Name()+" ", err); 
 			return "", -1, err 
 		}
 
 		fmt.Println("USER: ")
-		fmt.Println(username)
+		fmt.Println(identity.Username)
 
 
-	user, err := GetUser(stub, username)
+	user, err := GetUser(stub, identity.Username)
 	if err !=nil {
-		fmt.Println("GetCallerMetadata: Could not get user with ID: %s %s", username, err); 
+		fmt.Println("GetCallerMetadata: Could not get user with ID: %s %s", identity.Username, err); 
 		return "", -1, err
 	}
 
+	if identity.Affiliation > 0 && identity.Affiliation != user.Affiliation {
+		return "", -1, errors.New("User " + identity.Username + " was created with affiliation " + strconv.Itoa(user.Affiliation) + " but presented affiliation " + strconv.Itoa(identity.Affiliation))
+	}
+
 	affiliation := user.Affiliation
 
-	return username, affiliation, nil
+	return identity.Username, affiliation, nil
 }
 
 
@@ -705,6 +706,8 @@ func GetMortgageApplications(stub *shim.ChaincodeStub, callerId string, callerAf
 				fmt.Println("GetMortgageApplications: Could not get mortgageApplication for id: "+mas[i]+" ",err)
 				return nil, err
 			}
+			//Same view as GetMortgageApplication
+			ma = ProjectMortgageApplication(ma, MortgageApplicationView(stub, ma, callerId, callerAffiliation))
 			mortgageApplications = append(mortgageApplications, ma)
 		}
 
@@ -1135,9 +1138,9 @@ Add the key to the list of mortgage applications keys associated with a user
 func CreateMortgageApplication(stub *shim.ChaincodeStub, callerId string, callerAffiliation int , args[]string) ([]byte, error){
 	fmt.Println("Entering CreateMortgageApplication")
 
-	if len(args) < 2 {
-		fmt.Println("CreateMortgageApplication: expected two arguments")
-		return nil, errors.New("Could not create MortgageApplication. Invalid input")
+	if len(args) < 3 {
+		fmt.Println("CreateMortgageApplication: expected three arguments")
+		return nil, errors.New("Could not create MortgageApplication. Expected id, application and encryption key")
 	}
 
 	mortgageApplicationId := args[0]
@@ -1154,9 +1157,73 @@ func CreateMortgageApplication(stub *shim.ChaincodeStub, callerId string, caller
 		return nil, err
 	}
 
+	err = Authorize(stub, callerId, callerAffiliation, MORTGAGEAPPLICATION, OP_CREATE, ma)
+	if err !=nil {
+		return nil, err
+	}
+
+	//The caller is always the primary applicant
+	ma.BuyerId = callerId
+
+	err = ValidateMortgageApplicationAmounts(ma)
+	if err !=nil {
+		fmt.Println("CreateMortgageApplication: Invalid amounts", err)
+		return nil, err
+	}
+
+	err = ValidateCoApplicants(stub, &ma)
+	if err !=nil {
+		fmt.Println("CreateMortgageApplication: Invalid co-applicants", err)
+		return nil, err
+	}
+
+	ma.SalesContractId = strings.TrimSpace(ma.SalesContractId)
+	if len(ma.SalesContractId) > 0 {
+		_, err = LinkableSalesContract(stub, ma, ma.SalesContractId)
+		if err !=nil {
+			return nil, err
+		}
+	}
+
+	//Every applicant must be verified to the level the reviewing bank requires
+	kycParties := []string{callerId}
+	for _, co := range ma.CoApplicants {
+		if co.BuyerId != callerId {
+			kycParties = append(kycParties, co.BuyerId)
+		}
+	}
+	err = CheckAccountActive(stub, ma.ReviewerId)
+	if err !=nil {
+		return nil, err
+	}
+
+	err = CheckKycPolicy(stub, ma.ReviewerId, kycParties, "")
+	if err !=nil {
+		fmt.Println("CreateMortgageApplication: KYC check failed", err)
+		return nil, err
+	}
+
+	ma.CombinedFinancialInfo, err = CombineFinancialInfo(ma)
+	if err !=nil {
+		return nil, err
+	}
+
+	//Personal and financial info is only stored encrypted with the key from args[2]
+	keyId, key, err := ParseEncryptionKey(args[2])
+	if err !=nil {
+		return nil, err
+	}
+	ma.ID = mortgageApplicationId
+	err = SealMortgageApplication(stub, &ma, keyId, key)
+	if err !=nil {
+		return nil, err
+	}
+
 	bankId := ma.ReviewerId
 
-	err = stub.PutState(maKey, []byte(mortgageApplicationInput))
+	maBytes, _ := json.Marshal(&ma)
+
+	err = stub.PutState(maKey, maBytes)
 	if err != nil {
 		fmt.Println("Error saving mortgageApplication "+mortgageApplicationId +" to state", err)
 		return nil, err
@@ -1170,19 +1237,32 @@ func CreateMortgageApplication(stub *shim.ChaincodeStub, callerId string, caller
 		return nil, err
 	}
 
-	userKey, err := GetStateKey(callerId, USER)
+	err = AddIndexEntry(stub, maSalesContractIndex, ma.SalesContractId, mortgageApplicationId)
+	if err != nil {
+		return nil, err
+	}
+
+	//The application is listed for the caller. Co-applicants are listed once they consent
+	applicants := []string{callerId}
+
+	for _, applicantId := range applicants {
+		userKey, err := GetStateKey(applicantId, USER)
 	
-	user, err := GetBuyer(stub, userKey)		
+		user, err := GetBuyer(stub, userKey)		
+		if err != nil {
+			return nil, err
+		}
 
-	mas := user.MortgageApplications
-	//Store the external mortgage application id generated by front end as foreign key in user
-	user.MortgageApplications = append(mas, mortgageApplicationId)
+		mas := user.MortgageApplications
+		//Store the external mortgage application id generated by front end as foreign key in user
+		user.MortgageApplications = append(mas, mortgageApplicationId)
 
-	err = SaveBuyer(stub, user, userKey)
+		err = SaveBuyer(stub, user, userKey)
 
-	if err != nil {	
-		fmt.Printf("CreateMortgageApplication: Failed to store updated user with id"+ userKey + ": ", err)
-		return nil, err
+		if err != nil {	
+			fmt.Printf("CreateMortgageApplication: Failed to store updated user with id"+ userKey + ": ", err)
+			return nil, err
+		}
 	}
 
 	bankKey, err := GetStateKey(bankId, USER)
@@ -1240,12 +1320,28 @@ func GetMortgageApplication(stub *shim.ChaincodeStub, callerId string, callerAff
 		return ma, nil, err
 	}
 
-	if callerId == ma.BuyerId || callerId == ma.ReviewerId || callerAffiliation == AUDITOR_A {
+	err = Authorize(stub, callerId, callerAffiliation, MORTGAGEAPPLICATION, OP_READ, ma)
+	if err == nil {
 		//Caller is permitted to access mortgage application
+		view := MortgageApplicationView(stub, ma, callerId, callerAffiliation)
+		if len(args) > 1 && len(ma.PersonalDataId) > 0 && view != VIEW_APPRAISER {
+			//Decrypt personal and financial info with the key in args[1]
+			keyId, key, err := ParseEncryptionKey(args[1])
+			if err != nil {
+				return ma, nil, err
+			}
+			err = OpenMortgageApplication(stub, &ma, keyId, key)
+			if err != nil {
+				return ma, nil, err
+			}
+		}
+		//The caller gets the projection for their role, the returned struct is the whole application
+		projected := ProjectMortgageApplication(ma, view)
+		bytes, _ = json.Marshal(&projected)
 		return ma, bytes, nil
 	}else{
-		fmt.Println("GetMortgageApplication: Caller with ID "+callerId+ " and affiliation "+string(callerAffiliation)+" does not have rights to access mortgageApplication")
-		return ma, nil, errors.New("User "+callerId+ "does not have rights to access mortgageApplication with id "+maId)
+		fmt.Println("GetMortgageApplication: Caller with ID "+callerId+ " and affiliation "+strconv.Itoa(callerAffiliation)+" does not have rights to access mortgageApplication")
+		return ma, nil, err
 	}
 
 	
@@ -1269,11 +1365,17 @@ func UpdateMortgageApplication(stub *shim.ChaincodeStub, callerId string, caller
 	var scIdChanged bool = false
 	var amChanged bool = false
 
-	ma, _, err := GetMortgageApplication(stub, callerId, AUDITOR_A, []string{id})
+	ma, err := LoadMortgageApplication(stub, id)
 	if err != nil {	
 		return nil, err
 	}
 
+	//Only the reviewing bank. Appraisers set the value through SubmitAppraisalReport
+	err = Authorize(stub, callerId, callerAffiliation, MORTGAGEAPPLICATION, OP_UPDATE, ma)
+	if err != nil {
+		return nil, err
+	}
+
 	err = json.Unmarshal([]byte(args[1]), &updates )
 		if err != nil {
 			fmt.Println("UpdateMortgageApplication: Could not unmarshal updates ", err)
@@ -1286,6 +1388,17 @@ func UpdateMortgageApplication(stub *shim.ChaincodeStub, callerId string, caller
 		//Valid user to update the application
 	
 		status := strings.TrimSpace(updates.Status)
+		if strings.EqualFold(status, MA_APPROVED) {
+			//Approval is gated on the bank's document checklist
+			err = CheckRequiredDocuments(ma)
+			if err != nil {
+				return nil, err
+			}
+			pending := PendingCoApplicants(ma)
+			if len(pending) > 0 {
+				return nil, errors.New("Mortgage application " + ma.ID + " cannot be approved until co-applicants consent: " + strings.Join(pending, ", "))
+			}
+		}
 		if len(status) > 0{
 			currentStatus = ma.Status
 			ma.Status = status
@@ -1293,8 +1406,32 @@ func UpdateMortgageApplication(stub *shim.ChaincodeStub, callerId string, caller
 			msg += callerId+ " changed status from "+currentStatus+" to "+status
 		}
 
+		if len(updates.DeclineReasons) > 0 {
+			if !isDeniedStatus(ma.Status) {
+				return nil, errors.New("Decline reasons can only be given when the application is declined")
+			}
+			ma.DeclineReasons, err = ValidateDeclineReasons(updates.DeclineReasons)
+			if err != nil {
+				return nil, err
+			}
+			msg += ". Decline reasons: "+strings.Join(ma.DeclineReasons, ", ")
+			statusChanged = true
+		}
+
 		salesContractId :=  strings.TrimSpace(updates.SalesContractId)
 		if len(salesContractId) > 0 {
+			_, err = LinkableSalesContract(stub, ma, salesContractId)
+			if err != nil {
+				return nil, err
+			}
+			err = RemoveIndexEntry(stub, maSalesContractIndex, ma.SalesContractId, ma.ID)
+			if err != nil {
+				return nil, err
+			}
+			err = AddIndexEntry(stub, maSalesContractIndex, salesContractId, ma.ID)
+			if err != nil {
+				return nil, err
+			}
 			ma.SalesContractId = salesContractId
 			if statusChanged == true {
 				msg += "and updated sales contract Id to "+salesContractId+"."
@@ -1307,12 +1444,20 @@ func UpdateMortgageApplication(stub *shim.ChaincodeStub, callerId string, caller
 
 		approvedAmount :=  updates.ApprovedAmount
 		
-		if approvedAmount != 0 {
+		if !approvedAmount.IsZero() {
+			err = approvedAmount.Validate()
+			if err == nil {
+				err = SameCurrency(approvedAmount, ma.RequestedAmount)
+			}
+			if err != nil {
+				fmt.Println("UpdateMortgageApplication: Invalid approved amount ", err)
+				return nil, err
+			}
 			ma.ApprovedAmount = approvedAmount
 			if statusChanged == true || scIdChanged == true{
-				msg += "and updated approved amount to "+strconv.Itoa(approvedAmount)+"."
+				msg += "and updated approved amount to "+approvedAmount.String()+"."
 			}else {
-				msg += callerId+" updated approved amount to "+strconv.Itoa(approvedAmount)+"."
+				msg += callerId+" updated approved amount to "+approvedAmount.String()+"."
 			}
 			amChanged = true
 
@@ -1325,6 +1470,11 @@ func UpdateMortgageApplication(stub *shim.ChaincodeStub, callerId string, caller
 				return nil, err
 			}
 			AppendMALog(stub, "UpdateMortgageApplication", msg, ma.Status, id)
+
+			err = EvaluateContingencies(stub, ma)
+			if err != nil {
+				return nil, err
+			}
 			return bytes, nil
 		}else{
 			fmt.Println("SaveMortgageApplication: Nothing to update")
@@ -1342,23 +1492,6 @@ func UpdateMortgageApplication(stub *shim.ChaincodeStub, callerId string, caller
 
 		
 
-	}else if callerAffiliation == APPRAISER_A{
-		fairMarketValue :=  updates.FairMarketValue
-		
-		if fairMarketValue != 0 {
-			ma.FairMarketValue = fairMarketValue
-
-			bytes, err := SaveMortgageApplication(stub, ma, id)
-			if err != nil {
-				fmt.Println("SaveMortgageApplication: Could not save mortgageApplication ",err)
-				return nil, err
-			}
-			AppendMALog(stub, "UpdateMortgageApplication", msg, ma.Status, id)
-			return bytes, nil
-		}else{
-			fmt.Println("SaveMortgageApplication: Nothing to update")
-			return nil, nil
-		}
 	}else{
 		fmt.Println("UpdateMortgageApplication: User with id "+callerId+ "does not have rights to update the mortgage application")
 		return nil, errors.New("User with id "+callerId+ "does not have rights to update the mortgage application")
@@ -1368,7 +1501,9 @@ func UpdateMortgageApplication(stub *shim.ChaincodeStub, callerId string, caller
 }
 
 /**
-Create a new Appraiser Application
+Create a new Appraiser Application. The property comes from the mortgage application and
+the appraiser is assigned by rotation from the bank's appraiser panel for the property's
+jurisdiction
 **/
 func CreateAppraiserApplication(stub *shim.ChaincodeStub, callerId string, callerAffiliation int , args[]string) ([]byte, error){
 	fmt.Println("Entering CreateAppraiserApplication")
@@ -1378,12 +1513,6 @@ func CreateAppraiserApplication(stub *shim.ChaincodeStub, callerId string, calle
 		return nil, errors.New("Could not create CreateAppraiserApplication. Invalid input")
 	}
 
-	if callerAffiliation != BANK_A {
-		//Caller is not allowed to create an appraiser application
-		fmt.Println("CreateAppraiserApplication: "+callerId+" is not allowed to create appraiser application")
-		return nil, errors.New(callerId+" is not allowed to create appraiser application")
-	}
-
 	appraiserApplicationId := args[0]
 	appraiserApplicationInput := args[1]
 
@@ -1391,12 +1520,6 @@ func CreateAppraiserApplication(stub *shim.ChaincodeStub, callerId string, calle
 
 	fmt.Println("Generated appraiserApplication key "+maKey)
 
-	err = stub.PutState(maKey, []byte(appraiserApplicationInput))
-	if err != nil {
-		fmt.Println("Error saving CreateAppraiserApplication "+appraiserApplicationId +" to state")
-		return nil, errors.New("Error saving CreateAppraiserApplication "+appraiserApplicationId +" to state")
-	}
-
 	var aa AppraiserApplication
 	err = json.Unmarshal([]byte(appraiserApplicationInput), &aa)
 	if err !=nil {
@@ -1404,28 +1527,55 @@ func CreateAppraiserApplication(stub *shim.ChaincodeStub, callerId string, calle
 		return nil, err
 	}
 
-	ok, err := AddKey(stub, maKey, aaKeysName)
+	//Appraisers are assigned by rotation from the bank's panel to keep them independent
+	if len(strings.TrimSpace(aa.AppraiserId)) > 0 {
+		return nil, errors.New("Appraisers cannot be named directly. They are assigned from the appraiser panel for the region")
+	}
 
-	fmt.Println(ok)
+	ma, err := LoadMortgageApplication(stub, aa.MortgageApplicationId)
+	if err != nil {
+		return nil, err
+	}
 
+	//Only the bank reviewing the mortgage application
+	err = Authorize(stub, callerId, callerAffiliation, APPRAISERAPPLICATION, OP_CREATE, ma)
 	if err != nil {
+		fmt.Println("CreateAppraiserApplication: "+callerId+" is not allowed to create appraiser application")
 		return nil, err
 	}
 
-	userKey, err := GetStateKey(aa.AppraiserId, USER)
-	
-	user, err := GetAppraiser(stub, userKey)		
+	aa.ID = appraiserApplicationId
+	aa.ReviewerId = callerId
+	aa.PropertyId = ma.PropertyId
 
-	mas := user.AppraiserApplications
-	user.AppraiserApplications = append(mas, appraiserApplicationId)
+	//Panels are per jurisdiction so the bank cannot pick the panel by naming a region
+	region := normalizeRegion(propertyJurisdiction(stub, aa.PropertyId))
+	if len(region) == 0 {
+		return nil, errors.New("Property "+aa.PropertyId+" has no jurisdiction to assign an appraiser panel for")
+	}
+	if len(strings.TrimSpace(aa.Region)) > 0 && normalizeRegion(aa.Region) != region {
+		return nil, errors.New("Appraiser application region "+aa.Region+" is not the jurisdiction of property "+aa.PropertyId)
+	}
+	aa.Region = region
 
-	err = SaveAppraiser(stub, user, userKey)
+	rationale, err := AssignPanelAppraiser(stub, &aa, ma, nil)
+	if err != nil {
+		return nil, err
+	}
 
-	if err != nil {	
-		fmt.Printf("CreateAppraiserApplication: Failed to store updated user with id"+ userKey + ": %s", err)
-		return nil, errors.New("CreateAppraiserApplication: Failed to store updated user with id"+ userKey ) 
+	err = StoreAppraiserApplication(stub, aa)
+	if err != nil {
+		return nil, err
+	}
+
+	ma.AppraisalApplicationId = appraiserApplicationId
+	_, err = SaveMortgageApplication(stub, ma, ma.ID)
+	if err != nil {
+		return nil, err
 	}
 
+	AppendMALog(stub, "AssignAppraiser", rationale, aa.Status, appraiserApplicationId)
+	AppendMALog(stub, "AssignAppraiser", rationale, ma.Status, ma.ID)
 
 	fmt.Println("CreateAppraiserApplication: Successfully created and stored appraiserApplication with ID: "+appraiserApplicationId)
 
@@ -1466,12 +1616,13 @@ func GetAppraiserApplication(stub *shim.ChaincodeStub, callerId string, callerAf
 		return ma, nil, err
 	}
 
-	if callerId == ma.AppraiserId || callerId == ma.ReviewerId || callerAffiliation == AUDITOR_A {
+	err = Authorize(stub, callerId, callerAffiliation, APPRAISERAPPLICATION, OP_READ, ma)
+	if err == nil {
 		//Caller is permitted to access mortgage application
 		return ma, bytes, nil
 	}else{
-		fmt.Println("GetAppraiserApplication: Caller with ID "+callerId+ " and affiliation "+string(callerAffiliation)+" does not have rights to access mortgageApplication")
-		return ma, nil, errors.New("User "+callerId+ "does not have rights to access appraiserApplication with id "+maId)
+		fmt.Println("GetAppraiserApplication: Caller with ID "+callerId+ " and affiliation "+strconv.Itoa(callerAffiliation)+" does not have rights to access mortgageApplication")
+		return ma, nil, err
 	}
 
 	
@@ -1491,15 +1642,14 @@ func UpdateAppraiserApplication(stub *shim.ChaincodeStub, callerId string, calle
 	id := args[0]
 	var currentStatus string
 	var updates AAUpdateSchema
-	var statusChanged bool = false
-	var mvChanged bool = false
 	
-	ma, _, err := GetAppraiserApplication(stub, callerId, callerAffiliation, []string{id})
+	ma, err := LoadAppraiserApplication(stub, id)
 	if err != nil {	
 		return nil, err
 	}
 
-	if callerId == ma.AppraiserId {
+	err = Authorize(stub, callerId, callerAffiliation, APPRAISERAPPLICATION, OP_UPDATE, ma)
+	if err == nil {
 		//Valid user to update the application
 		err = json.Unmarshal([]byte(args[1]), &updates )
 		if err != nil {
@@ -1508,52 +1658,47 @@ func UpdateAppraiserApplication(stub *shim.ChaincodeStub, callerId string, calle
 		}
 
 
-		status := strings.TrimSpace(updates.Status)
-		if len(status) > 0{
-			currentStatus = ma.Status
-			ma.Status = status
-			statusChanged = true
+		//Appraisers with an expired license cannot submit
+		if callerId == ma.AppraiserId {
+			err = CheckAppraiserLicense(stub, ma)
+			if err != nil {
+				return nil, err
+			}
 		}
 
-		fairMarketValue :=  updates.FairMarketValue
-		
-		if fairMarketValue != 0 {
-			ma.FairMarketValue = fairMarketValue
-			mvChanged = true
+		//The value and completion only come in with the report through SubmitAppraisalReport
+		if !updates.FairMarketValue.IsZero() {
+			return nil, errors.New("The fair market value can only be given in an appraisal report through SubmitAppraisalReport")
+		}
+		if ma.Status == AA_COMPLETED {
+			return nil, errors.New("Appraiser application "+id+" is "+AA_COMPLETED+". Revisions go through reconsideration of value")
 		}
 
+		status := strings.TrimSpace(updates.Status)
+		if len(status) == 0 {
+			fmt.Println("UpdateAppraiserApplication: Nothing to update")
+			return nil, nil
+		}
+		if strings.EqualFold(status, AA_COMPLETED) {
+			return nil, errors.New("An appraiser application is completed by submitting the appraisal report")
+		}
+		currentStatus = ma.Status
+		ma.Status = status
+
 		bytes, err := SaveAppraiserApplication(stub, ma, id)
 		if err != nil {
 			fmt.Println("SaveAppraiserApplication: Could not save appraiser application ",err)
 			return nil, err
 		}
 
-		bytes, err = UpdateMortgageApplication(stub, callerId, callerAffiliation, []string{ma.MortgageApplicationId,`{"fairMarketValue":`+strconv.Itoa(fairMarketValue)+`}`})
-		if err != nil {
-			fmt.Println("SaveAppraiserApplication: Could not update mortgage application ",err)
-			return nil, err
-		}
-
-		var msg string
-		var fmvStr string
-		if mvChanged == true {
-			fmvStr = strconv.Itoa(fairMarketValue)
-		}
-
-		if statusChanged == true && mvChanged == true{
-			msg = callerId+ " changed status from "+currentStatus+" to "+status+" and updated fair market value: "+fmvStr
-		}else if statusChanged == true && mvChanged == false{
-			msg = callerId+ " changed status from "+currentStatus+" to "+status
-		}else if statusChanged == false && mvChanged == true{
-			msg = callerId+" updated fair market value: "+fmvStr
-		}
+		msg := callerId+ " changed status from "+currentStatus+" to "+status
 
 		AppendMALog(stub, "UpdateAppraiserApplication", msg, status, id)
 		return bytes, nil
 
 	}else{
 		fmt.Println("UpdateAppraiserApplication: User with id "+callerId+ "does not have rights to update the appraiser application")
-		return nil, errors.New("User with id "+callerId+ "does not have rights to update the appraiser application")
+		return nil, err
 	}
 }
 
@@ -1566,10 +1711,11 @@ func CreateSalesContract(stub *shim.ChaincodeStub, callerId string, callerAffili
 		return nil, errors.New("Could not create CreateSalesContract. Invalid input")
 	}
 
-	if callerAffiliation != BUYER_A {
+	err := Authorize(stub, callerId, callerAffiliation, SALESCONTRACT, OP_CREATE, nil)
+	if err != nil {
 		//Caller is not allowed to create an sales contract
 		fmt.Println("CreateSalesContract: "+callerId+" is not allowed to create seller contract")
-		return nil, errors.New(callerId+" is not allowed to create seller contract")
+		return nil, err
 	}
 
 	salesContractId := args[0]
@@ -1579,17 +1725,67 @@ func CreateSalesContract(stub *shim.ChaincodeStub, callerId string, callerAffili
 
 	fmt.Println("Generated salesContract key "+maKey)
 
+	existing, err := stub.GetState(maKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(existing) > 0 {
+		return nil, errors.New("Sales contract with id " + salesContractId + " already exists")
+	}
+
 	var sc SalesContract
 	err = json.Unmarshal([]byte(salesContractInput), &sc)
 	if err !=nil {
 		fmt.Println("CreateSalesContract: Could not unmarshal salesContractInput", err)
 		return nil, err
 	}
-	
-	sellerId := sc.SellerId
-	bankId := sc.ReviewerId
 
-	err = stub.PutState(maKey, []byte(salesContractInput))
+	//The caller is always the buyer and a new contract always starts out submitted
+	sc.ID = salesContractId
+	sc.BuyerId = callerId
+	sc.Status = "Submitted"
+	sc.SellerSignature = ""
+	sc.OfferId = ""
+	sc.EscrowId = ""
+	sc.CancellationRequestedBy = ""
+
+	seller, err := GetUser(stub, sc.SellerId)
+	if err != nil || seller.Affiliation != SELLER_A {
+		return nil, errors.New("Seller " + sc.SellerId + " is not a registered seller")
+	}
+
+	reviewer, err := GetUser(stub, sc.ReviewerId)
+	if err != nil || reviewer.Affiliation != BANK_A {
+		return nil, errors.New("Reviewer " + sc.ReviewerId + " is not a registered bank")
+	}
+
+	txTime, err := GetTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	sc.LastModifiedDate = txTime.Format(dateLayout)
+
+	err = sc.Price.Validate()
+	if err !=nil {
+		fmt.Println("CreateSalesContract: Invalid price", err)
+		return nil, err
+	}
+
+	sc.Contingencies, err = NormalizeContingencies(sc.Contingencies)
+	if err != nil {
+		fmt.Println("CreateSalesContract: Invalid contingencies", err)
+		return nil, err
+	}
+
+	err = CheckKycPolicy(stub, sc.ReviewerId, []string{sc.BuyerId}, sc.SellerId)
+	if err != nil {
+		fmt.Println("CreateSalesContract: KYC check failed", err)
+		return nil, err
+	}
+
+	scBytes, _ := json.Marshal(&sc)
+	
+	err = stub.PutState(maKey, scBytes)
 	if err != nil {
 		fmt.Println("Error saving CreateSalesContract "+salesContractId +" to state")
 		return nil, errors.New("Error saving CreateSalesContract "+salesContractId +" to state")
@@ -1603,6 +1799,24 @@ func CreateSalesContract(stub *shim.ChaincodeStub, callerId string, callerAffili
 		return nil, err
 	}
 
+	err = LinkSalesContract(stub, salesContractId, sc.BuyerId, sc.SellerId, sc.ReviewerId)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("CreateSalesContract: Successfully created and stored salesContract with ID: "+salesContractId)
+
+	AppendMALog(stub, "CreateSalesContract", callerId+" Submitted new SalesContract", "Submitted", salesContractId)
+	
+	return nil, nil
+}
+
+/**
+Adds the sales contract id to the buyer, seller and bank holding the contract
+**/
+func LinkSalesContract(stub *shim.ChaincodeStub, salesContractId string, buyerId string, sellerId string, bankId string)(error){
+	fmt.Println("Entering LinkSalesContract")
+
 	userKey, err := GetStateKey(sellerId, USER)
 	
 	user, err := GetSeller(stub, userKey)		
@@ -1613,11 +1827,11 @@ func CreateSalesContract(stub *shim.ChaincodeStub, callerId string, callerAffili
 	err = SaveSeller(stub, user, userKey)
 
 	if err != nil {	
-		fmt.Printf("CreateSalesContract: Failed to store updated user with id"+ userKey + ": %s", err)
-		return nil, errors.New("CreateSalesContract: Failed to store updated user with id"+ userKey ) 
+		fmt.Printf("LinkSalesContract: Failed to store updated user with id"+ userKey + ": %s", err)
+		return errors.New("LinkSalesContract: Failed to store updated user with id"+ userKey ) 
 	}
 
-	buyerKey, err := GetStateKey(callerId, USER)
+	buyerKey, err := GetStateKey(buyerId, USER)
 	
 	buyer, err := GetBuyer(stub, buyerKey)		
 
@@ -1627,8 +1841,8 @@ func CreateSalesContract(stub *shim.ChaincodeStub, callerId string, callerAffili
 	err = SaveBuyer(stub, buyer, buyerKey)
 
 	if err != nil {	
-		fmt.Printf("CreateSalesContract: Failed to store updated user with id"+ buyerKey + ": %s", err)
-		return nil, errors.New("CreateSalesContract: Failed to store updated user with id"+ buyerKey ) 
+		fmt.Printf("LinkSalesContract: Failed to store updated user with id"+ buyerKey + ": %s", err)
+		return errors.New("LinkSalesContract: Failed to store updated user with id"+ buyerKey ) 
 	}
 
 	bankKey, err := GetStateKey(bankId, USER)
@@ -1641,16 +1855,11 @@ func CreateSalesContract(stub *shim.ChaincodeStub, callerId string, callerAffili
 	err = SaveBank(stub, bank, bankKey)
 
 	if err != nil {	
-		fmt.Printf("CreateSalesContract: Failed to store updated user with id"+ bankKey + ": %s", err)
-		return nil, errors.New("CreateSalesContract: Failed to store updated user with id"+ bankKey ) 
+		fmt.Printf("LinkSalesContract: Failed to store updated user with id"+ bankKey + ": %s", err)
+		return errors.New("LinkSalesContract: Failed to store updated user with id"+ bankKey ) 
 	}
 
-
-	fmt.Println("CreateSalesContract: Successfully created and stored salesContract with ID: "+salesContractId)
-
-	AppendMALog(stub, "CreateSalesContract", callerId+" Submitted new SalesContract", "Submitted", salesContractId)
-	
-	return nil, nil
+	return nil
 }
 
 /**
@@ -1685,12 +1894,14 @@ func GetSalesContract(stub *shim.ChaincodeStub, callerId string, callerAffiliati
 		return ma, nil, err
 	}
 
-	if callerId == ma.SellerId || callerId == ma.BuyerId || callerAffiliation == AUDITOR_A || callerAffiliation == BANK_A {
+	//Banks only read the contracts they review
+	err = Authorize(stub, callerId, callerAffiliation, SALESCONTRACT, OP_READ, ma)
+	if err == nil {
 		//Caller is permitted to access sales contract
 		return ma, bytes, nil
 	}else{
 		fmt.Println("GetSalesContract: Caller with ID "+callerId+ " and affiliation "+strconv.Itoa(callerAffiliation)+" does not have rights to access mortgageContract")
-		return ma, nil, errors.New("User "+callerId+ "does not have rights to access salesContract with id "+maId)
+		return ma, nil, err
 	}
 
 	
@@ -1710,14 +1921,16 @@ func UpdateSalesContract(stub *shim.ChaincodeStub, callerId string, callerAffili
 	id := args[0]
 	var currentStatus string
 	var updates SCUpdateSchema
+	priceChanged := false
 	
 	
-	ma, _, err := GetSalesContract(stub, callerId, callerAffiliation, []string{id})
+	ma, err := LoadSalesContract(stub, id)
 	if err != nil {	
 		return nil, err
 	}
 
-	if callerId == ma.SellerId || callerId == ma.BuyerId {
+	err = Authorize(stub, callerId, callerAffiliation, SALESCONTRACT, OP_UPDATE, ma)
+	if err == nil {
 		//Valid user to update the contract
 		err = json.Unmarshal([]byte(args[1]), &updates )
 		if err != nil {
@@ -1728,7 +1941,37 @@ func UpdateSalesContract(stub *shim.ChaincodeStub, callerId string, callerAffili
 		var logs[] string
 
 		status := strings.TrimSpace(updates.Status)
+		if (ma.Status == SC_CLOSED || ma.Status == SC_CANCELLED) && ((len(status) > 0 && !strings.EqualFold(status, ma.Status)) || !updates.Price.IsZero()) {
+			return nil, errors.New("Sales contract " + ma.ID + " is " + ma.Status + " and can no longer be changed")
+		}
+		if strings.EqualFold(status, SC_CANCELLED) && ma.Status != SC_CANCELLED {
+			//Both parties have to agree to a cancellation since it allows escrow to be refunded
+			cancelled, err := requestCancellation(&ma, callerId)
+			if err != nil {
+				return nil, err
+			}
+			if cancelled {
+				status = SC_CANCELLED
+			} else {
+				logs = append(logs, callerId+" requested cancellation")
+				status = ""
+			}
+		}
 		if len(status) > 0{
+			if strings.EqualFold(status, SC_CLOSED) {
+				//A contract can only close once every contingency is satisfied or waived
+				txTime, err := GetTxTime(stub)
+				if err != nil {
+					return nil, err
+				}
+				ExpireContingencies(&ma, txTime)
+				err = CheckContingenciesCleared(ma)
+				if err != nil {
+					fmt.Println("UpdateSalesContract: ", err)
+					return nil, err
+				}
+				status = SC_CLOSED
+			}
 			currentStatus = ma.Status
 			ma.Status = status
 			logs = append(logs, "changed status from "+currentStatus+" to "+status+"")
@@ -1747,9 +1990,22 @@ func UpdateSalesContract(stub *shim.ChaincodeStub, callerId string, callerAffili
 		}
 
 		price := updates.Price
-		if price != 0{
+		if !price.IsZero(){
+			err = price.Validate()
+			if err == nil && !ma.Price.IsZero() {
+				err = SameCurrency(price, ma.Price)
+			}
+			if err != nil {
+				fmt.Println("UpdateSalesContract: Invalid price ", err)
+				return nil, err
+			}
+			priceChanged = ma.Price != price
 			ma.Price = price
-			logs = append(logs, "Price updated to: "+strconv.Itoa(price))
+			logs = append(logs, "Price updated to: "+price.String())
+			//The appraisal contingency has to be met again at the new price
+			if priceChanged && resetAppraisalContingency(&ma) {
+				logs = append(logs, "appraisal contingency reset to "+CONTINGENCY_PENDING)
+			}
 		}
 
 
@@ -1758,6 +2014,18 @@ func UpdateSalesContract(stub *shim.ChaincodeStub, callerId string, callerAffili
 			return nil, err
 		}
 
+		if priceChanged {
+			err = ReevaluateContingencies(stub, id)
+			if err != nil {
+				return nil, err
+			}
+			ma, err = LoadSalesContract(stub, id)
+			if err != nil {
+				return nil, err
+			}
+			bytes, _ = json.Marshal(&ma)
+		}
+
 		var msg string
 		for _, log := range logs{
 			msg+= " "+log
@@ -1768,7 +2036,7 @@ func UpdateSalesContract(stub *shim.ChaincodeStub, callerId string, callerAffili
 
 	}else{
 		fmt.Println("UpdateSalesContract: User with id "+callerId+ "does not have rights to update the seller application")
-		return nil, errors.New("User with id "+callerId+ "does not have rights to update the seller application")
+		return nil, err
 	}
 }
 
@@ -1920,6 +2188,44 @@ func SaveBank(stub *shim.ChaincodeStub, bank Bank, id string)(error){
 	}
 }
 
+/**
+Stores a new Appraiser Application and lists it for its appraiser
+**/
+func StoreAppraiserApplication(stub *shim.ChaincodeStub, aa AppraiserApplication)(error){
+	fmt.Println("Entering StoreAppraiserApplication")
+
+	_, err := SaveAppraiserApplication(stub, aa, aa.ID)
+	if err != nil {
+		fmt.Println("Error saving AppraiserApplication "+aa.ID +" to state")
+		return errors.New("Error saving AppraiserApplication "+aa.ID +" to state")
+	}
+
+	aaKey, err  := GetStateKey(aa.ID, APPRAISERAPPLICATION)
+	ok, err := AddKey(stub, aaKey, aaKeysName)
+
+	fmt.Println(ok)
+
+	if err != nil {
+		return err
+	}
+
+	userKey, err := GetStateKey(aa.AppraiserId, USER)
+	
+	user, err := GetAppraiser(stub, userKey)		
+
+	mas := user.AppraiserApplications
+	user.AppraiserApplications = append(mas, aa.ID)
+
+	err = SaveAppraiser(stub, user, userKey)
+
+	if err != nil {	
+		fmt.Printf("StoreAppraiserApplication: Failed to store updated user with id"+ userKey + ": %s", err)
+		return errors.New("StoreAppraiserApplication: Failed to store updated user with id"+ userKey ) 
+	}
+
+	return nil
+}
+
 /**
 Save Appraiser Application to the ledger
 **/
@@ -2207,7 +2513,7 @@ func AddKey(stub *shim.ChaincodeStub, id string, keysName string)(bool, error){
 
 	bytes, _ := json.Marshal(&maKeys)
 	
-	err = stub.PutState(maKeysName, bytes)
+	err = stub.PutState(keysName, bytes)
 	if err != nil{
 		fmt.Printf("AddKey: Error storing key: %s", err);
 		return false, err
@@ -2249,12 +2555,50 @@ func  GetStateKey(id string, otype int)(string, error){
 		return typePropertyAd+id, nil
 	}else if otype == MALOG {
 		return typeMALog+id, nil
+	}else if otype == OFFER {
+		return typeOffer+id, nil
+	}else if otype == ESCROW {
+		return typeEscrow+id, nil
+	}else if otype == LOAN {
+		return typeLoan+id, nil
+	}else if otype == RATESHEET {
+		return typeRateSheet+id, nil
+	}else if otype == PANEL {
+		return typePanel+id, nil
+	}else if otype == INVOICE {
+		return typeInvoice+id, nil
+	}else if otype == PERSONALDATA {
+		return typePersonalData+id, nil
+	}else if otype == KYC {
+		return typeKyc+id, nil
+	}else if otype == KYCPOLICY {
+		return typeKycPolicy+id, nil
+	}else if otype == PROFILE {
+		return typeProfile+id, nil
+	}else if otype == LICENSE {
+		return typeLicense+id, nil
+	}else if otype == ACCOUNT {
+		return typeAccount+id, nil
 	}else{
 		fmt.Println("GetStateKey: Invalid type "+string(otype))
 		return "", errors.New("Invalid type")
 	}
 }
 
+/**
+Returns the timestamp of the current transaction. Use this instead of time.Now() for
+any value that affects state so that all peers compute the same result
+**/
+func GetTxTime(stub *shim.ChaincodeStub)(time.Time, error){
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		fmt.Println("GetTxTime: Could not get transaction timestamp ", err)
+		return time.Time{}, err
+	}
+
+	return time.Unix(ts.Seconds, int64(ts.Nanos)).UTC(), nil
+}
+
 /**
 Adds Log for Mortgage Application changes
 **/
@@ -2262,7 +2606,11 @@ func AppendMALog(stub *shim.ChaincodeStub, action string, text string, status st
 	fmt.Println("Entering AppendMALog")
 
 
-	nowTime := time.Now()
+	//Every peer must write the same timestamp
+	nowTime, err := GetTxTime(stub)
+	if err != nil {
+		return err
+	}
 	key, _ := GetStateKey(id, MALOG)
 
 	lh, err := GetMALogHolder(stub, key)
@@ -2532,6 +2880,21 @@ func CreateUser(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
 		}
 		
 		
+	}else if affiliation == ESCROW_A{
+		return nil, errors.New("Escrow agents can only be registered by an admin")
+
+	}else if affiliation == KYC_A{
+		return nil, errors.New("KYC providers can only be registered by an admin")
+
+	}else if affiliation == REGULATOR_A{
+		return nil, errors.New("Regulators can only be registered by an admin")
+
+	}else if affiliation == ADMIN_A{
+		return nil, errors.New("Admins can only be created by an admin")
+
+	}else if affiliation == LICENSING_A{
+		return nil, errors.New("Licensing authorities can only be registered by an admin")
+
 	}else{
 		return nil, errors.New("Invalid user type")
 	}
@@ -2650,6 +3013,18 @@ func (t *MarketplaceChaincode) Init(stub *shim.ChaincodeStub, function string, a
 	if function == "Setup" {
         fmt.Println("Firing setup")
         return Setup(stub, args)
+    }
+	if function == "ConfigureIdentity" {
+        fmt.Println("Firing ConfigureIdentity")
+        return ConfigureIdentity(stub, args)
+    }
+	if function == "Initialize" {
+        fmt.Println("Firing Initialize")
+        return Initialize(stub, args)
+    }
+	if function == "MigrateState" {
+        fmt.Println("Firing MigrateState")
+        return migrateState(stub)
     }
 	return nil, nil
 }
@@ -2675,7 +3050,15 @@ func (t *MarketplaceChaincode) Query(stub *shim.ChaincodeStub, function string,
 
 	fmt.Println("Caller Metadata: ",username, affiliation);
 
-	
+	err = CheckAccountActive(stub, username)
+	if err !=nil {
+		return nil, err
+	}
+
+	if affiliation == REGULATOR_A {
+		//Every read of a regulator is logged, which a query cannot do
+		return nil, errors.New("Regulators read through the RegulatorRead transaction")
+	}
 
 
 	if function == "GetMortgageApplication" {
@@ -2728,6 +3111,84 @@ func (t *MarketplaceChaincode) Query(stub *shim.ChaincodeStub, function string,
 			fmt.Println("All success, returning property ad")
 			return bytes, nil		 
 		}
+	}else if function == "SearchPropertyAds" {
+		fmt.Println("Getting SearchPropertyAds")
+		return SearchPropertyAds(stub, args)
+	}else if function == "GetOffer" {
+		fmt.Println("Getting GetOffer")
+		_, bytes, err := GetOffer(stub, username, affiliation, args)
+		if err != nil {
+			fmt.Println("Error from GetOffer")
+			return nil, err
+		} else {
+			fmt.Println("All success, returning offer")
+			return bytes, nil		 
+		}
+	}else if function == "GetEscrow" {
+		fmt.Println("Getting GetEscrow")
+		_, bytes, err := GetEscrow(stub, username, affiliation, args)
+		if err != nil {
+			fmt.Println("Error from GetEscrow")
+			return nil, err
+		} else {
+			fmt.Println("All success, returning escrow")
+			return bytes, nil		 
+		}
+	}else if function == "GetOffers" {
+		fmt.Println("Getting GetOffers")
+		return GetOffers(stub, username, affiliation, args)
+	}else if function == "GetLoan" {
+		fmt.Println("Getting GetLoan")
+		_, bytes, err := GetLoan(stub, username, affiliation, args)
+		if err != nil {
+			fmt.Println("Error from GetLoan")
+			return nil, err
+		} else {
+			fmt.Println("All success, returning loan")
+			return bytes, nil		 
+		}
+	}else if function == "GetLoans" {
+		fmt.Println("Getting GetLoans")
+		return GetLoans(stub, username, affiliation, args)
+	}else if function == "GetLoanSchedule" {
+		fmt.Println("Getting GetLoanSchedule")
+		return GetLoanSchedule(stub, username, affiliation, args)
+	}else if function == "GetLoanPayoff" {
+		fmt.Println("Getting GetLoanPayoff")
+		return GetLoanPayoff(stub, username, affiliation, args)
+	}else if function == "GetLoanPayments" {
+		fmt.Println("Getting GetLoanPayments")
+		return GetLoanPayments(stub, username, affiliation, args)
+	}else if function == "GetUnpaidInvoices" {
+		fmt.Println("Getting GetUnpaidInvoices")
+		return GetUnpaidInvoices(stub, username, affiliation, args)
+	}else if function == "GetAppraisalReport" {
+		fmt.Println("Getting GetAppraisalReport")
+		return GetAppraisalReport(stub, username, affiliation, args)
+	}else if function == "VerifyDocument" {
+		fmt.Println("Getting VerifyDocument")
+		return VerifyDocument(stub, username, affiliation, args)
+	}else if function == "GetRateSheet" {
+		fmt.Println("Getting GetRateSheet")
+		return GetRateSheet(stub, username, affiliation, args)
+	}else if function == "GetLendingReport" {
+		fmt.Println("Getting GetLendingReport")
+		return GetLendingReport(stub, username, affiliation, args)
+	}else if function == "GetKycStatus" {
+		fmt.Println("Getting GetKycStatus")
+		return GetKycStatus(stub, username, affiliation, args)
+	}else if function == "GetProfile" {
+		fmt.Println("Getting GetProfile")
+		return GetProfile(stub, username, affiliation, args)
+	}else if function == "GetProfiles" {
+		fmt.Println("Getting GetProfiles")
+		return GetProfiles(stub, username, affiliation, args)
+	}else if function == "GetLicenses" {
+		fmt.Println("Getting GetLicenses")
+		return GetLicenses(stub, username, affiliation, args)
+	}else if function == "GetAccountStatus" {
+		fmt.Println("Getting GetAccountStatus")
+		return GetAccountStatus(stub, username, affiliation, args)
 	}else if function == "GetMortgageApplications" {
 		fmt.Println("Getting GetMortgageApplications")
 		return GetMortgageApplications(stub, username, affiliation, args)
@@ -2757,10 +3218,6 @@ func (t *MarketplaceChaincode) Invoke(stub *shim.ChaincodeStub, function string,
 		fmt.Println("Firing CreateUser")
         return CreateUser(stub, args)
     }
-    if function == "Setup" {
-        fmt.Println("Firing Setup")
-        return Setup(stub, args)
-    }
 
 	username, affiliation, err := GetCallerMetadata(stub)
 	if err !=nil {
@@ -2777,6 +3234,19 @@ func (t *MarketplaceChaincode) Invoke(stub *shim.ChaincodeStub, function string,
 
 	fmt.Println("Caller Metadata: ",username, affiliation);
 
+	err = CheckAccountActive(stub, username)
+	if err !=nil {
+		return nil, err
+	}
+
+	if affiliation == REGULATOR_A {
+		//Regulators have read-only access
+		if function == "RegulatorRead" {
+			fmt.Println("Firing RegulatorRead")
+			return RegulatorRead(stub, username, affiliation, args)
+		}
+		return nil, errors.New("Regulator "+username+" cannot invoke "+function)
+	}
 
 	if function == "CreateMortgageApplication" {
 		fmt.Println("Firing CreateMortgageApplication")
@@ -2796,6 +3266,114 @@ func (t *MarketplaceChaincode) Invoke(stub *shim.ChaincodeStub, function string,
 	}else if function == "UpdateSalesContract" {
 		fmt.Println("Firing UpdateSalesContract")
 		return UpdateSalesContract(stub, username, affiliation, args)
+	}else if function == "UpdateContingency" {
+		fmt.Println("Firing UpdateContingency")
+		return UpdateContingency(stub, username, affiliation, args)
+	}else if function == "CreateLoan" {
+		fmt.Println("Firing CreateLoan")
+		return CreateLoan(stub, username, affiliation, args)
+	}else if function == "AcknowledgeInvoicePayment" {
+		fmt.Println("Firing AcknowledgeInvoicePayment")
+		return AcknowledgeInvoicePayment(stub, username, affiliation, args)
+	}else if function == "FileReconsideration" {
+		fmt.Println("Firing FileReconsideration")
+		return FileReconsideration(stub, username, affiliation, args)
+	}else if function == "RespondToReconsideration" {
+		fmt.Println("Firing RespondToReconsideration")
+		return RespondToReconsideration(stub, username, affiliation, args)
+	}else if function == "OrderSecondAppraisal" {
+		fmt.Println("Firing OrderSecondAppraisal")
+		return OrderSecondAppraisal(stub, username, affiliation, args)
+	}else if function == "SelectAppraisedValue" {
+		fmt.Println("Firing SelectAppraisedValue")
+		return SelectAppraisedValue(stub, username, affiliation, args)
+	}else if function == "SubmitAppraisalReport" {
+		fmt.Println("Firing SubmitAppraisalReport")
+		return SubmitAppraisalReport(stub, username, affiliation, args)
+	}else if function == "RegisterAppraiserPanel" {
+		fmt.Println("Firing RegisterAppraiserPanel")
+		return RegisterAppraiserPanel(stub, username, affiliation, args)
+	}else if function == "RecordKycVerification" {
+		fmt.Println("Firing RecordKycVerification")
+		return RecordKycVerification(stub, username, affiliation, args)
+	}else if function == "SetKycPolicy" {
+		fmt.Println("Firing SetKycPolicy")
+		return SetKycPolicy(stub, username, affiliation, args)
+	}else if function == "UpdateProfile" {
+		fmt.Println("Firing UpdateProfile")
+		return UpdateProfile(stub, username, affiliation, args)
+	}else if function == "VerifyProfile" {
+		fmt.Println("Firing VerifyProfile")
+		return VerifyProfile(stub, username, affiliation, args)
+	}else if function == "EraseProfile" {
+		fmt.Println("Firing EraseProfile")
+		return EraseProfile(stub, username, affiliation, args)
+	}else if function == "MigrateState" {
+		fmt.Println("Firing MigrateState")
+		return MigrateState(stub, username, affiliation, args)
+	}else if function == "RegisterUser" {
+		fmt.Println("Firing RegisterUser")
+		return RegisterUser(stub, username, affiliation, args)
+	}else if function == "ConsentToMortgageApplication" {
+		fmt.Println("Firing ConsentToMortgageApplication")
+		return ConsentToMortgageApplication(stub, username, affiliation, args)
+	}else if function == "RecordLicense" {
+		fmt.Println("Firing RecordLicense")
+		return RecordLicense(stub, username, affiliation, args)
+	}else if function == "SuspendUser" {
+		fmt.Println("Firing SuspendUser")
+		return SuspendUser(stub, username, affiliation, args)
+	}else if function == "ReactivateUser" {
+		fmt.Println("Firing ReactivateUser")
+		return ReactivateUser(stub, username, affiliation, args)
+	}else if function == "DeactivateUser" {
+		fmt.Println("Firing DeactivateUser")
+		return DeactivateUser(stub, username, affiliation, args)
+	}else if function == "RequestErasure" {
+		fmt.Println("Firing RequestErasure")
+		return RequestErasure(stub, username, affiliation, args)
+	}else if function == "DecideErasure" {
+		fmt.Println("Firing DecideErasure")
+		return DecideErasure(stub, username, affiliation, args)
+	}else if function == "UnmaskMortgageApplication" {
+		fmt.Println("Firing UnmaskMortgageApplication")
+		return UnmaskMortgageApplication(stub, username, affiliation, args)
+	}else if function == "RotateMortgageApplicationKey" {
+		fmt.Println("Firing RotateMortgageApplicationKey")
+		return RotateMortgageApplicationKey(stub, username, affiliation, args)
+	}else if function == "SetDocumentRequirements" {
+		fmt.Println("Firing SetDocumentRequirements")
+		return SetDocumentRequirements(stub, username, affiliation, args)
+	}else if function == "AttachDocument" {
+		fmt.Println("Firing AttachDocument")
+		return AttachDocument(stub, username, affiliation, args)
+	}else if function == "PublishRateSheet" {
+		fmt.Println("Firing PublishRateSheet")
+		return PublishRateSheet(stub, username, affiliation, args)
+	}else if function == "LockRate" {
+		fmt.Println("Firing LockRate")
+		return LockRate(stub, username, affiliation, args)
+	}else if function == "RecordPayment" {
+		fmt.Println("Firing RecordPayment")
+		return RecordPayment(stub, username, affiliation, args)
+	}else if function == "RefreshLoanDelinquency" {
+		fmt.Println("Firing RefreshLoanDelinquency")
+		return RefreshLoanDelinquency(stub, username, affiliation, args)
+	}else if function == "OpenEscrow" {
+		fmt.Println("Firing OpenEscrow")
+		return OpenEscrow(stub, username, affiliation, args)
+	}else if function == "RecordEscrowDeposit" {
+		fmt.Println("Firing RecordEscrowDeposit")
+		return RecordEscrowDeposit(stub, username, affiliation, args)
+	}else if function == "DisburseEscrow" {
+		fmt.Println("Firing DisburseEscrow")
+		return DisburseEscrow(stub, username, affiliation, args)
+	}else if function == "CreateOffer" {
+		fmt.Println("Firing CreateOffer")
+		return CreateOffer(stub, username, affiliation, args)
+	}else if function == "RespondToOffer" {
+		fmt.Println("Firing RespondToOffer")
+		return RespondToOffer(stub, username, affiliation, args)
 	}else if function == "CreateUser" {
         fmt.Println("Firing CreateUser")
         return CreateUser(stub, args)
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//Contingency types
+const CONTINGENCY_FINANCING string = "financing"
+const CONTINGENCY_APPRAISAL string = "appraisal"
+const CONTINGENCY_INSPECTION string = "inspection"
+
+//Contingency status values
+const CONTINGENCY_PENDING string = "Pending"
+const CONTINGENCY_SATISFIED string = "Satisfied"
+const CONTINGENCY_WAIVED string = "Waived"
+const CONTINGENCY_EXPIRED string = "Expired"
+
+//Sales contract and mortgage application status values the contingencies depend on
+const SC_CLOSED string = "Closed"
+const MA_APPROVED string = "Approved"
+
+//Index of the mortgage applications linked to a sales contract
+var maSalesContractIndex = "ma:salescontract:"
+
+type Contingency struct {
+	Type       string `json:"type"`
+	Status     string `json:"status"`
+	Deadline   string `json:"deadline"`
+	ResolvedBy string `json:"resolvedBy"`
+	ResolvedAt string `json:"resolvedAt"`
+	Note       string `json:"note"`
+}
+
+type ContingencySchema struct {
+	Type     string `json:"type"`
+	Action   string `json:"action"`
+	Deadline string `json:"deadline"`
+	Note     string `json:"note"`
+}
+
+/**
+Creates pending contingency records for the given types
+**/
+func NewContingencies(types []string) []Contingency {
+	contingencies := []Contingency{}
+	for _, t := range types {
+		contingencies = append(contingencies, Contingency{Type: t, Status: CONTINGENCY_PENDING})
+	}
+	return contingencies
+}
+
+/**
+Validates contingencies supplied with a new sales contract and resets them to pending
+**/
+func NormalizeContingencies(contingencies []Contingency) ([]Contingency, error) {
+	var types []string
+	for _, c := range contingencies {
+		types = append(types, c.Type)
+	}
+
+	valid, err := validateContingencies(types)
+	if err != nil {
+		return nil, err
+	}
+
+	result := NewContingencies(valid)
+	for i := range result {
+		for _, c := range contingencies {
+			if strings.ToLower(strings.TrimSpace(c.Type)) == result[i].Type && len(strings.TrimSpace(c.Deadline)) > 0 {
+				_, err := time.Parse(dateLayout, strings.TrimSpace(c.Deadline))
+				if err != nil {
+					return nil, errors.New("Invalid deadline " + c.Deadline + ". Expected format " + dateLayout)
+				}
+				result[i].Deadline = strings.TrimSpace(c.Deadline)
+			}
+		}
+	}
+
+	return result, nil
+}
+
+/**
+Returns true if the contingency no longer blocks closing
+**/
+func IsContingencyCleared(c Contingency) bool {
+	return c.Status == CONTINGENCY_SATISFIED || c.Status == CONTINGENCY_WAIVED
+}
+
+/**
+Marks pending contingencies whose deadline has passed as expired.
+Returns true if any contingency was changed
+**/
+func ExpireContingencies(sc *SalesContract, txTime time.Time) bool {
+	changed := false
+	for i := range sc.Contingencies {
+		c := &sc.Contingencies[i]
+		if c.Status != CONTINGENCY_PENDING || len(c.Deadline) == 0 {
+			continue
+		}
+		deadline, err := time.Parse(dateLayout, c.Deadline)
+		if err == nil && txTime.After(deadline) {
+			c.Status = CONTINGENCY_EXPIRED
+			c.ResolvedAt = txTime.Format(dateLayout)
+			c.Note = "Deadline passed"
+			changed = true
+		}
+	}
+	return changed
+}
+
+/**
+Returns an error naming every contingency which has not been satisfied or waived
+**/
+func CheckContingenciesCleared(sc SalesContract) error {
+	var outstanding []string
+	for _, c := range sc.Contingencies {
+		if !IsContingencyCleared(c) {
+			outstanding = append(outstanding, c.Type+" ("+c.Status+")")
+		}
+	}
+
+	if len(outstanding) > 0 {
+		return errors.New("Sales contract " + sc.ID + " cannot be closed. Outstanding contingencies: " + strings.Join(outstanding, ", "))
+	}
+	return nil
+}
+
+/**
+Reads a sales contract from the ledger without any access checks
+**/
+func LoadSalesContract(stub *shim.ChaincodeStub, id string) (SalesContract, error) {
+	var sc SalesContract
+
+	key, err := GetStateKey(id, SALESCONTRACT)
+	if err != nil {
+		return sc, err
+	}
+
+	bytes, err := stub.GetState(key)
+	if err != nil {
+		fmt.Println("LoadSalesContract: Could not fetch salesContract with ID : "+id, err)
+		return sc, err
+	}
+	if len(bytes) == 0 {
+		return sc, errors.New("Sales contract with id " + id + " does not exist")
+	}
+
+	err = json.Unmarshal(bytes, &sc)
+	if err != nil {
+		fmt.Println("LoadSalesContract: Could not unmarshal salesContract with ID : "+id, err)
+		return sc, err
+	}
+
+	return sc, nil
+}
+
+/**
+Checks that a sales contract can be linked to a mortgage application: it must be the
+contract of one of the applicants for the same property, reviewed by the same bank
+**/
+func checkSalesContractLink(ma MortgageApplication, sc SalesContract) error {
+	if !containsString(ApplicantIds(ma), sc.BuyerId) {
+		return errors.New("Sales contract " + sc.ID + " is not the contract of an applicant on mortgage application " + ma.ID)
+	}
+	if sc.PropertyId != ma.PropertyId {
+		return errors.New("Sales contract " + sc.ID + " is for property " + sc.PropertyId + ", not " + ma.PropertyId)
+	}
+	if sc.ReviewerId != ma.ReviewerId {
+		return errors.New("Sales contract " + sc.ID + " is reviewed by " + sc.ReviewerId + ", not " + ma.ReviewerId)
+	}
+	return nil
+}
+
+/**
+Loads the sales contract and checks that it can be linked to the mortgage application
+**/
+func LinkableSalesContract(stub *shim.ChaincodeStub, ma MortgageApplication, id string) (SalesContract, error) {
+	sc, err := LoadSalesContract(stub, id)
+	if err != nil {
+		return sc, errors.New("Sales contract " + id + " does not exist")
+	}
+	return sc, checkSalesContractLink(ma, sc)
+}
+
+/**
+Sets a satisfied appraisal contingency back to pending, e.g. when the price it was
+satisfied against changes. Returns true if the contingency was changed
+**/
+func resetAppraisalContingency(sc *SalesContract) bool {
+	for i := range sc.Contingencies {
+		c := &sc.Contingencies[i]
+		if c.Type == CONTINGENCY_APPRAISAL && c.Status == CONTINGENCY_SATISFIED {
+			c.Status = CONTINGENCY_PENDING
+			c.ResolvedBy = ""
+			c.ResolvedAt = ""
+			c.Note = ""
+			return true
+		}
+	}
+	return false
+}
+
+/**
+Evaluates the contingencies of a sales contract again against every mortgage application
+linked to it
+**/
+func ReevaluateContingencies(stub *shim.ChaincodeStub, scId string) error {
+	ids, err := GetIndexEntries(stub, maSalesContractIndex, scId)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		ma, err := LoadMortgageApplication(stub, id)
+		if err != nil {
+			return err
+		}
+		if ma.SalesContractId != scId {
+			continue
+		}
+		err = EvaluateContingencies(stub, ma)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/**
+Sets a pending contingency to satisfied. Returns true if the contingency was changed
+**/
+func satisfyContingency(sc *SalesContract, ctype string, resolvedBy string, note string, now string) bool {
+	for i := range sc.Contingencies {
+		c := &sc.Contingencies[i]
+		if c.Type == ctype && c.Status == CONTINGENCY_PENDING {
+			c.Status = CONTINGENCY_SATISFIED
+			c.ResolvedBy = resolvedBy
+			c.ResolvedAt = now
+			c.Note = note
+			return true
+		}
+	}
+	return false
+}
+
+/**
+Satisfies the financing and appraisal contingencies on the sales contract linked to a
+mortgage application once the application is approved and the fair market value is at
+or above the contract price
+**/
+func EvaluateContingencies(stub *shim.ChaincodeStub, ma MortgageApplication) error {
+	fmt.Println("Entering EvaluateContingencies")
+
+	scId := strings.TrimSpace(ma.SalesContractId)
+	if len(scId) == 0 {
+		return nil
+	}
+
+	sc, err := LoadSalesContract(stub, scId)
+	if err != nil {
+		fmt.Println("EvaluateContingencies: Could not load sales contract "+scId+" ", err)
+		return err
+	}
+
+	txTime, err := GetTxTime(stub)
+	if err != nil {
+		return err
+	}
+	now := txTime.Format(dateLayout)
+
+	changed := ExpireContingencies(&sc, txTime)
+	var msgs []string
+
+	if strings.EqualFold(strings.TrimSpace(ma.Status), MA_APPROVED) {
+		if satisfyContingency(&sc, CONTINGENCY_FINANCING, ma.ReviewerId, "Mortgage application "+ma.ID+" approved", now) {
+			changed = true
+			msgs = append(msgs, "financing contingency satisfied by mortgage application "+ma.ID)
+		}
+	}
+
+	cmp, err := ma.FairMarketValue.Compare(sc.Price)
+	if err != nil && !ma.FairMarketValue.IsZero() {
+		//Values in different currencies cannot satisfy the appraisal contingency
+		fmt.Println("EvaluateContingencies: Cannot compare fair market value with price ", err)
+	}
+	if err == nil && !ma.FairMarketValue.IsZero() && cmp >= 0 {
+		note := "Fair market value " + ma.FairMarketValue.String() + " is at or above price " + sc.Price.String()
+		if satisfyContingency(&sc, CONTINGENCY_APPRAISAL, ma.AppraisalApplicationId, note, now) {
+			changed = true
+			msgs = append(msgs, "appraisal contingency satisfied. "+note)
+		}
+	}
+
+	if !changed {
+		return nil
+	}
+
+	sc.LastModifiedDate = now
+	_, err = SaveSalesContract(stub, sc, sc.ID)
+	if err != nil {
+		return err
+	}
+
+	for _, msg := range msgs {
+		AppendMALog(stub, "EvaluateContingencies", msg, sc.Status, sc.ID)
+	}
+
+	return nil
+}
+
+/**
+Adds, satisfies or waives a contingency on a sales contract.
+Only the buyer, who the contingencies protect, can add or waive them or mark the
+inspection as satisfied. Financing and appraisal are satisfied automatically from the
+linked mortgage and appraiser applications.
+args[0] is the sales contract id and args[1] a ContingencySchema json string
+**/
+func UpdateContingency(stub *shim.ChaincodeStub, callerId string, callerAffiliation int, args []string) ([]byte, error) {
+	fmt.Println("Entering UpdateContingency")
+
+	if len(args) < 2 {
+		fmt.Println("UpdateContingency: expected two arguments")
+		return nil, errors.New("Could not update contingency. Invalid input")
+	}
+
+	sc, err := LoadSalesContract(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	err = Authorize(stub, callerId, callerAffiliation, SALESCONTRACT, OP_CONTINGENCY, sc)
+	if err != nil {
+		return nil, err
+	}
+
+	if sc.Status == SC_CLOSED {
+		return nil, errors.New("Sales contract " + sc.ID + " is closed")
+	}
+
+	var input ContingencySchema
+	err = json.Unmarshal([]byte(args[1]), &input)
+	if err != nil {
+		fmt.Println("UpdateContingency: Could not unmarshal input ", err)
+		return nil, err
+	}
+
+	ctype := strings.ToLower(strings.TrimSpace(input.Type))
+	action := strings.ToLower(strings.TrimSpace(input.Action))
+
+	txTime, err := GetTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	now := txTime.Format(dateLayout)
+
+	ExpireContingencies(&sc, txTime)
+
+	var msg string
+
+	if action == "add" {
+		added, err := NormalizeContingencies([]Contingency{Contingency{Type: ctype, Deadline: input.Deadline}})
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range sc.Contingencies {
+			if c.Type == ctype {
+				return nil, errors.New("Sales contract " + sc.ID + " already has a " + ctype + " contingency")
+			}
+		}
+		sc.Contingencies = append(sc.Contingencies, added...)
+		msg = callerId + " added " + ctype + " contingency"
+
+	} else if action == "satisfy" || action == "waive" {
+		if action == "satisfy" && ctype != CONTINGENCY_INSPECTION {
+			return nil, errors.New("The " + ctype + " contingency is satisfied by its linked application and can only be waived")
+		}
+
+		found := false
+		for i := range sc.Contingencies {
+			c := &sc.Contingencies[i]
+			if c.Type != ctype {
+				continue
+			}
+			found = true
+			if IsContingencyCleared(*c) {
+				return nil, errors.New("The " + ctype + " contingency is already " + c.Status)
+			}
+			if action == "satisfy" && c.Status == CONTINGENCY_EXPIRED {
+				return nil, errors.New("The " + ctype + " contingency deadline has passed. It can only be waived")
+			}
+			if action == "satisfy" {
+				c.Status = CONTINGENCY_SATISFIED
+			} else {
+				c.Status = CONTINGENCY_WAIVED
+			}
+			c.ResolvedBy = callerId
+			c.ResolvedAt = now
+			c.Note = input.Note
+			msg = callerId + " marked " + ctype + " contingency as " + c.Status
+		}
+		if !found {
+			return nil, errors.New("Sales contract " + sc.ID + " has no " + ctype + " contingency")
+		}
+
+	} else {
+		return nil, errors.New("Invalid action " + input.Action + ". Expected add, satisfy or waive")
+	}
+
+	sc.LastModifiedDate = now
+	bytes, err := SaveSalesContract(stub, sc, sc.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	AppendMALog(stub, "UpdateContingency", msg, sc.Status, sc.ID)
+
+	return bytes, nil
+}
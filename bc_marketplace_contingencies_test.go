@@ -0,0 +1,69 @@
+package main
+
+import "testing"
+
+func TestSalesContractLink(t *testing.T) {
+	ma := MortgageApplication{
+		ID:           "ma1",
+		BuyerId:      "buyer1",
+		PropertyId:   "property1",
+		ReviewerId:   "bank1",
+		CoApplicants: []CoApplicant{{BuyerId: "buyer2"}},
+	}
+
+	cases := []struct {
+		name   string
+		sc     SalesContract
+		wantOk bool
+	}{
+		{"contract of the applicant", SalesContract{ID: "sc1", BuyerId: "buyer1", PropertyId: "property1", ReviewerId: "bank1"}, true},
+		{"contract of a co-applicant", SalesContract{ID: "sc2", BuyerId: "buyer2", PropertyId: "property1", ReviewerId: "bank1"}, true},
+		{"contract of another buyer", SalesContract{ID: "sc3", BuyerId: "buyer3", PropertyId: "property1", ReviewerId: "bank1"}, false},
+		{"contract for another property", SalesContract{ID: "sc4", BuyerId: "buyer1", PropertyId: "property2", ReviewerId: "bank1"}, false},
+		{"contract reviewed by another bank", SalesContract{ID: "sc5", BuyerId: "buyer1", PropertyId: "property1", ReviewerId: "bank2"}, false},
+	}
+
+	for _, c := range cases {
+		err := checkSalesContractLink(ma, c.sc)
+		if c.wantOk && err != nil {
+			t.Errorf("%s: unexpected error %v", c.name, err)
+		}
+		if !c.wantOk && err == nil {
+			t.Errorf("%s: expected an error", c.name)
+		}
+	}
+}
+
+func TestResetAppraisalContingency(t *testing.T) {
+	cases := []struct {
+		name        string
+		status      string
+		wantChanged bool
+		wantStatus  string
+	}{
+		{"satisfied", CONTINGENCY_SATISFIED, true, CONTINGENCY_PENDING},
+		{"pending", CONTINGENCY_PENDING, false, CONTINGENCY_PENDING},
+		{"waived by the buyer", CONTINGENCY_WAIVED, false, CONTINGENCY_WAIVED},
+		{"expired", CONTINGENCY_EXPIRED, false, CONTINGENCY_EXPIRED},
+	}
+
+	for _, c := range cases {
+		sc := SalesContract{ID: "sc1", Contingencies: []Contingency{
+			{Type: CONTINGENCY_FINANCING, Status: CONTINGENCY_SATISFIED, ResolvedBy: "bank1"},
+			{Type: CONTINGENCY_APPRAISAL, Status: c.status, ResolvedBy: "aa1", ResolvedAt: "2026-01-01 00:00:00", Note: "old price"},
+		}}
+		changed := resetAppraisalContingency(&sc)
+		if changed != c.wantChanged {
+			t.Errorf("%s: changed is %v, want %v", c.name, changed, c.wantChanged)
+		}
+		if sc.Contingencies[1].Status != c.wantStatus {
+			t.Errorf("%s: status is %s, want %s", c.name, sc.Contingencies[1].Status, c.wantStatus)
+		}
+		if changed && (sc.Contingencies[1].ResolvedBy != "" || sc.Contingencies[1].ResolvedAt != "") {
+			t.Errorf("%s: resolution was kept %v", c.name, sc.Contingencies[1])
+		}
+		if sc.Contingencies[0].Status != CONTINGENCY_SATISFIED {
+			t.Errorf("%s: financing contingency changed to %s", c.name, sc.Contingencies[0].Status)
+		}
+	}
+}
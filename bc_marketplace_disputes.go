@@ -0,0 +1,443 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//Reconsideration of value status values
+const ROV_FILED string = "Filed"
+const ROV_REVISED string = "Revised"
+const ROV_UPHELD string = "Upheld"
+
+//How the fair market value on a mortgage application was arrived at
+const VALUE_BASIS_APPRAISAL string = "appraisal"
+const VALUE_BASIS_REVISED string = "revised"
+const VALUE_BASIS_UPHELD string = "upheld"
+const VALUE_BASIS_SECOND_APPRAISAL string = "second_appraisal"
+
+/**
+Records which appraisal the fair market value of a mortgage application came from
+**/
+type ValueSource struct {
+	AppraiserApplicationId string `json:"appraiserApplicationId"`
+	Basis                  string `json:"basis"`
+	SetBy                  string `json:"setBy"`
+	SetAt                  string `json:"setAt"`
+}
+
+/**
+A request from the bank for the appraiser to reconsider the fair market value
+**/
+type Reconsideration struct {
+	ID             string       `json:"id"`
+	FiledBy        string       `json:"filedBy"`
+	FiledAt        string       `json:"filedAt"`
+	Reason         string       `json:"reason"`
+	RequestedValue Money        `json:"requestedValue"`
+	OriginalValue  Money        `json:"originalValue"`
+	Comparables    []Comparable `json:"comparables"`
+	Status         string       `json:"status"`
+	RespondedBy    string       `json:"respondedBy"`
+	RespondedAt    string       `json:"respondedAt"`
+	Reasoning      string       `json:"reasoning"`
+	RevisedValue   Money        `json:"revisedValue"`
+}
+
+type ReconsiderationSchema struct {
+	Reason         string       `json:"reason"`
+	RequestedValue Money        `json:"requestedValue"`
+	Comparables    []Comparable `json:"comparables"`
+}
+
+type ReconsiderationResponseSchema struct {
+	Action       string `json:"action"`
+	Reasoning    string `json:"reasoning"`
+	RevisedValue Money  `json:"revisedValue"`
+}
+
+/**
+Returns the reconsideration awaiting a response from the appraiser, if any
+**/
+func openReconsideration(aa *AppraiserApplication) *Reconsideration {
+	for i := range aa.Reconsiderations {
+		if aa.Reconsiderations[i].Status == ROV_FILED {
+			return &aa.Reconsiderations[i]
+		}
+	}
+	return nil
+}
+
+/**
+Returns an error if the appraiser of the appraiser application can no longer set the value
+of the mortgage application directly: while a reconsideration is open, once a second
+appraisal is ordered, or once the value came from anything but the original appraisal
+**/
+func checkAppraisedValueOpen(ma MortgageApplication, aa AppraiserApplication) error {
+	if ma.AppraisalApplicationId != aa.ID {
+		return errors.New("Appraiser application " + aa.ID + " is not the appraisal of mortgage application " + ma.ID)
+	}
+	if openReconsideration(&aa) != nil {
+		return errors.New("Appraiser application " + aa.ID + " has an open reconsideration of value")
+	}
+	if len(aa.SecondAppraisalId) > 0 {
+		return errors.New("A second appraisal " + aa.SecondAppraisalId + " was ordered for " + aa.ID + ". The bank selects the value")
+	}
+	if len(ma.ValueSource.Basis) > 0 && ma.ValueSource.Basis != VALUE_BASIS_APPRAISAL {
+		return errors.New("The value of mortgage application " + ma.ID + " is based on " + ma.ValueSource.Basis + " and can no longer be set by the appraiser")
+	}
+	return nil
+}
+
+/**
+Sets the fair market value of a mortgage application from an appraiser application and
+records where the value came from. Every change to the value goes through here
+**/
+func ApplyAppraisedValue(stub *shim.ChaincodeStub, ma MortgageApplication, aa AppraiserApplication, basis string, setBy string, now string) error {
+	fmt.Println("Entering ApplyAppraisedValue")
+
+	err := SameCurrency(aa.FairMarketValue, ma.RequestedAmount)
+	if err != nil {
+		return err
+	}
+
+	previous := ma.FairMarketValue
+	ma.FairMarketValue = aa.FairMarketValue
+	ma.ValueSource = ValueSource{aa.ID, basis, setBy, now}
+	ma.LastModifiedDate = now
+
+	_, err = SaveMortgageApplication(stub, ma, ma.ID)
+	if err != nil {
+		return err
+	}
+
+	AppendMALog(stub, "ApplyAppraisedValue", setBy+" set fair market value from "+previous.String()+" to "+ma.FairMarketValue.String()+" based on "+basis+" of appraiser application "+aa.ID, ma.Status, ma.ID)
+
+	return EvaluateContingencies(stub, ma)
+}
+
+/**
+Files a reconsideration of value with supporting comparables. Only the reviewing bank can
+file and only one reconsideration can be open at a time.
+args[0] is the appraiser application id and args[1] a ReconsiderationSchema json string
+**/
+func FileReconsideration(stub *shim.ChaincodeStub, callerId string, callerAffiliation int, args []string) ([]byte, error) {
+	fmt.Println("Entering FileReconsideration")
+
+	if len(args) < 2 {
+		fmt.Println("FileReconsideration: expected two arguments")
+		return nil, errors.New("Could not file reconsideration. Invalid input")
+	}
+
+	aa, _, err := GetAppraiserApplication(stub, callerId, callerAffiliation, []string{args[0]})
+	if err != nil {
+		return nil, err
+	}
+
+	err = Authorize(stub, callerId, callerAffiliation, APPRAISERAPPLICATION, OP_DISPUTE, aa)
+	if err != nil {
+		return nil, err
+	}
+
+	if aa.FairMarketValue.IsZero() {
+		return nil, errors.New("Appraiser application " + aa.ID + " has no fair market value to reconsider")
+	}
+
+	if openReconsideration(&aa) != nil {
+		return nil, errors.New("Appraiser application " + aa.ID + " already has an open reconsideration")
+	}
+
+	var input ReconsiderationSchema
+	err = json.Unmarshal([]byte(args[1]), &input)
+	if err != nil {
+		fmt.Println("FileReconsideration: Could not unmarshal input ", err)
+		return nil, err
+	}
+
+	if len(strings.TrimSpace(input.Reason)) == 0 {
+		return nil, errors.New("A reconsideration needs a reason")
+	}
+	if len(input.Comparables) == 0 {
+		return nil, errors.New("A reconsideration needs at least one supporting comparable")
+	}
+	if input.RequestedValue.Amount <= 0 || input.RequestedValue.Currency != aa.FairMarketValue.Currency {
+		return nil, errors.New("Requested value must be a positive amount in " + aa.FairMarketValue.Currency)
+	}
+
+	for i := range input.Comparables {
+		err = validateComparable(stub, &input.Comparables[i], aa.PropertyId, aa.FairMarketValue.Currency)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	txTime, err := GetTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	now := txTime.Format(dateLayout)
+
+	rov := Reconsideration{
+		ID:             "rov-" + strconv.Itoa(len(aa.Reconsiderations)+1),
+		FiledBy:        callerId,
+		FiledAt:        now,
+		Reason:         strings.TrimSpace(input.Reason),
+		RequestedValue: input.RequestedValue,
+		OriginalValue:  aa.FairMarketValue,
+		Comparables:    input.Comparables,
+		Status:         ROV_FILED,
+	}
+	aa.Reconsiderations = append(aa.Reconsiderations, rov)
+	aa.LastModifiedDate = now
+
+	bytes, err := SaveAppraiserApplication(stub, aa, aa.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := callerId + " filed reconsideration " + rov.ID + " of " + aa.FairMarketValue.String() + " requesting " + rov.RequestedValue.String() + " with " + strconv.Itoa(len(rov.Comparables)) + " comparables"
+	AppendMALog(stub, "FileReconsideration", msg, aa.Status, aa.ID)
+	AppendMALog(stub, "FileReconsideration", msg, "", aa.MortgageApplicationId)
+
+	return bytes, nil
+}
+
+/**
+The appraiser revises or upholds the value under reconsideration. Reasoning is required
+either way. A revised value is carried into the mortgage application.
+args[0] is the appraiser application id and args[1] a ReconsiderationResponseSchema json string
+**/
+func RespondToReconsideration(stub *shim.ChaincodeStub, callerId string, callerAffiliation int, args []string) ([]byte, error) {
+	fmt.Println("Entering RespondToReconsideration")
+
+	if len(args) < 2 {
+		fmt.Println("RespondToReconsideration: expected two arguments")
+		return nil, errors.New("Could not respond to reconsideration. Invalid input")
+	}
+
+	aa, _, err := GetAppraiserApplication(stub, callerId, callerAffiliation, []string{args[0]})
+	if err != nil {
+		return nil, err
+	}
+
+	err = Authorize(stub, callerId, callerAffiliation, APPRAISERAPPLICATION, OP_RESPOND, aa)
+	if err != nil {
+		return nil, err
+	}
+
+	rov := openReconsideration(&aa)
+	if rov == nil {
+		return nil, errors.New("Appraiser application " + aa.ID + " has no open reconsideration")
+	}
+
+	var input ReconsiderationResponseSchema
+	err = json.Unmarshal([]byte(args[1]), &input)
+	if err != nil {
+		fmt.Println("RespondToReconsideration: Could not unmarshal input ", err)
+		return nil, err
+	}
+
+	if len(strings.TrimSpace(input.Reasoning)) == 0 {
+		return nil, errors.New("A response to a reconsideration needs reasoning")
+	}
+
+	txTime, err := GetTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	now := txTime.Format(dateLayout)
+
+	var basis string
+	action := strings.ToLower(strings.TrimSpace(input.Action))
+	if action == "revise" {
+		if input.RevisedValue.Amount <= 0 || input.RevisedValue.Currency != aa.FairMarketValue.Currency {
+			return nil, errors.New("Revised value must be a positive amount in " + aa.FairMarketValue.Currency)
+		}
+		rov.Status = ROV_REVISED
+		rov.RevisedValue = input.RevisedValue
+		aa.FairMarketValue = input.RevisedValue
+		if len(aa.Report.SubmittedAt) > 0 {
+			aa.Report.FairMarketValue = input.RevisedValue
+		}
+		basis = VALUE_BASIS_REVISED
+	} else if action == "uphold" {
+		rov.Status = ROV_UPHELD
+		basis = VALUE_BASIS_UPHELD
+	} else {
+		return nil, errors.New("Invalid action " + input.Action + ". Expected revise or uphold")
+	}
+	rov.RespondedBy = callerId
+	rov.RespondedAt = now
+	rov.Reasoning = strings.TrimSpace(input.Reasoning)
+	aa.LastModifiedDate = now
+
+	bytes, err := SaveAppraiserApplication(stub, aa, aa.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := callerId + " " + strings.ToLower(rov.Status) + " the value on reconsideration " + rov.ID + " at " + aa.FairMarketValue.String() + ": " + rov.Reasoning
+	AppendMALog(stub, "RespondToReconsideration", msg, aa.Status, aa.ID)
+
+	//A second appraisal's value is only used once the bank selects it
+	if len(aa.SecondAppraisalOf) == 0 {
+		ma, err := LoadMortgageApplication(stub, aa.MortgageApplicationId)
+		if err != nil {
+			return nil, err
+		}
+		err = ApplyAppraisedValue(stub, ma, aa, basis, callerId, now)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return bytes, nil
+}
+
+/**
+Orders a second appraisal of the same property from the bank's panel. The appraiser of
+the disputed appraisal is excluded from the rotation.
+args[0] is the disputed appraiser application id and args[1] the id of the new one
+**/
+func OrderSecondAppraisal(stub *shim.ChaincodeStub, callerId string, callerAffiliation int, args []string) ([]byte, error) {
+	fmt.Println("Entering OrderSecondAppraisal")
+
+	if len(args) < 2 {
+		fmt.Println("OrderSecondAppraisal: expected two arguments")
+		return nil, errors.New("Could not order second appraisal. Invalid input")
+	}
+
+	original, _, err := GetAppraiserApplication(stub, callerId, callerAffiliation, []string{args[0]})
+	if err != nil {
+		return nil, err
+	}
+
+	err = Authorize(stub, callerId, callerAffiliation, APPRAISERAPPLICATION, OP_DISPUTE, original)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(original.SecondAppraisalOf) > 0 {
+		return nil, errors.New("Appraiser application " + original.ID + " is already a second appraisal")
+	}
+	if len(original.SecondAppraisalId) > 0 {
+		return nil, errors.New("A second appraisal " + original.SecondAppraisalId + " was already ordered for " + original.ID)
+	}
+
+	aaId := strings.TrimSpace(args[1])
+	if len(aaId) == 0 {
+		return nil, errors.New("Invalid appraiser application Id")
+	}
+	existing, err := LoadAppraiserApplication(stub, aaId)
+	if err == nil && len(existing.ID) > 0 {
+		return nil, errors.New("Appraiser application with id " + aaId + " already exists")
+	}
+
+	ma, err := LoadMortgageApplication(stub, original.MortgageApplicationId)
+	if err != nil {
+		return nil, err
+	}
+
+	txTime, err := GetTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	now := txTime.Format(dateLayout)
+
+	var aa AppraiserApplication
+	aa.ID = aaId
+	aa.MortgageApplicationId = original.MortgageApplicationId
+	aa.ReviewerId = callerId
+	aa.PropertyId = original.PropertyId
+	aa.Region = original.Region
+	aa.Status = "Submitted"
+	aa.SecondAppraisalOf = original.ID
+	aa.LastModifiedDate = now
+
+	rationale, err := AssignPanelAppraiser(stub, &aa, ma, []string{original.AppraiserId})
+	if err != nil {
+		return nil, err
+	}
+
+	err = StoreAppraiserApplication(stub, aa)
+	if err != nil {
+		return nil, err
+	}
+
+	original.SecondAppraisalId = aaId
+	original.LastModifiedDate = now
+	_, err = SaveAppraiserApplication(stub, original, original.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	AppendMALog(stub, "OrderSecondAppraisal", callerId+" ordered second appraisal "+aaId+" of "+original.ID+". "+rationale, aa.Status, aaId)
+	AppendMALog(stub, "OrderSecondAppraisal", callerId+" ordered second appraisal "+aaId+" of "+original.ID, ma.Status, ma.ID)
+
+	bytes, _ := json.Marshal(&aa)
+	return bytes, nil
+}
+
+/**
+Selects the appraisal whose value the mortgage application uses once a second appraisal
+has been completed. Only the reviewing bank can select the value.
+args[0] is the mortgage application id and args[1] the appraiser application id
+**/
+func SelectAppraisedValue(stub *shim.ChaincodeStub, callerId string, callerAffiliation int, args []string) ([]byte, error) {
+	fmt.Println("Entering SelectAppraisedValue")
+
+	if len(args) < 2 {
+		fmt.Println("SelectAppraisedValue: expected two arguments")
+		return nil, errors.New("Could not select appraised value. Invalid input")
+	}
+
+	ma, err := LoadMortgageApplication(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	err = Authorize(stub, callerId, callerAffiliation, MORTGAGEAPPLICATION, OP_DISPUTE, ma)
+	if err != nil {
+		return nil, err
+	}
+
+	aa, err := LoadAppraiserApplication(stub, args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	if aa.MortgageApplicationId != ma.ID {
+		return nil, errors.New("Appraiser application " + aa.ID + " is not for mortgage application " + ma.ID)
+	}
+	if aa.FairMarketValue.IsZero() {
+		return nil, errors.New("Appraiser application " + aa.ID + " has no fair market value")
+	}
+	if openReconsideration(&aa) != nil {
+		return nil, errors.New("Appraiser application " + aa.ID + " has an open reconsideration")
+	}
+
+	basis := VALUE_BASIS_APPRAISAL
+	if len(aa.SecondAppraisalOf) > 0 {
+		basis = VALUE_BASIS_SECOND_APPRAISAL
+	} else if len(aa.Reconsiderations) > 0 {
+		basis = strings.ToLower(aa.Reconsiderations[len(aa.Reconsiderations)-1].Status)
+	}
+
+	txTime, err := GetTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ApplyAppraisedValue(stub, ma, aa, basis, callerId, txTime.Format(dateLayout))
+	if err != nil {
+		return nil, err
+	}
+
+	_, bytes, err := GetMortgageApplication(stub, callerId, callerAffiliation, []string{ma.ID})
+	return bytes, err
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//Document types which can be attached to a mortgage application
+const DOC_PAY_STUB string = "pay_stub"
+const DOC_TAX_RETURN string = "tax_return"
+const DOC_BANK_STATEMENT string = "bank_statement"
+const DOC_TITLE_REPORT string = "title_report"
+const DOC_APPRAISAL_REPORT string = "appraisal_report"
+const DOC_IDENTIFICATION string = "identification"
+const DOC_OTHER string = "other"
+
+var documentTypes = []string{DOC_PAY_STUB, DOC_TAX_RETURN, DOC_BANK_STATEMENT, DOC_TITLE_REPORT, DOC_APPRAISAL_REPORT, DOC_IDENTIFICATION, DOC_OTHER}
+
+/**
+A document attached to a mortgage application. Only the SHA-256 hash is stored on the
+ledger, the content stays with the uploader. Attaching a document of the same type again
+adds a new version rather than replacing the earlier record
+**/
+type DocumentRecord struct {
+	ID         string `json:"id"`
+	Type       string `json:"type"`
+	Name       string `json:"name"`
+	Sha256     string `json:"sha256"`
+	Version    int    `json:"version"`
+	UploadedBy string `json:"uploadedBy"`
+	UploadedAt string `json:"uploadedAt"`
+}
+
+type DocumentSchema struct {
+	Type   string `json:"type"`
+	Name   string `json:"name"`
+	Sha256 string `json:"sha256"`
+}
+
+type DocumentRequirementsSchema struct {
+	RequiredDocuments []string `json:"requiredDocuments"`
+}
+
+/**
+A file presented for verification, either as its hash or as base64 content
+**/
+type DocumentVerificationSchema struct {
+	DocumentId string `json:"documentId"`
+	Sha256     string `json:"sha256"`
+	Content    string `json:"content"`
+}
+
+type DocumentVerificationResult struct {
+	DocumentId      string `json:"documentId"`
+	Type            string `json:"type"`
+	Version         int    `json:"version"`
+	StoredSha256    string `json:"storedSha256"`
+	PresentedSha256 string `json:"presentedSha256"`
+	Matches         bool   `json:"matches"`
+}
+
+func validateDocumentType(docType string) (string, error) {
+	docType = strings.ToLower(strings.TrimSpace(docType))
+	for _, t := range documentTypes {
+		if t == docType {
+			return docType, nil
+		}
+	}
+	return "", errors.New("Invalid document type " + docType + ". Expected one of " + strings.Join(documentTypes, ", "))
+}
+
+/**
+Normalizes a hex encoded SHA-256 hash to lower case and checks its length
+**/
+func normalizeSha256(hash string) (string, error) {
+	hash = strings.ToLower(strings.TrimSpace(hash))
+	decoded, err := hex.DecodeString(hash)
+	if err != nil || len(decoded) != sha256.Size {
+		return "", errors.New("Invalid SHA-256 hash " + hash)
+	}
+	return hash, nil
+}
+
+/**
+Returns the required document types which have no document attached
+**/
+func MissingDocuments(ma MortgageApplication) []string {
+	var missing []string
+	for _, required := range ma.RequiredDocuments {
+		found := false
+		for _, doc := range ma.Documents {
+			if doc.Type == required {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, required)
+		}
+	}
+	return missing
+}
+
+/**
+Returns an error unless every required document has been attached
+**/
+func CheckRequiredDocuments(ma MortgageApplication) error {
+	missing := MissingDocuments(ma)
+	if len(missing) > 0 {
+		return errors.New("Mortgage application " + ma.ID + " is missing required documents: " + strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+/**
+Returns true if the user is the appraiser on the application linked to the mortgage application
+**/
+func isLinkedAppraiser(stub *shim.ChaincodeStub, ma MortgageApplication, callerId string) bool {
+	if len(ma.AppraisalApplicationId) == 0 {
+		return false
+	}
+	aa, err := LoadAppraiserApplication(stub, ma.AppraisalApplicationId)
+	return err == nil && aa.AppraiserId == callerId
+}
+
+/**
+Sets the document types the bank requires before the application can be approved.
+Only the reviewing bank can set the requirements.
+args[0] is the mortgage application id and args[1] a DocumentRequirementsSchema json string
+**/
+func SetDocumentRequirements(stub *shim.ChaincodeStub, callerId string, callerAffiliation int, args []string) ([]byte, error) {
+	fmt.Println("Entering SetDocumentRequirements")
+
+	if len(args) < 2 {
+		fmt.Println("SetDocumentRequirements: expected two arguments")
+		return nil, errors.New("Could not set document requirements. Invalid input")
+	}
+
+	ma, err := LoadMortgageApplication(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	err = Authorize(stub, callerId, callerAffiliation, MORTGAGEAPPLICATION, OP_UPDATE, ma)
+	if err != nil {
+		return nil, err
+	}
+
+	var input DocumentRequirementsSchema
+	err = json.Unmarshal([]byte(args[1]), &input)
+	if err != nil {
+		fmt.Println("SetDocumentRequirements: Could not unmarshal input ", err)
+		return nil, err
+	}
+
+	required := []string{}
+	for _, t := range input.RequiredDocuments {
+		docType, err := validateDocumentType(t)
+		if err != nil {
+			return nil, err
+		}
+		duplicate := false
+		for _, r := range required {
+			if r == docType {
+				duplicate = true
+			}
+		}
+		if !duplicate {
+			required = append(required, docType)
+		}
+	}
+
+	txTime, err := GetTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	ma.RequiredDocuments = required
+	ma.LastModifiedDate = txTime.Format(dateLayout)
+
+	bytes, err := SaveMortgageApplication(stub, ma, ma.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	AppendMALog(stub, "SetDocumentRequirements", callerId+" set required documents to: "+strings.Join(required, ", "), ma.Status, ma.ID)
+
+	return bytes, nil
+}
+
+/**
+Records the hash of a document for a mortgage application. Applicants, the reviewing
+bank and the appraiser on the linked appraiser application can attach documents.
+args[0] is the mortgage application id and args[1] a DocumentSchema json string
+**/
+func AttachDocument(stub *shim.ChaincodeStub, callerId string, callerAffiliation int, args []string) ([]byte, error) {
+	fmt.Println("Entering AttachDocument")
+
+	if len(args) < 2 {
+		fmt.Println("AttachDocument: expected two arguments")
+		return nil, errors.New("Could not attach document. Invalid input")
+	}
+
+	ma, err := LoadMortgageApplication(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	err = Authorize(stub, callerId, callerAffiliation, MORTGAGEAPPLICATION, OP_ATTACH, ma)
+	if err != nil {
+		return nil, err
+	}
+
+	var input DocumentSchema
+	err = json.Unmarshal([]byte(args[1]), &input)
+	if err != nil {
+		fmt.Println("AttachDocument: Could not unmarshal input ", err)
+		return nil, err
+	}
+
+	docType, err := validateDocumentType(input.Type)
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := normalizeSha256(input.Sha256)
+	if err != nil {
+		return nil, err
+	}
+
+	txTime, err := GetTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	now := txTime.Format(dateLayout)
+
+	version := 1
+	for _, doc := range ma.Documents {
+		if doc.Type == docType {
+			version++
+		}
+	}
+
+	doc := DocumentRecord{"doc-" + strconv.Itoa(len(ma.Documents)+1), docType, strings.TrimSpace(input.Name), hash, version, callerId, now}
+	ma.Documents = append(ma.Documents, doc)
+	ma.LastModifiedDate = now
+
+	_, err = SaveMortgageApplication(stub, ma, ma.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	AppendMALog(stub, "AttachDocument", callerId+" attached "+docType+" version "+strconv.Itoa(version)+" ("+doc.ID+") with SHA-256 "+hash, ma.Status, ma.ID)
+
+	return MortgageApplicationViewBytes(stub, ma, callerId, callerAffiliation)
+}
+
+/**
+Checks a presented file against the hash stored when it was attached.
+args[0] is the mortgage application id and args[1] a DocumentVerificationSchema json string
+**/
+func VerifyDocument(stub *shim.ChaincodeStub, callerId string, callerAffiliation int, args []string) ([]byte, error) {
+	fmt.Println("Entering VerifyDocument")
+
+	if len(args) < 2 {
+		fmt.Println("VerifyDocument: expected two arguments")
+		return nil, errors.New("Could not verify document. Invalid input")
+	}
+
+	ma, _, err := GetMortgageApplication(stub, callerId, callerAffiliation, []string{args[0]})
+	if err != nil {
+		return nil, err
+	}
+
+	var input DocumentVerificationSchema
+	err = json.Unmarshal([]byte(args[1]), &input)
+	if err != nil {
+		fmt.Println("VerifyDocument: Could not unmarshal input ", err)
+		return nil, err
+	}
+
+	var presented string
+	if len(input.Content) > 0 {
+		content, err := base64.StdEncoding.DecodeString(input.Content)
+		if err != nil {
+			return nil, errors.New("Document content must be base64 encoded")
+		}
+		sum := sha256.Sum256(content)
+		presented = hex.EncodeToString(sum[:])
+	} else {
+		presented, err = normalizeSha256(input.Sha256)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, doc := range ma.Documents {
+		if doc.ID == strings.TrimSpace(input.DocumentId) {
+			result := DocumentVerificationResult{doc.ID, doc.Type, doc.Version, doc.Sha256, presented, doc.Sha256 == presented}
+			bytes, err := json.Marshal(&result)
+			if err != nil {
+				return nil, err
+			}
+			return bytes, nil
+		}
+	}
+
+	return nil, errors.New("Mortgage application " + ma.ID + " has no document " + input.DocumentId)
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+const ENCRYPTION_ALGORITHM string = "AES-256-GCM"
+
+/**
+Ciphertext of the private fields of a record. KeyId names the key without revealing it
+so the holder knows which key to present
+**/
+type EncryptedData struct {
+	KeyId      string `json:"keyId"`
+	Algorithm  string `json:"algorithm"`
+	Nonce      string `json:"nonce"`
+	Ciphertext string `json:"ciphertext"`
+}
+
+/**
+A key passed in the invocation arguments. Key is 32 bytes, base64 encoded. It is never
+written to the world state, but the arguments are part of the transaction, which every
+peer keeps in its blocks. Erasure records this as its limitation
+**/
+type EncryptionKeySchema struct {
+	KeyId string `json:"keyId"`
+	Key   string `json:"key"`
+}
+
+type KeyRotationSchema struct {
+	OldKey EncryptionKeySchema `json:"oldKey"`
+	NewKey EncryptionKeySchema `json:"newKey"`
+}
+
+type CoApplicantPrivateData struct {
+	BuyerId       string        `json:"buyerId"`
+	PersonalInfo  PersonalInfo  `json:"personalInfo"`
+	FinancialInfo FinancialInfo `json:"financialInfo"`
+}
+
+/**
+Everything on a mortgage application which identifies the applicants or their finances
+**/
+type MortgageApplicationPrivateData struct {
+	PersonalInfo          PersonalInfo             `json:"personalInfo"`
+	FinancialInfo         FinancialInfo            `json:"financialInfo"`
+	CombinedFinancialInfo FinancialInfo            `json:"combinedFinancialInfo"`
+	CoApplicants          []CoApplicantPrivateData `json:"coApplicants"`
+}
+
+/**
+Parses a key argument
+**/
+func ParseEncryptionKey(arg string) (string, []byte, error) {
+	var input EncryptionKeySchema
+	err := json.Unmarshal([]byte(arg), &input)
+	if err != nil {
+		return "", nil, errors.New("Invalid encryption key argument")
+	}
+	return decodeEncryptionKey(input)
+}
+
+func decodeEncryptionKey(input EncryptionKeySchema) (string, []byte, error) {
+	keyId := strings.TrimSpace(input.KeyId)
+	if len(keyId) == 0 {
+		return "", nil, errors.New("Encryption key is missing a key id")
+	}
+	key, err := base64.StdEncoding.DecodeString(input.Key)
+	if err != nil || len(key) != 32 {
+		return "", nil, errors.New("Encryption key " + keyId + " must be 32 bytes, base64 encoded")
+	}
+	return keyId, key, nil
+}
+
+/**
+Encrypts plaintext with AES-256-GCM. The nonce is derived from the transaction id, the
+record id and the key id so that every peer produces the same ciphertext while no nonce
+is reused with the same key
+**/
+func encryptData(stub *shim.ChaincodeStub, recordId string, keyId string, key []byte, plaintext []byte) (EncryptedData, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return EncryptedData{}, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return EncryptedData{}, err
+	}
+
+	seed := sha256.Sum256([]byte(stub.UUID + ":" + recordId + ":" + keyId))
+	nonce := seed[:gcm.NonceSize()]
+
+	//The record id is authenticated so ciphertext cannot be moved to another record
+	ciphertext := gcm.Seal(nil, nonce, plaintext, []byte(recordId))
+
+	return EncryptedData{keyId, ENCRYPTION_ALGORITHM, base64.StdEncoding.EncodeToString(nonce), base64.StdEncoding.EncodeToString(ciphertext)}, nil
+}
+
+func decryptData(recordId string, keyId string, key []byte, data EncryptedData) ([]byte, error) {
+	if data.KeyId != keyId {
+		return nil, errors.New("Record " + recordId + " is encrypted with key " + data.KeyId + ", not " + keyId)
+	}
+	if data.Algorithm != ENCRYPTION_ALGORITHM {
+		return nil, errors.New("Unsupported algorithm " + data.Algorithm)
+	}
+
+	nonce, err := base64.StdEncoding.DecodeString(data.Nonce)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(data.Ciphertext)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != gcm.NonceSize() {
+		return nil, errors.New("Record " + recordId + " has an invalid nonce")
+	}
+
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, []byte(recordId))
+	if err != nil {
+		return nil, errors.New("Could not decrypt record " + recordId + " with key " + keyId)
+	}
+	return plaintext, nil
+}
+
+/**
+Encrypts the private fields of a mortgage application into its personal data record and
+clears the plaintext so only the ciphertext reaches the ledger
+**/
+func SealMortgageApplication(stub *shim.ChaincodeStub, ma *MortgageApplication, keyId string, key []byte) error {
+	fmt.Println("Entering SealMortgageApplication")
+
+	private := MortgageApplicationPrivateData{ma.PersonalInfo, ma.FinancialInfo, ma.CombinedFinancialInfo, []CoApplicantPrivateData{}}
+	for _, co := range ma.CoApplicants {
+		private.CoApplicants = append(private.CoApplicants, CoApplicantPrivateData{co.BuyerId, co.PersonalInfo, co.FinancialInfo})
+	}
+
+	plaintext, _ := json.Marshal(&private)
+	encrypted, err := encryptData(stub, ma.ID, keyId, key, plaintext)
+	if err != nil {
+		return err
+	}
+
+	_, err = SavePersonalDataRecord(stub, PersonalDataRecord{ID: ma.ID, MortgageApplicationId: ma.ID, Status: PD_ACTIVE, Encrypted: encrypted})
+	if err != nil {
+		return err
+	}
+
+	ma.PersonalDataId = ma.ID
+	ma.PersonalInfo = PersonalInfo{}
+	ma.FinancialInfo = FinancialInfo{}
+	ma.CombinedFinancialInfo = FinancialInfo{}
+	for i := range ma.CoApplicants {
+		ma.CoApplicants[i].PersonalInfo = PersonalInfo{}
+		ma.CoApplicants[i].FinancialInfo = FinancialInfo{}
+	}
+
+	return nil
+}
+
+/**
+Decrypts the personal data record of a mortgage application into the plaintext fields
+**/
+func OpenMortgageApplication(stub *shim.ChaincodeStub, ma *MortgageApplication, keyId string, key []byte) error {
+	fmt.Println("Entering OpenMortgageApplication")
+
+	if len(ma.PersonalDataId) == 0 {
+		return nil
+	}
+
+	if erasure := completedErasure(ma); erasure != nil {
+		return errors.New("Personal data of mortgage application " + ma.ID + " was erased on " + erasure.DecidedAt)
+	}
+
+	record, err := LoadPersonalDataRecord(stub, ma.PersonalDataId)
+	if err != nil {
+		return err
+	}
+	if record.Status != PD_ACTIVE {
+		return errors.New("Personal data record " + record.ID + " is " + record.Status)
+	}
+
+	plaintext, err := decryptData(ma.ID, keyId, key, record.Encrypted)
+	if err != nil {
+		return err
+	}
+
+	var private MortgageApplicationPrivateData
+	err = json.Unmarshal(plaintext, &private)
+	if err != nil {
+		return err
+	}
+
+	ma.PersonalInfo = private.PersonalInfo
+	ma.FinancialInfo = private.FinancialInfo
+	ma.CombinedFinancialInfo = private.CombinedFinancialInfo
+	for i := range ma.CoApplicants {
+		for _, co := range private.CoApplicants {
+			if co.BuyerId == ma.CoApplicants[i].BuyerId {
+				ma.CoApplicants[i].PersonalInfo = co.PersonalInfo
+				ma.CoApplicants[i].FinancialInfo = co.FinancialInfo
+			}
+		}
+	}
+
+	return nil
+}
+
+/**
+Re-encrypts the private fields of a mortgage application under a new key. An application
+stored before encryption was introduced is encrypted for the first time and needs no old
+key. Applicants and the reviewing bank can rotate the key.
+args[0] is the mortgage application id and args[1] a KeyRotationSchema json string
+**/
+func RotateMortgageApplicationKey(stub *shim.ChaincodeStub, callerId string, callerAffiliation int, args []string) ([]byte, error) {
+	fmt.Println("Entering RotateMortgageApplicationKey")
+
+	if len(args) < 2 {
+		fmt.Println("RotateMortgageApplicationKey: expected two arguments")
+		return nil, errors.New("Could not rotate key. Invalid input")
+	}
+
+	ma, _, err := GetMortgageApplication(stub, callerId, callerAffiliation, []string{args[0]})
+	if err != nil {
+		return nil, err
+	}
+
+	err = Authorize(stub, callerId, callerAffiliation, MORTGAGEAPPLICATION, OP_ROTATE_KEY, ma)
+	if err != nil {
+		return nil, err
+	}
+
+	var input KeyRotationSchema
+	err = json.Unmarshal([]byte(args[1]), &input)
+	if err != nil {
+		fmt.Println("RotateMortgageApplicationKey: Could not unmarshal input ", err)
+		return nil, err
+	}
+
+	oldKeyId := "none"
+	if len(ma.PersonalDataId) > 0 {
+		keyId, key, err := decodeEncryptionKey(input.OldKey)
+		if err != nil {
+			return nil, err
+		}
+		err = OpenMortgageApplication(stub, &ma, keyId, key)
+		if err != nil {
+			return nil, err
+		}
+		oldKeyId = keyId
+	}
+
+	newKeyId, newKey, err := decodeEncryptionKey(input.NewKey)
+	if err != nil {
+		return nil, err
+	}
+	if newKeyId == oldKeyId {
+		return nil, errors.New("The new key must have a different key id")
+	}
+
+	err = SealMortgageApplication(stub, &ma, newKeyId, newKey)
+	if err != nil {
+		return nil, err
+	}
+
+	txTime, err := GetTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	ma.LastModifiedDate = txTime.Format(dateLayout)
+
+	bytes, err := SaveMortgageApplication(stub, ma, ma.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	AppendMALog(stub, "RotateMortgageApplicationKey", callerId+" rotated encryption key from "+oldKeyId+" to "+newKeyId, ma.Status, ma.ID)
+
+	return bytes, nil
+}
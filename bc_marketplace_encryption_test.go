@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	stub := &shim.ChaincodeStub{UUID: "tx1"}
+	key := bytes.Repeat([]byte{1}, 32)
+	otherKey := bytes.Repeat([]byte{2}, 32)
+	plaintext := []byte(`{"personalInfo":{"firstname":"Ann"}}`)
+
+	data, err := encryptData(stub, "ma1", "key1", key, plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains([]byte(data.Ciphertext), []byte("Ann")) {
+		t.Errorf("ciphertext contains the plaintext")
+	}
+
+	again, err := encryptData(stub, "ma1", "key1", key, plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != data {
+		t.Errorf("encryption is not deterministic within a transaction")
+	}
+
+	tampered := data
+	tampered.Ciphertext = data.Ciphertext[:len(data.Ciphertext)-4] + "AAAA"
+
+	cases := []struct {
+		name     string
+		recordId string
+		keyId    string
+		key      []byte
+		data     EncryptedData
+		wantOk   bool
+	}{
+		{"same record and key", "ma1", "key1", key, data, true},
+		{"wrong key", "ma1", "key1", otherKey, data, false},
+		{"wrong key id", "ma1", "key2", key, data, false},
+		{"wrong record", "ma2", "key1", key, data, false},
+		{"tampered ciphertext", "ma1", "key1", key, tampered, false},
+		{"unsupported algorithm", "ma1", "key1", key, EncryptedData{"key1", "DES", data.Nonce, data.Ciphertext}, false},
+	}
+
+	for _, c := range cases {
+		got, err := decryptData(c.recordId, c.keyId, c.key, c.data)
+		if c.wantOk {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", c.name, err)
+			} else if !bytes.Equal(got, plaintext) {
+				t.Errorf("%s: decrypted %s, want %s", c.name, got, plaintext)
+			}
+		}
+		if !c.wantOk && err == nil {
+			t.Errorf("%s: expected an error", c.name)
+		}
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//Personal data record status values
+const PD_ACTIVE string = "Active"
+const PD_SHREDDED string = "Shredded"
+
+//Erasure request status values
+const ERASURE_PENDING string = "Pending"
+const ERASURE_REJECTED string = "Rejected"
+const ERASURE_COMPLETED string = "Completed"
+
+//Erasure methods
+const ERASURE_CRYPTO_SHRED string = "crypto_shred"
+const ERASURE_PURGE string = "purge"
+
+//What erasure cannot reach. Keys are passed in transaction arguments and every peer keeps
+//the transactions and earlier states in its blocks
+const ERASURE_LIMIT_KEY_IN_TRANSACTIONS string = "The key was passed in the arguments of the transactions which stored and read this data, so anyone holding the block history can recover it and decrypt the ciphertext in earlier states. The data is only erased from the current state"
+const ERASURE_LIMIT_HISTORY string = "Earlier states in the block history still hold the data. It is only erased from the current state"
+
+/**
+The encrypted personal and financial info of a mortgage application, kept apart from the
+application so it can be erased without touching the application or its log. The record
+shares the id of its mortgage application
+**/
+type PersonalDataRecord struct {
+	ID                    string        `json:"id"`
+	MortgageApplicationId string        `json:"mortgageApplicationId"`
+	Status                string        `json:"status"`
+	Encrypted             EncryptedData `json:"encrypted"`
+	ErasedAt              string        `json:"erasedAt"`
+	Limitation            string        `json:"limitation"`
+}
+
+/**
+A data subject's request to erase the personal data on a mortgage application. The
+reviewing bank decides, as it may have to keep the data for a loan it has made. Once
+completed, Outcome says what was erased and Limitation what could not be
+**/
+type ErasureRequest struct {
+	ID          string `json:"id"`
+	RequestedBy string `json:"requestedBy"`
+	RequestedAt string `json:"requestedAt"`
+	Method      string `json:"method"`
+	Reason      string `json:"reason"`
+	Status      string `json:"status"`
+	DecidedBy   string `json:"decidedBy"`
+	DecidedAt   string `json:"decidedAt"`
+	Decision    string `json:"decision"`
+	Outcome     string `json:"outcome"`
+	Limitation  string `json:"limitation"`
+}
+
+type ErasureRequestSchema struct {
+	Method string `json:"method"`
+	Reason string `json:"reason"`
+}
+
+type ErasureDecisionSchema struct {
+	Approve  bool   `json:"approve"`
+	Decision string `json:"decision"`
+}
+
+func SavePersonalDataRecord(stub *shim.ChaincodeStub, record PersonalDataRecord) ([]byte, error) {
+	fmt.Println("Entering SavePersonalDataRecord")
+
+	key, err := GetStateKey(record.ID, PERSONALDATA)
+	if err != nil {
+		return nil, err
+	}
+
+	bytes, _ := json.Marshal(&record)
+	err = stub.PutState(key, bytes)
+	if err != nil {
+		fmt.Println("SavePersonalDataRecord: Could not save personal data record ", err)
+		return nil, err
+	}
+	return bytes, nil
+}
+
+/**
+Reads a personal data record from the ledger without any access checks
+**/
+func LoadPersonalDataRecord(stub *shim.ChaincodeStub, id string) (PersonalDataRecord, error) {
+	var record PersonalDataRecord
+
+	key, err := GetStateKey(id, PERSONALDATA)
+	if err != nil {
+		return record, err
+	}
+
+	bytes, err := stub.GetState(key)
+	if err != nil {
+		fmt.Println("LoadPersonalDataRecord: Could not fetch personal data record with ID : "+id, err)
+		return record, err
+	}
+	if len(bytes) == 0 {
+		return record, errors.New("Personal data record " + id + " does not exist")
+	}
+
+	err = json.Unmarshal(bytes, &record)
+	if err != nil {
+		fmt.Println("LoadPersonalDataRecord: Could not unmarshal personal data record with ID : "+id, err)
+		return record, err
+	}
+
+	return record, nil
+}
+
+/**
+Returns the erasure request which erased the personal data of the application, if any
+**/
+func completedErasure(ma *MortgageApplication) *ErasureRequest {
+	for i := range ma.ErasureRequests {
+		if ma.ErasureRequests[i].Status == ERASURE_COMPLETED {
+			return &ma.ErasureRequests[i]
+		}
+	}
+	return nil
+}
+
+func pendingErasure(ma *MortgageApplication) *ErasureRequest {
+	for i := range ma.ErasureRequests {
+		if ma.ErasureRequests[i].Status == ERASURE_PENDING {
+			return &ma.ErasureRequests[i]
+		}
+	}
+	return nil
+}
+
+/**
+Erases the personal and financial info of a mortgage application. Crypto-shredding drops
+the ciphertext and keeps a record of the key id, whose holders must destroy the key.
+Purging deletes the record. Plaintext left on applications stored before encryption is
+cleared on the application. Returns what was erased and what erasure could not reach:
+the key went through transaction arguments, so the block history can still reveal the data
+**/
+func erasePersonalData(stub *shim.ChaincodeStub, ma *MortgageApplication, method string, now string) (string, string, error) {
+	fmt.Println("Entering erasePersonalData")
+
+	ma.PersonalInfo = PersonalInfo{}
+	ma.FinancialInfo = FinancialInfo{}
+	ma.CombinedFinancialInfo = FinancialInfo{}
+	for i := range ma.CoApplicants {
+		ma.CoApplicants[i].PersonalInfo = PersonalInfo{}
+		ma.CoApplicants[i].FinancialInfo = FinancialInfo{}
+	}
+
+	if len(ma.PersonalDataId) == 0 {
+		return "Cleared unencrypted personal data", ERASURE_LIMIT_HISTORY, nil
+	}
+
+	record, err := LoadPersonalDataRecord(stub, ma.PersonalDataId)
+	if err != nil {
+		return "", "", err
+	}
+
+	if method == ERASURE_PURGE {
+		key, _ := GetStateKey(record.ID, PERSONALDATA)
+		err = stub.DelState(key)
+		if err != nil {
+			fmt.Println("erasePersonalData: Could not delete personal data record ", err)
+			return "", "", err
+		}
+		return "Purged personal data record " + record.ID, ERASURE_LIMIT_KEY_IN_TRANSACTIONS, nil
+	}
+
+	keyId := record.Encrypted.KeyId
+	record.Encrypted = EncryptedData{KeyId: keyId}
+	record.Status = PD_SHREDDED
+	record.ErasedAt = now
+	record.Limitation = ERASURE_LIMIT_KEY_IN_TRANSACTIONS
+	_, err = SavePersonalDataRecord(stub, record)
+	if err != nil {
+		return "", "", err
+	}
+	return "Crypto-shredded personal data record " + record.ID + ". Holders of key " + keyId + " must destroy it", ERASURE_LIMIT_KEY_IN_TRANSACTIONS, nil
+}
+
+/**
+An applicant requests erasure of the personal data on a mortgage application. Erasure
+covers every applicant on the application as their data is stored together.
+args[0] is the mortgage application id and args[1] an ErasureRequestSchema json string
+**/
+func RequestErasure(stub *shim.ChaincodeStub, callerId string, callerAffiliation int, args []string) ([]byte, error) {
+	fmt.Println("Entering RequestErasure")
+
+	if len(args) < 2 {
+		fmt.Println("RequestErasure: expected two arguments")
+		return nil, errors.New("Could not request erasure. Invalid input")
+	}
+
+	ma, _, err := GetMortgageApplication(stub, callerId, callerAffiliation, []string{args[0]})
+	if err != nil {
+		return nil, err
+	}
+
+	err = Authorize(stub, callerId, callerAffiliation, MORTGAGEAPPLICATION, OP_REQUEST_ERASURE, ma)
+	if err != nil {
+		return nil, err
+	}
+
+	if completedErasure(&ma) != nil {
+		return nil, errors.New("Personal data of mortgage application " + ma.ID + " has already been erased")
+	}
+	if pendingErasure(&ma) != nil {
+		return nil, errors.New("Mortgage application " + ma.ID + " already has a pending erasure request")
+	}
+
+	var input ErasureRequestSchema
+	err = json.Unmarshal([]byte(args[1]), &input)
+	if err != nil {
+		fmt.Println("RequestErasure: Could not unmarshal input ", err)
+		return nil, err
+	}
+
+	method := strings.ToLower(strings.TrimSpace(input.Method))
+	if len(method) == 0 {
+		method = ERASURE_CRYPTO_SHRED
+	}
+	if method != ERASURE_CRYPTO_SHRED && method != ERASURE_PURGE {
+		return nil, errors.New("Invalid erasure method " + method + ". Expected " + ERASURE_CRYPTO_SHRED + " or " + ERASURE_PURGE)
+	}
+
+	txTime, err := GetTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	request := ErasureRequest{
+		ID:          "erasure-" + strconv.Itoa(len(ma.ErasureRequests)+1),
+		RequestedBy: callerId,
+		RequestedAt: txTime.Format(dateLayout),
+		Method:      method,
+		Reason:      strings.TrimSpace(input.Reason),
+		Status:      ERASURE_PENDING,
+	}
+	ma.ErasureRequests = append(ma.ErasureRequests, request)
+
+	_, err = SaveMortgageApplication(stub, ma, ma.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	AppendMALog(stub, "RequestErasure", callerId+" requested erasure "+request.ID+" of personal data by "+method, ma.Status, ma.ID)
+
+	bytes, err := json.Marshal(&request)
+	if err != nil {
+		return nil, err
+	}
+	return bytes, nil
+}
+
+/**
+The reviewing bank approves or rejects the pending erasure request of a mortgage
+application. An approved request is carried out in the same transaction. The application,
+its log and the request stay on the ledger as the record that the erasure took place.
+args[0] is the mortgage application id and args[1] an ErasureDecisionSchema json string
+**/
+func DecideErasure(stub *shim.ChaincodeStub, callerId string, callerAffiliation int, args []string) ([]byte, error) {
+	fmt.Println("Entering DecideErasure")
+
+	if len(args) < 2 {
+		fmt.Println("DecideErasure: expected two arguments")
+		return nil, errors.New("Could not decide erasure. Invalid input")
+	}
+
+	ma, _, err := GetMortgageApplication(stub, callerId, callerAffiliation, []string{args[0]})
+	if err != nil {
+		return nil, err
+	}
+
+	err = Authorize(stub, callerId, callerAffiliation, MORTGAGEAPPLICATION, OP_DECIDE_ERASURE, ma)
+	if err != nil {
+		return nil, err
+	}
+
+	request := pendingErasure(&ma)
+	if request == nil {
+		return nil, errors.New("Mortgage application " + ma.ID + " has no pending erasure request")
+	}
+
+	var input ErasureDecisionSchema
+	err = json.Unmarshal([]byte(args[1]), &input)
+	if err != nil {
+		fmt.Println("DecideErasure: Could not unmarshal input ", err)
+		return nil, err
+	}
+
+	decision := strings.TrimSpace(input.Decision)
+	if !input.Approve && len(decision) == 0 {
+		return nil, errors.New("A rejected erasure request needs a reason")
+	}
+
+	txTime, err := GetTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	now := txTime.Format(dateLayout)
+
+	request.DecidedBy = callerId
+	request.DecidedAt = now
+	request.Decision = decision
+
+	var msg string
+	if input.Approve {
+		outcome, limitation, err := erasePersonalData(stub, &ma, request.Method, now)
+		if err != nil {
+			return nil, err
+		}
+		request.Status = ERASURE_COMPLETED
+		request.Outcome = outcome
+		request.Limitation = limitation
+		msg = callerId + " approved erasure " + request.ID + " requested by " + request.RequestedBy + ". " + outcome + ". " + limitation
+	} else {
+		request.Status = ERASURE_REJECTED
+		msg = callerId + " rejected erasure " + request.ID + " requested by " + request.RequestedBy + ": " + decision
+	}
+	ma.LastModifiedDate = now
+
+	_, err = SaveMortgageApplication(stub, ma, ma.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	AppendMALog(stub, "DecideErasure", msg, ma.Status, ma.ID)
+
+	bytes, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	return bytes, nil
+}
@@ -0,0 +1,597 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//Escrow status values
+const ESCROW_OPEN string = "Open"
+const ESCROW_RELEASED string = "Released"
+const ESCROW_REFUNDED string = "Refunded"
+
+//Escrow transaction types
+const ESCROW_DEPOSIT string = "Deposit"
+const ESCROW_RELEASE string = "Release"
+const ESCROW_REFUND string = "Refund"
+
+//Deposit categories
+const EARNEST_MONEY string = "earnest_money"
+const DOWN_PAYMENT string = "down_payment"
+const LOAN_DISBURSEMENT string = "loan_disbursement"
+
+//Sales contract status which allows escrow to be refunded
+const SC_CANCELLED string = "Cancelled"
+
+type EscrowAgent struct {
+	ID          string   `json:"id"`
+	Affiliation int      `json:"affiliation"`
+	Escrows     []string `json:"escrows"`
+	ApprovedBy  string   `json:"approvedBy"`
+}
+
+type EscrowTransaction struct {
+	Sequence     int    `json:"sequence"`
+	Type         string `json:"type"`
+	Category     string `json:"category"`
+	Amount       Money  `json:"amount"`
+	From         string `json:"from"`
+	To           string `json:"to"`
+	BalanceAfter Money  `json:"balanceAfter"`
+	RecordedBy   string `json:"recordedBy"`
+	Note         string `json:"note"`
+	Timestamp    string `json:"timestamp"`
+}
+
+type Escrow struct {
+	ID               string              `json:"id"`
+	SalesContractId  string              `json:"salesContractId"`
+	EscrowAgentId    string              `json:"escrowAgentId"`
+	BuyerId          string              `json:"buyerId"`
+	SellerId         string              `json:"sellerId"`
+	BankId           string              `json:"bankId"`
+	Status           string              `json:"status"`
+	Currency         string              `json:"currency"`
+	Balance          Money               `json:"balance"`
+	TotalDeposited   Money               `json:"totalDeposited"`
+	TotalDisbursed   Money               `json:"totalDisbursed"`
+	Transactions     []EscrowTransaction `json:"transactions"`
+	LastModifiedDate string              `json:"lastModifiedDate"`
+}
+
+type EscrowDepositSchema struct {
+	Category string `json:"category"`
+	Amount   Money  `json:"amount"`
+	Note     string `json:"note"`
+}
+
+type EscrowDisbursementSchema struct {
+	Action string `json:"action"`
+	Note   string `json:"note"`
+}
+
+/**
+Records a party's request to cancel a sales contract. The contract is only cancelled once
+the other party asks for it too. Returns true if the contract can be cancelled
+**/
+func requestCancellation(sc *SalesContract, callerId string) (bool, error) {
+	if callerId != sc.BuyerId && callerId != sc.SellerId {
+		return false, errors.New("Only the buyer and seller can cancel sales contract " + sc.ID)
+	}
+	if len(sc.CancellationRequestedBy) == 0 || sc.CancellationRequestedBy == callerId {
+		sc.CancellationRequestedBy = callerId
+		return false, nil
+	}
+	return true, nil
+}
+
+/**
+Creates an escrow agent. Agents are registered by an admin through RegisterUser, which
+records who approved them, and cannot be created over an existing user
+**/
+func CreateEscrowAgent(stub *shim.ChaincodeStub, key string, id string, approvedBy string) (EscrowAgent, error) {
+	fmt.Println("Entering CreateEscrowAgent")
+
+	agent := EscrowAgent{id, ESCROW_A, []string{}, approvedBy}
+
+	bytes, err := stub.GetState(key)
+	if err != nil {
+		return agent, err
+	}
+	if len(bytes) > 0 {
+		return agent, errors.New("User " + id + " already exists")
+	}
+
+	err = SaveEscrowAgent(stub, agent, key)
+	if err != nil {
+		return agent, errors.New("CreateEscrowAgent: Could not save escrow agent with id " + id)
+	}
+	return agent, nil
+}
+
+/**
+Reads an escrow agent. Returns an error unless the user is an escrow agent approved by an admin
+**/
+func LoadEscrowAgent(stub *shim.ChaincodeStub, key string) (EscrowAgent, error) {
+	var agent EscrowAgent
+	bytes, err := stub.GetState(key)
+	if err != nil {
+		fmt.Println("LoadEscrowAgent: Could not get escrow agent "+key+" ", err)
+		return agent, err
+	}
+
+	err = json.Unmarshal(bytes, &agent)
+	if err != nil || agent.Affiliation != ESCROW_A {
+		return agent, errors.New("LoadEscrowAgent: " + key + " is not an escrow agent")
+	}
+	if len(agent.ApprovedBy) == 0 {
+		return agent, errors.New("Escrow agent " + agent.ID + " has not been approved by an admin")
+	}
+	return agent, nil
+}
+
+func SaveEscrowAgent(stub *shim.ChaincodeStub, agent EscrowAgent, id string) error {
+	fmt.Println("Entering SaveEscrowAgent")
+	bytes, _ := json.Marshal(&agent)
+	err := stub.PutState(id, bytes)
+	if err != nil {
+		fmt.Println("SaveEscrowAgent: Could not save escrow agent ", err)
+		return err
+	}
+	return nil
+}
+
+/**
+Recomputes the balance from the transaction log and checks it against the stored totals.
+Every save goes through this check so the ledger can never hold an inconsistent escrow
+**/
+func CheckEscrowBalance(escrow Escrow) error {
+	var deposited int64
+	var disbursed int64
+
+	amounts := []Money{escrow.Balance, escrow.TotalDeposited, escrow.TotalDisbursed}
+	for _, tx := range escrow.Transactions {
+		amounts = append(amounts, tx.Amount, tx.BalanceAfter)
+	}
+	for _, amount := range amounts {
+		if amount.Currency != escrow.Currency {
+			return errors.New("Escrow " + escrow.ID + " holds an amount in " + amount.Currency + " but is denominated in " + escrow.Currency)
+		}
+	}
+
+	for i, tx := range escrow.Transactions {
+		if tx.Amount.Amount <= 0 {
+			return errors.New("Escrow " + escrow.ID + " has a non positive movement at sequence " + strconv.Itoa(tx.Sequence))
+		}
+		if tx.Sequence != i+1 {
+			return errors.New("Escrow " + escrow.ID + " has an out of order movement at sequence " + strconv.Itoa(tx.Sequence))
+		}
+
+		if tx.Type == ESCROW_DEPOSIT {
+			deposited += tx.Amount.Amount
+		} else if tx.Type == ESCROW_RELEASE || tx.Type == ESCROW_REFUND {
+			disbursed += tx.Amount.Amount
+		} else {
+			return errors.New("Escrow " + escrow.ID + " has an unknown movement type " + tx.Type)
+		}
+
+		if deposited-disbursed < 0 {
+			return errors.New("Escrow " + escrow.ID + " balance would become negative at sequence " + strconv.Itoa(tx.Sequence))
+		}
+		if tx.BalanceAfter.Amount != deposited-disbursed {
+			return errors.New("Escrow " + escrow.ID + " running balance mismatch at sequence " + strconv.Itoa(tx.Sequence))
+		}
+	}
+
+	if deposited != escrow.TotalDeposited.Amount || disbursed != escrow.TotalDisbursed.Amount || deposited-disbursed != escrow.Balance.Amount {
+		return errors.New("Escrow " + escrow.ID + " balance does not match its movements")
+	}
+
+	if escrow.Status != ESCROW_OPEN && !escrow.Balance.IsZero() {
+		return errors.New("Escrow " + escrow.ID + " cannot be " + escrow.Status + " with a remaining balance")
+	}
+
+	return nil
+}
+
+/**
+Save Escrow to the ledger after enforcing the balance invariant
+**/
+func SaveEscrow(stub *shim.ChaincodeStub, escrow Escrow) ([]byte, error) {
+	fmt.Println("Entering SaveEscrow")
+
+	err := CheckEscrowBalance(escrow)
+	if err != nil {
+		fmt.Println("SaveEscrow: ", err)
+		return nil, err
+	}
+
+	key, err := GetStateKey(escrow.ID, ESCROW)
+	if err != nil {
+		return nil, err
+	}
+
+	bytes, _ := json.Marshal(&escrow)
+	err = stub.PutState(key, bytes)
+	if err != nil {
+		fmt.Println("SaveEscrow: Could not save escrow ", err)
+		return nil, err
+	}
+	return bytes, nil
+}
+
+/**
+Reads an escrow from the ledger without any access checks
+**/
+func LoadEscrow(stub *shim.ChaincodeStub, id string) (Escrow, error) {
+	var escrow Escrow
+
+	key, err := GetStateKey(id, ESCROW)
+	if err != nil {
+		return escrow, err
+	}
+
+	bytes, err := stub.GetState(key)
+	if err != nil {
+		fmt.Println("LoadEscrow: Could not fetch escrow with ID : "+id, err)
+		return escrow, err
+	}
+	if len(bytes) == 0 {
+		return escrow, errors.New("Escrow with id " + id + " does not exist")
+	}
+
+	err = json.Unmarshal(bytes, &escrow)
+	if err != nil {
+		fmt.Println("LoadEscrow: Could not unmarshal escrow with ID : "+id, err)
+		return escrow, err
+	}
+
+	return escrow, nil
+}
+
+/**
+Appends a movement to the escrow and updates the running totals
+**/
+func appendEscrowTransaction(escrow *Escrow, txType string, category string, amount int64, from string, to string, recordedBy string, note string, now string) EscrowTransaction {
+	if txType == ESCROW_DEPOSIT {
+		escrow.Balance.Amount += amount
+		escrow.TotalDeposited.Amount += amount
+	} else {
+		escrow.Balance.Amount -= amount
+		escrow.TotalDisbursed.Amount += amount
+	}
+
+	tx := EscrowTransaction{len(escrow.Transactions) + 1, txType, category, Money{amount, escrow.Currency}, from, to, escrow.Balance, recordedBy, note, now}
+	escrow.Transactions = append(escrow.Transactions, tx)
+	escrow.LastModifiedDate = now
+	return tx
+}
+
+/**
+Logs an escrow movement against both the escrow and the sales contract
+**/
+func logEscrowTransaction(stub *shim.ChaincodeStub, action string, escrow Escrow, tx EscrowTransaction) {
+	msg := tx.RecordedBy + " recorded " + tx.Type + " of " + tx.Amount.String()
+	if len(tx.Category) > 0 {
+		msg += " (" + tx.Category + ")"
+	}
+	msg += " from " + tx.From + " to " + tx.To + ". Balance " + tx.BalanceAfter.String()
+
+	AppendMALog(stub, action, msg, escrow.Status, escrow.ID)
+	AppendMALog(stub, action, msg, escrow.Status, escrow.SalesContractId)
+}
+
+/**
+Opens an escrow for a sales contract. Only an escrow agent registered by an admin can
+open an escrow and a sales contract can only have one.
+args[0] is the escrow id and args[1] the sales contract id
+**/
+func OpenEscrow(stub *shim.ChaincodeStub, callerId string, callerAffiliation int, args []string) ([]byte, error) {
+	fmt.Println("Entering OpenEscrow")
+
+	if len(args) < 2 {
+		fmt.Println("OpenEscrow: expected two arguments")
+		return nil, errors.New("Could not open Escrow. Invalid input")
+	}
+
+	err := Authorize(stub, callerId, callerAffiliation, ESCROW, OP_CREATE, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	agentKey, _ := GetStateKey(callerId, USER)
+	agent, err := LoadEscrowAgent(stub, agentKey)
+	if err != nil {
+		return nil, err
+	}
+
+	escrowId := strings.TrimSpace(args[0])
+	if len(escrowId) == 0 {
+		return nil, errors.New("Invalid escrow Id")
+	}
+
+	_, err = LoadEscrow(stub, escrowId)
+	if err == nil {
+		return nil, errors.New("Escrow with id " + escrowId + " already exists")
+	}
+
+	sc, err := LoadSalesContract(stub, strings.TrimSpace(args[1]))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sc.EscrowId) > 0 {
+		return nil, errors.New("Sales contract " + sc.ID + " already has escrow " + sc.EscrowId)
+	}
+
+	if sc.Status == SC_CLOSED || sc.Status == SC_CANCELLED {
+		return nil, errors.New("Sales contract " + sc.ID + " is " + sc.Status)
+	}
+
+	txTime, err := GetTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	now := txTime.Format(dateLayout)
+
+	var escrow Escrow
+	escrow.ID = escrowId
+	escrow.SalesContractId = sc.ID
+	escrow.EscrowAgentId = callerId
+	escrow.BuyerId = sc.BuyerId
+	escrow.SellerId = sc.SellerId
+	escrow.BankId = sc.ReviewerId
+	escrow.Status = ESCROW_OPEN
+	//Funds are held in the currency of the contract price
+	err = ValidateCurrency(sc.Price.Currency)
+	if err != nil {
+		return nil, errors.New("Sales contract " + sc.ID + " has no price currency. " + err.Error())
+	}
+	escrow.Currency = sc.Price.Currency
+	escrow.Balance = Money{0, escrow.Currency}
+	escrow.TotalDeposited = Money{0, escrow.Currency}
+	escrow.TotalDisbursed = Money{0, escrow.Currency}
+	escrow.Transactions = []EscrowTransaction{}
+	escrow.LastModifiedDate = now
+
+	bytes, err := SaveEscrow(stub, escrow)
+	if err != nil {
+		return nil, err
+	}
+
+	escrowKey, _ := GetStateKey(escrowId, ESCROW)
+	_, err = AddKey(stub, escrowKey, escrowKeysName)
+	if err != nil {
+		return nil, err
+	}
+
+	sc.EscrowId = escrowId
+	sc.LastModifiedDate = now
+	_, err = SaveSalesContract(stub, sc, sc.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	agent.Escrows = append(agent.Escrows, escrowId)
+	err = SaveEscrowAgent(stub, agent, agentKey)
+	if err != nil {
+		return nil, err
+	}
+
+	AppendMALog(stub, "OpenEscrow", callerId+" opened escrow for sales contract "+sc.ID, ESCROW_OPEN, escrowId)
+	AppendMALog(stub, "OpenEscrow", callerId+" opened escrow "+escrowId, sc.Status, sc.ID)
+
+	return bytes, nil
+}
+
+/**
+Records funds received into an open escrow. Earnest money and down payments come from
+the buyer and loan disbursements from the bank.
+args[0] is the escrow id and args[1] an EscrowDepositSchema json string
+**/
+func RecordEscrowDeposit(stub *shim.ChaincodeStub, callerId string, callerAffiliation int, args []string) ([]byte, error) {
+	fmt.Println("Entering RecordEscrowDeposit")
+
+	if len(args) < 2 {
+		fmt.Println("RecordEscrowDeposit: expected two arguments")
+		return nil, errors.New("Could not record deposit. Invalid input")
+	}
+
+	escrow, err := LoadEscrow(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	err = Authorize(stub, callerId, callerAffiliation, ESCROW, OP_UPDATE, escrow)
+	if err != nil {
+		return nil, err
+	}
+
+	if escrow.Status != ESCROW_OPEN {
+		return nil, errors.New("Escrow " + escrow.ID + " is " + escrow.Status)
+	}
+
+	var input EscrowDepositSchema
+	err = json.Unmarshal([]byte(args[1]), &input)
+	if err != nil {
+		fmt.Println("RecordEscrowDeposit: Could not unmarshal input ", err)
+		return nil, err
+	}
+
+	if input.Amount.Amount <= 0 {
+		return nil, errors.New("Deposit amount must be greater than zero")
+	}
+
+	err = SameCurrency(input.Amount, Money{0, escrow.Currency})
+	if err != nil {
+		return nil, errors.New("Deposits into escrow " + escrow.ID + " must be in " + escrow.Currency)
+	}
+
+	var from string
+	category := strings.ToLower(strings.TrimSpace(input.Category))
+	if category == EARNEST_MONEY || category == DOWN_PAYMENT {
+		from = escrow.BuyerId
+	} else if category == LOAN_DISBURSEMENT {
+		from = escrow.BankId
+	} else {
+		return nil, errors.New("Invalid deposit category " + input.Category)
+	}
+
+	txTime, err := GetTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	now := txTime.Format(dateLayout)
+
+	tx := appendEscrowTransaction(&escrow, ESCROW_DEPOSIT, category, input.Amount.Amount, from, escrow.ID, callerId, input.Note, now)
+
+	bytes, err := SaveEscrow(stub, escrow)
+	if err != nil {
+		return nil, err
+	}
+
+	logEscrowTransaction(stub, "RecordEscrowDeposit", escrow, tx)
+
+	return bytes, nil
+}
+
+/**
+Releases the escrow balance to the seller once the sales contract has closed, or
+refunds every deposit to the party which made it once the contract is cancelled.
+args[0] is the escrow id and args[1] an EscrowDisbursementSchema json string
+**/
+func DisburseEscrow(stub *shim.ChaincodeStub, callerId string, callerAffiliation int, args []string) ([]byte, error) {
+	fmt.Println("Entering DisburseEscrow")
+
+	if len(args) < 2 {
+		fmt.Println("DisburseEscrow: expected two arguments")
+		return nil, errors.New("Could not disburse escrow. Invalid input")
+	}
+
+	escrow, err := LoadEscrow(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	err = Authorize(stub, callerId, callerAffiliation, ESCROW, OP_UPDATE, escrow)
+	if err != nil {
+		return nil, err
+	}
+
+	if escrow.Status != ESCROW_OPEN {
+		return nil, errors.New("Escrow " + escrow.ID + " is " + escrow.Status)
+	}
+
+	var input EscrowDisbursementSchema
+	err = json.Unmarshal([]byte(args[1]), &input)
+	if err != nil {
+		fmt.Println("DisburseEscrow: Could not unmarshal input ", err)
+		return nil, err
+	}
+
+	sc, err := LoadSalesContract(stub, escrow.SalesContractId)
+	if err != nil {
+		return nil, err
+	}
+
+	txTime, err := GetTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	now := txTime.Format(dateLayout)
+
+	var txs []EscrowTransaction
+	action := strings.ToLower(strings.TrimSpace(input.Action))
+
+	if action == "release" {
+		if sc.Status != SC_CLOSED {
+			return nil, errors.New("Escrow " + escrow.ID + " can only be released once sales contract " + sc.ID + " is " + SC_CLOSED)
+		}
+		if escrow.Balance.Amount > 0 {
+			txs = append(txs, appendEscrowTransaction(&escrow, ESCROW_RELEASE, "", escrow.Balance.Amount, escrow.ID, escrow.SellerId, callerId, input.Note, now))
+		}
+		escrow.Status = ESCROW_RELEASED
+
+	} else if action == "refund" {
+		if sc.Status != SC_CANCELLED {
+			return nil, errors.New("Escrow " + escrow.ID + " can only be refunded once sales contract " + sc.ID + " is " + SC_CANCELLED)
+		}
+
+		//Return funds to the party which deposited them, net of anything already disbursed
+		owed := map[string]int64{}
+		var parties []string
+		for _, tx := range escrow.Transactions {
+			party := tx.From
+			if tx.Type != ESCROW_DEPOSIT {
+				party = tx.To
+			}
+			if _, ok := owed[party]; !ok {
+				parties = append(parties, party)
+			}
+			if tx.Type == ESCROW_DEPOSIT {
+				owed[party] += tx.Amount.Amount
+			} else {
+				owed[party] -= tx.Amount.Amount
+			}
+		}
+
+		for _, party := range parties {
+			if owed[party] > 0 {
+				txs = append(txs, appendEscrowTransaction(&escrow, ESCROW_REFUND, "", owed[party], escrow.ID, party, callerId, input.Note, now))
+			}
+		}
+		escrow.Status = ESCROW_REFUNDED
+
+	} else {
+		return nil, errors.New("Invalid action " + input.Action + ". Expected release or refund")
+	}
+
+	escrow.LastModifiedDate = now
+	bytes, err := SaveEscrow(stub, escrow)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, tx := range txs {
+		logEscrowTransaction(stub, "DisburseEscrow", escrow, tx)
+	}
+	AppendMALog(stub, "DisburseEscrow", callerId+" marked escrow as "+escrow.Status, escrow.Status, escrow.ID)
+
+	return bytes, nil
+}
+
+/**
+Return an escrow based on access rights
+**/
+func GetEscrow(stub *shim.ChaincodeStub, callerId string, callerAffiliation int, args []string) (Escrow, []byte, error) {
+	fmt.Println("Entering GetEscrow")
+
+	var escrow Escrow
+
+	if len(args) < 1 {
+		fmt.Println("GetEscrow: expected 1 argument")
+		return escrow, nil, errors.New("Could not GetEscrow. Invalid input")
+	}
+
+	escrow, err := LoadEscrow(stub, args[0])
+	if err != nil {
+		return escrow, nil, err
+	}
+
+	err = Authorize(stub, callerId, callerAffiliation, ESCROW, OP_READ, escrow)
+	if err != nil {
+		return escrow, nil, err
+	}
+
+	bytes, err := json.Marshal(&escrow)
+	if err != nil {
+		return escrow, nil, err
+	}
+
+	return escrow, bytes, nil
+}
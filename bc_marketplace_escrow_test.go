@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestRequestCancellation(t *testing.T) {
+	cases := []struct {
+		name          string
+		requestedBy   string
+		callerId      string
+		wantCancelled bool
+		wantErr       bool
+		wantRequested string
+	}{
+		{"buyer asks first", "", "buyer1", false, false, "buyer1"},
+		{"seller asks first", "", "seller1", false, false, "seller1"},
+		{"buyer asks again", "buyer1", "buyer1", false, false, "buyer1"},
+		{"seller agrees with the buyer", "buyer1", "seller1", true, false, "buyer1"},
+		{"buyer agrees with the seller", "seller1", "buyer1", true, false, "seller1"},
+		{"bank cannot cancel", "buyer1", "bank1", false, true, "buyer1"},
+	}
+
+	for _, c := range cases {
+		sc := SalesContract{ID: "sc1", BuyerId: "buyer1", SellerId: "seller1", ReviewerId: "bank1", CancellationRequestedBy: c.requestedBy}
+		cancelled, err := requestCancellation(&sc, c.callerId)
+		if (err != nil) != c.wantErr {
+			t.Errorf("%s: error is %v", c.name, err)
+		}
+		if cancelled != c.wantCancelled {
+			t.Errorf("%s: cancelled is %v, want %v", c.name, cancelled, c.wantCancelled)
+		}
+		if sc.CancellationRequestedBy != c.wantRequested {
+			t.Errorf("%s: requested by %s, want %s", c.name, sc.CancellationRequestedBy, c.wantRequested)
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//Secondary index names for invoices
+var invoiceAppraiserIndex = "invoice:appraiser:"
+var invoiceBankIndex = "invoice:bank:"
+
+//Invoice status values
+const INVOICE_UNPAID string = "Unpaid"
+const INVOICE_PAID string = "Paid"
+
+//Days the bank has to pay an appraisal invoice
+const INVOICE_PAYMENT_TERMS_DAYS int = 30
+
+type AppraisalInvoice struct {
+	ID                     string `json:"id"`
+	AppraiserApplicationId string `json:"appraiserApplicationId"`
+	MortgageApplicationId  string `json:"mortgageApplicationId"`
+	AppraiserId            string `json:"appraiserId"`
+	BankId                 string `json:"bankId"`
+	Amount                 Money  `json:"amount"`
+	Status                 string `json:"status"`
+	IssuedAt               string `json:"issuedAt"`
+	DueDate                string `json:"dueDate"`
+	PaidAt                 string `json:"paidAt"`
+	PaymentReference       string `json:"paymentReference"`
+	AcknowledgedBy         string `json:"acknowledgedBy"`
+}
+
+type InvoicePaymentSchema struct {
+	Amount    Money  `json:"amount"`
+	Reference string `json:"reference"`
+}
+
+type InvoiceAging struct {
+	Invoice     AppraisalInvoice `json:"invoice"`
+	DaysOpen    int              `json:"daysOpen"`
+	DaysOverdue int              `json:"daysOverdue"`
+	AgingBucket string           `json:"agingBucket"`
+}
+
+type UnpaidInvoicesResult struct {
+	Invoices    []InvoiceAging `json:"invoices"`
+	Outstanding []Money        `json:"outstanding"`
+}
+
+/**
+Aging bucket by days since the invoice was issued
+**/
+func InvoiceAgingBucket(daysOpen int) string {
+	if daysOpen <= 30 {
+		return "0-30"
+	} else if daysOpen <= 60 {
+		return "31-60"
+	} else if daysOpen <= 90 {
+		return "61-90"
+	}
+	return "90+"
+}
+
+func SaveInvoice(stub *shim.ChaincodeStub, invoice AppraisalInvoice) ([]byte, error) {
+	fmt.Println("Entering SaveInvoice")
+
+	key, err := GetStateKey(invoice.ID, INVOICE)
+	if err != nil {
+		return nil, err
+	}
+
+	bytes, _ := json.Marshal(&invoice)
+	err = stub.PutState(key, bytes)
+	if err != nil {
+		fmt.Println("SaveInvoice: Could not save invoice ", err)
+		return nil, err
+	}
+	return bytes, nil
+}
+
+/**
+Reads an invoice from the ledger without any access checks
+**/
+func LoadInvoice(stub *shim.ChaincodeStub, id string) (AppraisalInvoice, error) {
+	var invoice AppraisalInvoice
+
+	key, err := GetStateKey(id, INVOICE)
+	if err != nil {
+		return invoice, err
+	}
+
+	bytes, err := stub.GetState(key)
+	if err != nil {
+		fmt.Println("LoadInvoice: Could not fetch invoice with ID : "+id, err)
+		return invoice, err
+	}
+	if len(bytes) == 0 {
+		return invoice, errors.New("Invoice with id " + id + " does not exist")
+	}
+
+	err = json.Unmarshal(bytes, &invoice)
+	if err != nil {
+		fmt.Println("LoadInvoice: Could not unmarshal invoice with ID : "+id, err)
+		return invoice, err
+	}
+
+	return invoice, nil
+}
+
+/**
+Issues the invoice for a completed appraisal at the fee quoted on assignment. An
+appraisal is only invoiced once and an appraisal without a quote is not invoiced
+**/
+func IssueAppraisalInvoice(stub *shim.ChaincodeStub, aa *AppraiserApplication, txTime time.Time) error {
+	fmt.Println("Entering IssueAppraisalInvoice")
+
+	if aa.FeeQuote.IsZero() || len(aa.InvoiceId) > 0 {
+		return nil
+	}
+
+	var invoice AppraisalInvoice
+	invoice.ID = "inv-" + aa.ID
+	invoice.AppraiserApplicationId = aa.ID
+	invoice.MortgageApplicationId = aa.MortgageApplicationId
+	invoice.AppraiserId = aa.AppraiserId
+	invoice.BankId = aa.ReviewerId
+	invoice.Amount = aa.FeeQuote
+	invoice.Status = INVOICE_UNPAID
+	invoice.IssuedAt = txTime.Format(dateLayout)
+	invoice.DueDate = txTime.AddDate(0, 0, INVOICE_PAYMENT_TERMS_DAYS).Format(dateLayout)
+
+	_, err := SaveInvoice(stub, invoice)
+	if err != nil {
+		return err
+	}
+
+	invoiceKey, _ := GetStateKey(invoice.ID, INVOICE)
+	_, err = AddKey(stub, invoiceKey, invoiceKeysName)
+	if err != nil {
+		return err
+	}
+	err = AddIndexEntry(stub, invoiceAppraiserIndex, invoice.AppraiserId, invoice.ID)
+	if err != nil {
+		return err
+	}
+	err = AddIndexEntry(stub, invoiceBankIndex, invoice.BankId, invoice.ID)
+	if err != nil {
+		return err
+	}
+
+	aa.InvoiceId = invoice.ID
+
+	msg := "Invoice " + invoice.ID + " of " + invoice.Amount.String() + " issued to " + invoice.BankId + ", due " + invoice.DueDate
+	AppendMALog(stub, "IssueAppraisalInvoice", msg, aa.Status, aa.ID)
+	AppendMALog(stub, "IssueAppraisalInvoice", msg, "", aa.MortgageApplicationId)
+
+	return nil
+}
+
+/**
+The bank acknowledges payment of an appraisal invoice. The amount must settle the invoice.
+args[0] is the invoice id and args[1] an InvoicePaymentSchema json string
+**/
+func AcknowledgeInvoicePayment(stub *shim.ChaincodeStub, callerId string, callerAffiliation int, args []string) ([]byte, error) {
+	fmt.Println("Entering AcknowledgeInvoicePayment")
+
+	if len(args) < 2 {
+		fmt.Println("AcknowledgeInvoicePayment: expected two arguments")
+		return nil, errors.New("Could not acknowledge payment. Invalid input")
+	}
+
+	invoice, err := LoadInvoice(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	err = Authorize(stub, callerId, callerAffiliation, INVOICE, OP_UPDATE, invoice)
+	if err != nil {
+		return nil, err
+	}
+
+	if invoice.Status != INVOICE_UNPAID {
+		return nil, errors.New("Invoice " + invoice.ID + " is " + invoice.Status)
+	}
+
+	var input InvoicePaymentSchema
+	err = json.Unmarshal([]byte(args[1]), &input)
+	if err != nil {
+		fmt.Println("AcknowledgeInvoicePayment: Could not unmarshal input ", err)
+		return nil, err
+	}
+
+	if input.Amount != invoice.Amount {
+		return nil, errors.New("Payment of " + input.Amount.String() + " does not settle invoice " + invoice.ID + " of " + invoice.Amount.String())
+	}
+
+	txTime, err := GetTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	invoice.Status = INVOICE_PAID
+	invoice.PaidAt = txTime.Format(dateLayout)
+	invoice.PaymentReference = strings.TrimSpace(input.Reference)
+	invoice.AcknowledgedBy = callerId
+
+	bytes, err := SaveInvoice(stub, invoice)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := callerId + " paid invoice " + invoice.ID + " of " + invoice.Amount.String()
+	if len(invoice.PaymentReference) > 0 {
+		msg += ", reference " + invoice.PaymentReference
+	}
+	AppendMALog(stub, "AcknowledgeInvoicePayment", msg, INVOICE_PAID, invoice.AppraiserApplicationId)
+	AppendMALog(stub, "AcknowledgeInvoicePayment", msg, "", invoice.MortgageApplicationId)
+
+	return bytes, nil
+}
+
+/**
+Lists the calling appraiser's unpaid invoices with their age and the outstanding total
+per currency. Invoices are indexed as they are issued so the oldest comes first. Age is
+measured at the transaction time
+**/
+func GetUnpaidInvoices(stub *shim.ChaincodeStub, callerId string, callerAffiliation int, args []string) ([]byte, error) {
+	fmt.Println("Entering GetUnpaidInvoices")
+
+	if callerAffiliation != APPRAISER_A {
+		return nil, errors.New("GetUnpaidInvoices: callerId " + callerId + " is not an appraiser")
+	}
+
+	ids, err := GetIndexEntries(stub, invoiceAppraiserIndex, callerId)
+	if err != nil {
+		return nil, err
+	}
+
+	txTime, err := GetTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	result := UnpaidInvoicesResult{[]InvoiceAging{}, []Money{}}
+	for _, id := range ids {
+		invoice, err := LoadInvoice(stub, id)
+		if err != nil {
+			return nil, err
+		}
+		err = Authorize(stub, callerId, callerAffiliation, INVOICE, OP_READ, invoice)
+		if err != nil {
+			return nil, err
+		}
+		if invoice.Status != INVOICE_UNPAID {
+			continue
+		}
+
+		issued, err := time.Parse(dateLayout, invoice.IssuedAt)
+		if err != nil {
+			return nil, errors.New("Invoice " + invoice.ID + " has an invalid issue date")
+		}
+		due, err := time.Parse(dateLayout, invoice.DueDate)
+		if err != nil {
+			return nil, errors.New("Invoice " + invoice.ID + " has an invalid due date")
+		}
+
+		aging := InvoiceAging{Invoice: invoice, DaysOpen: daysBetween(issued, txTime)}
+		if overdue := daysBetween(due, txTime); overdue > 0 {
+			aging.DaysOverdue = overdue
+		}
+		aging.AgingBucket = InvoiceAgingBucket(aging.DaysOpen)
+		result.Invoices = append(result.Invoices, aging)
+
+		added := false
+		for i := range result.Outstanding {
+			if result.Outstanding[i].Currency == invoice.Amount.Currency {
+				result.Outstanding[i].Amount += invoice.Amount.Amount
+				added = true
+			}
+		}
+		if !added {
+			result.Outstanding = append(result.Outstanding, invoice.Amount)
+		}
+	}
+
+	fmt.Println("GetUnpaidInvoices: " + strconv.Itoa(len(result.Invoices)) + " unpaid invoices for " + callerId)
+
+	bytes, err := json.Marshal(&result)
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes, nil
+}
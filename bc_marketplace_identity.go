@@ -0,0 +1,297 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//Identity provider names
+const IDP_CERT_ATTRIBUTE string = "certAttribute"
+const IDP_CN_CONVENTION string = "cnConvention"
+const IDP_STATIC string = "static"
+
+//Key holding the identity provider chosen at Init
+var identityConfigKey = "identityConfig"
+
+//Certificate attributes are listed in a header extension and stored in the extensions after it
+var attributeHeaderOID = asn1.ObjectIdentifier{1, 2, 3, 4, 5, 6, 9}
+
+/**
+Who the caller is. Affiliation is 0 when the provider does not carry one, in which case
+the affiliation the user was created with is used
+**/
+type Identity struct {
+	Username    string
+	Affiliation int
+}
+
+/**
+Resolves the caller of a transaction
+**/
+type IdentityProvider interface {
+	Name() string
+	Resolve(stub *shim.ChaincodeStub) (Identity, error)
+}
+
+/**
+Selects and configures the identity provider. Set once at Init
+**/
+type IdentityConfig struct {
+	Provider          string `json:"provider"`
+	UsernameAttribute string `json:"usernameAttribute"`
+	RoleAttribute     string `json:"roleAttribute"`
+	Username          string `json:"username"`
+	Affiliation       int    `json:"affiliation"`
+}
+
+/**
+Reads the username and role from attributes of the caller's certificate
+**/
+type CertAttributeProvider struct {
+	UsernameAttribute string
+	RoleAttribute     string
+}
+
+/**
+Reads the caller from the common name of the caller's certificate. The common name is
+either the username or of the form username\organization\affiliation
+**/
+type CNConventionProvider struct{}
+
+/**
+Returns the same caller for every transaction, whatever the certificate. For tests only
+**/
+type StaticProvider struct {
+	Username    string
+	Affiliation int
+}
+
+/**
+Returns the caller's certificate. The certificate is DER encoded, or PEM encoded when it
+comes from a client which passes it on as it was issued
+**/
+func callerCertificate(stub *shim.ChaincodeStub) (*x509.Certificate, error) {
+	bytes, err := stub.GetCallerCertificate()
+	if err != nil {
+		return nil, errors.New("Couldn't retrieve caller certificate")
+	}
+	if len(bytes) == 0 {
+		return nil, errors.New("Caller did not present a certificate")
+	}
+
+	if block, _ := pem.Decode(bytes); block != nil {
+		bytes = block.Bytes
+	}
+
+	cert, err := x509.ParseCertificate(bytes)
+	if err != nil {
+		return nil, errors.New("Couldn't parse certificate")
+	}
+	return cert, nil
+}
+
+func certExtension(cert *x509.Certificate, oid asn1.ObjectIdentifier) ([]byte, bool) {
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(oid) {
+			return ext.Value, true
+		}
+	}
+	return nil, false
+}
+
+/**
+Returns the value of a certificate attribute. The header extension lists the attributes
+as name->position# and the value of each is in the extension at its position after the
+header. Only attributes issued unencrypted can be read
+**/
+func certAttribute(cert *x509.Certificate, name string) (string, error) {
+	header, ok := certExtension(cert, attributeHeaderOID)
+	if !ok {
+		return "", errors.New("Certificate has no attributes")
+	}
+
+	for _, entry := range strings.Split(string(header), "#") {
+		parts := strings.SplitN(entry, "->", 2)
+		if len(parts) != 2 || parts[0] != name {
+			continue
+		}
+		position, err := strconv.Atoi(parts[1])
+		if err != nil || position <= 0 {
+			return "", errors.New("Invalid position of certificate attribute " + name)
+		}
+
+		oid := append(asn1.ObjectIdentifier{}, attributeHeaderOID...)
+		oid[len(oid)-1] += position
+		value, ok := certExtension(cert, oid)
+		if !ok {
+			return "", errors.New("Certificate has no value for attribute " + name)
+		}
+		for _, c := range value {
+			if c < 0x20 || c > 0x7e {
+				return "", errors.New("Certificate attribute " + name + " is encrypted")
+			}
+		}
+		return string(value), nil
+	}
+	return "", errors.New("Certificate has no attribute " + name)
+}
+
+func (p CertAttributeProvider) Name() string {
+	return IDP_CERT_ATTRIBUTE
+}
+
+func (p CertAttributeProvider) Resolve(stub *shim.ChaincodeStub) (Identity, error) {
+	var identity Identity
+
+	cert, err := callerCertificate(stub)
+	if err != nil {
+		return identity, err
+	}
+
+	username, err := certAttribute(cert, p.UsernameAttribute)
+	if err != nil {
+		return identity, err
+	}
+	role, err := certAttribute(cert, p.RoleAttribute)
+	if err != nil {
+		return identity, err
+	}
+	affiliation, err := strconv.Atoi(strings.TrimSpace(role))
+	if err != nil || affiliation <= 0 {
+		return identity, errors.New("Invalid affiliation " + role + " in certificate attribute " + p.RoleAttribute)
+	}
+
+	identity.Username = strings.TrimSpace(username)
+	identity.Affiliation = affiliation
+	return identity, nil
+}
+
+func (p CNConventionProvider) Name() string {
+	return IDP_CN_CONVENTION
+}
+
+func (p CNConventionProvider) Resolve(stub *shim.ChaincodeStub) (Identity, error) {
+	var identity Identity
+
+	cert, err := callerCertificate(stub)
+	if err != nil {
+		return identity, err
+	}
+
+	cn := cert.Subject.CommonName
+	res := strings.Split(cn, "\\")
+	if len(res) < 3 {
+		identity.Username = cn
+		return identity, nil
+	}
+
+	affiliation, err := strconv.Atoi(res[2])
+	if err != nil || affiliation <= 0 {
+		return identity, errors.New("Invalid affiliation " + res[2] + " in common name " + cn)
+	}
+	identity.Username = res[0]
+	identity.Affiliation = affiliation
+	return identity, nil
+}
+
+func (p StaticProvider) Name() string {
+	return IDP_STATIC
+}
+
+func (p StaticProvider) Resolve(stub *shim.ChaincodeStub) (Identity, error) {
+	return Identity{p.Username, p.Affiliation}, nil
+}
+
+/**
+Returns the provider for a configuration
+**/
+func NewIdentityProvider(config IdentityConfig) (IdentityProvider, error) {
+	switch config.Provider {
+	case "", IDP_CN_CONVENTION:
+		return CNConventionProvider{}, nil
+	case IDP_CERT_ATTRIBUTE:
+		provider := CertAttributeProvider{config.UsernameAttribute, config.RoleAttribute}
+		if len(provider.UsernameAttribute) == 0 {
+			provider.UsernameAttribute = "username"
+		}
+		if len(provider.RoleAttribute) == 0 {
+			provider.RoleAttribute = "role"
+		}
+		return provider, nil
+	case IDP_STATIC:
+		if len(strings.TrimSpace(config.Username)) == 0 || config.Affiliation <= 0 {
+			return nil, errors.New("The static identity provider needs a username and an affiliation")
+		}
+		return StaticProvider{strings.TrimSpace(config.Username), config.Affiliation}, nil
+	}
+	return nil, errors.New("Unknown identity provider " + config.Provider + ". Expected " + strings.Join([]string{IDP_CERT_ATTRIBUTE, IDP_CN_CONVENTION, IDP_STATIC}, ", "))
+}
+
+/**
+Returns the provider chosen at Init. Chaincode deployed without a choice reads the
+caller from the common name, as it always has
+**/
+func GetIdentityProvider(stub *shim.ChaincodeStub) (IdentityProvider, error) {
+	var config IdentityConfig
+
+	bytes, err := stub.GetState(identityConfigKey)
+	if err != nil {
+		fmt.Println("GetIdentityProvider: Could not fetch identity config ", err)
+		return nil, err
+	}
+	if len(bytes) > 0 {
+		err = json.Unmarshal(bytes, &config)
+		if err != nil {
+			fmt.Println("GetIdentityProvider: Could not unmarshal identity config ", err)
+			return nil, err
+		}
+	}
+	return NewIdentityProvider(config)
+}
+
+/**
+Chooses the identity provider. Only called from Init so a caller cannot switch providers
+once the chaincode is deployed. args[0] is an IdentityConfig json string
+**/
+func ConfigureIdentity(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	fmt.Println("Entering ConfigureIdentity")
+
+	if len(args) < 1 {
+		return nil, errors.New("Could not configure identity. Expected an identity config")
+	}
+
+	var config IdentityConfig
+	err := json.Unmarshal([]byte(args[0]), &config)
+	if err != nil {
+		fmt.Println("ConfigureIdentity: Could not unmarshal identity config ", err)
+		return nil, err
+	}
+	return saveIdentityConfig(stub, config)
+}
+
+func saveIdentityConfig(stub *shim.ChaincodeStub, config IdentityConfig) ([]byte, error) {
+	config.Provider = strings.TrimSpace(config.Provider)
+
+	provider, err := NewIdentityProvider(config)
+	if err != nil {
+		return nil, err
+	}
+
+	bytes, _ := json.Marshal(&config)
+	err = stub.PutState(identityConfigKey, bytes)
+	if err != nil {
+		fmt.Println("saveIdentityConfig: Could not save identity config ", err)
+		return nil, err
+	}
+
+	fmt.Println("Identity provider: " + provider.Name())
+	return bytes, nil
+}
@@ -0,0 +1,606 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//Verification levels, from least to most assurance
+const KYC_LEVEL_NONE string = "none"
+const KYC_LEVEL_BASIC string = "basic"
+const KYC_LEVEL_STANDARD string = "standard"
+const KYC_LEVEL_ENHANCED string = "enhanced"
+
+var kycLevels = []string{KYC_LEVEL_NONE, KYC_LEVEL_BASIC, KYC_LEVEL_STANDARD, KYC_LEVEL_ENHANCED}
+
+//Verification methods
+const KYC_METHOD_DOCUMENT string = "document"
+const KYC_METHOD_ELECTRONIC string = "electronic"
+const KYC_METHOD_VIDEO string = "video"
+const KYC_METHOD_IN_PERSON string = "in_person"
+
+var kycMethods = []string{KYC_METHOD_DOCUMENT, KYC_METHOD_ELECTRONIC, KYC_METHOD_VIDEO, KYC_METHOD_IN_PERSON}
+
+//Verification result values
+const KYC_VERIFIED string = "Verified"
+const KYC_FAILED string = "Failed"
+const KYC_REVOKED string = "Revoked"
+
+//Level required by a bank which has not configured a KYC policy
+const DEFAULT_KYC_LEVEL string = KYC_LEVEL_BASIC
+
+type KycProvider struct {
+	ID          string   `json:"id"`
+	Affiliation int      `json:"affiliation"`
+	Users       []string `json:"users"`
+	ApprovedBy  string   `json:"approvedBy"`
+}
+
+/**
+The result of a verification by a KYC provider. Only hashes of the documents checked are
+stored, the documents stay with the provider. ExpiresAt is a date
+**/
+type KycVerification struct {
+	Status         string   `json:"status"`
+	Level          string   `json:"level"`
+	Method         string   `json:"method"`
+	DocumentHashes []string `json:"documentHashes"`
+	VerifiedBy     string   `json:"verifiedBy"`
+	VerifiedAt     string   `json:"verifiedAt"`
+	ExpiresAt      string   `json:"expiresAt"`
+}
+
+/**
+The verification history of a user. The last verification is the current one
+**/
+type KycRecord struct {
+	UserId        string            `json:"userId"`
+	Verifications []KycVerification `json:"verifications"`
+}
+
+type KycVerificationSchema struct {
+	Status         string   `json:"status"`
+	Level          string   `json:"level"`
+	Method         string   `json:"method"`
+	DocumentHashes []string `json:"documentHashes"`
+	ExpiresAt      string   `json:"expiresAt"`
+}
+
+/**
+The verification levels a bank requires of the parties to its mortgage applications and
+sales contracts. When ApprovedProviders is set only verifications by those providers count
+**/
+type KycPolicy struct {
+	BankId            string   `json:"bankId"`
+	BuyerLevel        string   `json:"buyerLevel"`
+	SellerLevel       string   `json:"sellerLevel"`
+	ApprovedProviders []string `json:"approvedProviders"`
+	LastModifiedDate  string   `json:"lastModifiedDate"`
+}
+
+/**
+Creates a KYC provider. Providers are registered by an admin through RegisterUser, which
+records who approved them, and cannot be created over an existing user
+**/
+func CreateKycProvider(stub *shim.ChaincodeStub, key string, id string, approvedBy string) (KycProvider, error) {
+	fmt.Println("Entering CreateKycProvider")
+
+	provider := KycProvider{id, KYC_A, []string{}, approvedBy}
+
+	bytes, err := stub.GetState(key)
+	if err != nil {
+		return provider, err
+	}
+	if len(bytes) > 0 {
+		return provider, errors.New("User " + id + " already exists")
+	}
+
+	err = SaveKycProvider(stub, provider, key)
+	if err != nil {
+		return provider, err
+	}
+	return provider, nil
+}
+
+/**
+Reads a KYC provider. Returns an error unless the user is a KYC provider approved by an admin
+**/
+func LoadKycProvider(stub *shim.ChaincodeStub, key string) (KycProvider, error) {
+	var provider KycProvider
+	bytes, err := stub.GetState(key)
+	if err != nil {
+		fmt.Println("LoadKycProvider: Could not get KYC provider "+key+" ", err)
+		return provider, err
+	}
+
+	err = json.Unmarshal(bytes, &provider)
+	if err != nil || provider.Affiliation != KYC_A {
+		return provider, errors.New("LoadKycProvider: " + key + " is not a KYC provider")
+	}
+	if len(provider.ApprovedBy) == 0 {
+		return provider, errors.New("KYC provider " + provider.ID + " has not been approved by an admin")
+	}
+	return provider, nil
+}
+
+func SaveKycProvider(stub *shim.ChaincodeStub, provider KycProvider, id string) error {
+	fmt.Println("Entering SaveKycProvider")
+	bytes, _ := json.Marshal(&provider)
+	err := stub.PutState(id, bytes)
+	if err != nil {
+		fmt.Println("SaveKycProvider: Could not save KYC provider ", err)
+		return err
+	}
+	return nil
+}
+
+/**
+Returns true if the bank reviews one of the mortgage applications or sales contracts
+listed for the user
+**/
+func isReviewerOfUser(stub *shim.ChaincodeStub, bankId string, userId string) bool {
+	key, err := GetStateKey(userId, USER)
+	if err != nil {
+		return false
+	}
+	bytes, err := stub.GetState(key)
+	if err != nil || len(bytes) == 0 {
+		return false
+	}
+
+	//Buyers list applications and contracts, sellers only contracts
+	var user Buyer
+	if json.Unmarshal(bytes, &user) != nil {
+		return false
+	}
+
+	for _, id := range user.MortgageApplications {
+		ma, err := LoadMortgageApplication(stub, id)
+		if err == nil && ma.ReviewerId == bankId {
+			return true
+		}
+	}
+	for _, id := range user.SalesContracts {
+		sc, err := LoadSalesContract(stub, id)
+		if err == nil && sc.ReviewerId == bankId {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+Reads the KYC record of a user. A user who was never verified has an empty record
+**/
+func LoadKycRecord(stub *shim.ChaincodeStub, userId string) (KycRecord, error) {
+	record := KycRecord{UserId: userId, Verifications: []KycVerification{}}
+
+	key, err := GetStateKey(userId, KYC)
+	if err != nil {
+		return record, err
+	}
+
+	bytes, err := stub.GetState(key)
+	if err != nil {
+		fmt.Println("LoadKycRecord: Could not fetch KYC record of "+userId, err)
+		return record, err
+	}
+	if len(bytes) == 0 {
+		return record, nil
+	}
+
+	err = json.Unmarshal(bytes, &record)
+	if err != nil {
+		fmt.Println("LoadKycRecord: Could not unmarshal KYC record of "+userId, err)
+		return record, err
+	}
+
+	return record, nil
+}
+
+func SaveKycRecord(stub *shim.ChaincodeStub, record KycRecord) ([]byte, error) {
+	fmt.Println("Entering SaveKycRecord")
+
+	key, err := GetStateKey(record.UserId, KYC)
+	if err != nil {
+		return nil, err
+	}
+
+	bytes, _ := json.Marshal(&record)
+	err = stub.PutState(key, bytes)
+	if err != nil {
+		fmt.Println("SaveKycRecord: Could not save KYC record ", err)
+		return nil, err
+	}
+	return bytes, nil
+}
+
+/**
+Reads the KYC policy of a bank. A bank without a policy requires DEFAULT_KYC_LEVEL of everyone
+**/
+func LoadKycPolicy(stub *shim.ChaincodeStub, bankId string) (KycPolicy, error) {
+	policy := KycPolicy{BankId: bankId, BuyerLevel: DEFAULT_KYC_LEVEL, SellerLevel: DEFAULT_KYC_LEVEL}
+
+	key, err := GetStateKey(bankId, KYCPOLICY)
+	if err != nil {
+		return policy, err
+	}
+
+	bytes, err := stub.GetState(key)
+	if err != nil {
+		fmt.Println("LoadKycPolicy: Could not fetch KYC policy of "+bankId, err)
+		return policy, err
+	}
+	if len(bytes) == 0 {
+		return policy, nil
+	}
+
+	err = json.Unmarshal(bytes, &policy)
+	if err != nil {
+		fmt.Println("LoadKycPolicy: Could not unmarshal KYC policy of "+bankId, err)
+		return policy, err
+	}
+
+	return policy, nil
+}
+
+/**
+Returns the rank of a level, or -1 if it is not a known level
+**/
+func kycLevelRank(level string) int {
+	for i, l := range kycLevels {
+		if l == level {
+			return i
+		}
+	}
+	return -1
+}
+
+func validateKycLevel(level string) (string, error) {
+	level = strings.ToLower(strings.TrimSpace(level))
+	if kycLevelRank(level) < 0 {
+		return "", errors.New("Invalid KYC level " + level + ". Expected one of " + strings.Join(kycLevels, ", "))
+	}
+	return level, nil
+}
+
+/**
+Returns the current verification of a user or nil if there is none
+**/
+func currentKycVerification(record KycRecord) *KycVerification {
+	if len(record.Verifications) == 0 {
+		return nil
+	}
+	return &record.Verifications[len(record.Verifications)-1]
+}
+
+/**
+Returns an error unless the user's current verification passed, has not expired, is at
+least the required level and was made by an approved provider other than the user. An
+empty approvedProviders accepts any provider approved by an admin
+**/
+func CheckKycLevel(stub *shim.ChaincodeStub, userId string, required string, approvedProviders []string, now time.Time) error {
+	if kycLevelRank(required) <= 0 {
+		return nil
+	}
+
+	record, err := LoadKycRecord(stub, userId)
+	if err != nil {
+		return err
+	}
+
+	current := currentKycVerification(record)
+	err = checkKycVerification(userId, current, required, approvedProviders, now)
+	if err != nil {
+		return err
+	}
+
+	providerKey, _ := GetStateKey(current.VerifiedBy, USER)
+	_, err = LoadKycProvider(stub, providerKey)
+	if err != nil {
+		return errors.New("KYC verification of user " + userId + " was not made by an approved provider")
+	}
+
+	return nil
+}
+
+/**
+The checks of CheckKycLevel which only need the user's current verification
+**/
+func checkKycVerification(userId string, current *KycVerification, required string, approvedProviders []string, now time.Time) error {
+	if current == nil {
+		return errors.New("User " + userId + " has not been verified. Level " + required + " is required")
+	}
+	if current.Status != KYC_VERIFIED {
+		return errors.New("KYC verification of user " + userId + " is " + current.Status)
+	}
+
+	expires, err := time.Parse(loanDateLayout, current.ExpiresAt)
+	if err != nil {
+		return errors.New("KYC verification of user " + userId + " has an invalid expiry date")
+	}
+	//A verification is valid through its expiry date
+	if !now.Before(expires.AddDate(0, 0, 1)) {
+		return errors.New("KYC verification of user " + userId + " expired on " + current.ExpiresAt)
+	}
+
+	if kycLevelRank(current.Level) < kycLevelRank(required) {
+		return errors.New("User " + userId + " is verified to level " + current.Level + ", bank requires " + required)
+	}
+
+	if current.VerifiedBy == userId {
+		return errors.New("KYC verification of user " + userId + " was made by the user")
+	}
+	if len(approvedProviders) > 0 && !containsString(approvedProviders, current.VerifiedBy) {
+		return errors.New("KYC verification of user " + userId + " was made by " + current.VerifiedBy + ", which the bank has not approved")
+	}
+
+	return nil
+}
+
+/**
+Checks the buyers and optionally the seller of a transaction against the KYC policy of
+the bank. An empty seller id skips the seller check
+**/
+func CheckKycPolicy(stub *shim.ChaincodeStub, bankId string, buyerIds []string, sellerId string) error {
+	fmt.Println("Entering CheckKycPolicy")
+
+	policy, err := LoadKycPolicy(stub, bankId)
+	if err != nil {
+		return err
+	}
+
+	now, err := GetTxTime(stub)
+	if err != nil {
+		return err
+	}
+
+	for _, buyerId := range buyerIds {
+		err = CheckKycLevel(stub, buyerId, policy.BuyerLevel, policy.ApprovedProviders, now)
+		if err != nil {
+			return err
+		}
+	}
+	if len(sellerId) > 0 {
+		err = CheckKycLevel(stub, sellerId, policy.SellerLevel, policy.ApprovedProviders, now)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/**
+A KYC provider records the result of verifying a user. A failed or revoked result replaces
+any earlier verification.
+args[0] is the user id and args[1] a KycVerificationSchema json string
+**/
+func RecordKycVerification(stub *shim.ChaincodeStub, callerId string, callerAffiliation int, args []string) ([]byte, error) {
+	fmt.Println("Entering RecordKycVerification")
+
+	if len(args) < 2 {
+		fmt.Println("RecordKycVerification: expected two arguments")
+		return nil, errors.New("Could not record KYC verification. Invalid input")
+	}
+
+	err := Authorize(stub, callerId, callerAffiliation, KYC, OP_UPDATE, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	providerKey, _ := GetStateKey(callerId, USER)
+	provider, err := LoadKycProvider(stub, providerKey)
+	if err != nil {
+		return nil, err
+	}
+
+	userId := strings.TrimSpace(args[0])
+	user, err := GetUser(stub, userId)
+	if err != nil {
+		return nil, errors.New("User " + userId + " does not exist")
+	}
+	if userId == callerId || userId == provider.ApprovedBy {
+		return nil, errors.New("A KYC provider cannot verify itself or the admin who approved it")
+	}
+	if user.Affiliation != BUYER_A && user.Affiliation != SELLER_A {
+		return nil, errors.New("Only buyers and sellers are verified by KYC providers")
+	}
+
+	var input KycVerificationSchema
+	err = json.Unmarshal([]byte(args[1]), &input)
+	if err != nil {
+		fmt.Println("RecordKycVerification: Could not unmarshal input ", err)
+		return nil, err
+	}
+
+	txTime, err := GetTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	verification := KycVerification{VerifiedBy: callerId, VerifiedAt: txTime.Format(dateLayout), DocumentHashes: []string{}}
+
+	switch strings.ToLower(strings.TrimSpace(input.Status)) {
+	case "", strings.ToLower(KYC_VERIFIED):
+		verification.Status = KYC_VERIFIED
+	case strings.ToLower(KYC_FAILED):
+		verification.Status = KYC_FAILED
+	case strings.ToLower(KYC_REVOKED):
+		verification.Status = KYC_REVOKED
+	default:
+		return nil, errors.New("Invalid KYC status " + input.Status + ". Expected " + KYC_VERIFIED + ", " + KYC_FAILED + " or " + KYC_REVOKED)
+	}
+
+	if verification.Status == KYC_VERIFIED {
+		verification.Level, err = validateKycLevel(input.Level)
+		if err != nil {
+			return nil, err
+		}
+		if verification.Level == KYC_LEVEL_NONE {
+			return nil, errors.New("A passed verification needs a level above " + KYC_LEVEL_NONE)
+		}
+
+		verification.Method = strings.ToLower(strings.TrimSpace(input.Method))
+		if !containsString(kycMethods, verification.Method) {
+			return nil, errors.New("Invalid KYC method " + verification.Method + ". Expected one of " + strings.Join(kycMethods, ", "))
+		}
+
+		expires, err := time.Parse(loanDateLayout, strings.TrimSpace(input.ExpiresAt))
+		if err != nil {
+			return nil, errors.New("Invalid expiry date " + input.ExpiresAt + ". Expected " + loanDateLayout)
+		}
+		if !txTime.Before(expires.AddDate(0, 0, 1)) {
+			return nil, errors.New("Expiry date " + input.ExpiresAt + " is in the past")
+		}
+		verification.ExpiresAt = expires.Format(loanDateLayout)
+
+		if len(input.DocumentHashes) == 0 && verification.Method == KYC_METHOD_DOCUMENT {
+			return nil, errors.New("A document verification needs the hashes of the documents checked")
+		}
+	} else {
+		verification.Level = KYC_LEVEL_NONE
+	}
+
+	for _, h := range input.DocumentHashes {
+		hash, err := normalizeSha256(h)
+		if err != nil {
+			return nil, err
+		}
+		verification.DocumentHashes = append(verification.DocumentHashes, hash)
+	}
+
+	record, err := LoadKycRecord(stub, userId)
+	if err != nil {
+		return nil, err
+	}
+	record.Verifications = append(record.Verifications, verification)
+
+	bytes, err := SaveKycRecord(stub, record)
+	if err != nil {
+		return nil, err
+	}
+
+	if !containsString(provider.Users, userId) {
+		provider.Users = append(provider.Users, userId)
+		err = SaveKycProvider(stub, provider, providerKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	msg := callerId + " recorded KYC " + verification.Status + " for " + userId
+	if verification.Status == KYC_VERIFIED {
+		msg += " at level " + verification.Level + " by " + verification.Method + ", expires " + verification.ExpiresAt
+	}
+	key, _ := GetStateKey(userId, KYC)
+	AppendMALog(stub, "RecordKycVerification", msg, verification.Status, key)
+
+	return bytes, nil
+}
+
+/**
+Returns the KYC record of a user. The user, KYC providers, banks and auditors can read it.
+args[0] is the user id
+**/
+func GetKycStatus(stub *shim.ChaincodeStub, callerId string, callerAffiliation int, args []string) ([]byte, error) {
+	fmt.Println("Entering GetKycStatus")
+
+	if len(args) < 1 {
+		fmt.Println("GetKycStatus: expected 1 argument")
+		return nil, errors.New("Could not get KYC status. Invalid input")
+	}
+
+	record, err := LoadKycRecord(stub, strings.TrimSpace(args[0]))
+	if err != nil {
+		return nil, err
+	}
+
+	err = Authorize(stub, callerId, callerAffiliation, KYC, OP_READ, record)
+	if err != nil {
+		return nil, err
+	}
+
+	bytes, err := json.Marshal(&record)
+	if err != nil {
+		return nil, err
+	}
+	return bytes, nil
+}
+
+/**
+A bank sets the verification levels it requires of buyers and sellers and, optionally, the
+KYC providers whose verifications it accepts.
+args[0] is a KycPolicy json string
+**/
+func SetKycPolicy(stub *shim.ChaincodeStub, callerId string, callerAffiliation int, args []string) ([]byte, error) {
+	fmt.Println("Entering SetKycPolicy")
+
+	if len(args) < 1 {
+		fmt.Println("SetKycPolicy: expected 1 argument")
+		return nil, errors.New("Could not set KYC policy. Invalid input")
+	}
+
+	err := Authorize(stub, callerId, callerAffiliation, KYCPOLICY, OP_UPDATE, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var policy KycPolicy
+	err = json.Unmarshal([]byte(args[0]), &policy)
+	if err != nil {
+		fmt.Println("SetKycPolicy: Could not unmarshal input ", err)
+		return nil, err
+	}
+
+	policy.BankId = callerId
+	policy.BuyerLevel, err = validateKycLevel(policy.BuyerLevel)
+	if err != nil {
+		return nil, err
+	}
+	policy.SellerLevel, err = validateKycLevel(policy.SellerLevel)
+	if err != nil {
+		return nil, err
+	}
+
+	providers := []string{}
+	for _, id := range policy.ApprovedProviders {
+		id = strings.TrimSpace(id)
+		providerKey, _ := GetStateKey(id, USER)
+		_, err = LoadKycProvider(stub, providerKey)
+		if err != nil {
+			return nil, err
+		}
+		if !containsString(providers, id) {
+			providers = append(providers, id)
+		}
+	}
+	policy.ApprovedProviders = providers
+
+	txTime, err := GetTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	policy.LastModifiedDate = txTime.Format(dateLayout)
+
+	key, _ := GetStateKey(callerId, KYCPOLICY)
+	bytes, _ := json.Marshal(&policy)
+	err = stub.PutState(key, bytes)
+	if err != nil {
+		fmt.Println("SetKycPolicy: Could not save KYC policy ", err)
+		return nil, err
+	}
+
+	msg := callerId + " requires KYC level " + policy.BuyerLevel + " of buyers and " + policy.SellerLevel + " of sellers"
+	if len(providers) > 0 {
+		msg += ", verified by " + strings.Join(providers, ", ")
+	}
+	AppendMALog(stub, "SetKycPolicy", msg, "", key)
+
+	return bytes, nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckKycVerification(t *testing.T) {
+	now := time.Date(2026, 6, 15, 12, 0, 0, 0, time.UTC)
+	verified := func(level string, verifiedBy string, expiresAt string) *KycVerification {
+		return &KycVerification{Status: KYC_VERIFIED, Level: level, VerifiedBy: verifiedBy, ExpiresAt: expiresAt}
+	}
+
+	cases := []struct {
+		name      string
+		current   *KycVerification
+		required  string
+		providers []string
+		wantOk    bool
+	}{
+		{"never verified", nil, KYC_LEVEL_BASIC, nil, false},
+		{"verification failed", &KycVerification{Status: KYC_FAILED, Level: KYC_LEVEL_ENHANCED, VerifiedBy: "kyc1", ExpiresAt: "2027-01-01"}, KYC_LEVEL_BASIC, nil, false},
+		{"verification revoked", &KycVerification{Status: KYC_REVOKED, Level: KYC_LEVEL_ENHANCED, VerifiedBy: "kyc1", ExpiresAt: "2027-01-01"}, KYC_LEVEL_BASIC, nil, false},
+		{"expired yesterday", verified(KYC_LEVEL_STANDARD, "kyc1", "2026-06-14"), KYC_LEVEL_BASIC, nil, false},
+		{"expires today", verified(KYC_LEVEL_STANDARD, "kyc1", "2026-06-15"), KYC_LEVEL_BASIC, nil, true},
+		{"invalid expiry", verified(KYC_LEVEL_STANDARD, "kyc1", "next year"), KYC_LEVEL_BASIC, nil, false},
+		{"level below required", verified(KYC_LEVEL_BASIC, "kyc1", "2027-01-01"), KYC_LEVEL_STANDARD, nil, false},
+		{"level equal to required", verified(KYC_LEVEL_STANDARD, "kyc1", "2027-01-01"), KYC_LEVEL_STANDARD, nil, true},
+		{"level above required", verified(KYC_LEVEL_ENHANCED, "kyc1", "2027-01-01"), KYC_LEVEL_STANDARD, nil, true},
+		{"unknown level", verified("gold", "kyc1", "2027-01-01"), KYC_LEVEL_BASIC, nil, false},
+		{"verified by the user", verified(KYC_LEVEL_ENHANCED, "buyer1", "2027-01-01"), KYC_LEVEL_BASIC, nil, false},
+		{"provider approved by the bank", verified(KYC_LEVEL_STANDARD, "kyc1", "2027-01-01"), KYC_LEVEL_BASIC, []string{"kyc2", "kyc1"}, true},
+		{"provider not approved by the bank", verified(KYC_LEVEL_STANDARD, "kyc1", "2027-01-01"), KYC_LEVEL_BASIC, []string{"kyc2"}, false},
+	}
+
+	for _, c := range cases {
+		err := checkKycVerification("buyer1", c.current, c.required, c.providers, now)
+		if c.wantOk && err != nil {
+			t.Errorf("%s: unexpected error %v", c.name, err)
+		}
+		if !c.wantOk && err == nil {
+			t.Errorf("%s: expected an error", c.name)
+		}
+	}
+}
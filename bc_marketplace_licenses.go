@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//License status values
+const LICENSE_ACTIVE string = "Active"
+const LICENSE_SUSPENDED string = "Suspended"
+const LICENSE_REVOKED string = "Revoked"
+
+var licenseStatuses = []string{LICENSE_ACTIVE, LICENSE_SUSPENDED, LICENSE_REVOKED}
+
+/**
+A state licensing board. It maintains the licenses issued in its jurisdictions
+**/
+type LicensingAuthority struct {
+	ID            string   `json:"id"`
+	Affiliation   int      `json:"affiliation"`
+	Jurisdictions []string `json:"jurisdictions"`
+}
+
+/**
+A state license of an appraiser or bank. ExpiresAt is a date
+**/
+type License struct {
+	State            string `json:"state"`
+	Number           string `json:"number"`
+	ExpiresAt        string `json:"expiresAt"`
+	Status           string `json:"status"`
+	RecordedBy       string `json:"recordedBy"`
+	LastModifiedDate string `json:"lastModifiedDate"`
+}
+
+/**
+The licenses of a user, one per issuing state
+**/
+type LicenseRecord struct {
+	UserId   string    `json:"userId"`
+	Licenses []License `json:"licenses"`
+}
+
+type LicenseSchema struct {
+	State     string `json:"state"`
+	Number    string `json:"number"`
+	ExpiresAt string `json:"expiresAt"`
+	Status    string `json:"status"`
+}
+
+/**
+Creates a licensing authority. Like a regulator it is registered by an admin through
+RegisterUser and cannot be created over an existing user
+**/
+func CreateLicensingAuthority(stub *shim.ChaincodeStub, key string, id string, jurisdictions []string) (LicensingAuthority, error) {
+	fmt.Println("Entering CreateLicensingAuthority")
+
+	authority := LicensingAuthority{id, LICENSING_A, jurisdictions}
+
+	bytes, err := stub.GetState(key)
+	if err != nil {
+		return authority, err
+	}
+	if len(bytes) > 0 {
+		return authority, errors.New("User " + id + " already exists")
+	}
+	if len(jurisdictions) == 0 {
+		return authority, errors.New("A licensing authority needs at least one jurisdiction")
+	}
+
+	bytes, _ = json.Marshal(&authority)
+	err = stub.PutState(key, bytes)
+	if err != nil {
+		fmt.Println("CreateLicensingAuthority: Could not save licensing authority ", err)
+		return authority, err
+	}
+	return authority, nil
+}
+
+func GetLicensingAuthority(stub *shim.ChaincodeStub, key string) (LicensingAuthority, error) {
+	fmt.Println("Entering GetLicensingAuthority")
+
+	var authority LicensingAuthority
+	bytes, err := stub.GetState(key)
+	if err != nil {
+		fmt.Println("GetLicensingAuthority: Could not get licensing authority "+key+" ", err)
+		return authority, err
+	}
+
+	err = json.Unmarshal(bytes, &authority)
+	if err != nil || authority.Affiliation != LICENSING_A {
+		return authority, errors.New("GetLicensingAuthority: " + key + " is not a licensing authority")
+	}
+	return authority, nil
+}
+
+/**
+Returns the licenses of a user. A user without licenses gets an empty record
+**/
+func LoadLicenseRecord(stub *shim.ChaincodeStub, userId string) (LicenseRecord, error) {
+	record := LicenseRecord{UserId: userId, Licenses: []License{}}
+
+	key, err := GetStateKey(userId, LICENSE)
+	if err != nil {
+		return record, err
+	}
+
+	bytes, err := stub.GetState(key)
+	if err != nil {
+		fmt.Println("LoadLicenseRecord: Could not fetch license record of "+userId, err)
+		return record, err
+	}
+	if len(bytes) == 0 {
+		return record, nil
+	}
+
+	err = json.Unmarshal(bytes, &record)
+	if err != nil {
+		fmt.Println("LoadLicenseRecord: Could not unmarshal license record of "+userId, err)
+		return record, err
+	}
+
+	return record, nil
+}
+
+func SaveLicenseRecord(stub *shim.ChaincodeStub, record LicenseRecord) ([]byte, error) {
+	fmt.Println("Entering SaveLicenseRecord")
+
+	key, err := GetStateKey(record.UserId, LICENSE)
+	if err != nil {
+		return nil, err
+	}
+
+	bytes, _ := json.Marshal(&record)
+	err = stub.PutState(key, bytes)
+	if err != nil {
+		fmt.Println("SaveLicenseRecord: Could not save license record ", err)
+		return nil, err
+	}
+	return bytes, nil
+}
+
+/**
+Checks that the user holds an active, unexpired license issued by the state
+**/
+func CheckLicense(stub *shim.ChaincodeStub, userId string, state string, now time.Time) error {
+	state = normalizeJurisdiction(state)
+	if len(state) == 0 {
+		return errors.New("Cannot check the license of " + userId + " without a state")
+	}
+
+	record, err := LoadLicenseRecord(stub, userId)
+	if err != nil {
+		return err
+	}
+
+	for _, license := range record.Licenses {
+		if license.State != state {
+			continue
+		}
+		if license.Status != LICENSE_ACTIVE {
+			return errors.New("License " + license.Number + " of " + userId + " in " + state + " is " + license.Status)
+		}
+		expires, err := time.Parse(loanDateLayout, license.ExpiresAt)
+		if err != nil {
+			return errors.New("License " + license.Number + " of " + userId + " has an invalid expiry date")
+		}
+		//A license is valid through its expiry date
+		if !now.Before(expires.AddDate(0, 0, 1)) {
+			return errors.New("License " + license.Number + " of " + userId + " in " + state + " expired on " + license.ExpiresAt)
+		}
+		return nil
+	}
+	return errors.New(userId + " is not licensed in " + state)
+}
+
+/**
+Returns the appraisers on a panel who cannot appraise in the state, with the reason
+**/
+func unlicensedAppraisers(stub *shim.ChaincodeStub, panel AppraiserPanel, state string, now time.Time) map[string]string {
+	unlicensed := map[string]string{}
+	for _, a := range panel.Appraisers {
+		if CheckLicense(stub, a.AppraiserId, state, now) != nil {
+			unlicensed[a.AppraiserId] = "not licensed in " + state
+		}
+	}
+	return unlicensed
+}
+
+/**
+Checks that the appraiser of an appraiser application is licensed in the state of its
+property, before the appraiser submits anything on it
+**/
+func CheckAppraiserLicense(stub *shim.ChaincodeStub, aa AppraiserApplication) error {
+	txTime, err := GetTxTime(stub)
+	if err != nil {
+		return err
+	}
+
+	state := propertyJurisdiction(stub, aa.PropertyId)
+	if len(state) == 0 {
+		return errors.New("Property " + aa.PropertyId + " has no jurisdiction to check the appraiser's license against")
+	}
+	return CheckLicense(stub, aa.AppraiserId, state, txTime)
+}
+
+/**
+A licensing authority records or changes a license of an appraiser or bank in one of its
+jurisdictions. A suspended or revoked license stays on the record.
+args[0] is the user id and args[1] a LicenseSchema json string
+**/
+func RecordLicense(stub *shim.ChaincodeStub, callerId string, callerAffiliation int, args []string) ([]byte, error) {
+	fmt.Println("Entering RecordLicense")
+
+	if len(args) < 2 {
+		fmt.Println("RecordLicense: expected two arguments")
+		return nil, errors.New("Could not record license. Invalid input")
+	}
+
+	err := Authorize(stub, callerId, callerAffiliation, LICENSE, OP_UPDATE, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	authorityKey, _ := GetStateKey(callerId, USER)
+	authority, err := GetLicensingAuthority(stub, authorityKey)
+	if err != nil {
+		return nil, err
+	}
+
+	userId := strings.TrimSpace(args[0])
+	user, err := GetUser(stub, userId)
+	if err != nil {
+		return nil, errors.New("User " + userId + " does not exist")
+	}
+	if user.Affiliation != APPRAISER_A && user.Affiliation != BANK_A {
+		return nil, errors.New("Only appraisers and banks hold licenses")
+	}
+
+	var input LicenseSchema
+	err = json.Unmarshal([]byte(args[1]), &input)
+	if err != nil {
+		fmt.Println("RecordLicense: Could not unmarshal input ", err)
+		return nil, err
+	}
+
+	state := normalizeJurisdiction(input.State)
+	if !containsString(authority.Jurisdictions, state) {
+		return nil, errors.New("Licensing authority " + callerId + " cannot record licenses in " + state)
+	}
+
+	number := strings.TrimSpace(input.Number)
+	if len(number) == 0 {
+		return nil, errors.New("A license needs a number")
+	}
+
+	status := LICENSE_ACTIVE
+	if len(strings.TrimSpace(input.Status)) > 0 {
+		status = ""
+		for _, s := range licenseStatuses {
+			if strings.EqualFold(s, strings.TrimSpace(input.Status)) {
+				status = s
+			}
+		}
+		if len(status) == 0 {
+			return nil, errors.New("Invalid license status " + input.Status + ". Expected " + strings.Join(licenseStatuses, ", "))
+		}
+	}
+
+	expires, err := time.Parse(loanDateLayout, strings.TrimSpace(input.ExpiresAt))
+	if err != nil {
+		return nil, errors.New("Invalid expiry date " + input.ExpiresAt + ". Expected " + loanDateLayout)
+	}
+
+	txTime, err := GetTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	license := License{
+		State:            state,
+		Number:           number,
+		ExpiresAt:        expires.Format(loanDateLayout),
+		Status:           status,
+		RecordedBy:       callerId,
+		LastModifiedDate: txTime.Format(dateLayout),
+	}
+
+	record, err := LoadLicenseRecord(stub, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	replaced := false
+	for i := range record.Licenses {
+		if record.Licenses[i].State == state {
+			record.Licenses[i] = license
+			replaced = true
+		}
+	}
+	if !replaced {
+		record.Licenses = append(record.Licenses, license)
+	}
+
+	bytes, err := SaveLicenseRecord(stub, record)
+	if err != nil {
+		return nil, err
+	}
+
+	key, _ := GetStateKey(userId, LICENSE)
+	AppendMALog(stub, "RecordLicense", callerId+" recorded "+state+" license "+number+" of "+userId+" as "+status+", expiring "+license.ExpiresAt, status, key)
+
+	return bytes, nil
+}
+
+/**
+Returns the licenses of a user. Licenses are public so anyone can check them.
+args[0] is the user id
+**/
+func GetLicenses(stub *shim.ChaincodeStub, callerId string, callerAffiliation int, args []string) ([]byte, error) {
+	fmt.Println("Entering GetLicenses")
+
+	if len(args) < 1 {
+		fmt.Println("GetLicenses: expected 1 argument")
+		return nil, errors.New("Could not get licenses. Invalid input")
+	}
+
+	record, err := LoadLicenseRecord(stub, strings.TrimSpace(args[0]))
+	if err != nil {
+		return nil, err
+	}
+
+	bytes, err := json.Marshal(&record)
+	if err != nil {
+		return nil, err
+	}
+	return bytes, nil
+}
@@ -0,0 +1,547 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//Secondary index names for loans
+var loanBuyerIndex = "loan:buyer:"
+var loanBankIndex = "loan:bank:"
+
+//Layout of loan start and due dates
+var loanDateLayout = "2006-01-02"
+
+//Loan status values
+const LOAN_ACTIVE string = "Active"
+const LOAN_PAID_OFF string = "PaidOff"
+
+//Limits on loan terms
+const MAX_LOAN_TERM_MONTHS int = 480
+const MAX_LOAN_RATE_BPS int = 5000
+
+type Loan struct {
+	ID                    string        `json:"id"`
+	MortgageApplicationId string        `json:"mortgageApplicationId"`
+	SalesContractId       string        `json:"salesContractId"`
+	PropertyId            string        `json:"propertyId"`
+	BuyerId               string        `json:"buyerId"`
+	CoBorrowerIds         []string      `json:"coBorrowerIds"`
+	BankId                string        `json:"bankId"`
+	Principal             Money         `json:"principal"`
+	AnnualRateBps         int           `json:"annualRateBps"`
+	TermMonths            int           `json:"termMonths"`
+	RateProductId         string        `json:"rateProductId"`
+	PointsBps             int           `json:"pointsBps"`
+	StartDate             string        `json:"startDate"`
+	MonthlyPayment        Money         `json:"monthlyPayment"`
+	OutstandingPrincipal  Money         `json:"outstandingPrincipal"`
+	Status                string        `json:"status"`
+	InstallmentsPaid      int           `json:"installmentsPaid"`
+	InstallmentProgress   Money         `json:"installmentProgress"`
+	FeesOutstanding       Money         `json:"feesOutstanding"`
+	LateFeesAssessed      int           `json:"lateFeesAssessed"`
+	DaysPastDue           int           `json:"daysPastDue"`
+	DelinquencyBucket     string        `json:"delinquencyBucket"`
+	Payments              []LoanPayment `json:"payments"`
+	Curtailments          []Curtailment `json:"curtailments"`
+	LastModifiedDate      string        `json:"lastModifiedDate"`
+}
+
+/**
+Principal paid ahead of the schedule once AfterInstallment installments were paid. The
+installments after it keep their amount, so the loan is paid off sooner
+**/
+type Curtailment struct {
+	AfterInstallment int    `json:"afterInstallment"`
+	Amount           Money  `json:"amount"`
+	AppliedAt        string `json:"appliedAt"`
+}
+
+type LoanSchema struct {
+	MortgageApplicationId string `json:"mortgageApplicationId"`
+	AnnualRateBps         int    `json:"annualRateBps"`
+	TermMonths            int    `json:"termMonths"`
+	StartDate             string `json:"startDate"`
+}
+
+type ScheduleEntry struct {
+	Number    int    `json:"number"`
+	DueDate   string `json:"dueDate"`
+	Payment   Money  `json:"payment"`
+	Interest  Money  `json:"interest"`
+	Principal Money  `json:"principal"`
+	Balance   Money  `json:"balance"`
+}
+
+type LoanScheduleResult struct {
+	Loan               Loan            `json:"loan"`
+	Schedule           []ScheduleEntry `json:"schedule"`
+	TotalInterest      Money           `json:"totalInterest"`
+	OutstandingBalance Money           `json:"outstandingBalance"`
+}
+
+type LoanPayoffResult struct {
+	LoanId               string `json:"loanId"`
+	PayoffDate           string `json:"payoffDate"`
+	OutstandingPrincipal Money  `json:"outstandingPrincipal"`
+	AccruedInterest      Money  `json:"accruedInterest"`
+	FeesOutstanding      Money  `json:"feesOutstanding"`
+	PayoffAmount         Money  `json:"payoffAmount"`
+}
+
+/**
+Rounds num/den to the nearest integer, halves away from zero
+**/
+func roundRat(r *big.Rat) int64 {
+	num := new(big.Int).Abs(r.Num())
+	den := r.Denom()
+
+	num.Mul(num, big.NewInt(2))
+	num.Add(num, den)
+	num.Quo(num, new(big.Int).Mul(den, big.NewInt(2)))
+
+	if r.Sign() < 0 {
+		return -num.Int64()
+	}
+	return num.Int64()
+}
+
+/**
+Interest for one month on a balance, in minor units
+**/
+func monthlyInterest(balance int64, annualRateBps int) int64 {
+	return roundRat(big.NewRat(balance*int64(annualRateBps), 120000))
+}
+
+/**
+Level monthly payment which repays the principal over the term. Computed with exact
+rational arithmetic so every peer arrives at the same amount
+**/
+func MonthlyPayment(principal int64, annualRateBps int, termMonths int) int64 {
+	if annualRateBps == 0 {
+		return (principal + int64(termMonths) - 1) / int64(termMonths)
+	}
+
+	rate := big.NewRat(int64(annualRateBps), 120000)
+	growth := new(big.Rat).Add(big.NewRat(1, 1), rate)
+	factor := big.NewRat(1, 1)
+	for i := 0; i < termMonths; i++ {
+		factor.Mul(factor, growth)
+	}
+
+	//principal * rate * factor / (factor - 1)
+	payment := new(big.Rat).Mul(big.NewRat(principal, 1), rate)
+	payment.Mul(payment, factor)
+	payment.Quo(payment, new(big.Rat).Sub(factor, big.NewRat(1, 1)))
+
+	return roundRat(payment)
+}
+
+/**
+Adds months to a date, keeping the day of month where possible and using the last
+day of shorter months, e.g. Jan 31 + 1 month is Feb 28
+**/
+func addMonths(date time.Time, months int) time.Time {
+	first := time.Date(date.Year(), date.Month(), 1, 0, 0, 0, 0, time.UTC).AddDate(0, months, 0)
+	last := first.AddDate(0, 1, -1).Day()
+
+	day := date.Day()
+	if day > last {
+		day = last
+	}
+	return time.Date(first.Year(), first.Month(), day, 0, 0, 0, 0, time.UTC)
+}
+
+/**
+Generates the amortization schedule for a loan. The first installment is due one month
+after the start date. Each installment pays the interest on the outstanding balance and
+the remainder reduces principal. The last installment clears whatever rounding left over.
+Curtailments reduce the balance after the installment they follow, which shortens the
+schedule
+**/
+func GenerateAmortizationSchedule(loan Loan) ([]ScheduleEntry, error) {
+	start, err := time.Parse(loanDateLayout, loan.StartDate)
+	if err != nil {
+		return nil, errors.New("Loan " + loan.ID + " has an invalid start date " + loan.StartDate)
+	}
+
+	currency := loan.Principal.Currency
+	payment := loan.MonthlyPayment.Amount
+	balance := loan.Principal.Amount
+
+	schedule := []ScheduleEntry{}
+	for n := 1; n <= loan.TermMonths; n++ {
+		for _, c := range loan.Curtailments {
+			if c.AfterInstallment == n-1 {
+				balance -= c.Amount.Amount
+			}
+		}
+		if balance <= 0 {
+			break
+		}
+
+		interest := monthlyInterest(balance, loan.AnnualRateBps)
+		principal := payment - interest
+		if principal > balance || n == loan.TermMonths {
+			principal = balance
+		}
+		if principal < 0 {
+			return nil, errors.New("Loan " + loan.ID + " payment does not cover interest at installment " + strconv.Itoa(n))
+		}
+		balance -= principal
+
+		schedule = append(schedule, ScheduleEntry{
+			n,
+			addMonths(start, n).Format(loanDateLayout),
+			Money{principal + interest, currency},
+			Money{interest, currency},
+			Money{principal, currency},
+			Money{balance, currency},
+		})
+
+		if balance == 0 {
+			break
+		}
+	}
+
+	return schedule, nil
+}
+
+/**
+Returns true if the user is the primary borrower or a co-borrower on the loan
+**/
+func IsLoanBorrower(loan Loan, id string) bool {
+	if id == loan.BuyerId {
+		return true
+	}
+	for _, coBorrowerId := range loan.CoBorrowerIds {
+		if id == coBorrowerId {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+Save Loan to the ledger
+**/
+func SaveLoan(stub *shim.ChaincodeStub, loan Loan) ([]byte, error) {
+	fmt.Println("Entering SaveLoan")
+
+	key, err := GetStateKey(loan.ID, LOAN)
+	if err != nil {
+		return nil, err
+	}
+
+	bytes, _ := json.Marshal(&loan)
+	err = stub.PutState(key, bytes)
+	if err != nil {
+		fmt.Println("SaveLoan: Could not save loan ", err)
+		return nil, err
+	}
+	return bytes, nil
+}
+
+/**
+Reads a loan from the ledger without any access checks
+**/
+func LoadLoan(stub *shim.ChaincodeStub, id string) (Loan, error) {
+	var loan Loan
+
+	key, err := GetStateKey(id, LOAN)
+	if err != nil {
+		return loan, err
+	}
+
+	bytes, err := stub.GetState(key)
+	if err != nil {
+		fmt.Println("LoadLoan: Could not fetch loan with ID : "+id, err)
+		return loan, err
+	}
+	if len(bytes) == 0 {
+		return loan, errors.New("Loan with id " + id + " does not exist")
+	}
+
+	err = json.Unmarshal(bytes, &loan)
+	if err != nil {
+		fmt.Println("LoadLoan: Could not unmarshal loan with ID : "+id, err)
+		return loan, err
+	}
+
+	return loan, nil
+}
+
+/**
+Originates a loan from an approved mortgage application. Only the reviewing bank can
+originate the loan and an application can only fund one loan. The principal is the
+approved amount of the application. If the buyer holds an active rate lock, the locked
+rate and term are used.
+args[0] is the loan id and args[1] a LoanSchema json string
+**/
+func CreateLoan(stub *shim.ChaincodeStub, callerId string, callerAffiliation int, args []string) ([]byte, error) {
+	fmt.Println("Entering CreateLoan")
+
+	if len(args) < 2 {
+		fmt.Println("CreateLoan: expected two arguments")
+		return nil, errors.New("Could not create Loan. Invalid input")
+	}
+
+	loanId := strings.TrimSpace(args[0])
+	if len(loanId) == 0 {
+		return nil, errors.New("Invalid loan Id")
+	}
+
+	_, err := LoadLoan(stub, loanId)
+	if err == nil {
+		return nil, errors.New("Loan with id " + loanId + " already exists")
+	}
+
+	var input LoanSchema
+	err = json.Unmarshal([]byte(args[1]), &input)
+	if err != nil {
+		fmt.Println("CreateLoan: Could not unmarshal loan input ", err)
+		return nil, err
+	}
+
+	ma, err := LoadMortgageApplication(stub, strings.TrimSpace(input.MortgageApplicationId))
+	if err != nil {
+		return nil, err
+	}
+
+	err = Authorize(stub, callerId, callerAffiliation, LOAN, OP_CREATE, ma)
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.EqualFold(strings.TrimSpace(ma.Status), MA_APPROVED) {
+		return nil, errors.New("Mortgage application " + ma.ID + " is " + ma.Status + ". A loan can only be created once it is " + MA_APPROVED)
+	}
+
+	if len(ma.LoanId) > 0 {
+		return nil, errors.New("Mortgage application " + ma.ID + " already funded loan " + ma.LoanId)
+	}
+
+	if ma.ApprovedAmount.Amount <= 0 {
+		return nil, errors.New("Mortgage application " + ma.ID + " has no approved amount")
+	}
+	err = ma.ApprovedAmount.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	txTime, err := GetTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	now := txTime.Format(dateLayout)
+
+	//A locked rate is carried into the loan and cannot be overridden by the bank
+	var productId string
+	pointsBps := 0
+	if IsRateLockActive(ma.RateLock, txTime) {
+		lock := ma.RateLock
+		if (input.AnnualRateBps != 0 && input.AnnualRateBps != lock.AnnualRateBps) || (input.TermMonths != 0 && input.TermMonths != lock.TermMonths) {
+			return nil, errors.New("Mortgage application " + ma.ID + " has " + lock.ProductId + " locked at " + strconv.Itoa(lock.AnnualRateBps) + " bps for " + strconv.Itoa(lock.TermMonths) + " months until " + lock.ExpiresAt)
+		}
+		input.AnnualRateBps = lock.AnnualRateBps
+		input.TermMonths = lock.TermMonths
+		productId = lock.ProductId
+		pointsBps = lock.PointsBps
+	}
+
+	if input.TermMonths <= 0 || input.TermMonths > MAX_LOAN_TERM_MONTHS {
+		return nil, errors.New("Term must be between 1 and " + strconv.Itoa(MAX_LOAN_TERM_MONTHS) + " months")
+	}
+
+	if input.AnnualRateBps < 0 || input.AnnualRateBps > MAX_LOAN_RATE_BPS {
+		return nil, errors.New("Annual rate must be between 0 and " + strconv.Itoa(MAX_LOAN_RATE_BPS) + " basis points")
+	}
+
+	startDate := strings.TrimSpace(input.StartDate)
+	if len(startDate) == 0 {
+		startDate = txTime.Format(loanDateLayout)
+	}
+	_, err = time.Parse(loanDateLayout, startDate)
+	if err != nil {
+		return nil, errors.New("Invalid start date " + input.StartDate + ". Expected format " + loanDateLayout)
+	}
+
+	var loan Loan
+	loan.ID = loanId
+	loan.MortgageApplicationId = ma.ID
+	loan.SalesContractId = ma.SalesContractId
+	loan.PropertyId = ma.PropertyId
+	loan.BuyerId = ma.BuyerId
+	loan.CoBorrowerIds = ApplicantIds(ma)[1:]
+	loan.BankId = callerId
+	loan.Principal = ma.ApprovedAmount
+	loan.AnnualRateBps = input.AnnualRateBps
+	loan.TermMonths = input.TermMonths
+	loan.RateProductId = productId
+	loan.PointsBps = pointsBps
+	loan.StartDate = startDate
+	loan.MonthlyPayment = Money{MonthlyPayment(loan.Principal.Amount, loan.AnnualRateBps, loan.TermMonths), loan.Principal.Currency}
+	loan.OutstandingPrincipal = loan.Principal
+	loan.Status = LOAN_ACTIVE
+	loan.InstallmentProgress = Money{0, loan.Principal.Currency}
+	loan.FeesOutstanding = Money{0, loan.Principal.Currency}
+	loan.DelinquencyBucket = BUCKET_CURRENT
+	loan.Payments = []LoanPayment{}
+	loan.Curtailments = []Curtailment{}
+	loan.LastModifiedDate = now
+
+	//Make sure the terms produce a valid schedule before anything is stored
+	_, err = GenerateAmortizationSchedule(loan)
+	if err != nil {
+		return nil, err
+	}
+
+	bytes, err := SaveLoan(stub, loan)
+	if err != nil {
+		return nil, err
+	}
+
+	loanKey, _ := GetStateKey(loanId, LOAN)
+	_, err = AddKey(stub, loanKey, loanKeysName)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, borrowerId := range ApplicantIds(ma) {
+		err = AddIndexEntry(stub, loanBuyerIndex, borrowerId, loanId)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = AddIndexEntry(stub, loanBankIndex, loan.BankId, loanId)
+	if err != nil {
+		return nil, err
+	}
+
+	ma.LoanId = loanId
+	ma.LastModifiedDate = now
+	_, err = SaveMortgageApplication(stub, ma, ma.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("CreateLoan: Successfully created loan with ID: " + loanId)
+
+	msg := callerId + " originated loan " + loanId + " of " + loan.Principal.String() + " at " + strconv.Itoa(loan.AnnualRateBps) + " bps for " + strconv.Itoa(loan.TermMonths) + " months"
+	AppendMALog(stub, "CreateLoan", msg, LOAN_ACTIVE, loanId)
+	AppendMALog(stub, "CreateLoan", msg, ma.Status, ma.ID)
+
+	return bytes, nil
+}
+
+/**
+Return a loan based on access rights
+**/
+func GetLoan(stub *shim.ChaincodeStub, callerId string, callerAffiliation int, args []string) (Loan, []byte, error) {
+	fmt.Println("Entering GetLoan")
+
+	var loan Loan
+
+	if len(args) < 1 {
+		fmt.Println("GetLoan: expected 1 argument")
+		return loan, nil, errors.New("Could not GetLoan. Invalid input")
+	}
+
+	loan, err := LoadLoan(stub, args[0])
+	if err != nil {
+		return loan, nil, err
+	}
+
+	err = Authorize(stub, callerId, callerAffiliation, LOAN, OP_READ, loan)
+	if err != nil {
+		return loan, nil, err
+	}
+
+	bytes, err := json.Marshal(&loan)
+	if err != nil {
+		return loan, nil, err
+	}
+
+	return loan, bytes, nil
+}
+
+/**
+Returns the loans of the calling buyer or bank
+**/
+func GetLoans(stub *shim.ChaincodeStub, callerId string, callerAffiliation int, args []string) ([]byte, error) {
+	fmt.Println("Entering GetLoans")
+
+	var ids []string
+	var err error
+
+	if callerAffiliation == BUYER_A {
+		ids, err = GetIndexEntries(stub, loanBuyerIndex, callerId)
+	} else if callerAffiliation == BANK_A {
+		ids, err = GetIndexEntries(stub, loanBankIndex, callerId)
+	} else {
+		return nil, errors.New("GetLoans: callerId " + callerId + " cannot access loans")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	loans := []Loan{}
+	for _, id := range ids {
+		loan, _, err := GetLoan(stub, callerId, callerAffiliation, []string{id})
+		if err != nil {
+			return nil, err
+		}
+		loans = append(loans, loan)
+	}
+
+	bytes, err := json.Marshal(&loans)
+	if err != nil {
+		fmt.Println("GetLoans: Could not marshal loans ", err)
+		return nil, err
+	}
+
+	return bytes, nil
+}
+
+/**
+Returns the amortization schedule of a loan along with its outstanding balance.
+args[0] is the loan id
+**/
+func GetLoanSchedule(stub *shim.ChaincodeStub, callerId string, callerAffiliation int, args []string) ([]byte, error) {
+	fmt.Println("Entering GetLoanSchedule")
+
+	loan, _, err := GetLoan(stub, callerId, callerAffiliation, args)
+	if err != nil {
+		return nil, err
+	}
+
+	schedule, err := GenerateAmortizationSchedule(loan)
+	if err != nil {
+		return nil, err
+	}
+
+	var result LoanScheduleResult
+	result.Loan = loan
+	result.Schedule = schedule
+	result.TotalInterest = Money{0, loan.Principal.Currency}
+	for _, entry := range schedule {
+		result.TotalInterest.Amount += entry.Interest.Amount
+	}
+	result.OutstandingBalance = loan.OutstandingPrincipal
+
+	bytes, err := json.Marshal(&result)
+	if err != nil {
+		fmt.Println("GetLoanSchedule: Could not marshal schedule ", err)
+		return nil, err
+	}
+
+	return bytes, nil
+}
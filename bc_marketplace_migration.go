@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//Key holding the version of the stored record layout
+var schemaVersionKey = "schemaVersion"
+
+//Version 1: amounts stored as bare whole numbers
+//Version 2: amounts stored as Money in minor units with a currency
+//Version 3: property ads indexed by the words of their address
+const SCHEMA_VERSION int = 3
+
+//Price index written by version 1, replaced by one index per currency
+var legacyPriceIndexName = "propertyAdPriceIndex"
+
+/**
+Returns the schema version of the stored records. State written before versioning is version 1
+**/
+func GetSchemaVersion(stub *shim.ChaincodeStub) (int, error) {
+	bytes, err := stub.GetState(schemaVersionKey)
+	if err != nil {
+		fmt.Println("GetSchemaVersion: Could not get schema version ", err)
+		return 0, err
+	}
+	if len(bytes) == 0 {
+		return 1, nil
+	}
+
+	version, err := strconv.Atoi(string(bytes))
+	if err != nil {
+		return 0, errors.New("Invalid schema version " + string(bytes))
+	}
+	return version, nil
+}
+
+func SaveSchemaVersion(stub *shim.ChaincodeStub, version int) error {
+	err := stub.PutState(schemaVersionKey, []byte(strconv.Itoa(version)))
+	if err != nil {
+		fmt.Println("SaveSchemaVersion: Could not save schema version ", err)
+		return err
+	}
+	return nil
+}
+
+/**
+Returns every key from the given key lists without duplicates. Older versions of AddKey
+wrote all keys into maKeys so records are dispatched on their prefix, not their list
+**/
+func collectKeys(stub *shim.ChaincodeStub, keysNames []string) ([]string, error) {
+	var result []string
+	seen := make(map[string]bool)
+
+	for _, name := range keysNames {
+		keys, err := GetKeys(stub, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			if !seen[key] {
+				seen[key] = true
+				result = append(result, key)
+			}
+		}
+	}
+
+	return result, nil
+}
+
+/**
+Rewrites a record through its Go type. Money decodes the version 1 whole numbers so
+re-encoding stores the version 2 layout
+**/
+func rewriteRecord(stub *shim.ChaincodeStub, key string, record interface{}) error {
+	bytes, err := stub.GetState(key)
+	if err != nil {
+		return err
+	}
+	if len(bytes) == 0 {
+		return nil
+	}
+
+	err = json.Unmarshal(bytes, record)
+	if err != nil {
+		fmt.Println("rewriteRecord: Could not unmarshal record "+key+" ", err)
+		return errors.New("Could not migrate record " + key)
+	}
+
+	bytes, _ = json.Marshal(record)
+	return stub.PutState(key, bytes)
+}
+
+/**
+Version 1 to 2: converts bare integer amounts to Money and rebuilds the price indexes
+**/
+func migrateMoneyV2(stub *shim.ChaincodeStub) error {
+	fmt.Println("Entering migrateMoneyV2")
+
+	keys, err := collectKeys(stub, []string{propertyKeysName, propertyAdKeysName, maKeysName, scKeysName, aaKeysName, offerKeysName, escrowKeysName})
+	if err != nil {
+		return err
+	}
+
+	err = stub.DelState(legacyPriceIndexName)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if strings.HasPrefix(key, typePropertyAd) {
+			var pa PropertyAd
+			err = rewriteRecord(stub, key, &pa)
+			if err == nil && len(pa.ID) > 0 {
+				err = IndexPropertyAd(stub, pa)
+			}
+		} else if strings.HasPrefix(key, typeProperty) {
+			err = rewriteRecord(stub, key, &Property{})
+		} else if strings.HasPrefix(key, typeMortgageApplication) {
+			err = rewriteRecord(stub, key, &MortgageApplication{})
+		} else if strings.HasPrefix(key, typeSalesContract) {
+			err = rewriteRecord(stub, key, &SalesContract{})
+		} else if strings.HasPrefix(key, typeAppraiserApplication) {
+			err = rewriteRecord(stub, key, &AppraiserApplication{})
+		} else if strings.HasPrefix(key, typeOffer) {
+			err = rewriteRecord(stub, key, &Offer{})
+		} else if strings.HasPrefix(key, typeEscrow) {
+			var escrow Escrow
+			err = rewriteRecord(stub, key, &escrow)
+			if err == nil && len(escrow.ID) > 0 && len(escrow.Currency) == 0 {
+				escrow.Currency = defaultCurrency
+				_, err = SaveEscrow(stub, escrow)
+			}
+		}
+
+		if err != nil {
+			fmt.Println("migrateMoneyV2: Could not migrate "+key+" ", err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+/**
+Version 2 to 3: indexes every property ad by the words of its address
+**/
+func migrateAddressIndexV3(stub *shim.ChaincodeStub) error {
+	fmt.Println("Entering migrateAddressIndexV3")
+
+	keys, err := collectKeys(stub, []string{propertyAdKeysName})
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if !strings.HasPrefix(key, typePropertyAd) {
+			continue
+		}
+		var pa PropertyAd
+		err = rewriteRecord(stub, key, &pa)
+		if err == nil && len(pa.ID) > 0 {
+			err = IndexPropertyAd(stub, pa)
+		}
+		if err != nil {
+			fmt.Println("migrateAddressIndexV3: Could not index "+key+" ", err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+/**
+Brings stored records up to SCHEMA_VERSION. Each step is idempotent so running the
+migration again, or on state which is already current, is a no-op. Runs at Init when
+the chaincode is upgraded, or through MigrateState
+**/
+func migrateState(stub *shim.ChaincodeStub) ([]byte, error) {
+	fmt.Println("Entering migrateState")
+
+	version, err := GetSchemaVersion(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	if version > SCHEMA_VERSION {
+		return nil, errors.New("Stored schema version " + strconv.Itoa(version) + " is newer than chaincode version " + strconv.Itoa(SCHEMA_VERSION))
+	}
+
+	if version < 2 {
+		err = migrateMoneyV2(stub)
+		if err != nil {
+			return nil, err
+		}
+		version = 2
+	}
+
+	if version < 3 {
+		err = migrateAddressIndexV3(stub)
+		if err != nil {
+			return nil, err
+		}
+		version = 3
+	}
+
+	err = SaveSchemaVersion(stub, version)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("migrateState: State is at schema version " + strconv.Itoa(version))
+	return []byte(strconv.Itoa(version)), nil
+}
+
+/**
+An admin brings stored records up to SCHEMA_VERSION
+**/
+func MigrateState(stub *shim.ChaincodeStub, callerId string, callerAffiliation int, args []string) ([]byte, error) {
+	fmt.Println("Entering MigrateState")
+
+	if callerAffiliation != ADMIN_A {
+		return nil, errors.New(callerId + " is not allowed to migrate state")
+	}
+
+	bytes, err := migrateState(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	AppendMALog(stub, "MigrateState", callerId+" migrated state to schema version "+string(bytes), "", schemaVersionKey)
+	return bytes, nil
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+//Currency used for amounts stored before Money was introduced
+var defaultCurrency = "USD"
+
+//Number of minor units digits for currencies which do not use cents
+var currencyExponents = map[string]int{
+	"BHD": 3,
+	"CLP": 0,
+	"ISK": 0,
+	"JOD": 3,
+	"JPY": 0,
+	"KRW": 0,
+	"KWD": 3,
+	"OMR": 3,
+	"TND": 3,
+	"VND": 0,
+}
+
+/**
+A monetary amount in the minor units of an ISO 4217 currency, e.g. cents for USD
+**/
+type Money struct {
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+type moneyJSON struct {
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+/**
+Accepts the object form {"amount":123456,"currency":"USD"} and, for records written
+before Money was introduced, a bare number of whole units in the default currency
+**/
+func (m *Money) UnmarshalJSON(data []byte) error {
+	trimmed := strings.TrimSpace(string(data))
+	if trimmed == "null" {
+		*m = Money{}
+		return nil
+	}
+
+	if len(trimmed) > 0 && trimmed[0] != '{' {
+		var whole int64
+		err := json.Unmarshal(data, &whole)
+		if err != nil {
+			return errors.New("Invalid amount " + trimmed)
+		}
+		*m = WholeUnits(whole, defaultCurrency)
+		return nil
+	}
+
+	var v moneyJSON
+	err := json.Unmarshal(data, &v)
+	if err != nil {
+		return err
+	}
+	m.Amount = v.Amount
+	m.Currency = strings.ToUpper(strings.TrimSpace(v.Currency))
+	return nil
+}
+
+/**
+Returns the number of minor unit digits for a currency
+**/
+func CurrencyExponent(currency string) int {
+	if exp, ok := currencyExponents[currency]; ok {
+		return exp
+	}
+	return 2
+}
+
+/**
+Builds a Money value from a whole number of major units, e.g. dollars
+**/
+func WholeUnits(amount int64, currency string) Money {
+	for i := 0; i < CurrencyExponent(currency); i++ {
+		amount *= 10
+	}
+	return Money{amount, currency}
+}
+
+func (m Money) IsZero() bool {
+	return m.Amount == 0
+}
+
+/**
+Checks that the currency is a three letter ISO code
+**/
+func ValidateCurrency(currency string) error {
+	if len(currency) != 3 {
+		return errors.New("Invalid currency " + currency)
+	}
+	for _, r := range currency {
+		if r < 'A' || r > 'Z' {
+			return errors.New("Invalid currency " + currency)
+		}
+	}
+	return nil
+}
+
+/**
+Validates a stored or input amount. Zero amounts are allowed without a currency
+**/
+func (m Money) Validate() error {
+	if m.Amount < 0 {
+		return errors.New("Amount cannot be negative")
+	}
+	if m.IsZero() && len(m.Currency) == 0 {
+		return nil
+	}
+	return ValidateCurrency(m.Currency)
+}
+
+/**
+Returns an error unless both amounts are in the same currency
+**/
+func SameCurrency(a Money, b Money) error {
+	if a.Currency != b.Currency {
+		return errors.New("Currency mismatch: " + a.Currency + " and " + b.Currency)
+	}
+	return nil
+}
+
+/**
+Compares two amounts in the same currency. Returns -1, 0 or 1
+**/
+func (m Money) Compare(other Money) (int, error) {
+	err := SameCurrency(m, other)
+	if err != nil {
+		return 0, err
+	}
+	if m.Amount < other.Amount {
+		return -1, nil
+	}
+	if m.Amount > other.Amount {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+func (m Money) Add(other Money) (Money, error) {
+	if m.IsZero() && len(m.Currency) == 0 {
+		return other, nil
+	}
+	err := SameCurrency(m, other)
+	if err != nil {
+		return m, err
+	}
+	return Money{m.Amount + other.Amount, m.Currency}, nil
+}
+
+func (m Money) Sub(other Money) (Money, error) {
+	if m.IsZero() && len(m.Currency) == 0 {
+		m.Currency = other.Currency
+	}
+	err := SameCurrency(m, other)
+	if err != nil {
+		return m, err
+	}
+	return Money{m.Amount - other.Amount, m.Currency}, nil
+}
+
+/**
+Formats the amount in major units, e.g. "USD 1500.25"
+**/
+func (m Money) String() string {
+	exp := CurrencyExponent(m.Currency)
+	amount := m.Amount
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+
+	digits := strconv.FormatInt(amount, 10)
+	if exp > 0 {
+		for len(digits) <= exp {
+			digits = "0" + digits
+		}
+		digits = digits[:len(digits)-exp] + "." + digits[len(digits)-exp:]
+	}
+
+	return strings.TrimSpace(m.Currency + " " + sign + digits)
+}
+
+/**
+Validates every amount on a mortgage application. The amounts are compared with each
+other during underwriting so they must all be in the currency of the requested amount
+**/
+func ValidateMortgageApplicationAmounts(ma MortgageApplication) error {
+	amounts := []struct {
+		name   string
+		amount Money
+	}{
+		{"requestedAmount", ma.RequestedAmount},
+		{"fairMarketValue", ma.FairMarketValue},
+		{"approvedAmount", ma.ApprovedAmount},
+		{"monthlySalary", ma.FinancialInfo.MonthlySalary},
+		{"otherIncome", ma.FinancialInfo.OtherIncome},
+		{"otherExpenditure", ma.FinancialInfo.OtherExpenditure},
+		{"monthlyRent", ma.FinancialInfo.MonthlyRent},
+		{"monthlyLoanPayment", ma.FinancialInfo.MonthlyLoanPayment},
+	}
+
+	for _, co := range ma.CoApplicants {
+		amounts = append(amounts, []struct {
+			name   string
+			amount Money
+		}{
+			{co.BuyerId + ".monthlySalary", co.FinancialInfo.MonthlySalary},
+			{co.BuyerId + ".otherIncome", co.FinancialInfo.OtherIncome},
+			{co.BuyerId + ".otherExpenditure", co.FinancialInfo.OtherExpenditure},
+			{co.BuyerId + ".monthlyRent", co.FinancialInfo.MonthlyRent},
+			{co.BuyerId + ".monthlyLoanPayment", co.FinancialInfo.MonthlyLoanPayment},
+		}...)
+	}
+
+	err := ValidateCurrency(ma.RequestedAmount.Currency)
+	if err != nil {
+		return errors.New("requestedAmount: " + err.Error())
+	}
+
+	for _, a := range amounts {
+		err = a.amount.Validate()
+		if err != nil {
+			return errors.New(a.name + ": " + err.Error())
+		}
+		if !a.amount.IsZero() && a.amount.Currency != ma.RequestedAmount.Currency {
+			return errors.New(a.name + ": currency " + a.amount.Currency + " does not match requested amount currency " + ma.RequestedAmount.Currency)
+		}
+	}
+
+	return nil
+}
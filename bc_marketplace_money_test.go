@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestMoneyUnmarshalJSON(t *testing.T) {
+	cases := []struct {
+		json   string
+		want   Money
+		wantOk bool
+	}{
+		{`{"amount":123456,"currency":"USD"}`, Money{123456, "USD"}, true},
+		{`{"amount":500,"currency":" eur "}`, Money{500, "EUR"}, true},
+		{`250000`, Money{25000000, defaultCurrency}, true},
+		{` 0 `, Money{0, defaultCurrency}, true},
+		{`null`, Money{}, true},
+		{`"250000"`, Money{}, false},
+		{`12.50`, Money{}, false},
+		{`{"amount":"12","currency":"USD"}`, Money{}, false},
+	}
+
+	for _, c := range cases {
+		var m Money
+		err := json.Unmarshal([]byte(c.json), &m)
+		if c.wantOk && err != nil {
+			t.Errorf("%s: unexpected error %v", c.json, err)
+		}
+		if !c.wantOk && err == nil {
+			t.Errorf("%s: expected an error, got %v", c.json, m)
+		}
+		if c.wantOk && m != c.want {
+			t.Errorf("%s: unmarshalled %v, want %v", c.json, m, c.want)
+		}
+	}
+}
+
+func TestMoneyUnmarshalLegacyRecord(t *testing.T) {
+	//A sales contract written before Money stored its price as whole dollars
+	var sc SalesContract
+	err := json.Unmarshal([]byte(`{"id":"sc1","price":350000}`), &sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sc.Price != (Money{35000000, "USD"}) {
+		t.Errorf("legacy price is %v", sc.Price)
+	}
+
+	bytes, err := json.Marshal(&sc.Price)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bytes) != `{"amount":35000000,"currency":"USD"}` {
+		t.Errorf("price is written back as %s", bytes)
+	}
+}
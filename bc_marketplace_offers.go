@@ -0,0 +1,661 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//Secondary index names for offers
+var offerBuyerIndex = "offer:buyer:"
+var offerSellerIndex = "offer:seller:"
+var offerPropertyAdIndex = "offer:propad:"
+
+//Layout used for every date stored on the ledger
+var dateLayout = "2006-01-02 15:04:05"
+
+//Offer status values
+const OFFER_SUBMITTED string = "Submitted"
+const OFFER_COUNTERED string = "Countered"
+const OFFER_ACCEPTED string = "Accepted"
+const OFFER_REJECTED string = "Rejected"
+const OFFER_WITHDRAWN string = "Withdrawn"
+const OFFER_EXPIRED string = "Expired"
+
+//Property ad status values
+const AD_ACTIVE string = "Active"
+const AD_UNDER_CONTRACT string = "UnderContract"
+
+//Contingency types a buyer can attach to an offer
+var contingencyTypes = []string{"financing", "appraisal", "inspection"}
+
+/**
+A single round of negotiation. The first round is the buyer's original offer
+and each counteroffer adds a new round
+**/
+type OfferTerms struct {
+	ProposedBy    string   `json:"proposedBy"`
+	Price         Money    `json:"price"`
+	Contingencies []string `json:"contingencies"`
+	ExpiresAt     string   `json:"expiresAt"`
+	Timestamp     string   `json:"timestamp"`
+}
+
+type Offer struct {
+	ID                   string       `json:"id"`
+	PropertyAdId         string       `json:"propertyAdId"`
+	PropertyId           string       `json:"propertyId"`
+	BuyerId              string       `json:"buyerId"`
+	SellerId             string       `json:"sellerId"`
+	ReviewerId           string       `json:"reviewerId"`
+	Price                Money        `json:"price"`
+	Contingencies        []string     `json:"contingencies"`
+	ExpiresAt            string       `json:"expiresAt"`
+	Status               string       `json:"status"`
+	AwaitingResponseFrom string       `json:"awaitingResponseFrom"`
+	Rounds               []OfferTerms `json:"rounds"`
+	SalesContractId      string       `json:"salesContractId"`
+	LastModifiedDate     string       `json:"lastModifiedDate"`
+}
+
+type OfferSchema struct {
+	PropertyAdId  string   `json:"propertyAdId"`
+	ReviewerId    string   `json:"reviewerId"`
+	Price         Money    `json:"price"`
+	Contingencies []string `json:"contingencies"`
+	ExpiresAt     string   `json:"expiresAt"`
+}
+
+type OfferResponseSchema struct {
+	Action          string   `json:"action"`
+	Price           Money    `json:"price"`
+	Contingencies   []string `json:"contingencies"`
+	ExpiresAt       string   `json:"expiresAt"`
+	SalesContractId string   `json:"salesContractId"`
+}
+
+/**
+Returns true while the offer can still be accepted, rejected or countered
+**/
+func IsOfferOpen(offer Offer) bool {
+	return offer.Status == OFFER_SUBMITTED || offer.Status == OFFER_COUNTERED
+}
+
+/**
+Marks an open offer as expired if its expiry is before the transaction time.
+Returns true if the status was changed
+**/
+func ExpireOfferIfDue(offer *Offer, txTime time.Time) bool {
+	if !IsOfferOpen(*offer) {
+		return false
+	}
+
+	expiresAt, err := time.Parse(dateLayout, offer.ExpiresAt)
+	if err != nil || txTime.After(expiresAt) {
+		offer.Status = OFFER_EXPIRED
+		offer.AwaitingResponseFrom = ""
+		return true
+	}
+
+	return false
+}
+
+/**
+Offer prices must be positive and in the currency the property is listed in
+**/
+func validateOfferPrice(price Money, pa PropertyAd) error {
+	if price.Amount <= 0 {
+		return errors.New("Offer price must be greater than zero")
+	}
+	err := price.Validate()
+	if err != nil {
+		return err
+	}
+	return SameCurrency(price, pa.ListedPrice)
+}
+
+/**
+Validates the expiry of a round of terms against the transaction time
+**/
+func validateOfferExpiry(expiresAt string, txTime time.Time) error {
+	expiry, err := time.Parse(dateLayout, strings.TrimSpace(expiresAt))
+	if err != nil {
+		return errors.New("Invalid expiresAt " + expiresAt + ". Expected format " + dateLayout)
+	}
+	if !expiry.After(txTime) {
+		return errors.New("expiresAt " + expiresAt + " is not in the future")
+	}
+	return nil
+}
+
+/**
+Validates and normalizes the list of contingencies on an offer
+**/
+func validateContingencies(contingencies []string) ([]string, error) {
+	result := []string{}
+	seen := make(map[string]bool)
+
+	for _, c := range contingencies {
+		c = strings.ToLower(strings.TrimSpace(c))
+		valid := false
+		for _, t := range contingencyTypes {
+			if c == t {
+				valid = true
+			}
+		}
+		if !valid {
+			return nil, errors.New("Invalid contingency " + c)
+		}
+		if !seen[c] {
+			seen[c] = true
+			result = append(result, c)
+		}
+	}
+
+	return result, nil
+}
+
+/**
+Save Offer to the ledger
+**/
+func SaveOffer(stub *shim.ChaincodeStub, offer Offer) ([]byte, error) {
+	fmt.Println("Entering SaveOffer")
+
+	bytes, _ := json.Marshal(&offer)
+	key, err := GetStateKey(offer.ID, OFFER)
+	if err != nil {
+		return nil, err
+	}
+
+	err = stub.PutState(key, bytes)
+	if err != nil {
+		fmt.Println("SaveOffer: Could not save offer ", err)
+		return nil, err
+	}
+	return bytes, nil
+}
+
+/**
+Reads an offer from the ledger without any access checks
+**/
+func LoadOffer(stub *shim.ChaincodeStub, id string) (Offer, error) {
+	var offer Offer
+
+	key, err := GetStateKey(id, OFFER)
+	if err != nil {
+		return offer, err
+	}
+
+	bytes, err := stub.GetState(key)
+	if err != nil {
+		fmt.Println("LoadOffer: Could not fetch offer with ID : "+id, err)
+		return offer, err
+	}
+	if len(bytes) == 0 {
+		return offer, errors.New("Offer with id " + id + " does not exist")
+	}
+
+	err = json.Unmarshal(bytes, &offer)
+	if err != nil {
+		fmt.Println("LoadOffer: Could not unmarshal offer with ID : "+id, err)
+		return offer, err
+	}
+
+	return offer, nil
+}
+
+/**
+Submit a new offer against a property ad. Only buyers can submit offers.
+args[0] is the offer id and args[1] an OfferSchema json string
+**/
+func CreateOffer(stub *shim.ChaincodeStub, callerId string, callerAffiliation int, args []string) ([]byte, error) {
+	fmt.Println("Entering CreateOffer")
+
+	if len(args) < 2 {
+		fmt.Println("CreateOffer: expected two arguments")
+		return nil, errors.New("Could not create Offer. Invalid input")
+	}
+
+	err := Authorize(stub, callerId, callerAffiliation, OFFER, OP_CREATE, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	offerId := strings.TrimSpace(args[0])
+	if len(offerId) == 0 {
+		return nil, errors.New("Invalid offer Id")
+	}
+
+	_, err = LoadOffer(stub, offerId)
+	if err == nil {
+		return nil, errors.New("Offer with id " + offerId + " already exists")
+	}
+
+	var input OfferSchema
+	err = json.Unmarshal([]byte(args[1]), &input)
+	if err != nil {
+		fmt.Println("CreateOffer: Could not unmarshal offer input ", err)
+		return nil, err
+	}
+
+	pa, _, err := GetPropertyAd(stub, input.PropertyAdId)
+	if err != nil {
+		return nil, errors.New("Property ad " + input.PropertyAdId + " does not exist")
+	}
+
+	if pa.Status != AD_ACTIVE {
+		return nil, errors.New("Property ad " + pa.ID + " is not accepting offers")
+	}
+
+	if pa.SellerID == callerId {
+		return nil, errors.New("Seller cannot make an offer on their own property")
+	}
+
+	err = validateOfferPrice(input.Price, pa)
+	if err != nil {
+		return nil, err
+	}
+
+	txTime, err := GetTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateOfferExpiry(input.ExpiresAt, txTime)
+	if err != nil {
+		return nil, err
+	}
+
+	contingencies, err := validateContingencies(input.Contingencies)
+	if err != nil {
+		return nil, err
+	}
+
+	reviewerId := strings.TrimSpace(input.ReviewerId)
+	if len(reviewerId) == 0 {
+		reviewerId = pa.BankID
+	}
+	reviewer, err := GetUser(stub, reviewerId)
+	if err != nil || reviewer.Affiliation != BANK_A {
+		return nil, errors.New("Reviewer " + reviewerId + " is not a registered bank")
+	}
+
+	now := txTime.Format(dateLayout)
+	terms := OfferTerms{callerId, input.Price, contingencies, strings.TrimSpace(input.ExpiresAt), now}
+
+	var offer Offer
+	offer.ID = offerId
+	offer.PropertyAdId = pa.ID
+	offer.PropertyId = pa.PropertyID
+	offer.BuyerId = callerId
+	offer.SellerId = pa.SellerID
+	offer.ReviewerId = reviewerId
+	offer.Price = terms.Price
+	offer.Contingencies = terms.Contingencies
+	offer.ExpiresAt = terms.ExpiresAt
+	offer.Status = OFFER_SUBMITTED
+	offer.AwaitingResponseFrom = pa.SellerID
+	offer.Rounds = []OfferTerms{terms}
+	offer.LastModifiedDate = now
+
+	bytes, err := SaveOffer(stub, offer)
+	if err != nil {
+		return nil, err
+	}
+
+	offerKey, _ := GetStateKey(offerId, OFFER)
+	_, err = AddKey(stub, offerKey, offerKeysName)
+	if err != nil {
+		return nil, err
+	}
+
+	indexes := map[string]string{
+		offerBuyerIndex:      offer.BuyerId,
+		offerSellerIndex:     offer.SellerId,
+		offerPropertyAdIndex: offer.PropertyAdId,
+	}
+	for index, value := range indexes {
+		err = AddIndexEntry(stub, index, value, offerId)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	fmt.Println("CreateOffer: Successfully created offer with ID: " + offerId)
+
+	AppendMALog(stub, "CreateOffer", callerId+" submitted offer of "+offer.Price.String()+" on property ad "+pa.ID, OFFER_SUBMITTED, offerId)
+
+	return bytes, nil
+}
+
+/**
+Accept, reject, counter or withdraw an offer.
+args[0] is the offer id and args[1] an OfferResponseSchema json string
+**/
+func RespondToOffer(stub *shim.ChaincodeStub, callerId string, callerAffiliation int, args []string) ([]byte, error) {
+	fmt.Println("Entering RespondToOffer")
+
+	if len(args) < 2 {
+		fmt.Println("RespondToOffer: expected two arguments")
+		return nil, errors.New("Could not respond to Offer. Invalid input")
+	}
+
+	offer, err := LoadOffer(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	err = Authorize(stub, callerId, callerAffiliation, OFFER, OP_RESPOND, offer)
+	if err != nil {
+		return nil, err
+	}
+
+	var response OfferResponseSchema
+	err = json.Unmarshal([]byte(args[1]), &response)
+	if err != nil {
+		fmt.Println("RespondToOffer: Could not unmarshal response ", err)
+		return nil, err
+	}
+
+	txTime, err := GetTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	now := txTime.Format(dateLayout)
+
+	//A failed transaction writes nothing, so the expiry is only applied to what is read
+	if ExpireOfferIfDue(&offer, txTime) {
+		return nil, errors.New("Offer " + offer.ID + " expired at " + offer.ExpiresAt + " and can no longer be changed")
+	}
+
+	if !IsOfferOpen(offer) {
+		return nil, errors.New("Offer " + offer.ID + " is " + offer.Status + " and can no longer be changed")
+	}
+
+	action := strings.ToLower(strings.TrimSpace(response.Action))
+
+	if action == "withdraw" {
+		if callerId != offer.BuyerId {
+			return nil, errors.New("Only the buyer can withdraw offer " + offer.ID)
+		}
+	} else if callerId != offer.AwaitingResponseFrom {
+		return nil, errors.New("Offer " + offer.ID + " is awaiting a response from " + offer.AwaitingResponseFrom)
+	}
+
+	var msg string
+
+	if action == "accept" {
+		offer.Status = OFFER_ACCEPTED
+		offer.AwaitingResponseFrom = ""
+		msg = callerId + " accepted offer at price " + offer.Price.String()
+
+	} else if action == "reject" {
+		offer.Status = OFFER_REJECTED
+		offer.AwaitingResponseFrom = ""
+		msg = callerId + " rejected offer"
+
+	} else if action == "withdraw" {
+		offer.Status = OFFER_WITHDRAWN
+		offer.AwaitingResponseFrom = ""
+		msg = callerId + " withdrew offer"
+
+	} else if action == "counter" {
+		pa, _, err := GetPropertyAd(stub, offer.PropertyAdId)
+		if err != nil {
+			return nil, err
+		}
+
+		err = validateOfferPrice(response.Price, pa)
+		if err != nil {
+			return nil, err
+		}
+
+		err = validateOfferExpiry(response.ExpiresAt, txTime)
+		if err != nil {
+			return nil, err
+		}
+
+		contingencies := offer.Contingencies
+		if response.Contingencies != nil {
+			contingencies, err = validateContingencies(response.Contingencies)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		terms := OfferTerms{callerId, response.Price, contingencies, strings.TrimSpace(response.ExpiresAt), now}
+		offer.Rounds = append(offer.Rounds, terms)
+		offer.Price = terms.Price
+		offer.Contingencies = terms.Contingencies
+		offer.ExpiresAt = terms.ExpiresAt
+		offer.Status = OFFER_COUNTERED
+
+		if callerId == offer.SellerId {
+			offer.AwaitingResponseFrom = offer.BuyerId
+		} else {
+			offer.AwaitingResponseFrom = offer.SellerId
+		}
+		msg = callerId + " countered with price " + offer.Price.String()
+
+	} else {
+		return nil, errors.New("Invalid action " + response.Action + ". Expected accept, reject, counter or withdraw")
+	}
+
+	offer.LastModifiedDate = now
+
+	if offer.Status == OFFER_ACCEPTED {
+		err = CreateSalesContractFromOffer(stub, &offer, strings.TrimSpace(response.SalesContractId), txTime)
+		if err != nil {
+			return nil, err
+		}
+		msg += " and created sales contract " + offer.SalesContractId
+	}
+
+	bytes, err := SaveOffer(stub, offer)
+	if err != nil {
+		return nil, err
+	}
+
+	AppendMALog(stub, "RespondToOffer", msg, offer.Status, offer.ID)
+
+	return bytes, nil
+}
+
+/**
+Creates the sales contract for an accepted offer, links it to the buyer, seller and bank,
+takes the property ad off the market and closes the remaining open offers on it
+**/
+func CreateSalesContractFromOffer(stub *shim.ChaincodeStub, offer *Offer, salesContractId string, txTime time.Time) error {
+	fmt.Println("Entering CreateSalesContractFromOffer")
+
+	now := txTime.Format(dateLayout)
+
+	if len(salesContractId) == 0 {
+		salesContractId = "sc-" + offer.ID
+	}
+
+	scKey, err := GetStateKey(salesContractId, SALESCONTRACT)
+	if err != nil {
+		return err
+	}
+
+	existing, err := stub.GetState(scKey)
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		return errors.New("Sales contract with id " + salesContractId + " already exists")
+	}
+
+	var sc SalesContract
+	sc.ID = salesContractId
+	sc.PropertyId = offer.PropertyId
+	sc.BuyerId = offer.BuyerId
+	sc.SellerId = offer.SellerId
+	sc.ReviewerId = offer.ReviewerId
+	sc.Status = "Submitted"
+	sc.Price = offer.Price
+	sc.OfferId = offer.ID
+	sc.Contingencies = NewContingencies(offer.Contingencies)
+	sc.LastModifiedDate = now
+
+	//Same KYC check as a sales contract created directly
+	err = CheckKycPolicy(stub, sc.ReviewerId, []string{sc.BuyerId}, sc.SellerId)
+	if err != nil {
+		fmt.Println("CreateSalesContractFromOffer: KYC check failed", err)
+		return err
+	}
+
+	_, err = SaveSalesContract(stub, sc, salesContractId)
+	if err != nil {
+		return err
+	}
+
+	_, err = AddKey(stub, scKey, scKeysName)
+	if err != nil {
+		return err
+	}
+
+	err = LinkSalesContract(stub, salesContractId, sc.BuyerId, sc.SellerId, sc.ReviewerId)
+	if err != nil {
+		return err
+	}
+
+	offer.SalesContractId = salesContractId
+
+	AppendMALog(stub, "CreateSalesContract", "Created from accepted offer "+offer.ID, sc.Status, salesContractId)
+
+	pa, _, err := GetPropertyAd(stub, offer.PropertyAdId)
+	if err != nil {
+		return err
+	}
+	pa.Status = AD_UNDER_CONTRACT
+	pa.LastModifiedDate = now
+	_, err = SavePropertyAd(stub, pa)
+	if err != nil {
+		return err
+	}
+
+	//Remaining open offers on the property can no longer be accepted
+	others, err := GetIndexEntries(stub, offerPropertyAdIndex, offer.PropertyAdId)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range others {
+		if id == offer.ID {
+			continue
+		}
+		other, err := LoadOffer(stub, id)
+		if err != nil {
+			return err
+		}
+		if !IsOfferOpen(other) {
+			continue
+		}
+		msg := closeCompetingOffer(&other, offer.ID, txTime)
+		other.LastModifiedDate = now
+		_, err = SaveOffer(stub, other)
+		if err != nil {
+			return err
+		}
+		AppendMALog(stub, "RespondToOffer", msg, other.Status, other.ID)
+	}
+
+	return nil
+}
+
+/**
+Closes an open offer once another offer on the same property is accepted. An offer
+already past its expiry is marked expired rather than rejected. Returns the log message
+**/
+func closeCompetingOffer(other *Offer, acceptedId string, txTime time.Time) string {
+	if ExpireOfferIfDue(other, txTime) {
+		return "Expired at " + other.ExpiresAt
+	}
+
+	other.Status = OFFER_REJECTED
+	other.AwaitingResponseFrom = ""
+	return "Rejected because offer " + acceptedId + " was accepted"
+}
+
+/**
+Return an offer based on access rights. Expiry is applied to the returned copy only
+**/
+func GetOffer(stub *shim.ChaincodeStub, callerId string, callerAffiliation int, args []string) (Offer, []byte, error) {
+	fmt.Println("Entering GetOffer")
+
+	var offer Offer
+
+	if len(args) < 1 {
+		fmt.Println("GetOffer: expected 1 argument")
+		return offer, nil, errors.New("Could not GetOffer. Invalid input")
+	}
+
+	offer, err := LoadOffer(stub, args[0])
+	if err != nil {
+		return offer, nil, err
+	}
+
+	err = Authorize(stub, callerId, callerAffiliation, OFFER, OP_READ, offer)
+	if err != nil {
+		return offer, nil, err
+	}
+
+	txTime, err := GetTxTime(stub)
+	if err == nil {
+		ExpireOfferIfDue(&offer, txTime)
+	}
+
+	bytes, err := json.Marshal(&offer)
+	if err != nil {
+		return offer, nil, err
+	}
+
+	return offer, bytes, nil
+}
+
+/**
+Fetch list of offers for a user. args[0] optionally restricts the list to a property ad
+**/
+func GetOffers(stub *shim.ChaincodeStub, callerId string, callerAffiliation int, args []string) ([]byte, error) {
+	fmt.Println("Entering GetOffers")
+
+	var ids []string
+	var err error
+
+	if len(args) > 0 && len(strings.TrimSpace(args[0])) > 0 {
+		ids, err = GetIndexEntries(stub, offerPropertyAdIndex, args[0])
+	} else if callerAffiliation == BUYER_A {
+		ids, err = GetIndexEntries(stub, offerBuyerIndex, callerId)
+	} else if callerAffiliation == SELLER_A {
+		ids, err = GetIndexEntries(stub, offerSellerIndex, callerId)
+	} else {
+		return nil, errors.New("GetOffers: callerId " + callerId + " cannot access offers")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	offers := []Offer{}
+	for _, id := range ids {
+		offer, _, err := GetOffer(stub, callerId, callerAffiliation, []string{id})
+		if err != nil {
+			//Offers on a property ad are only visible to their own parties
+			continue
+		}
+		offers = append(offers, offer)
+	}
+
+	bytes, err := json.Marshal(&offers)
+	if err != nil {
+		fmt.Println("GetOffers: Could not marshal offers ", err)
+		return nil, err
+	}
+
+	return bytes, nil
+}
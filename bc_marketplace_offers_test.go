@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCloseCompetingOffer(t *testing.T) {
+	txTime := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		name       string
+		status     string
+		expiresAt  string
+		wantStatus string
+	}{
+		{"open and not expired", OFFER_SUBMITTED, "2026-03-02 00:00:00", OFFER_REJECTED},
+		{"countered and not expired", OFFER_COUNTERED, "2026-03-01 12:00:00", OFFER_REJECTED},
+		{"open and past expiry", OFFER_SUBMITTED, "2026-02-28 00:00:00", OFFER_EXPIRED},
+		{"countered and past expiry", OFFER_COUNTERED, "2026-03-01 11:59:59", OFFER_EXPIRED},
+	}
+
+	for _, c := range cases {
+		other := Offer{ID: "offer2", Status: c.status, ExpiresAt: c.expiresAt, AwaitingResponseFrom: "seller1"}
+		msg := closeCompetingOffer(&other, "offer1", txTime)
+		if other.Status != c.wantStatus {
+			t.Errorf("%s: status is %s, want %s", c.name, other.Status, c.wantStatus)
+		}
+		if other.AwaitingResponseFrom != "" {
+			t.Errorf("%s: still awaiting a response from %s", c.name, other.AwaitingResponseFrom)
+		}
+		if len(msg) == 0 {
+			t.Errorf("%s: no log message", c.name)
+		}
+	}
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+/**
+An appraiser on a bank's panel. Conflicts lists the users the appraiser must not
+appraise for, e.g. relatives or past clients
+**/
+type PanelAppraiser struct {
+	AppraiserId string   `json:"appraiserId"`
+	Active      bool     `json:"active"`
+	Conflicts   []string `json:"conflicts"`
+	Fee         Money    `json:"fee"`
+	Assignments int      `json:"assignments"`
+}
+
+//Hours before a registered panel is used for assignments, so a bank cannot change its
+//panel just before it assigns an appraiser
+const PANEL_CHANGE_DELAY_HOURS int = 72
+
+/**
+A bank's appraiser panel for a region, the jurisdiction of the properties it appraises.
+Appraisers are assigned from Appraisers. A registered panel waits in PendingAppraisers
+until PendingEffectiveAt
+**/
+type AppraiserPanel struct {
+	BankId             string           `json:"bankId"`
+	Region             string           `json:"region"`
+	Appraisers         []PanelAppraiser `json:"appraisers"`
+	PendingAppraisers  []PanelAppraiser `json:"pendingAppraisers"`
+	PendingEffectiveAt string           `json:"pendingEffectiveAt"`
+	LastModifiedDate   string           `json:"lastModifiedDate"`
+}
+
+type AppraiserPanelSchema struct {
+	Region     string           `json:"region"`
+	Appraisers []PanelAppraiser `json:"appraisers"`
+}
+
+func normalizeRegion(region string) string {
+	return strings.ToLower(strings.TrimSpace(region))
+}
+
+func panelId(bankId string, region string) string {
+	return bankId + ":" + normalizeRegion(region)
+}
+
+/**
+Reads the appraiser panel of a bank for a region
+**/
+func LoadAppraiserPanel(stub *shim.ChaincodeStub, bankId string, region string) (AppraiserPanel, error) {
+	var panel AppraiserPanel
+
+	key, err := GetStateKey(panelId(bankId, region), PANEL)
+	if err != nil {
+		return panel, err
+	}
+
+	bytes, err := stub.GetState(key)
+	if err != nil {
+		fmt.Println("LoadAppraiserPanel: Could not fetch panel "+key, err)
+		return panel, err
+	}
+	if len(bytes) == 0 {
+		return panel, errors.New("Bank " + bankId + " has no appraiser panel for region " + region)
+	}
+
+	err = json.Unmarshal(bytes, &panel)
+	if err != nil {
+		fmt.Println("LoadAppraiserPanel: Could not unmarshal panel "+key, err)
+		return panel, err
+	}
+
+	return panel, nil
+}
+
+/**
+Puts a pending panel into effect once its time has come. Assignment counts of appraisers
+which stay on the panel are kept so the rotation stays fair. Returns true if it did
+**/
+func applyPendingPanel(panel *AppraiserPanel, now time.Time) (bool, error) {
+	if len(panel.PendingEffectiveAt) == 0 {
+		return false, nil
+	}
+	effective, err := time.Parse(dateLayout, panel.PendingEffectiveAt)
+	if err != nil {
+		return false, errors.New("Appraiser panel " + panelId(panel.BankId, panel.Region) + " has an invalid effective date " + panel.PendingEffectiveAt)
+	}
+	if now.Before(effective) {
+		return false, nil
+	}
+
+	appraisers := []PanelAppraiser{}
+	for _, a := range panel.PendingAppraisers {
+		a.Assignments = 0
+		for _, p := range panel.Appraisers {
+			if p.AppraiserId == a.AppraiserId {
+				a.Assignments = p.Assignments
+			}
+		}
+		appraisers = append(appraisers, a)
+	}
+
+	panel.Appraisers = appraisers
+	panel.PendingAppraisers = []PanelAppraiser{}
+	panel.PendingEffectiveAt = ""
+	return true, nil
+}
+
+func SaveAppraiserPanel(stub *shim.ChaincodeStub, panel AppraiserPanel) ([]byte, error) {
+	fmt.Println("Entering SaveAppraiserPanel")
+
+	key, err := GetStateKey(panelId(panel.BankId, panel.Region), PANEL)
+	if err != nil {
+		return nil, err
+	}
+
+	bytes, _ := json.Marshal(&panel)
+	err = stub.PutState(key, bytes)
+	if err != nil {
+		fmt.Println("SaveAppraiserPanel: Could not save panel ", err)
+		return nil, err
+	}
+	return bytes, nil
+}
+
+/**
+Registers or replaces the calling bank's appraiser panel for a region. Every appraiser
+must be a registered appraiser. The panel takes effect PANEL_CHANGE_DELAY_HOURS later and
+until then appraisers are assigned from the panel already in effect. Registering again
+before then replaces the pending panel and restarts the delay.
+args[0] is an AppraiserPanelSchema json string
+**/
+func RegisterAppraiserPanel(stub *shim.ChaincodeStub, callerId string, callerAffiliation int, args []string) ([]byte, error) {
+	fmt.Println("Entering RegisterAppraiserPanel")
+
+	if len(args) < 1 {
+		fmt.Println("RegisterAppraiserPanel: expected 1 argument")
+		return nil, errors.New("Could not register appraiser panel. Invalid input")
+	}
+
+	//A bank only ever registers its own panels
+	err := Authorize(stub, callerId, callerAffiliation, PANEL, OP_UPDATE, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var input AppraiserPanelSchema
+	err = json.Unmarshal([]byte(args[0]), &input)
+	if err != nil {
+		fmt.Println("RegisterAppraiserPanel: Could not unmarshal input ", err)
+		return nil, err
+	}
+
+	region := normalizeRegion(input.Region)
+	if len(region) == 0 {
+		return nil, errors.New("Appraiser panel is missing a region")
+	}
+	if len(input.Appraisers) == 0 {
+		return nil, errors.New("Appraiser panel has no appraisers")
+	}
+
+	txTime, err := GetTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	panel, err := LoadAppraiserPanel(stub, callerId, region)
+	if err != nil {
+		panel = AppraiserPanel{BankId: callerId, Region: region, Appraisers: []PanelAppraiser{}}
+	}
+	_, err = applyPendingPanel(&panel, txTime)
+	if err != nil {
+		return nil, err
+	}
+
+	pending := []PanelAppraiser{}
+	var ids []string
+	for _, a := range input.Appraisers {
+		a.AppraiserId = strings.TrimSpace(a.AppraiserId)
+		if len(a.AppraiserId) == 0 {
+			return nil, errors.New("Appraiser panel entry is missing an appraiser id")
+		}
+		for _, id := range ids {
+			if id == a.AppraiserId {
+				return nil, errors.New("Appraiser " + a.AppraiserId + " is listed more than once")
+			}
+		}
+		ids = append(ids, a.AppraiserId)
+
+		user, err := GetUser(stub, a.AppraiserId)
+		if err != nil || user.Affiliation != APPRAISER_A {
+			return nil, errors.New(a.AppraiserId + " is not a registered appraiser")
+		}
+
+		a.Assignments = 0
+		if !a.Fee.IsZero() {
+			err = a.Fee.Validate()
+			if err != nil {
+				return nil, errors.New("Appraiser " + a.AppraiserId + " fee: " + err.Error())
+			}
+		}
+		if a.Conflicts == nil {
+			a.Conflicts = []string{}
+		}
+		pending = append(pending, a)
+	}
+
+	panel.PendingAppraisers = pending
+	panel.PendingEffectiveAt = txTime.Add(time.Duration(PANEL_CHANGE_DELAY_HOURS) * time.Hour).Format(dateLayout)
+	panel.LastModifiedDate = txTime.Format(dateLayout)
+
+	bytes, err := SaveAppraiserPanel(stub, panel)
+	if err != nil {
+		return nil, err
+	}
+
+	AppendMALog(stub, "RegisterAppraiserPanel", callerId+" registered appraiser panel for "+region+", effective "+panel.PendingEffectiveAt+": "+strings.Join(ids, ", "), "", typePanel+panelId(callerId, region))
+
+	return bytes, nil
+}
+
+/**
+Returns the buyers and seller of the transaction behind a mortgage application. These
+are the parties an appraiser must be independent of
+**/
+func appraisalParties(stub *shim.ChaincodeStub, ma MortgageApplication) []string {
+	parties := ApplicantIds(ma)
+
+	if len(ma.SalesContractId) > 0 {
+		sc, err := LoadSalesContract(stub, ma.SalesContractId)
+		if err == nil && len(sc.SellerId) > 0 {
+			parties = append(parties, sc.SellerId)
+		}
+	}
+
+	if len(ma.PropertyId) > 0 {
+		key, _ := GetStateKey(ma.PropertyId, PROPERTY)
+		bytes, err := stub.GetState(key)
+		if err == nil && len(bytes) > 0 {
+			var property Property
+			if json.Unmarshal(bytes, &property) == nil && len(property.OwnerId) > 0 {
+				parties = append(parties, property.OwnerId)
+			}
+		}
+	}
+
+	return parties
+}
+
+/**
+Returns the reason an appraiser cannot appraise for the given parties, or "" if eligible
+**/
+func appraiserConflict(a PanelAppraiser, parties []string) string {
+	if !a.Active {
+		return "inactive"
+	}
+	for _, party := range parties {
+		if a.AppraiserId == party {
+			return "is a party"
+		}
+		for _, conflict := range a.Conflicts {
+			if conflict == party {
+				return "conflict with " + party
+			}
+		}
+	}
+	return ""
+}
+
+/**
+Picks an appraiser from the panel by rotation. Eligible appraisers with the fewest
+assignments are the candidates and the transaction ID picks among them, so every peer
+makes the same choice while no one can steer it. Appraisers in exclude, e.g. the
+appraiser of a disputed appraisal, are never picked, nor are those in ineligible, which
+maps appraisers to the reason they cannot appraise. Returns the index of the chosen
+appraiser in the panel and the rationale for the log
+**/
+func SelectPanelAppraiser(panel AppraiserPanel, parties []string, exclude []string, ineligible map[string]string, txId string) (int, string, error) {
+	var skipped []string
+	var eligible []int
+	for i, a := range panel.Appraisers {
+		reason := appraiserConflict(a, parties)
+		if len(reason) == 0 && containsString(exclude, a.AppraiserId) {
+			reason = "excluded"
+		}
+		if len(reason) == 0 {
+			reason = ineligible[a.AppraiserId]
+		}
+		if len(reason) > 0 {
+			skipped = append(skipped, a.AppraiserId+" ("+reason+")")
+			continue
+		}
+		eligible = append(eligible, i)
+	}
+
+	if len(eligible) == 0 {
+		return -1, "", errors.New("No eligible appraiser on the " + panel.Region + " panel of bank " + panel.BankId + ". Skipped: " + strings.Join(skipped, ", "))
+	}
+
+	fewest := panel.Appraisers[eligible[0]].Assignments
+	for _, i := range eligible {
+		if panel.Appraisers[i].Assignments < fewest {
+			fewest = panel.Appraisers[i].Assignments
+		}
+	}
+	var candidates []int
+	for _, i := range eligible {
+		if panel.Appraisers[i].Assignments == fewest {
+			candidates = append(candidates, i)
+		}
+	}
+
+	sum := sha256.Sum256([]byte(txId))
+	seed := binary.BigEndian.Uint64(sum[:8])
+	chosen := candidates[seed%uint64(len(candidates))]
+
+	var names []string
+	for _, i := range candidates {
+		names = append(names, panel.Appraisers[i].AppraiserId)
+	}
+	rationale := "Selected " + panel.Appraisers[chosen].AppraiserId + " from the " + panel.Region + " panel of bank " + panel.BankId +
+		". " + strconv.Itoa(len(eligible)) + " of " + strconv.Itoa(len(panel.Appraisers)) + " appraisers eligible" +
+		". Candidates with " + strconv.Itoa(fewest) + " prior assignments: " + strings.Join(names, ", ") +
+		". Rotation seed from transaction " + txId
+	if len(skipped) > 0 {
+		rationale += ". Skipped: " + strings.Join(skipped, ", ")
+	}
+
+	return chosen, rationale, nil
+}
+
+/**
+Assigns an appraiser to an appraiser application from the bank's panel for the region and
+records the assignment against the appraiser. Only active appraisers licensed in the
+state of the property are assigned
+**/
+func AssignPanelAppraiser(stub *shim.ChaincodeStub, aa *AppraiserApplication, ma MortgageApplication, exclude []string) (string, error) {
+	fmt.Println("Entering AssignPanelAppraiser")
+
+	panel, err := LoadAppraiserPanel(stub, aa.ReviewerId, aa.Region)
+	if err != nil {
+		return "", err
+	}
+
+	state := propertyJurisdiction(stub, aa.PropertyId)
+	if len(state) == 0 {
+		return "", errors.New("Property " + aa.PropertyId + " has no jurisdiction to check appraiser licenses against")
+	}
+	txTime, err := GetTxTime(stub)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = applyPendingPanel(&panel, txTime)
+	if err != nil {
+		return "", err
+	}
+	if len(panel.Appraisers) == 0 {
+		return "", errors.New("The " + panel.Region + " panel of bank " + panel.BankId + " takes effect " + panel.PendingEffectiveAt)
+	}
+
+	ineligible := unlicensedAppraisers(stub, panel, state, txTime)
+	for id, reason := range inactiveAppraisers(stub, panel) {
+		ineligible[id] = reason
+	}
+
+	chosen, rationale, err := SelectPanelAppraiser(panel, appraisalParties(stub, ma), exclude, ineligible, stub.UUID)
+	if err != nil {
+		return "", err
+	}
+
+	aa.AppraiserId = panel.Appraisers[chosen].AppraiserId
+	aa.FeeQuote = panel.Appraisers[chosen].Fee
+	if !aa.FeeQuote.IsZero() {
+		rationale += ". Fee quoted " + aa.FeeQuote.String()
+	}
+	aa.AssignmentRationale = rationale
+
+	panel.Appraisers[chosen].Assignments++
+	_, err = SaveAppraiserPanel(stub, panel)
+	if err != nil {
+		return "", err
+	}
+
+	return rationale, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import "testing"
+
+func TestSelectPanelAppraiser(t *testing.T) {
+	panel := AppraiserPanel{
+		BankId: "bank1",
+		Region: "CA",
+		Appraisers: []PanelAppraiser{
+			{AppraiserId: "aa1", Active: true, Assignments: 2},
+			{AppraiserId: "aa2", Active: true, Assignments: 1, Conflicts: []string{"seller1"}},
+			{AppraiserId: "aa3", Active: true, Assignments: 1},
+			{AppraiserId: "aa4", Active: true, Assignments: 1},
+			{AppraiserId: "aa5", Active: true, Assignments: 0},
+		},
+	}
+	parties := []string{"buyer1", "seller1", "bank1"}
+
+	cases := []struct {
+		name       string
+		exclude    []string
+		ineligible map[string]string
+		want       []string
+	}{
+		{"fewest assignments wins", nil, nil, []string{"aa5"}},
+		{"conflicted appraiser is skipped", []string{"aa5"}, nil, []string{"aa3", "aa4"}},
+		{"excluded and ineligible are skipped", []string{"aa5"}, map[string]string{"aa3": "not licensed in CA"}, []string{"aa4"}},
+		{"only busier appraisers left", []string{"aa5", "aa4"}, map[string]string{"aa3": "inactive"}, []string{"aa1"}},
+		{"nobody eligible", []string{"aa1", "aa5"}, map[string]string{"aa3": "inactive", "aa4": "inactive"}, nil},
+	}
+
+	for _, c := range cases {
+		for _, txId := range []string{"tx1", "tx2", "tx3", "tx4"} {
+			chosen, rationale, err := SelectPanelAppraiser(panel, parties, c.exclude, c.ineligible, txId)
+			if len(c.want) == 0 {
+				if err == nil {
+					t.Errorf("%s: expected an error, chose %d", c.name, chosen)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", c.name, err)
+				continue
+			}
+			if !containsString(c.want, panel.Appraisers[chosen].AppraiserId) {
+				t.Errorf("%s: chose %s, want one of %v", c.name, panel.Appraisers[chosen].AppraiserId, c.want)
+			}
+			if len(rationale) == 0 {
+				t.Errorf("%s: no rationale", c.name)
+			}
+
+			again, _, _ := SelectPanelAppraiser(panel, parties, c.exclude, c.ineligible, txId)
+			if again != chosen {
+				t.Errorf("%s: transaction %s chose %d then %d", c.name, txId, chosen, again)
+			}
+		}
+	}
+}
+
+func TestSelectPanelAppraiserSkipsParties(t *testing.T) {
+	panel := AppraiserPanel{BankId: "bank1", Region: "CA", Appraisers: []PanelAppraiser{
+		{AppraiserId: "seller1", Active: true},
+		{AppraiserId: "aa2", Active: true, Assignments: 5},
+	}}
+
+	chosen, _, err := SelectPanelAppraiser(panel, []string{"buyer1", "seller1"}, nil, nil, "tx1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if panel.Appraisers[chosen].AppraiserId != "aa2" {
+		t.Errorf("chose %s, a party to the sale", panel.Appraisers[chosen].AppraiserId)
+	}
+}
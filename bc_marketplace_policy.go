@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//Operations on a record
+const OP_CREATE string = "create"
+const OP_READ string = "read"
+const OP_UPDATE string = "update"
+const OP_RESPOND string = "respond to"
+const OP_ATTACH string = "attach documents to"
+const OP_LOCK_RATE string = "lock a rate on"
+const OP_ROTATE_KEY string = "rotate the key of"
+const OP_UNMASK string = "unmask"
+const OP_REQUEST_ERASURE string = "request erasure on"
+const OP_DECIDE_ERASURE string = "decide erasure on"
+const OP_DISPUTE string = "dispute the value of"
+const OP_CONTINGENCY string = "change the contingencies of"
+
+//How a caller is related to a record
+const REL_ANY string = "any"
+const REL_APPLICANT string = "applicant"
+const REL_REVIEWER string = "reviewer"
+const REL_APPRAISER string = "appraiser"
+const REL_PARTY string = "party"
+const REL_BUYER string = "buyer"
+const REL_BORROWER string = "borrower"
+const REL_LENDER string = "lender"
+const REL_ESCROW_AGENT string = "escrowAgent"
+const REL_SUBJECT string = "subject"
+
+/**
+Allows callers of an affiliation to perform an operation on a type of record when they
+have the relationship to the record
+**/
+type PolicyRule struct {
+	Affiliation  int
+	ObjectType   int
+	Operation    string
+	Relationship string
+}
+
+/**
+Who can do what. Anything not listed is denied. For create the relationship is to the
+record the new one belongs to, e.g. the mortgage application of an appraiser application.
+Records kept per user and only ever read or written by that user, such as rate sheets,
+profiles and account status, and the admin, regulator and audit log functions check the
+caller's affiliation themselves instead
+**/
+var policyTable = []PolicyRule{
+	{BUYER_A, MORTGAGEAPPLICATION, OP_CREATE, REL_ANY},
+	{BUYER_A, MORTGAGEAPPLICATION, OP_READ, REL_APPLICANT},
+	{BANK_A, MORTGAGEAPPLICATION, OP_READ, REL_REVIEWER},
+	{BANK_A, MORTGAGEAPPLICATION, OP_UPDATE, REL_REVIEWER},
+	{APPRAISER_A, MORTGAGEAPPLICATION, OP_READ, REL_APPRAISER},
+	{AUDITOR_A, MORTGAGEAPPLICATION, OP_READ, REL_ANY},
+	{BUYER_A, MORTGAGEAPPLICATION, OP_ATTACH, REL_APPLICANT},
+	{BANK_A, MORTGAGEAPPLICATION, OP_ATTACH, REL_REVIEWER},
+	{APPRAISER_A, MORTGAGEAPPLICATION, OP_ATTACH, REL_APPRAISER},
+	{BUYER_A, MORTGAGEAPPLICATION, OP_LOCK_RATE, REL_APPLICANT},
+	{BUYER_A, MORTGAGEAPPLICATION, OP_ROTATE_KEY, REL_APPLICANT},
+	{BANK_A, MORTGAGEAPPLICATION, OP_ROTATE_KEY, REL_REVIEWER},
+	{AUDITOR_A, MORTGAGEAPPLICATION, OP_UNMASK, REL_ANY},
+	{BUYER_A, MORTGAGEAPPLICATION, OP_REQUEST_ERASURE, REL_APPLICANT},
+	{BANK_A, MORTGAGEAPPLICATION, OP_DECIDE_ERASURE, REL_REVIEWER},
+	{BANK_A, MORTGAGEAPPLICATION, OP_DISPUTE, REL_REVIEWER},
+
+	{BANK_A, APPRAISERAPPLICATION, OP_CREATE, REL_REVIEWER},
+	{BANK_A, APPRAISERAPPLICATION, OP_READ, REL_REVIEWER},
+	{APPRAISER_A, APPRAISERAPPLICATION, OP_READ, REL_APPRAISER},
+	{APPRAISER_A, APPRAISERAPPLICATION, OP_UPDATE, REL_APPRAISER},
+	{AUDITOR_A, APPRAISERAPPLICATION, OP_READ, REL_ANY},
+	{BANK_A, APPRAISERAPPLICATION, OP_DISPUTE, REL_REVIEWER},
+	{APPRAISER_A, APPRAISERAPPLICATION, OP_RESPOND, REL_APPRAISER},
+
+	{BUYER_A, SALESCONTRACT, OP_CREATE, REL_ANY},
+	{BUYER_A, SALESCONTRACT, OP_READ, REL_PARTY},
+	{BUYER_A, SALESCONTRACT, OP_UPDATE, REL_PARTY},
+	{SELLER_A, SALESCONTRACT, OP_READ, REL_PARTY},
+	{SELLER_A, SALESCONTRACT, OP_UPDATE, REL_PARTY},
+	{BANK_A, SALESCONTRACT, OP_READ, REL_REVIEWER},
+	{AUDITOR_A, SALESCONTRACT, OP_READ, REL_ANY},
+	{BUYER_A, SALESCONTRACT, OP_CONTINGENCY, REL_BUYER},
+
+	{BUYER_A, OFFER, OP_CREATE, REL_ANY},
+	{BUYER_A, OFFER, OP_READ, REL_PARTY},
+	{SELLER_A, OFFER, OP_READ, REL_PARTY},
+	{BANK_A, OFFER, OP_READ, REL_REVIEWER},
+	{AUDITOR_A, OFFER, OP_READ, REL_ANY},
+	{BUYER_A, OFFER, OP_RESPOND, REL_PARTY},
+	{SELLER_A, OFFER, OP_RESPOND, REL_PARTY},
+
+	{ESCROW_A, ESCROW, OP_CREATE, REL_ANY},
+	{ESCROW_A, ESCROW, OP_READ, REL_ESCROW_AGENT},
+	{ESCROW_A, ESCROW, OP_UPDATE, REL_ESCROW_AGENT},
+	{BUYER_A, ESCROW, OP_READ, REL_PARTY},
+	{SELLER_A, ESCROW, OP_READ, REL_PARTY},
+	{BANK_A, ESCROW, OP_READ, REL_LENDER},
+	{AUDITOR_A, ESCROW, OP_READ, REL_ANY},
+
+	{BANK_A, LOAN, OP_CREATE, REL_REVIEWER},
+	{BANK_A, LOAN, OP_READ, REL_LENDER},
+	{BANK_A, LOAN, OP_UPDATE, REL_LENDER},
+	{BUYER_A, LOAN, OP_READ, REL_BORROWER},
+	{AUDITOR_A, LOAN, OP_READ, REL_ANY},
+
+	{KYC_A, KYC, OP_UPDATE, REL_ANY},
+	{KYC_A, KYC, OP_READ, REL_ANY},
+	{BUYER_A, KYC, OP_READ, REL_SUBJECT},
+	{SELLER_A, KYC, OP_READ, REL_SUBJECT},
+	{BANK_A, KYC, OP_READ, REL_REVIEWER},
+	{AUDITOR_A, KYC, OP_READ, REL_ANY},
+	{BANK_A, KYCPOLICY, OP_UPDATE, REL_ANY},
+
+	{APPRAISER_A, INVOICE, OP_READ, REL_APPRAISER},
+	{BANK_A, INVOICE, OP_READ, REL_REVIEWER},
+	{BANK_A, INVOICE, OP_UPDATE, REL_REVIEWER},
+	{AUDITOR_A, INVOICE, OP_READ, REL_ANY},
+
+	{BANK_A, PANEL, OP_UPDATE, REL_ANY},
+
+	{LICENSING_A, LICENSE, OP_UPDATE, REL_ANY},
+
+	{BANK_A, LENDINGREPORT, OP_READ, REL_LENDER},
+	{AUDITOR_A, LENDINGREPORT, OP_READ, REL_ANY},
+}
+
+var objectTypeNames = map[int]string{
+	MORTGAGEAPPLICATION:  "mortgage application",
+	APPRAISERAPPLICATION: "appraiser application",
+	SALESCONTRACT:        "sales contract",
+	OFFER:                "offer",
+	ESCROW:               "escrow",
+	LOAN:                 "loan",
+	KYC:                  "KYC record",
+	KYCPOLICY:            "KYC policy",
+	INVOICE:              "invoice",
+	PANEL:                "appraiser panel",
+	LICENSE:              "license",
+	LENDINGREPORT:        "lending report",
+}
+
+/**
+Reads a mortgage application from the ledger without any access checks
+**/
+func LoadMortgageApplication(stub *shim.ChaincodeStub, id string) (MortgageApplication, error) {
+	var ma MortgageApplication
+
+	key, err := GetStateKey(id, MORTGAGEAPPLICATION)
+	if err != nil {
+		return ma, err
+	}
+
+	bytes, err := stub.GetState(key)
+	if err != nil {
+		fmt.Println("LoadMortgageApplication: Could not fetch mortgageApplication with ID : "+id, err)
+		return ma, err
+	}
+	if len(bytes) == 0 {
+		return ma, errors.New("Mortgage application with id " + id + " does not exist")
+	}
+
+	err = json.Unmarshal(bytes, &ma)
+	if err != nil {
+		fmt.Println("LoadMortgageApplication: Could not unmarshal mortgageApplication with ID : "+id, err)
+		return ma, err
+	}
+
+	return ma, nil
+}
+
+/**
+Reads an appraiser application from the ledger without any access checks
+**/
+func LoadAppraiserApplication(stub *shim.ChaincodeStub, id string) (AppraiserApplication, error) {
+	var aa AppraiserApplication
+
+	key, err := GetStateKey(id, APPRAISERAPPLICATION)
+	if err != nil {
+		return aa, err
+	}
+
+	bytes, err := stub.GetState(key)
+	if err != nil {
+		fmt.Println("LoadAppraiserApplication: Could not fetch appraiserApplication with ID : "+id, err)
+		return aa, err
+	}
+	if len(bytes) == 0 {
+		return aa, errors.New("Appraiser application with id " + id + " does not exist")
+	}
+
+	err = json.Unmarshal(bytes, &aa)
+	if err != nil {
+		fmt.Println("LoadAppraiserApplication: Could not unmarshal appraiserApplication with ID : "+id, err)
+		return aa, err
+	}
+
+	return aa, nil
+}
+
+/**
+Returns the id of a record and the relationships of the caller to it which can be told
+from the record alone
+**/
+func relationshipsTo(callerId string, object interface{}) (string, []string) {
+	relationships := []string{REL_ANY}
+	if len(callerId) == 0 {
+		return "", relationships
+	}
+
+	switch o := object.(type) {
+	case MortgageApplication:
+		if IsMortgageApplicant(o, callerId) {
+			relationships = append(relationships, REL_APPLICANT)
+		}
+		if callerId == o.ReviewerId {
+			relationships = append(relationships, REL_REVIEWER)
+		}
+		return o.ID, relationships
+	case AppraiserApplication:
+		if callerId == o.ReviewerId {
+			relationships = append(relationships, REL_REVIEWER)
+		}
+		if callerId == o.AppraiserId {
+			relationships = append(relationships, REL_APPRAISER)
+		}
+		return o.ID, relationships
+	case SalesContract:
+		if callerId == o.BuyerId || callerId == o.SellerId {
+			relationships = append(relationships, REL_PARTY)
+		}
+		if callerId == o.BuyerId {
+			relationships = append(relationships, REL_BUYER)
+		}
+		if callerId == o.ReviewerId {
+			relationships = append(relationships, REL_REVIEWER)
+		}
+		return o.ID, relationships
+	case Offer:
+		if callerId == o.BuyerId || callerId == o.SellerId {
+			relationships = append(relationships, REL_PARTY)
+		}
+		if callerId == o.ReviewerId {
+			relationships = append(relationships, REL_REVIEWER)
+		}
+		return o.ID, relationships
+	case Escrow:
+		if callerId == o.EscrowAgentId {
+			relationships = append(relationships, REL_ESCROW_AGENT)
+		}
+		if callerId == o.BuyerId || callerId == o.SellerId {
+			relationships = append(relationships, REL_PARTY)
+		}
+		if callerId == o.BankId {
+			relationships = append(relationships, REL_LENDER)
+		}
+		return o.ID, relationships
+	case Loan:
+		if IsLoanBorrower(o, callerId) {
+			relationships = append(relationships, REL_BORROWER)
+		}
+		if callerId == o.BankId {
+			relationships = append(relationships, REL_LENDER)
+		}
+		return o.ID, relationships
+	case KycRecord:
+		if callerId == o.UserId {
+			relationships = append(relationships, REL_SUBJECT)
+		}
+		return o.UserId, relationships
+	case AppraisalInvoice:
+		if callerId == o.AppraiserId {
+			relationships = append(relationships, REL_APPRAISER)
+		}
+		if callerId == o.BankId {
+			relationships = append(relationships, REL_REVIEWER)
+		}
+		return o.ID, relationships
+	case LendingReport:
+		if callerId == o.BankId {
+			relationships = append(relationships, REL_LENDER)
+		}
+		return o.BankId, relationships
+	}
+
+	return "", relationships
+}
+
+/**
+Returns the id of a record and the relationships of the caller to it, including the
+appraiser of a mortgage application's linked appraiser application and the bank reviewing
+the applications or contracts of the subject of a KYC record
+**/
+func callerRelationships(stub *shim.ChaincodeStub, callerId string, object interface{}) (string, []string) {
+	id, relationships := relationshipsTo(callerId, object)
+
+	if ma, ok := object.(MortgageApplication); ok && len(callerId) > 0 && isLinkedAppraiser(stub, ma, callerId) {
+		relationships = append(relationships, REL_APPRAISER)
+	}
+	if record, ok := object.(KycRecord); ok && len(callerId) > 0 && isReviewerOfUser(stub, callerId, record.UserId) {
+		relationships = append(relationships, REL_REVIEWER)
+	}
+	return id, relationships
+}
+
+/**
+Returns true if a rule for the affiliation, the type of record and the operation matches
+one of the relationships
+**/
+func policyAllows(callerAffiliation int, objectType int, operation string, relationships []string) bool {
+	for _, rule := range policyTable {
+		if rule.Affiliation != callerAffiliation || rule.ObjectType != objectType || rule.Operation != operation {
+			continue
+		}
+		if containsString(relationships, rule.Relationship) {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+Checks the policy table. Returns an error unless a rule for the caller's affiliation,
+the type of record and the operation matches one of the caller's relationships to the record
+**/
+func Authorize(stub *shim.ChaincodeStub, callerId string, callerAffiliation int, objectType int, operation string, object interface{}) error {
+	id, relationships := callerRelationships(stub, callerId, object)
+
+	if policyAllows(callerAffiliation, objectType, operation, relationships) {
+		return nil
+	}
+
+	fmt.Println("Authorize: " + callerId + " with affiliation " + strconv.Itoa(callerAffiliation) + " cannot " + operation + " " + objectTypeNames[objectType] + " " + id)
+	return errors.New("User " + callerId + " does not have rights to " + operation + " " + objectTypeNames[objectType] + " " + id)
+}
@@ -0,0 +1,283 @@
+package main
+
+import "testing"
+
+var policyAffiliations = []int{BUYER_A, SELLER_A, BANK_A, APPRAISER_A, AUDITOR_A, ESCROW_A, KYC_A, REGULATOR_A, ADMIN_A, LICENSING_A}
+
+var policyOperations = []string{OP_CREATE, OP_READ, OP_UPDATE, OP_RESPOND, OP_ATTACH, OP_LOCK_RATE, OP_ROTATE_KEY, OP_UNMASK, OP_REQUEST_ERASURE, OP_DECIDE_ERASURE, OP_DISPUTE, OP_CONTINGENCY}
+
+func policyRecords() map[int]interface{} {
+	ma := MortgageApplication{ID: "ma1", BuyerId: "buyer1", ReviewerId: "bank1"}
+	ma.CoApplicants = []CoApplicant{{BuyerId: "buyer2", Consented: true}, {BuyerId: "buyer3"}}
+
+	return map[int]interface{}{
+		MORTGAGEAPPLICATION:  ma,
+		APPRAISERAPPLICATION: AppraiserApplication{ID: "aa1", ReviewerId: "bank1", AppraiserId: "appraiser1"},
+		SALESCONTRACT:        SalesContract{ID: "sc1", BuyerId: "buyer1", SellerId: "seller1", ReviewerId: "bank1"},
+		OFFER:                Offer{ID: "offer1", BuyerId: "buyer1", SellerId: "seller1", ReviewerId: "bank1"},
+		ESCROW:               Escrow{ID: "escrow1", EscrowAgentId: "escrow1", BuyerId: "buyer1", SellerId: "seller1", BankId: "bank1"},
+		LOAN:                 Loan{ID: "loan1", BuyerId: "buyer1", CoBorrowerIds: []string{"buyer2"}, BankId: "bank1"},
+		KYC:                  KycRecord{UserId: "buyer1"},
+		KYCPOLICY:            nil,
+		INVOICE:              AppraisalInvoice{ID: "invoice1", AppraiserId: "appraiser1", BankId: "bank1"},
+		PANEL:                nil,
+		LICENSE:              nil,
+		LENDINGREPORT:        LendingReport{BankId: "bank1"},
+	}
+}
+
+func allowed(callerId string, callerAffiliation int, objectType int, operation string) bool {
+	_, relationships := relationshipsTo(callerId, policyRecords()[objectType])
+	return policyAllows(callerAffiliation, objectType, operation, relationships)
+}
+
+func TestPolicyRelatedCallers(t *testing.T) {
+	cases := []struct {
+		name        string
+		callerId    string
+		affiliation int
+		objectType  int
+		operation   string
+		want        bool
+	}{
+		{"applicant reads mortgage application", "buyer1", BUYER_A, MORTGAGEAPPLICATION, OP_READ, true},
+		{"consented co-applicant reads mortgage application", "buyer2", BUYER_A, MORTGAGEAPPLICATION, OP_READ, true},
+		{"pending co-applicant cannot read mortgage application", "buyer3", BUYER_A, MORTGAGEAPPLICATION, OP_READ, false},
+		{"other buyer cannot read mortgage application", "buyer9", BUYER_A, MORTGAGEAPPLICATION, OP_READ, false},
+		{"reviewer updates mortgage application", "bank1", BANK_A, MORTGAGEAPPLICATION, OP_UPDATE, true},
+		{"other bank cannot update mortgage application", "bank9", BANK_A, MORTGAGEAPPLICATION, OP_UPDATE, false},
+		{"applicant cannot update mortgage application", "buyer1", BUYER_A, MORTGAGEAPPLICATION, OP_UPDATE, false},
+		{"applicant attaches documents", "buyer1", BUYER_A, MORTGAGEAPPLICATION, OP_ATTACH, true},
+		{"reviewer attaches documents", "bank1", BANK_A, MORTGAGEAPPLICATION, OP_ATTACH, true},
+		{"auditor cannot attach documents", "auditor1", AUDITOR_A, MORTGAGEAPPLICATION, OP_ATTACH, false},
+		{"applicant locks rate", "buyer1", BUYER_A, MORTGAGEAPPLICATION, OP_LOCK_RATE, true},
+		{"reviewer cannot lock rate", "bank1", BANK_A, MORTGAGEAPPLICATION, OP_LOCK_RATE, false},
+		{"applicant rotates key", "buyer1", BUYER_A, MORTGAGEAPPLICATION, OP_ROTATE_KEY, true},
+		{"reviewer rotates key", "bank1", BANK_A, MORTGAGEAPPLICATION, OP_ROTATE_KEY, true},
+		{"auditor unmasks", "auditor1", AUDITOR_A, MORTGAGEAPPLICATION, OP_UNMASK, true},
+		{"reviewer cannot unmask", "bank1", BANK_A, MORTGAGEAPPLICATION, OP_UNMASK, false},
+		{"applicant requests erasure", "buyer1", BUYER_A, MORTGAGEAPPLICATION, OP_REQUEST_ERASURE, true},
+		{"reviewer cannot request erasure", "bank1", BANK_A, MORTGAGEAPPLICATION, OP_REQUEST_ERASURE, false},
+		{"reviewer decides erasure", "bank1", BANK_A, MORTGAGEAPPLICATION, OP_DECIDE_ERASURE, true},
+		{"applicant cannot decide erasure", "buyer1", BUYER_A, MORTGAGEAPPLICATION, OP_DECIDE_ERASURE, false},
+		{"reviewer selects appraised value", "bank1", BANK_A, MORTGAGEAPPLICATION, OP_DISPUTE, true},
+		{"buyer creates mortgage application", "buyer9", BUYER_A, MORTGAGEAPPLICATION, OP_CREATE, true},
+		{"bank cannot create mortgage application", "bank1", BANK_A, MORTGAGEAPPLICATION, OP_CREATE, false},
+
+		{"reviewer reads appraiser application", "bank1", BANK_A, APPRAISERAPPLICATION, OP_READ, true},
+		{"appraiser updates appraiser application", "appraiser1", APPRAISER_A, APPRAISERAPPLICATION, OP_UPDATE, true},
+		{"other appraiser cannot update appraiser application", "appraiser9", APPRAISER_A, APPRAISERAPPLICATION, OP_UPDATE, false},
+		{"reviewer cannot update appraiser application", "bank1", BANK_A, APPRAISERAPPLICATION, OP_UPDATE, false},
+		{"reviewer disputes appraisal", "bank1", BANK_A, APPRAISERAPPLICATION, OP_DISPUTE, true},
+		{"appraiser cannot dispute appraisal", "appraiser1", APPRAISER_A, APPRAISERAPPLICATION, OP_DISPUTE, false},
+		{"appraiser responds to reconsideration", "appraiser1", APPRAISER_A, APPRAISERAPPLICATION, OP_RESPOND, true},
+		{"reviewer cannot respond to reconsideration", "bank1", BANK_A, APPRAISERAPPLICATION, OP_RESPOND, false},
+
+		{"buyer updates sales contract", "buyer1", BUYER_A, SALESCONTRACT, OP_UPDATE, true},
+		{"seller updates sales contract", "seller1", SELLER_A, SALESCONTRACT, OP_UPDATE, true},
+		{"other seller cannot read sales contract", "seller9", SELLER_A, SALESCONTRACT, OP_READ, false},
+		{"reviewer reads sales contract", "bank1", BANK_A, SALESCONTRACT, OP_READ, true},
+		{"reviewer cannot update sales contract", "bank1", BANK_A, SALESCONTRACT, OP_UPDATE, false},
+		{"buyer changes contingencies", "buyer1", BUYER_A, SALESCONTRACT, OP_CONTINGENCY, true},
+		{"seller cannot change contingencies", "seller1", SELLER_A, SALESCONTRACT, OP_CONTINGENCY, false},
+		{"other buyer cannot change contingencies", "buyer9", BUYER_A, SALESCONTRACT, OP_CONTINGENCY, false},
+
+		{"buyer creates offer", "buyer9", BUYER_A, OFFER, OP_CREATE, true},
+		{"seller cannot create offer", "seller1", SELLER_A, OFFER, OP_CREATE, false},
+		{"buyer responds to offer", "buyer1", BUYER_A, OFFER, OP_RESPOND, true},
+		{"seller responds to offer", "seller1", SELLER_A, OFFER, OP_RESPOND, true},
+		{"other buyer cannot respond to offer", "buyer9", BUYER_A, OFFER, OP_RESPOND, false},
+		{"reviewer reads offer", "bank1", BANK_A, OFFER, OP_READ, true},
+		{"reviewer cannot respond to offer", "bank1", BANK_A, OFFER, OP_RESPOND, false},
+		{"auditor reads offer", "auditor1", AUDITOR_A, OFFER, OP_READ, true},
+
+		{"escrow agent opens escrow", "escrow9", ESCROW_A, ESCROW, OP_CREATE, true},
+		{"bank cannot open escrow", "bank1", BANK_A, ESCROW, OP_CREATE, false},
+		{"escrow agent updates escrow", "escrow1", ESCROW_A, ESCROW, OP_UPDATE, true},
+		{"other escrow agent cannot update escrow", "escrow9", ESCROW_A, ESCROW, OP_UPDATE, false},
+		{"buyer reads escrow", "buyer1", BUYER_A, ESCROW, OP_READ, true},
+		{"buyer cannot update escrow", "buyer1", BUYER_A, ESCROW, OP_UPDATE, false},
+		{"lender reads escrow", "bank1", BANK_A, ESCROW, OP_READ, true},
+		{"other bank cannot read escrow", "bank9", BANK_A, ESCROW, OP_READ, false},
+
+		{"borrower reads loan", "buyer1", BUYER_A, LOAN, OP_READ, true},
+		{"co-borrower reads loan", "buyer2", BUYER_A, LOAN, OP_READ, true},
+		{"other buyer cannot read loan", "buyer9", BUYER_A, LOAN, OP_READ, false},
+		{"lender records payments", "bank1", BANK_A, LOAN, OP_UPDATE, true},
+		{"other bank cannot record payments", "bank9", BANK_A, LOAN, OP_UPDATE, false},
+		{"borrower cannot record payments", "buyer1", BUYER_A, LOAN, OP_UPDATE, false},
+		{"auditor reads loan", "auditor1", AUDITOR_A, LOAN, OP_READ, true},
+
+		{"subject reads own KYC record", "buyer1", BUYER_A, KYC, OP_READ, true},
+		{"other buyer cannot read KYC record", "buyer9", BUYER_A, KYC, OP_READ, false},
+		{"bank without an application of the subject cannot read KYC record", "bank9", BANK_A, KYC, OP_READ, false},
+		{"KYC provider records verification", "kyc1", KYC_A, KYC, OP_UPDATE, true},
+		{"subject cannot record verification", "buyer1", BUYER_A, KYC, OP_UPDATE, false},
+		{"bank sets KYC policy", "bank1", BANK_A, KYCPOLICY, OP_UPDATE, true},
+		{"buyer cannot set KYC policy", "buyer1", BUYER_A, KYCPOLICY, OP_UPDATE, false},
+
+		{"appraiser reads own invoice", "appraiser1", APPRAISER_A, INVOICE, OP_READ, true},
+		{"other appraiser cannot read invoice", "appraiser9", APPRAISER_A, INVOICE, OP_READ, false},
+		{"billed bank acknowledges payment", "bank1", BANK_A, INVOICE, OP_UPDATE, true},
+		{"other bank cannot acknowledge payment", "bank9", BANK_A, INVOICE, OP_UPDATE, false},
+		{"appraiser cannot acknowledge payment", "appraiser1", APPRAISER_A, INVOICE, OP_UPDATE, false},
+
+		{"bank registers its panel", "bank1", BANK_A, PANEL, OP_UPDATE, true},
+		{"appraiser cannot register a panel", "appraiser1", APPRAISER_A, PANEL, OP_UPDATE, false},
+
+		{"licensing authority records license", "licensing1", LICENSING_A, LICENSE, OP_UPDATE, true},
+		{"appraiser cannot record license", "appraiser1", APPRAISER_A, LICENSE, OP_UPDATE, false},
+
+		{"bank reads its lending report", "bank1", BANK_A, LENDINGREPORT, OP_READ, true},
+		{"other bank cannot read lending report", "bank9", BANK_A, LENDINGREPORT, OP_READ, false},
+		{"auditor reads lending report", "auditor1", AUDITOR_A, LENDINGREPORT, OP_READ, true},
+	}
+
+	for _, c := range cases {
+		if got := allowed(c.callerId, c.affiliation, c.objectType, c.operation); got != c.want {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+//What a caller with no relationship to a record may do, by type of record and affiliation.
+//Every other combination is denied
+var unrelatedCallerGrants = map[int]map[int][]string{
+	MORTGAGEAPPLICATION:  {BUYER_A: {OP_CREATE}, AUDITOR_A: {OP_READ, OP_UNMASK}},
+	APPRAISERAPPLICATION: {AUDITOR_A: {OP_READ}},
+	SALESCONTRACT:        {BUYER_A: {OP_CREATE}, AUDITOR_A: {OP_READ}},
+	OFFER:                {BUYER_A: {OP_CREATE}, AUDITOR_A: {OP_READ}},
+	ESCROW:               {ESCROW_A: {OP_CREATE}, AUDITOR_A: {OP_READ}},
+	LOAN:                 {AUDITOR_A: {OP_READ}},
+	KYC:                  {KYC_A: {OP_READ, OP_UPDATE}, AUDITOR_A: {OP_READ}},
+	KYCPOLICY:            {BANK_A: {OP_UPDATE}},
+	INVOICE:              {AUDITOR_A: {OP_READ}},
+	PANEL:                {BANK_A: {OP_UPDATE}},
+	LICENSE:              {LICENSING_A: {OP_UPDATE}},
+	LENDINGREPORT:        {AUDITOR_A: {OP_READ}},
+}
+
+func TestPolicyUnrelatedCallers(t *testing.T) {
+	for objectType := range policyRecords() {
+		if _, ok := unrelatedCallerGrants[objectType]; !ok {
+			t.Errorf("no expected grants for %s", objectTypeNames[objectType])
+		}
+		for _, affiliation := range policyAffiliations {
+			for _, operation := range policyOperations {
+				want := containsString(unrelatedCallerGrants[objectType][affiliation], operation)
+				if got := allowed("stranger", affiliation, objectType, operation); got != want {
+					t.Errorf("affiliation %d, %s %s: got %v, want %v", affiliation, operation, objectTypeNames[objectType], got, want)
+				}
+			}
+		}
+	}
+}
+
+//What the caller related to each record in policyRecords may do with it. A mortgage
+//application's appraiser is only known from the ledger and is covered by the view tests
+var relatedCallerGrants = []struct {
+	objectType  int
+	affiliation int
+	callerId    string
+	operations  []string
+}{
+	{MORTGAGEAPPLICATION, BUYER_A, "buyer1", []string{OP_CREATE, OP_READ, OP_ATTACH, OP_LOCK_RATE, OP_ROTATE_KEY, OP_REQUEST_ERASURE}},
+	{MORTGAGEAPPLICATION, BANK_A, "bank1", []string{OP_READ, OP_UPDATE, OP_ATTACH, OP_ROTATE_KEY, OP_DECIDE_ERASURE, OP_DISPUTE}},
+	{APPRAISERAPPLICATION, BANK_A, "bank1", []string{OP_CREATE, OP_READ, OP_DISPUTE}},
+	{APPRAISERAPPLICATION, APPRAISER_A, "appraiser1", []string{OP_READ, OP_UPDATE, OP_RESPOND}},
+	{SALESCONTRACT, BUYER_A, "buyer1", []string{OP_CREATE, OP_READ, OP_UPDATE, OP_CONTINGENCY}},
+	{SALESCONTRACT, SELLER_A, "seller1", []string{OP_READ, OP_UPDATE}},
+	{SALESCONTRACT, BANK_A, "bank1", []string{OP_READ}},
+	{OFFER, BUYER_A, "buyer1", []string{OP_CREATE, OP_READ, OP_RESPOND}},
+	{OFFER, SELLER_A, "seller1", []string{OP_READ, OP_RESPOND}},
+	{OFFER, BANK_A, "bank1", []string{OP_READ}},
+	{ESCROW, ESCROW_A, "escrow1", []string{OP_CREATE, OP_READ, OP_UPDATE}},
+	{ESCROW, BUYER_A, "buyer1", []string{OP_READ}},
+	{ESCROW, SELLER_A, "seller1", []string{OP_READ}},
+	{ESCROW, BANK_A, "bank1", []string{OP_READ}},
+	{LOAN, BUYER_A, "buyer1", []string{OP_READ}},
+	{LOAN, BUYER_A, "buyer2", []string{OP_READ}},
+	{LOAN, BANK_A, "bank1", []string{OP_READ, OP_UPDATE}},
+	{KYC, BUYER_A, "buyer1", []string{OP_READ}},
+	{INVOICE, APPRAISER_A, "appraiser1", []string{OP_READ}},
+	{INVOICE, BANK_A, "bank1", []string{OP_READ, OP_UPDATE}},
+	{LENDINGREPORT, BANK_A, "bank1", []string{OP_READ}},
+}
+
+func TestPolicyRelatedCallerGrants(t *testing.T) {
+	for _, g := range relatedCallerGrants {
+		for _, operation := range policyOperations {
+			want := containsString(g.operations, operation)
+			if got := allowed(g.callerId, g.affiliation, g.objectType, operation); got != want {
+				t.Errorf("%s with affiliation %d, %s %s: got %v, want %v", g.callerId, g.affiliation, operation, objectTypeNames[g.objectType], got, want)
+			}
+		}
+	}
+}
+
+//Being related to a record grants nothing to a caller of the wrong affiliation
+func TestPolicyRequiresAffiliation(t *testing.T) {
+	for objectType, record := range policyRecords() {
+		for _, callerId := range []string{"buyer1", "seller1", "bank1", "appraiser1", "escrow1"} {
+			_, relationships := relationshipsTo(callerId, record)
+			for _, operation := range policyOperations {
+				if policyAllows(REGULATOR_A, objectType, operation, relationships) || policyAllows(ADMIN_A, objectType, operation, relationships) || (objectType != LICENSE && policyAllows(LICENSING_A, objectType, operation, relationships)) {
+					t.Errorf("%s can %s %s without a rule for its affiliation", callerId, operation, objectTypeNames[objectType])
+				}
+			}
+		}
+	}
+}
+
+func TestPolicyTableTypesAreNamed(t *testing.T) {
+	for _, rule := range policyTable {
+		if len(objectTypeNames[rule.ObjectType]) == 0 {
+			t.Errorf("object type %d has no name", rule.ObjectType)
+		}
+	}
+}
+
+func TestRelationshipsOfAnonymousCaller(t *testing.T) {
+	for objectType, record := range policyRecords() {
+		_, relationships := relationshipsTo("", record)
+		if len(relationships) != 1 || relationships[0] != REL_ANY {
+			t.Errorf("anonymous caller has relationships %v to %s", relationships, objectTypeNames[objectType])
+		}
+	}
+}
+
+func TestMortgageApplicationView(t *testing.T) {
+	cases := []struct {
+		name          string
+		affiliation   int
+		relationships []string
+		unmasked      bool
+		want          string
+	}{
+		{"applicant", BUYER_A, []string{REL_ANY, REL_APPLICANT}, false, VIEW_FULL},
+		{"reviewer", BANK_A, []string{REL_ANY, REL_REVIEWER}, false, VIEW_FULL},
+		{"auditor", AUDITOR_A, []string{REL_ANY}, false, VIEW_AUDITOR},
+		{"auditor with unmask grant", AUDITOR_A, []string{REL_ANY}, true, VIEW_FULL},
+		{"linked appraiser", APPRAISER_A, []string{REL_ANY, REL_APPRAISER}, false, VIEW_APPRAISER},
+		{"unrelated bank", BANK_A, []string{REL_ANY}, false, VIEW_NONE},
+		{"unmask grant of a non auditor", BANK_A, []string{REL_ANY}, true, VIEW_NONE},
+	}
+
+	for _, c := range cases {
+		if got := mortgageApplicationView(c.affiliation, c.relationships, c.unmasked); got != c.want {
+			t.Errorf("%s: got %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+//The bank reviewing an application or contract of the subject reads the KYC record
+func TestPolicyReviewerReadsKyc(t *testing.T) {
+	record := KycRecord{UserId: "buyer1"}
+	_, relationships := relationshipsTo("bank1", record)
+	if policyAllows(BANK_A, KYC, OP_READ, relationships) {
+		t.Errorf("bank reads KYC record without reviewing the subject")
+	}
+	if !policyAllows(BANK_A, KYC, OP_READ, append(relationships, REL_REVIEWER)) {
+		t.Errorf("reviewing bank cannot read KYC record")
+	}
+}
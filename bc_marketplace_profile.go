@@ -0,0 +1,430 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//Contact channel types
+const CHANNEL_EMAIL string = "email"
+const CHANNEL_PHONE string = "phone"
+const CHANNEL_MOBILE string = "mobile"
+const CHANNEL_POSTAL string = "postal"
+
+var contactChannelTypes = []string{CHANNEL_EMAIL, CHANNEL_PHONE, CHANNEL_MOBILE, CHANNEL_POSTAL}
+
+//Language of a user who has not set one
+const DEFAULT_LANGUAGE string = "en"
+
+/**
+A way to reach a user. Only shared channels are shown to other users
+**/
+type ContactChannel struct {
+	Type      string `json:"type"`
+	Value     string `json:"value"`
+	Preferred bool   `json:"preferred"`
+	Shared    bool   `json:"shared"`
+}
+
+/**
+Set by an admin once the profile has been checked. A flag is cleared when the user
+changes what it covers
+**/
+type ProfileVerification struct {
+	IdentityVerified     bool   `json:"identityVerified"`
+	OrganizationVerified bool   `json:"organizationVerified"`
+	LicensesVerified     bool   `json:"licensesVerified"`
+	VerifiedBy           string `json:"verifiedBy"`
+	VerifiedAt           string `json:"verifiedAt"`
+}
+
+/**
+Who a user is, as shown to the users they deal with. License numbers are only kept for
+appraisers and banks
+**/
+type Profile struct {
+	UserId            string              `json:"userId"`
+	Affiliation       int                 `json:"affiliation"`
+	DisplayName       string              `json:"displayName"`
+	Organization      string              `json:"organization"`
+	LicenseNumbers    []string            `json:"licenseNumbers"`
+	ContactChannels   []ContactChannel    `json:"contactChannels"`
+	PreferredLanguage string              `json:"preferredLanguage"`
+	Verification      ProfileVerification `json:"verification"`
+	LastModifiedDate  string              `json:"lastModifiedDate"`
+}
+
+type ProfileSchema struct {
+	DisplayName       string           `json:"displayName"`
+	Organization      string           `json:"organization"`
+	LicenseNumbers    []string         `json:"licenseNumbers"`
+	ContactChannels   []ContactChannel `json:"contactChannels"`
+	PreferredLanguage string           `json:"preferredLanguage"`
+}
+
+type ProfileVerificationSchema struct {
+	IdentityVerified     bool `json:"identityVerified"`
+	OrganizationVerified bool `json:"organizationVerified"`
+	LicensesVerified     bool `json:"licensesVerified"`
+}
+
+func holdsLicenses(affiliation int) bool {
+	return affiliation == APPRAISER_A || affiliation == BANK_A
+}
+
+/**
+Returns the profile of a user. A user who has not filled in a profile gets an empty one
+**/
+func LoadProfile(stub *shim.ChaincodeStub, userId string) (Profile, error) {
+	profile := Profile{UserId: userId, LicenseNumbers: []string{}, ContactChannels: []ContactChannel{}, PreferredLanguage: DEFAULT_LANGUAGE}
+
+	user, err := GetUser(stub, userId)
+	if err != nil {
+		return profile, errors.New("User " + userId + " does not exist")
+	}
+	profile.Affiliation = user.Affiliation
+
+	key, err := GetStateKey(userId, PROFILE)
+	if err != nil {
+		return profile, err
+	}
+
+	bytes, err := stub.GetState(key)
+	if err != nil {
+		fmt.Println("LoadProfile: Could not fetch profile of "+userId, err)
+		return profile, err
+	}
+	if len(bytes) == 0 {
+		return profile, nil
+	}
+
+	err = json.Unmarshal(bytes, &profile)
+	if err != nil {
+		fmt.Println("LoadProfile: Could not unmarshal profile of "+userId, err)
+		return profile, err
+	}
+
+	return profile, nil
+}
+
+func SaveProfile(stub *shim.ChaincodeStub, profile Profile) ([]byte, error) {
+	fmt.Println("Entering SaveProfile")
+
+	key, err := GetStateKey(profile.UserId, PROFILE)
+	if err != nil {
+		return nil, err
+	}
+
+	bytes, _ := json.Marshal(&profile)
+	err = stub.PutState(key, bytes)
+	if err != nil {
+		fmt.Println("SaveProfile: Could not save profile ", err)
+		return nil, err
+	}
+	return bytes, nil
+}
+
+/**
+Checks a language tag such as en or pt-BR
+**/
+func validateLanguage(language string) (string, error) {
+	language = strings.TrimSpace(language)
+	if len(language) == 0 {
+		return DEFAULT_LANGUAGE, nil
+	}
+
+	parts := strings.Split(language, "-")
+	for i, part := range parts {
+		if len(part) < 2 || len(part) > 8 {
+			return "", errors.New("Invalid preferred language " + language)
+		}
+		for _, c := range part {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || i > 0 && c >= '0' && c <= '9') {
+				return "", errors.New("Invalid preferred language " + language)
+			}
+		}
+	}
+	return language, nil
+}
+
+func validateContactChannels(channels []ContactChannel) ([]ContactChannel, error) {
+	result := []ContactChannel{}
+	preferred := false
+
+	for _, channel := range channels {
+		channel.Type = strings.ToLower(strings.TrimSpace(channel.Type))
+		channel.Value = strings.TrimSpace(channel.Value)
+		if !containsString(contactChannelTypes, channel.Type) {
+			return nil, errors.New("Invalid contact channel " + channel.Type + ". Expected " + strings.Join(contactChannelTypes, ", "))
+		}
+		if len(channel.Value) == 0 {
+			return nil, errors.New("Contact channel " + channel.Type + " has no value")
+		}
+		if channel.Type == CHANNEL_EMAIL && !strings.Contains(channel.Value, "@") {
+			return nil, errors.New("Invalid email address " + channel.Value)
+		}
+		if channel.Preferred {
+			if preferred {
+				return nil, errors.New("Only one contact channel can be preferred")
+			}
+			preferred = true
+		}
+		result = append(result, channel)
+	}
+	return result, nil
+}
+
+func sameStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+/**
+Returns the profile as shown to the caller. Other users only see shared contact channels
+**/
+func profileView(profile Profile, callerId string, callerAffiliation int) Profile {
+	if callerId == profile.UserId || callerAffiliation == ADMIN_A {
+		return profile
+	}
+
+	shared := []ContactChannel{}
+	for _, channel := range profile.ContactChannels {
+		if channel.Shared {
+			shared = append(shared, channel)
+		}
+	}
+	profile.ContactChannels = shared
+	return profile
+}
+
+/**
+A user fills in or changes their own profile. Changing the display name, organization or
+license numbers clears their verification.
+args[0] is a ProfileSchema json string
+**/
+func UpdateProfile(stub *shim.ChaincodeStub, callerId string, callerAffiliation int, args []string) ([]byte, error) {
+	fmt.Println("Entering UpdateProfile")
+
+	if len(args) < 1 {
+		fmt.Println("UpdateProfile: expected 1 argument")
+		return nil, errors.New("Could not update profile. Invalid input")
+	}
+
+	var input ProfileSchema
+	err := json.Unmarshal([]byte(args[0]), &input)
+	if err != nil {
+		fmt.Println("UpdateProfile: Could not unmarshal input ", err)
+		return nil, err
+	}
+
+	profile, err := LoadProfile(stub, callerId)
+	if err != nil {
+		return nil, err
+	}
+
+	displayName := strings.TrimSpace(input.DisplayName)
+	if len(displayName) == 0 {
+		return nil, errors.New("A profile needs a display name")
+	}
+	organization := strings.TrimSpace(input.Organization)
+
+	licenses := []string{}
+	for _, license := range input.LicenseNumbers {
+		license = strings.TrimSpace(license)
+		if len(license) > 0 && !containsString(licenses, license) {
+			licenses = append(licenses, license)
+		}
+	}
+	if len(licenses) > 0 && !holdsLicenses(profile.Affiliation) {
+		return nil, errors.New("Only appraisers and banks have license numbers")
+	}
+
+	channels, err := validateContactChannels(input.ContactChannels)
+	if err != nil {
+		return nil, err
+	}
+	language, err := validateLanguage(input.PreferredLanguage)
+	if err != nil {
+		return nil, err
+	}
+
+	if displayName != profile.DisplayName {
+		profile.Verification.IdentityVerified = false
+	}
+	if organization != profile.Organization {
+		profile.Verification.OrganizationVerified = false
+	}
+	if !sameStrings(licenses, profile.LicenseNumbers) {
+		profile.Verification.LicensesVerified = false
+	}
+
+	profile.DisplayName = displayName
+	profile.Organization = organization
+	profile.LicenseNumbers = licenses
+	profile.ContactChannels = channels
+	profile.PreferredLanguage = language
+
+	txTime, err := GetTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	profile.LastModifiedDate = txTime.Format(dateLayout)
+
+	return SaveProfile(stub, profile)
+}
+
+/**
+An admin records what they have checked on a user's profile.
+args[0] is the user id and args[1] a ProfileVerificationSchema json string
+**/
+func VerifyProfile(stub *shim.ChaincodeStub, callerId string, callerAffiliation int, args []string) ([]byte, error) {
+	fmt.Println("Entering VerifyProfile")
+
+	if len(args) < 2 {
+		fmt.Println("VerifyProfile: expected 2 arguments")
+		return nil, errors.New("Could not verify profile. Invalid input")
+	}
+
+	if callerAffiliation != ADMIN_A {
+		return nil, errors.New(callerId + " is not allowed to verify profiles")
+	}
+
+	var input ProfileVerificationSchema
+	err := json.Unmarshal([]byte(args[1]), &input)
+	if err != nil {
+		fmt.Println("VerifyProfile: Could not unmarshal input ", err)
+		return nil, err
+	}
+
+	profile, err := LoadProfile(stub, strings.TrimSpace(args[0]))
+	if err != nil {
+		return nil, err
+	}
+	if len(profile.DisplayName) == 0 {
+		return nil, errors.New("User " + profile.UserId + " has not filled in a profile")
+	}
+	if input.OrganizationVerified && len(profile.Organization) == 0 {
+		return nil, errors.New("User " + profile.UserId + " has no organization to verify")
+	}
+	if input.LicensesVerified && len(profile.LicenseNumbers) == 0 {
+		return nil, errors.New("User " + profile.UserId + " has no license numbers to verify")
+	}
+
+	txTime, err := GetTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	profile.Verification = ProfileVerification{
+		IdentityVerified:     input.IdentityVerified,
+		OrganizationVerified: input.OrganizationVerified,
+		LicensesVerified:     input.LicensesVerified,
+		VerifiedBy:           callerId,
+		VerifiedAt:           txTime.Format(dateLayout),
+	}
+
+	return SaveProfile(stub, profile)
+}
+
+/**
+Erases a user's profile, including their contact channels. Users erase their own profile
+and admins anyone's. The user keeps their account and can fill in a new profile.
+args[0] is the user id, the caller's own profile if left out
+**/
+func EraseProfile(stub *shim.ChaincodeStub, callerId string, callerAffiliation int, args []string) ([]byte, error) {
+	fmt.Println("Entering EraseProfile")
+
+	userId := callerId
+	if len(args) > 0 && len(strings.TrimSpace(args[0])) > 0 {
+		userId = strings.TrimSpace(args[0])
+	}
+	if userId != callerId && callerAffiliation != ADMIN_A {
+		return nil, errors.New("User " + callerId + " does not have rights to erase the profile of " + userId)
+	}
+
+	_, err := GetUser(stub, userId)
+	if err != nil {
+		return nil, errors.New("User " + userId + " does not exist")
+	}
+
+	key, err := GetStateKey(userId, PROFILE)
+	if err != nil {
+		return nil, err
+	}
+	bytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes) == 0 {
+		return nil, errors.New("User " + userId + " has no profile to erase")
+	}
+
+	err = stub.DelState(key)
+	if err != nil {
+		fmt.Println("EraseProfile: Could not delete profile ", err)
+		return nil, err
+	}
+
+	AppendMALog(stub, "EraseProfile", callerId+" erased the profile of "+userId+". "+ERASURE_LIMIT_HISTORY, "", key)
+
+	return []byte(userId), nil
+}
+
+/**
+Returns the profile of a user.
+args[0] is the user id
+**/
+func GetProfile(stub *shim.ChaincodeStub, callerId string, callerAffiliation int, args []string) ([]byte, error) {
+	fmt.Println("Entering GetProfile")
+
+	if len(args) < 1 {
+		fmt.Println("GetProfile: expected 1 argument")
+		return nil, errors.New("Could not get profile. Invalid input")
+	}
+
+	profile, err := LoadProfile(stub, strings.TrimSpace(args[0]))
+	if err != nil {
+		return nil, err
+	}
+
+	bytes, err := json.Marshal(profileView(profile, callerId, callerAffiliation))
+	if err != nil {
+		return nil, err
+	}
+	return bytes, nil
+}
+
+/**
+Returns the profiles of several users, e.g. the parties to a sales contract. Unknown
+users are left out.
+args are the user ids
+**/
+func GetProfiles(stub *shim.ChaincodeStub, callerId string, callerAffiliation int, args []string) ([]byte, error) {
+	fmt.Println("Entering GetProfiles")
+
+	profiles := []Profile{}
+	for _, id := range args {
+		profile, err := LoadProfile(stub, strings.TrimSpace(id))
+		if err != nil {
+			continue
+		}
+		profiles = append(profiles, profileView(profile, callerId, callerAffiliation))
+	}
+
+	bytes, err := json.Marshal(profiles)
+	if err != nil {
+		return nil, err
+	}
+	return bytes, nil
+}
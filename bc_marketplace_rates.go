@@ -0,0 +1,347 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//Length of a rate lock when the buyer does not ask for one
+const DEFAULT_RATE_LOCK_DAYS int = 30
+const MAX_RATE_LOCK_DAYS int = 90
+
+/**
+A product offered by a bank. Rates and points are in basis points, e.g. 650 is 6.50%.
+The entry can be locked from EffectiveFrom up to, but not including, EffectiveTo.
+An empty EffectiveTo means the entry does not end
+**/
+type RateSheetEntry struct {
+	ProductId     string `json:"productId"`
+	Product       string `json:"product"`
+	TermMonths    int    `json:"termMonths"`
+	AnnualRateBps int    `json:"annualRateBps"`
+	PointsBps     int    `json:"pointsBps"`
+	EffectiveFrom string `json:"effectiveFrom"`
+	EffectiveTo   string `json:"effectiveTo"`
+}
+
+type RateSheet struct {
+	BankId           string           `json:"bankId"`
+	Entries          []RateSheetEntry `json:"entries"`
+	LastModifiedDate string           `json:"lastModifiedDate"`
+}
+
+type RateSheetSchema struct {
+	Entries []RateSheetEntry `json:"entries"`
+}
+
+type RateLock struct {
+	BankId        string `json:"bankId"`
+	ProductId     string `json:"productId"`
+	TermMonths    int    `json:"termMonths"`
+	AnnualRateBps int    `json:"annualRateBps"`
+	PointsBps     int    `json:"pointsBps"`
+	LockedBy      string `json:"lockedBy"`
+	LockedAt      string `json:"lockedAt"`
+	ExpiresAt     string `json:"expiresAt"`
+}
+
+type RateLockSchema struct {
+	ProductId string `json:"productId"`
+	LockDays  int    `json:"lockDays"`
+}
+
+/**
+Returns true if the rate lock exists and has not expired at the given time
+**/
+func IsRateLockActive(lock RateLock, txTime time.Time) bool {
+	if len(lock.ProductId) == 0 {
+		return false
+	}
+	expiresAt, err := time.Parse(dateLayout, lock.ExpiresAt)
+	if err != nil {
+		return false
+	}
+	return txTime.Before(expiresAt)
+}
+
+/**
+Returns true if the entry can be locked at the given time
+**/
+func IsRateSheetEntryEffective(entry RateSheetEntry, txTime time.Time) bool {
+	from, err := time.Parse(dateLayout, entry.EffectiveFrom)
+	if err != nil || txTime.Before(from) {
+		return false
+	}
+	if len(entry.EffectiveTo) == 0 {
+		return true
+	}
+	to, err := time.Parse(dateLayout, entry.EffectiveTo)
+	return err == nil && txTime.Before(to)
+}
+
+func validateRateSheetEntry(entry RateSheetEntry) error {
+	if len(entry.ProductId) == 0 {
+		return errors.New("Rate sheet entry is missing a product id")
+	}
+	if entry.TermMonths <= 0 || entry.TermMonths > MAX_LOAN_TERM_MONTHS {
+		return errors.New("Product " + entry.ProductId + ": term must be between 1 and " + strconv.Itoa(MAX_LOAN_TERM_MONTHS) + " months")
+	}
+	if entry.AnnualRateBps < 0 || entry.AnnualRateBps > MAX_LOAN_RATE_BPS {
+		return errors.New("Product " + entry.ProductId + ": annual rate must be between 0 and " + strconv.Itoa(MAX_LOAN_RATE_BPS) + " basis points")
+	}
+	if entry.PointsBps < 0 {
+		return errors.New("Product " + entry.ProductId + ": points cannot be negative")
+	}
+
+	from, err := time.Parse(dateLayout, entry.EffectiveFrom)
+	if err != nil {
+		return errors.New("Product " + entry.ProductId + ": invalid effectiveFrom " + entry.EffectiveFrom + ". Expected format " + dateLayout)
+	}
+	if len(entry.EffectiveTo) > 0 {
+		to, err := time.Parse(dateLayout, entry.EffectiveTo)
+		if err != nil {
+			return errors.New("Product " + entry.ProductId + ": invalid effectiveTo " + entry.EffectiveTo + ". Expected format " + dateLayout)
+		}
+		if !to.After(from) {
+			return errors.New("Product " + entry.ProductId + ": effectiveTo must be after effectiveFrom")
+		}
+	}
+	return nil
+}
+
+/**
+Reads a bank's rate sheet. A bank which has not published one has an empty sheet
+**/
+func LoadRateSheet(stub *shim.ChaincodeStub, bankId string) (RateSheet, error) {
+	sheet := RateSheet{BankId: bankId, Entries: []RateSheetEntry{}}
+
+	key, err := GetStateKey(bankId, RATESHEET)
+	if err != nil {
+		return sheet, err
+	}
+
+	bytes, err := stub.GetState(key)
+	if err != nil {
+		fmt.Println("LoadRateSheet: Could not fetch rate sheet for bank : "+bankId, err)
+		return sheet, err
+	}
+	if len(bytes) == 0 {
+		return sheet, nil
+	}
+
+	err = json.Unmarshal(bytes, &sheet)
+	if err != nil {
+		fmt.Println("LoadRateSheet: Could not unmarshal rate sheet for bank : "+bankId, err)
+		return sheet, err
+	}
+
+	return sheet, nil
+}
+
+func SaveRateSheet(stub *shim.ChaincodeStub, sheet RateSheet) ([]byte, error) {
+	fmt.Println("Entering SaveRateSheet")
+
+	key, err := GetStateKey(sheet.BankId, RATESHEET)
+	if err != nil {
+		return nil, err
+	}
+
+	bytes, _ := json.Marshal(&sheet)
+	err = stub.PutState(key, bytes)
+	if err != nil {
+		fmt.Println("SaveRateSheet: Could not save rate sheet ", err)
+		return nil, err
+	}
+	return bytes, nil
+}
+
+/**
+Publishes products on the calling bank's rate sheet. An entry with the product id of an
+existing entry replaces it, other entries are added. Existing locks are not affected.
+args[0] is a RateSheetSchema json string
+**/
+func PublishRateSheet(stub *shim.ChaincodeStub, callerId string, callerAffiliation int, args []string) ([]byte, error) {
+	fmt.Println("Entering PublishRateSheet")
+
+	if len(args) < 1 {
+		fmt.Println("PublishRateSheet: expected 1 argument")
+		return nil, errors.New("Could not publish rate sheet. Invalid input")
+	}
+
+	if callerAffiliation != BANK_A {
+		fmt.Println("PublishRateSheet: " + callerId + " is not allowed to publish a rate sheet")
+		return nil, errors.New(callerId + " is not allowed to publish a rate sheet")
+	}
+
+	var input RateSheetSchema
+	err := json.Unmarshal([]byte(args[0]), &input)
+	if err != nil {
+		fmt.Println("PublishRateSheet: Could not unmarshal input ", err)
+		return nil, err
+	}
+
+	if len(input.Entries) == 0 {
+		return nil, errors.New("Rate sheet has no entries")
+	}
+
+	sheet, err := LoadRateSheet(stub, callerId)
+	if err != nil {
+		return nil, err
+	}
+
+	var published []string
+	for _, entry := range input.Entries {
+		entry.ProductId = strings.TrimSpace(entry.ProductId)
+		entry.EffectiveFrom = strings.TrimSpace(entry.EffectiveFrom)
+		entry.EffectiveTo = strings.TrimSpace(entry.EffectiveTo)
+
+		err = validateRateSheetEntry(entry)
+		if err != nil {
+			return nil, err
+		}
+
+		replaced := false
+		for i := range sheet.Entries {
+			if sheet.Entries[i].ProductId == entry.ProductId {
+				sheet.Entries[i] = entry
+				replaced = true
+			}
+		}
+		if !replaced {
+			sheet.Entries = append(sheet.Entries, entry)
+		}
+		published = append(published, entry.ProductId+" at "+strconv.Itoa(entry.AnnualRateBps)+" bps")
+	}
+
+	txTime, err := GetTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	sheet.LastModifiedDate = txTime.Format(dateLayout)
+
+	bytes, err := SaveRateSheet(stub, sheet)
+	if err != nil {
+		return nil, err
+	}
+
+	AppendMALog(stub, "PublishRateSheet", callerId+" published "+strings.Join(published, ", "), "", typeRateSheet+callerId)
+
+	return bytes, nil
+}
+
+/**
+Returns the rate sheet of a bank. Rate sheets are public.
+args[0] is the bank id
+**/
+func GetRateSheet(stub *shim.ChaincodeStub, callerId string, callerAffiliation int, args []string) ([]byte, error) {
+	fmt.Println("Entering GetRateSheet")
+
+	if len(args) < 1 {
+		fmt.Println("GetRateSheet: expected 1 argument")
+		return nil, errors.New("Could not GetRateSheet. Invalid input")
+	}
+
+	sheet, err := LoadRateSheet(stub, strings.TrimSpace(args[0]))
+	if err != nil {
+		return nil, err
+	}
+
+	bytes, err := json.Marshal(&sheet)
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes, nil
+}
+
+/**
+Locks a rate from the reviewing bank's rate sheet on a mortgage application. Only an
+applicant can lock a rate and only while no other lock is active on the application.
+args[0] is the mortgage application id and args[1] a RateLockSchema json string
+**/
+func LockRate(stub *shim.ChaincodeStub, callerId string, callerAffiliation int, args []string) ([]byte, error) {
+	fmt.Println("Entering LockRate")
+
+	if len(args) < 2 {
+		fmt.Println("LockRate: expected two arguments")
+		return nil, errors.New("Could not lock rate. Invalid input")
+	}
+
+	ma, err := LoadMortgageApplication(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	err = Authorize(stub, callerId, callerAffiliation, MORTGAGEAPPLICATION, OP_LOCK_RATE, ma)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ma.LoanId) > 0 {
+		return nil, errors.New("Mortgage application " + ma.ID + " already funded loan " + ma.LoanId)
+	}
+
+	var input RateLockSchema
+	err = json.Unmarshal([]byte(args[1]), &input)
+	if err != nil {
+		fmt.Println("LockRate: Could not unmarshal input ", err)
+		return nil, err
+	}
+
+	lockDays := input.LockDays
+	if lockDays == 0 {
+		lockDays = DEFAULT_RATE_LOCK_DAYS
+	}
+	if lockDays < 0 || lockDays > MAX_RATE_LOCK_DAYS {
+		return nil, errors.New("Lock period must be between 1 and " + strconv.Itoa(MAX_RATE_LOCK_DAYS) + " days")
+	}
+
+	txTime, err := GetTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	now := txTime.Format(dateLayout)
+
+	if IsRateLockActive(ma.RateLock, txTime) {
+		return nil, errors.New("Mortgage application " + ma.ID + " already has a rate locked until " + ma.RateLock.ExpiresAt)
+	}
+
+	sheet, err := LoadRateSheet(stub, ma.ReviewerId)
+	if err != nil {
+		return nil, err
+	}
+
+	productId := strings.TrimSpace(input.ProductId)
+	var entry RateSheetEntry
+	found := false
+	for _, e := range sheet.Entries {
+		if e.ProductId == productId {
+			entry = e
+			found = true
+		}
+	}
+	if !found {
+		return nil, errors.New("Bank " + ma.ReviewerId + " does not offer product " + productId)
+	}
+	if !IsRateSheetEntryEffective(entry, txTime) {
+		return nil, errors.New("Product " + productId + " is not available at this time")
+	}
+
+	ma.RateLock = RateLock{ma.ReviewerId, entry.ProductId, entry.TermMonths, entry.AnnualRateBps, entry.PointsBps, callerId, now, txTime.AddDate(0, 0, lockDays).Format(dateLayout)}
+	ma.LastModifiedDate = now
+
+	bytes, err := SaveMortgageApplication(stub, ma, ma.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	AppendMALog(stub, "LockRate", callerId+" locked "+entry.ProductId+" at "+strconv.Itoa(entry.AnnualRateBps)+" bps and "+strconv.Itoa(entry.PointsBps)+" bps points until "+ma.RateLock.ExpiresAt, ma.Status, ma.ID)
+
+	return bytes, nil
+}
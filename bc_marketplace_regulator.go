@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//What a regulator can read
+const REG_MORTGAGE_APPLICATION string = "mortgageApplication"
+const REG_MORTGAGE_APPLICATIONS string = "mortgageApplications"
+const REG_SALES_CONTRACT string = "salesContract"
+const REG_SALES_CONTRACTS string = "salesContracts"
+const REG_LOGS string = "logs"
+const REG_LENDING_REPORT string = "lendingReport"
+
+//Id of the log which records every read of a regulator
+var regulatorLogPrefix = "regulator:"
+
+/**
+An external examiner with read-only access to the records of properties in their
+jurisdictions
+**/
+type Regulator struct {
+	ID            string   `json:"id"`
+	Affiliation   int      `json:"affiliation"`
+	Jurisdictions []string `json:"jurisdictions"`
+}
+
+func normalizeJurisdiction(jurisdiction string) string {
+	return strings.ToUpper(strings.TrimSpace(jurisdiction))
+}
+
+/**
+Parses a comma separated list of jurisdictions
+**/
+func ParseJurisdictions(arg string) []string {
+	var result []string
+	for _, j := range strings.Split(arg, ",") {
+		jurisdiction := normalizeJurisdiction(j)
+		if len(jurisdiction) > 0 && !containsString(result, jurisdiction) {
+			result = append(result, jurisdiction)
+		}
+	}
+	return result
+}
+
+/**
+Creates a regulator. Regulators are registered by an admin through RegisterUser and
+cannot be created twice, so their jurisdictions cannot be widened by registering again
+**/
+func CreateRegulator(stub *shim.ChaincodeStub, key string, id string, jurisdictions []string) (Regulator, error) {
+	fmt.Println("Entering CreateRegulator")
+
+	regulator := Regulator{id, REGULATOR_A, jurisdictions}
+
+	bytes, err := stub.GetState(key)
+	if err != nil {
+		return regulator, err
+	}
+	if len(bytes) > 0 {
+		return regulator, errors.New("User " + id + " already exists")
+	}
+	if len(jurisdictions) == 0 {
+		return regulator, errors.New("A regulator needs at least one jurisdiction")
+	}
+
+	err = SaveRegulator(stub, regulator, key)
+	if err != nil {
+		return regulator, err
+	}
+	return regulator, nil
+}
+
+func GetRegulator(stub *shim.ChaincodeStub, key string) (Regulator, error) {
+	fmt.Println("Entering GetRegulator")
+
+	var regulator Regulator
+	bytes, err := stub.GetState(key)
+	if err != nil {
+		fmt.Println("GetRegulator: Could not get regulator "+key+" ", err)
+		return regulator, err
+	}
+
+	err = json.Unmarshal(bytes, &regulator)
+	if err != nil || regulator.Affiliation != REGULATOR_A {
+		return regulator, errors.New("GetRegulator: " + key + " is not a regulator")
+	}
+	return regulator, nil
+}
+
+func SaveRegulator(stub *shim.ChaincodeStub, regulator Regulator, key string) error {
+	fmt.Println("Entering SaveRegulator")
+	bytes, _ := json.Marshal(&regulator)
+	err := stub.PutState(key, bytes)
+	if err != nil {
+		fmt.Println("SaveRegulator: Could not save regulator ", err)
+		return err
+	}
+	return nil
+}
+
+/**
+Returns the jurisdiction of a property, or "" if the property or its jurisdiction is not known
+**/
+func propertyJurisdiction(stub *shim.ChaincodeStub, propertyId string) string {
+	if len(propertyId) == 0 {
+		return ""
+	}
+	key, _ := GetStateKey(propertyId, PROPERTY)
+	bytes, err := stub.GetState(key)
+	if err != nil || len(bytes) == 0 {
+		return ""
+	}
+	var property Property
+	if json.Unmarshal(bytes, &property) != nil {
+		return ""
+	}
+	return normalizeJurisdiction(property.Jurisdiction)
+}
+
+func regulatorCovers(regulator Regulator, jurisdiction string) bool {
+	return len(jurisdiction) > 0 && containsString(regulator.Jurisdictions, jurisdiction)
+}
+
+/**
+Returns the mortgage application with the id, projected for a regulator, and its jurisdiction
+**/
+func regulatorMortgageApplication(stub *shim.ChaincodeStub, id string) (MortgageApplication, string, error) {
+	ma, err := LoadMortgageApplication(stub, id)
+	if err != nil {
+		return ma, "", err
+	}
+	//Regulators get the auditor view and cannot unmask contact details
+	return ProjectMortgageApplication(ma, VIEW_AUDITOR), propertyJurisdiction(stub, ma.PropertyId), nil
+}
+
+/**
+Returns the jurisdiction of the mortgage application or sales contract a log belongs to
+**/
+func logJurisdiction(stub *shim.ChaincodeStub, id string) string {
+	key, _ := GetStateKey(id, MORTGAGEAPPLICATION)
+	bytes, err := stub.GetState(key)
+	if err == nil && len(bytes) > 0 {
+		var ma MortgageApplication
+		if json.Unmarshal(bytes, &ma) == nil {
+			return propertyJurisdiction(stub, ma.PropertyId)
+		}
+	}
+	sc, err := LoadSalesContract(stub, id)
+	if err == nil {
+		return propertyJurisdiction(stub, sc.PropertyId)
+	}
+	return ""
+}
+
+/**
+Reads records for a regulator. Regulator reads are transactions rather than queries so
+that every read is written to the log of the record read and to the regulator's own log.
+args[0] is what to read: mortgageApplication, salesContract or logs with the id in args[1],
+mortgageApplications or salesContracts to list every record in the regulator's jurisdictions,
+or lendingReport with the bank id, first and last date in args[1] to args[3] to report on
+the bank's applications in the regulator's jurisdictions
+**/
+func RegulatorRead(stub *shim.ChaincodeStub, callerId string, callerAffiliation int, args []string) ([]byte, error) {
+	fmt.Println("Entering RegulatorRead")
+
+	if callerAffiliation != REGULATOR_A {
+		return nil, errors.New("User " + callerId + " is not a regulator")
+	}
+	if len(args) < 1 {
+		return nil, errors.New("Could not read. Expected what to read")
+	}
+
+	regulatorKey, _ := GetStateKey(callerId, USER)
+	regulator, err := GetRegulator(stub, regulatorKey)
+	if err != nil {
+		return nil, err
+	}
+
+	kind := strings.TrimSpace(args[0])
+	var id string
+	if kind == REG_MORTGAGE_APPLICATION || kind == REG_SALES_CONTRACT || kind == REG_LOGS {
+		if len(args) < 2 {
+			return nil, errors.New("Could not read " + kind + ". Expected an id")
+		}
+		id = strings.TrimSpace(args[1])
+	}
+
+	var result interface{}
+	var jurisdiction string
+	var read []string
+
+	switch kind {
+	case REG_MORTGAGE_APPLICATION:
+		result, jurisdiction, err = regulatorMortgageApplication(stub, id)
+		read = []string{id}
+	case REG_SALES_CONTRACT:
+		var sc SalesContract
+		sc, err = LoadSalesContract(stub, id)
+		jurisdiction = propertyJurisdiction(stub, sc.PropertyId)
+		result = sc
+		read = []string{id}
+	case REG_LOGS:
+		result, err = loadMALogs(stub, id)
+		jurisdiction = logJurisdiction(stub, id)
+		read = []string{id}
+	case REG_MORTGAGE_APPLICATIONS:
+		mas := []MortgageApplication{}
+		keys, err := collectKeys(stub, []string{maKeysName})
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			if !strings.HasPrefix(key, typeMortgageApplication) {
+				continue
+			}
+			ma, j, err := regulatorMortgageApplication(stub, strings.TrimPrefix(key, typeMortgageApplication))
+			if err == nil && regulatorCovers(regulator, j) {
+				mas = append(mas, ma)
+				read = append(read, ma.ID)
+			}
+		}
+		result = mas
+	case REG_SALES_CONTRACTS:
+		scs := []SalesContract{}
+		keys, err := collectKeys(stub, []string{scKeysName})
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			if !strings.HasPrefix(key, typeSalesContract) {
+				continue
+			}
+			sc, err := LoadSalesContract(stub, strings.TrimPrefix(key, typeSalesContract))
+			if err == nil && regulatorCovers(regulator, propertyJurisdiction(stub, sc.PropertyId)) {
+				scs = append(scs, sc)
+				read = append(read, sc.ID)
+			}
+		}
+		result = scs
+	case REG_LENDING_REPORT:
+		if len(args) < 4 {
+			return nil, errors.New("Could not read " + kind + ". Expected bank id, from and to dates")
+		}
+		from, to, err := parseReportDates(args[2], args[3])
+		if err != nil {
+			return nil, err
+		}
+		inJurisdiction := func(ma MortgageApplication) bool {
+			return regulatorCovers(regulator, propertyJurisdiction(stub, ma.PropertyId))
+		}
+		report, err := BuildLendingReport(stub, strings.TrimSpace(args[1]), from, to, inJurisdiction)
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range report.Rows {
+			read = append(read, row.MortgageApplicationId)
+		}
+		result = report
+	default:
+		return nil, errors.New("Invalid read " + kind + ". Expected " + strings.Join([]string{REG_MORTGAGE_APPLICATION, REG_MORTGAGE_APPLICATIONS, REG_SALES_CONTRACT, REG_SALES_CONTRACTS, REG_LOGS, REG_LENDING_REPORT}, ", "))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(id) > 0 {
+		if !regulatorCovers(regulator, jurisdiction) {
+			return nil, errors.New("Regulator " + callerId + " does not have rights to read " + kind + " " + id + " outside their jurisdictions")
+		}
+		AppendMALog(stub, "RegulatorRead", "Regulator "+callerId+" read "+kind+" in "+jurisdiction, "", id)
+	}
+	AppendMALog(stub, "RegulatorRead", "Read "+kind+": "+strconv.Itoa(len(read))+" records "+strings.Join(read, ", "), "", regulatorLogPrefix+callerId)
+
+	bytes, err := json.Marshal(result)
+	if err != nil {
+		return nil, err
+	}
+	return bytes, nil
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//Mortgage application statuses which mean the application was declined or withdrawn
+const MA_DENIED string = "Denied"
+const MA_WITHDRAWN string = "Withdrawn"
+
+var deniedStatuses = []string{MA_DENIED, "Declined", "Rejected"}
+var withdrawnStatuses = []string{MA_WITHDRAWN, "Cancelled"}
+
+//Action taken on an application, after the HMDA action taken codes
+const ACTION_ORIGINATED string = "originated"
+const ACTION_APPROVED_NOT_ACCEPTED string = "approved_not_accepted"
+const ACTION_DENIED string = "denied"
+const ACTION_WITHDRAWN string = "withdrawn"
+const ACTION_PENDING string = "pending"
+
+//Reasons for declining an application, after the HMDA denial reason codes
+var declineReasons = []string{"debt_to_income_ratio", "employment_history", "credit_history", "collateral", "insufficient_cash", "unverifiable_information", "credit_application_incomplete", "mortgage_insurance_denied", "other"}
+
+//Reported for a declined application without reasons
+const DECLINE_REASON_NOT_REPORTED string = "not_reported"
+
+//Reported for an application whose property location is not known
+const LOCATION_UNKNOWN string = "unknown"
+
+/**
+One application in the report. Holds no personal data of the applicants
+**/
+type LendingReportRow struct {
+	MortgageApplicationId string   `json:"mortgageApplicationId"`
+	ApplicationDate       string   `json:"applicationDate"`
+	ActionTaken           string   `json:"actionTaken"`
+	ActionDate            string   `json:"actionDate"`
+	Status                string   `json:"status"`
+	RequestedAmount       Money    `json:"requestedAmount"`
+	ApprovedAmount        Money    `json:"approvedAmount"`
+	LoanId                string   `json:"loanId"`
+	Location              string   `json:"location"`
+	DeclineReasons        []string `json:"declineReasons"`
+}
+
+type LendingReportBucket struct {
+	Key             string  `json:"key"`
+	Count           int     `json:"count"`
+	RequestedAmount []Money `json:"requestedAmount"`
+	ApprovedAmount  []Money `json:"approvedAmount"`
+}
+
+/**
+Application outcomes of a bank over a date range. Buckets are sorted by key and rows
+follow the order the bank received the applications, so the same ledger state always
+produces the same report
+**/
+type LendingReport struct {
+	BankId         string                `json:"bankId"`
+	From           string                `json:"from"`
+	To             string                `json:"to"`
+	Applications   int                   `json:"applications"`
+	ByStatus       []LendingReportBucket `json:"byStatus"`
+	ByActionTaken  []LendingReportBucket `json:"byActionTaken"`
+	DeclineReasons []LendingReportBucket `json:"declineReasons"`
+	ByLocation     []LendingReportBucket `json:"byLocation"`
+	Rows           []LendingReportRow    `json:"rows"`
+}
+
+func isDeniedStatus(status string) bool {
+	for _, s := range deniedStatuses {
+		if strings.EqualFold(strings.TrimSpace(status), s) {
+			return true
+		}
+	}
+	return false
+}
+
+func isWithdrawnStatus(status string) bool {
+	for _, s := range withdrawnStatuses {
+		if strings.EqualFold(strings.TrimSpace(status), s) {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+Normalizes and checks the reasons given for declining an application
+**/
+func ValidateDeclineReasons(reasons []string) ([]string, error) {
+	var result []string
+	for _, r := range reasons {
+		reason := strings.ToLower(strings.TrimSpace(r))
+		if !containsString(declineReasons, reason) {
+			return nil, errors.New("Invalid decline reason " + r + ". Expected one of " + strings.Join(declineReasons, ", "))
+		}
+		if !containsString(result, reason) {
+			result = append(result, reason)
+		}
+	}
+	return result, nil
+}
+
+/**
+Returns the action taken on an application
+**/
+func ActionTaken(ma MortgageApplication) string {
+	if len(ma.LoanId) > 0 {
+		return ACTION_ORIGINATED
+	} else if strings.EqualFold(strings.TrimSpace(ma.Status), MA_APPROVED) {
+		return ACTION_APPROVED_NOT_ACCEPTED
+	} else if isDeniedStatus(ma.Status) {
+		return ACTION_DENIED
+	} else if isWithdrawnStatus(ma.Status) {
+		return ACTION_WITHDRAWN
+	}
+	return ACTION_PENDING
+}
+
+/**
+Reads the log of a mortgage application without creating it, so it can be used in queries
+**/
+func loadMALogs(stub *shim.ChaincodeStub, maId string) ([]MALog, error) {
+	key, _ := GetStateKey(maId, MALOG)
+	bytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes) == 0 {
+		return []MALog{}, nil
+	}
+
+	var lh MALogHolder
+	err = json.Unmarshal(bytes, &lh)
+	if err != nil {
+		fmt.Println("loadMALogs: Could not unmarshal log of "+maId, err)
+		return nil, err
+	}
+	return lh.MALogs, nil
+}
+
+/**
+Returns the date an application was received and the date of its last status change,
+taken from its log. Entries which repeat the current status, such as documents attached
+after the decision, do not change the status
+**/
+func applicationDates(logs []MALog) (string, string) {
+	var received, actioned, status string
+	for _, log := range logs {
+		if len(log.Timestamp) < len(loanDateLayout) {
+			continue
+		}
+		day := log.Timestamp[:len(loanDateLayout)]
+		if len(received) == 0 {
+			received = day
+		}
+		if len(log.Status) > 0 && !strings.EqualFold(log.Status, status) {
+			actioned = day
+			status = log.Status
+		}
+	}
+	return received, actioned
+}
+
+/**
+Returns where the property of an application is: the region it was appraised in, else
+the address of the property
+**/
+func propertyLocation(stub *shim.ChaincodeStub, ma MortgageApplication) string {
+	if len(ma.AppraisalApplicationId) > 0 {
+		aa, err := LoadAppraiserApplication(stub, ma.AppraisalApplicationId)
+		if err == nil && len(aa.Region) > 0 {
+			return aa.Region
+		}
+	}
+	if len(ma.PropertyId) > 0 {
+		key, _ := GetStateKey(ma.PropertyId, PROPERTY)
+		bytes, err := stub.GetState(key)
+		if err == nil && len(bytes) > 0 {
+			var property Property
+			if json.Unmarshal(bytes, &property) == nil && len(strings.TrimSpace(property.Address)) > 0 {
+				return strings.TrimSpace(property.Address)
+			}
+		}
+	}
+	return LOCATION_UNKNOWN
+}
+
+/**
+Adds an amount to the total in its currency
+**/
+func addToTotals(totals []Money, amount Money) []Money {
+	if amount.IsZero() {
+		return totals
+	}
+	for i := range totals {
+		if totals[i].Currency == amount.Currency {
+			totals[i].Amount += amount.Amount
+			return totals
+		}
+	}
+	return append(totals, amount)
+}
+
+func addToBucket(buckets map[string]*LendingReportBucket, key string, row LendingReportRow) {
+	bucket, ok := buckets[key]
+	if !ok {
+		bucket = &LendingReportBucket{Key: key, RequestedAmount: []Money{}, ApprovedAmount: []Money{}}
+		buckets[key] = bucket
+	}
+	bucket.Count++
+	bucket.RequestedAmount = addToTotals(bucket.RequestedAmount, row.RequestedAmount)
+	bucket.ApprovedAmount = addToTotals(bucket.ApprovedAmount, row.ApprovedAmount)
+}
+
+/**
+Returns the buckets sorted by key so map order never reaches the report
+**/
+func sortedBuckets(buckets map[string]*LendingReportBucket) []LendingReportBucket {
+	var keys []string
+	for key := range buckets {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	result := []LendingReportBucket{}
+	for _, key := range keys {
+		result = append(result, *buckets[key])
+	}
+	return result
+}
+
+/**
+Parses the first and last date of a report
+**/
+func parseReportDates(fromArg string, toArg string) (time.Time, time.Time, error) {
+	from, err := time.Parse(loanDateLayout, strings.TrimSpace(fromArg))
+	if err != nil {
+		return from, from, errors.New("Invalid from date " + fromArg + ". Expected " + loanDateLayout)
+	}
+	to, err := time.Parse(loanDateLayout, strings.TrimSpace(toArg))
+	if err != nil {
+		return from, to, errors.New("Invalid to date " + toArg + ". Expected " + loanDateLayout)
+	}
+	if to.Before(from) {
+		return from, to, errors.New("The to date is before the from date")
+	}
+	return from, to, nil
+}
+
+/**
+Builds the lending report of a bank for applications received between from and to inclusive.
+When include is set only the applications it returns true for are reported
+**/
+func BuildLendingReport(stub *shim.ChaincodeStub, bankId string, from time.Time, to time.Time, include func(MortgageApplication) bool) (LendingReport, error) {
+	fmt.Println("Entering BuildLendingReport")
+
+	report := LendingReport{BankId: bankId, From: from.Format(loanDateLayout), To: to.Format(loanDateLayout), Rows: []LendingReportRow{}}
+
+	bankKey, _ := GetStateKey(bankId, USER)
+	bytes, err := stub.GetState(bankKey)
+	if err != nil {
+		return report, err
+	}
+	if len(bytes) == 0 {
+		return report, errors.New("Bank " + bankId + " does not exist")
+	}
+	var bank Bank
+	err = json.Unmarshal(bytes, &bank)
+	if err != nil {
+		fmt.Println("BuildLendingReport: Could not unmarshal bank ", err)
+		return report, err
+	}
+
+	byStatus := make(map[string]*LendingReportBucket)
+	byAction := make(map[string]*LendingReportBucket)
+	byReason := make(map[string]*LendingReportBucket)
+	byLocation := make(map[string]*LendingReportBucket)
+
+	for _, maId := range bank.MortgageApplications {
+		ma, err := LoadMortgageApplication(stub, maId)
+		if err != nil {
+			return report, err
+		}
+		if include != nil && !include(ma) {
+			continue
+		}
+
+		logs, err := loadMALogs(stub, maId)
+		if err != nil {
+			return report, err
+		}
+		received, actioned := applicationDates(logs)
+		if len(received) == 0 || received < report.From || received > report.To {
+			continue
+		}
+
+		row := LendingReportRow{
+			MortgageApplicationId: ma.ID,
+			ApplicationDate:       received,
+			ActionTaken:           ActionTaken(ma),
+			Status:                ma.Status,
+			RequestedAmount:       ma.RequestedAmount,
+			ApprovedAmount:        ma.ApprovedAmount,
+			LoanId:                ma.LoanId,
+			Location:              propertyLocation(stub, ma),
+			DeclineReasons:        []string{},
+		}
+		if row.ActionTaken != ACTION_PENDING {
+			row.ActionDate = actioned
+		}
+		if row.ActionTaken == ACTION_DENIED {
+			row.DeclineReasons = append(row.DeclineReasons, ma.DeclineReasons...)
+			if len(row.DeclineReasons) == 0 {
+				row.DeclineReasons = []string{DECLINE_REASON_NOT_REPORTED}
+			}
+		}
+
+		report.Rows = append(report.Rows, row)
+		addToBucket(byStatus, row.Status, row)
+		addToBucket(byAction, row.ActionTaken, row)
+		addToBucket(byLocation, row.Location, row)
+		for _, reason := range row.DeclineReasons {
+			addToBucket(byReason, reason, row)
+		}
+	}
+
+	report.Applications = len(report.Rows)
+	report.ByStatus = sortedBuckets(byStatus)
+	report.ByActionTaken = sortedBuckets(byAction)
+	report.DeclineReasons = sortedBuckets(byReason)
+	report.ByLocation = sortedBuckets(byLocation)
+
+	return report, nil
+}
+
+/**
+Writes the rows of a report as CSV. Amounts are in minor units
+**/
+func LendingReportCSV(report LendingReport) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+
+	w.Write([]string{"mortgageApplicationId", "applicationDate", "actionTaken", "actionDate", "status", "requestedAmount", "approvedAmount", "currency", "loanId", "location", "declineReasons"})
+	for _, row := range report.Rows {
+		currency := row.RequestedAmount.Currency
+		w.Write([]string{
+			row.MortgageApplicationId,
+			row.ApplicationDate,
+			row.ActionTaken,
+			row.ActionDate,
+			row.Status,
+			strconv.FormatInt(row.RequestedAmount.Amount, 10),
+			strconv.FormatInt(row.ApprovedAmount.Amount, 10),
+			currency,
+			row.LoanId,
+			row.Location,
+			strings.Join(row.DeclineReasons, ";"),
+		})
+	}
+
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+/**
+Reports the outcomes of a bank's mortgage applications received in a date range. Auditors
+can report on any bank and a bank on itself.
+args[0] is the bank id, args[1] and args[2] the first and last date (2006-01-02) and the
+optional args[3] the format, json or csv
+**/
+func GetLendingReport(stub *shim.ChaincodeStub, callerId string, callerAffiliation int, args []string) ([]byte, error) {
+	fmt.Println("Entering GetLendingReport")
+
+	if len(args) < 3 {
+		fmt.Println("GetLendingReport: expected three arguments")
+		return nil, errors.New("Could not get lending report. Expected bank id, from and to dates")
+	}
+
+	bankId := strings.TrimSpace(args[0])
+	err := Authorize(stub, callerId, callerAffiliation, LENDINGREPORT, OP_READ, LendingReport{BankId: bankId})
+	if err != nil {
+		return nil, err
+	}
+
+	from, to, err := parseReportDates(args[1], args[2])
+	if err != nil {
+		return nil, err
+	}
+
+	report, err := BuildLendingReport(stub, bankId, from, to, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	format := "json"
+	if len(args) > 3 {
+		format = strings.ToLower(strings.TrimSpace(args[3]))
+	}
+	if format == "csv" {
+		return LendingReportCSV(report)
+	} else if format != "json" {
+		return nil, errors.New("Invalid report format " + args[3] + ". Expected json or csv")
+	}
+
+	bytes, err := json.Marshal(&report)
+	if err != nil {
+		return nil, err
+	}
+	return bytes, nil
+}
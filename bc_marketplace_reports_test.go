@@ -0,0 +1,49 @@
+package main
+
+import "testing"
+
+func TestApplicationDates(t *testing.T) {
+	cases := []struct {
+		name         string
+		logs         []MALog
+		wantReceived string
+		wantActioned string
+	}{
+		{"no log", []MALog{}, "", ""},
+		{"submitted only", []MALog{
+			{Status: "Submitted", Timestamp: "2026-01-05 09:00:00"},
+		}, "2026-01-05", "2026-01-05"},
+		{"approved", []MALog{
+			{Status: "Submitted", Timestamp: "2026-01-05 09:00:00"},
+			{Status: MA_APPROVED, Timestamp: "2026-01-20 14:00:00"},
+		}, "2026-01-05", "2026-01-20"},
+		{"events after the decision repeat its status", []MALog{
+			{Status: "Submitted", Timestamp: "2026-01-05 09:00:00"},
+			{Status: MA_DENIED, Timestamp: "2026-01-20 14:00:00"},
+			{Action: "AttachDocument", Status: MA_DENIED, Timestamp: "2026-02-01 10:00:00"},
+			{Action: "UnmaskMortgageApplication", Status: MA_DENIED, Timestamp: "2026-02-03 10:00:00"},
+			{Action: "RequestErasure", Status: "denied", Timestamp: "2026-03-01 10:00:00"},
+		}, "2026-01-05", "2026-01-20"},
+		{"entries without a status", []MALog{
+			{Status: "Submitted", Timestamp: "2026-01-05 09:00:00"},
+			{Action: "RotateMortgageApplicationKey", Timestamp: "2026-01-07 09:00:00"},
+		}, "2026-01-05", "2026-01-05"},
+		{"status changed back and forth", []MALog{
+			{Status: "Submitted", Timestamp: "2026-01-05 09:00:00"},
+			{Status: MA_APPROVED, Timestamp: "2026-01-20 14:00:00"},
+			{Status: MA_WITHDRAWN, Timestamp: "2026-02-02 14:00:00"},
+			{Status: MA_WITHDRAWN, Timestamp: "2026-02-09 14:00:00"},
+		}, "2026-01-05", "2026-02-02"},
+		{"entries without a timestamp are skipped", []MALog{
+			{Status: "Submitted"},
+			{Status: "Submitted", Timestamp: "2026-01-06 09:00:00"},
+		}, "2026-01-06", "2026-01-06"},
+	}
+
+	for _, c := range cases {
+		received, actioned := applicationDates(c.logs)
+		if received != c.wantReceived || actioned != c.wantActioned {
+			t.Errorf("%s: got %s and %s, want %s and %s", c.name, received, actioned, c.wantReceived, c.wantActioned)
+		}
+	}
+}
@@ -0,0 +1,665 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//Key name for the lists of property ad keys ordered by listed price. There is one list per currency
+var propertyAdPriceIndexName = "propertyAdPriceIndex:"
+
+//Secondary index names for property ads. The indexed value is appended to the name
+var propertyAdCityIndex = "propad:city:"
+var propertyAdBankIndex = "propad:bank:"
+var propertyAdSellerIndex = "propad:seller:"
+var propertyAdStatusIndex = "propad:status:"
+var propertyAdWordIndex = "propad:word:"
+var propertyAdAddressIndex = "propad:address:"
+
+//Default and maximum number of results returned by a single search
+const DEFAULT_SEARCH_LIMIT int = 20
+const MAX_SEARCH_LIMIT int = 100
+
+type PriceIndexEntry struct {
+	Price int64  `json:"price"`
+	Key   string `json:"key"`
+}
+
+type PropertyAdSearchSchema struct {
+	MinPrice  Money  `json:"minPrice"`
+	MaxPrice  Money  `json:"maxPrice"`
+	Address   string `json:"address"`
+	City      string `json:"city"`
+	BankId    string `json:"bankId"`
+	SellerId  string `json:"sellerId"`
+	Status    string `json:"status"`
+	Keyword   string `json:"keyword"`
+	SortBy    string `json:"sortBy"`
+	SortOrder string `json:"sortOrder"`
+	Offset    int    `json:"offset"`
+	Limit     int    `json:"limit"`
+}
+
+type PropertyAdSearchResult struct {
+	Total       int          `json:"total"`
+	Offset      int          `json:"offset"`
+	Limit       int          `json:"limit"`
+	PropertyAds []PropertyAd `json:"propertyAds"`
+}
+
+/**
+Sort helper for property ads. Supported fields are price and lastModifiedDate
+**/
+type propertyAdSorter struct {
+	ads  []PropertyAd
+	by   string
+	desc bool
+}
+
+func (s propertyAdSorter) Len() int { return len(s.ads) }
+
+func (s propertyAdSorter) Swap(i, j int) { s.ads[i], s.ads[j] = s.ads[j], s.ads[i] }
+
+func (s propertyAdSorter) Less(i, j int) bool {
+	a, b := s.ads[i], s.ads[j]
+	if s.desc {
+		a, b = b, a
+	}
+	if s.by == "lastModifiedDate" && a.LastModifiedDate != b.LastModifiedDate {
+		return a.LastModifiedDate < b.LastModifiedDate
+	}
+	if s.by != "lastModifiedDate" && a.ListedPrice.Currency != b.ListedPrice.Currency {
+		return a.ListedPrice.Currency < b.ListedPrice.Currency
+	}
+	if s.by != "lastModifiedDate" && a.ListedPrice.Amount != b.ListedPrice.Amount {
+		return a.ListedPrice.Amount < b.ListedPrice.Amount
+	}
+	//Tie break on ID so that pagination is stable across peers
+	return a.ID < b.ID
+}
+
+/**
+Normalizes a value before it is used as part of an index name
+**/
+func NormalizeIndexValue(value string) string {
+	return strings.ToLower(strings.TrimSpace(value))
+}
+
+/**
+Splits free text into lower case words used by the keyword index
+**/
+func TokenizeText(text string) []string {
+	var tokens []string
+	seen := make(map[string]bool)
+
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !((r >= 'a' && r <= 'z') || (r >= '0' && r <= '9'))
+	})
+
+	for _, word := range words {
+		if len(word) < 2 || seen[word] {
+			continue
+		}
+		seen[word] = true
+		tokens = append(tokens, word)
+	}
+
+	return tokens
+}
+
+/**
+Returns the list of keys stored under keysName. Missing lists are returned empty
+**/
+func GetKeys(stub *shim.ChaincodeStub, keysName string) ([]string, error) {
+	var keys []string
+
+	bytes, err := stub.GetState(keysName)
+	if err != nil {
+		fmt.Println("GetKeys: Could not get keys for "+keysName+" ", err)
+		return keys, err
+	}
+
+	if len(bytes) == 0 {
+		return []string{}, nil
+	}
+
+	err = json.Unmarshal(bytes, &keys)
+	if err != nil {
+		fmt.Println("GetKeys: Could not unmarshal keys for "+keysName+" ", err)
+		return keys, err
+	}
+
+	return keys, nil
+}
+
+/**
+Removes a key from the list of keys stored under keysName
+**/
+func RemoveKey(stub *shim.ChaincodeStub, id string, keysName string) (bool, error) {
+	fmt.Println("Entering RemoveKey")
+
+	keys, err := GetKeys(stub, keysName)
+	if err != nil {
+		return false, err
+	}
+
+	var remaining []string
+	found := false
+	for _, key := range keys {
+		if key == id {
+			found = true
+			continue
+		}
+		remaining = append(remaining, key)
+	}
+
+	if !found {
+		return false, nil
+	}
+
+	if remaining == nil {
+		remaining = []string{}
+	}
+
+	bytes, _ := json.Marshal(&remaining)
+	err = stub.PutState(keysName, bytes)
+	if err != nil {
+		fmt.Println("RemoveKey: Error storing keys ", err)
+		return false, err
+	}
+
+	return true, nil
+}
+
+/**
+Adds a key to a secondary index if it is not already present
+**/
+func AddIndexEntry(stub *shim.ChaincodeStub, index string, value string, key string) error {
+	if len(NormalizeIndexValue(value)) == 0 {
+		return nil
+	}
+
+	indexKey := typeIndex + index + NormalizeIndexValue(value)
+
+	keys, err := GetKeys(stub, indexKey)
+	if err != nil {
+		return err
+	}
+
+	for _, k := range keys {
+		if k == key {
+			return nil
+		}
+	}
+
+	_, err = AddKey(stub, key, indexKey)
+	return err
+}
+
+/**
+Removes a key from a secondary index
+**/
+func RemoveIndexEntry(stub *shim.ChaincodeStub, index string, value string, key string) error {
+	if len(NormalizeIndexValue(value)) == 0 {
+		return nil
+	}
+
+	_, err := RemoveKey(stub, key, typeIndex+index+NormalizeIndexValue(value))
+	return err
+}
+
+/**
+Returns all keys stored in a secondary index for the given value
+**/
+func GetIndexEntries(stub *shim.ChaincodeStub, index string, value string) ([]string, error) {
+	return GetKeys(stub, typeIndex+index+NormalizeIndexValue(value))
+}
+
+/**
+Gets the list of property ad keys in a currency ordered by listed price
+**/
+func GetPriceIndex(stub *shim.ChaincodeStub, currency string) ([]PriceIndexEntry, error) {
+	var entries []PriceIndexEntry
+
+	bytes, err := stub.GetState(propertyAdPriceIndexName + currency)
+	if err != nil {
+		fmt.Println("GetPriceIndex: Could not get price index ", err)
+		return entries, err
+	}
+
+	if len(bytes) == 0 {
+		return []PriceIndexEntry{}, nil
+	}
+
+	err = json.Unmarshal(bytes, &entries)
+	if err != nil {
+		fmt.Println("GetPriceIndex: Could not unmarshal price index ", err)
+		return entries, err
+	}
+
+	return entries, nil
+}
+
+func SavePriceIndex(stub *shim.ChaincodeStub, currency string, entries []PriceIndexEntry) error {
+	if entries == nil {
+		entries = []PriceIndexEntry{}
+	}
+	bytes, _ := json.Marshal(&entries)
+	err := stub.PutState(propertyAdPriceIndexName+currency, bytes)
+	if err != nil {
+		fmt.Println("SavePriceIndex: Could not save price index ", err)
+		return err
+	}
+	return nil
+}
+
+/**
+Removes a property ad from the price index of a currency
+**/
+func RemoveFromPriceIndex(stub *shim.ChaincodeStub, key string, currency string) error {
+	entries, err := GetPriceIndex(stub, currency)
+	if err != nil {
+		return err
+	}
+
+	var updated []PriceIndexEntry
+	for _, entry := range entries {
+		if entry.Key != key {
+			updated = append(updated, entry)
+		}
+	}
+
+	if len(updated) == len(entries) {
+		return nil
+	}
+
+	return SavePriceIndex(stub, currency, updated)
+}
+
+/**
+Inserts or moves a property ad in the price index keeping the list sorted
+**/
+func UpdatePriceIndex(stub *shim.ChaincodeStub, key string, price Money) error {
+	entries, err := GetPriceIndex(stub, price.Currency)
+	if err != nil {
+		return err
+	}
+
+	var updated []PriceIndexEntry
+	for _, entry := range entries {
+		if entry.Key != key {
+			updated = append(updated, entry)
+		}
+	}
+
+	pos := sort.Search(len(updated), func(i int) bool {
+		return updated[i].Price > price.Amount || (updated[i].Price == price.Amount && updated[i].Key >= key)
+	})
+
+	updated = append(updated, PriceIndexEntry{})
+	copy(updated[pos+1:], updated[pos:])
+	updated[pos] = PriceIndexEntry{price.Amount, key}
+
+	return SavePriceIndex(stub, price.Currency, updated)
+}
+
+/**
+Returns the keys of property ads listed in a currency with a price between min and max
+inclusive. A max of 0 means there is no upper bound
+**/
+func GetKeysInPriceRange(stub *shim.ChaincodeStub, currency string, min int64, max int64) ([]string, error) {
+	entries, err := GetPriceIndex(stub, currency)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []string{}
+	start := sort.Search(len(entries), func(i int) bool { return entries[i].Price >= min })
+	for i := start; i < len(entries); i++ {
+		if max > 0 && entries[i].Price > max {
+			break
+		}
+		keys = append(keys, entries[i].Key)
+	}
+
+	return keys, nil
+}
+
+/**
+Adds a property ad to all secondary indexes
+**/
+func IndexPropertyAd(stub *shim.ChaincodeStub, pa PropertyAd) error {
+	fmt.Println("Entering IndexPropertyAd")
+
+	key, err := GetStateKey(pa.ID, PROPERTYAD)
+	if err != nil {
+		return err
+	}
+
+	indexes := map[string]string{
+		propertyAdCityIndex:   pa.City,
+		propertyAdBankIndex:   pa.BankID,
+		propertyAdSellerIndex: pa.SellerID,
+		propertyAdStatusIndex: pa.Status,
+	}
+
+	for index, value := range indexes {
+		err = AddIndexEntry(stub, index, value, key)
+		if err != nil {
+			fmt.Println("IndexPropertyAd: Could not update index "+index+" ", err)
+			return err
+		}
+	}
+
+	for _, word := range TokenizeText(pa.Description) {
+		err = AddIndexEntry(stub, propertyAdWordIndex, word, key)
+		if err != nil {
+			fmt.Println("IndexPropertyAd: Could not update keyword index ", err)
+			return err
+		}
+	}
+
+	for _, word := range TokenizeText(pa.Address) {
+		err = AddIndexEntry(stub, propertyAdAddressIndex, word, key)
+		if err != nil {
+			fmt.Println("IndexPropertyAd: Could not update address index ", err)
+			return err
+		}
+	}
+
+	return UpdatePriceIndex(stub, key, pa.ListedPrice)
+}
+
+/**
+Removes a property ad from all secondary indexes. Call before changing indexed fields
+**/
+func UnindexPropertyAd(stub *shim.ChaincodeStub, pa PropertyAd) error {
+	fmt.Println("Entering UnindexPropertyAd")
+
+	key, err := GetStateKey(pa.ID, PROPERTYAD)
+	if err != nil {
+		return err
+	}
+
+	indexes := map[string]string{
+		propertyAdCityIndex:   pa.City,
+		propertyAdBankIndex:   pa.BankID,
+		propertyAdSellerIndex: pa.SellerID,
+		propertyAdStatusIndex: pa.Status,
+	}
+
+	for index, value := range indexes {
+		err = RemoveIndexEntry(stub, index, value, key)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, word := range TokenizeText(pa.Description) {
+		err = RemoveIndexEntry(stub, propertyAdWordIndex, word, key)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, word := range TokenizeText(pa.Address) {
+		err = RemoveIndexEntry(stub, propertyAdAddressIndex, word, key)
+		if err != nil {
+			return err
+		}
+	}
+
+	return RemoveFromPriceIndex(stub, key, pa.ListedPrice.Currency)
+}
+
+/**
+Saves a property ad and keeps the secondary indexes in sync
+**/
+func SavePropertyAd(stub *shim.ChaincodeStub, pa PropertyAd) ([]byte, error) {
+	fmt.Println("Entering SavePropertyAd")
+
+	current, _, err := GetPropertyAd(stub, pa.ID)
+	if err == nil && len(current.ID) > 0 {
+		err = UnindexPropertyAd(stub, current)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	key, err := GetStateKey(pa.ID, PROPERTYAD)
+	if err != nil {
+		return nil, err
+	}
+
+	bytes, _ := json.Marshal(&pa)
+	err = stub.PutState(key, bytes)
+	if err != nil {
+		fmt.Println("SavePropertyAd: Could not save property ad ", err)
+		return nil, err
+	}
+
+	err = IndexPropertyAd(stub, pa)
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes, nil
+}
+
+/**
+Intersects candidate key lists. A nil list means the filter was not applied
+**/
+func intersectKeys(candidates []string, keys []string) []string {
+	if candidates == nil {
+		if keys == nil {
+			return []string{}
+		}
+		return keys
+	}
+
+	lookup := make(map[string]bool)
+	for _, key := range keys {
+		lookup[key] = true
+	}
+
+	result := []string{}
+	for _, key := range candidates {
+		if lookup[key] {
+			result = append(result, key)
+		}
+	}
+	return result
+}
+
+/**
+Checks the filters which cannot be answered from the indexes alone
+**/
+func matchesPropertyAd(pa PropertyAd, query PropertyAdSearchSchema) bool {
+	if !query.MinPrice.IsZero() {
+		cmp, err := pa.ListedPrice.Compare(query.MinPrice)
+		if err != nil || cmp < 0 {
+			return false
+		}
+	}
+	if !query.MaxPrice.IsZero() {
+		cmp, err := pa.ListedPrice.Compare(query.MaxPrice)
+		if err != nil || cmp > 0 {
+			return false
+		}
+	}
+
+	if len(NormalizeIndexValue(query.Address)) > 0 {
+		address := TokenizeText(pa.Address)
+		for _, word := range TokenizeText(query.Address) {
+			if !containsString(address, word) {
+				return false
+			}
+		}
+	}
+
+	if len(NormalizeIndexValue(query.Keyword)) > 0 {
+		description := strings.ToLower(pa.Description)
+		for _, word := range TokenizeText(query.Keyword) {
+			if !strings.Contains(description, word) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+/**
+Searches property ads using price, location, bank, seller, status and keyword filters.
+Candidates are resolved from the secondary indexes so only matching ads are read from state.
+args[0] is a PropertyAdSearchSchema json string
+**/
+func SearchPropertyAds(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+	fmt.Println("Entering SearchPropertyAds")
+
+	var query PropertyAdSearchSchema
+	if len(args) > 0 && len(strings.TrimSpace(args[0])) > 0 {
+		err := json.Unmarshal([]byte(args[0]), &query)
+		if err != nil {
+			fmt.Println("SearchPropertyAds: Could not unmarshal search query ", err)
+			return nil, errors.New("Invalid search query")
+		}
+	}
+
+	//Both ends of a price range must be in the same currency
+	priceCurrency := query.MinPrice.Currency
+	if query.MinPrice.IsZero() {
+		priceCurrency = query.MaxPrice.Currency
+	}
+	if query.MinPrice.Validate() != nil || query.MaxPrice.Validate() != nil {
+		return nil, errors.New("Invalid price range")
+	}
+	if !query.MinPrice.IsZero() && !query.MaxPrice.IsZero() {
+		cmp, err := query.MinPrice.Compare(query.MaxPrice)
+		if err != nil || cmp > 0 {
+			return nil, errors.New("Invalid price range")
+		}
+	}
+	if query.Offset < 0 {
+		return nil, errors.New("Invalid offset")
+	}
+	if query.Limit <= 0 {
+		query.Limit = DEFAULT_SEARCH_LIMIT
+	}
+	if query.Limit > MAX_SEARCH_LIMIT {
+		query.Limit = MAX_SEARCH_LIMIT
+	}
+
+	sortBy := strings.TrimSpace(query.SortBy)
+	if len(sortBy) == 0 {
+		sortBy = "price"
+	}
+	if sortBy != "price" && sortBy != "lastModifiedDate" {
+		return nil, errors.New("Invalid sort field " + sortBy)
+	}
+
+	//Resolve candidate keys from the indexes. nil means no index filter has been applied yet
+	var candidates []string
+
+	indexes := []struct {
+		index string
+		value string
+	}{
+		{propertyAdCityIndex, query.City},
+		{propertyAdBankIndex, query.BankId},
+		{propertyAdSellerIndex, query.SellerId},
+		{propertyAdStatusIndex, query.Status},
+	}
+
+	for _, idx := range indexes {
+		if len(NormalizeIndexValue(idx.value)) == 0 {
+			continue
+		}
+		keys, err := GetIndexEntries(stub, idx.index, idx.value)
+		if err != nil {
+			return nil, err
+		}
+		candidates = intersectKeys(candidates, keys)
+	}
+
+	for _, word := range TokenizeText(query.Keyword) {
+		keys, err := GetIndexEntries(stub, propertyAdWordIndex, word)
+		if err != nil {
+			return nil, err
+		}
+		candidates = intersectKeys(candidates, keys)
+	}
+
+	//An address matches when it has every word of the address searched for
+	for _, word := range TokenizeText(query.Address) {
+		keys, err := GetIndexEntries(stub, propertyAdAddressIndex, word)
+		if err != nil {
+			return nil, err
+		}
+		candidates = intersectKeys(candidates, keys)
+	}
+
+	if !query.MinPrice.IsZero() || !query.MaxPrice.IsZero() {
+		keys, err := GetKeysInPriceRange(stub, priceCurrency, query.MinPrice.Amount, query.MaxPrice.Amount)
+		if err != nil {
+			return nil, err
+		}
+		candidates = intersectKeys(candidates, keys)
+	}
+
+	if candidates == nil {
+		//No filters given, fall back to the full list of ads
+		keys, err := GetKeys(stub, propertyAdKeysName)
+		if err != nil {
+			return nil, err
+		}
+		candidates = keys
+	}
+
+	ads := []PropertyAd{}
+	for _, key := range candidates {
+		paBytes, err := stub.GetState(key)
+		if err != nil {
+			fmt.Println("SearchPropertyAds: Could not get property ad "+key+" ", err)
+			return nil, err
+		}
+		if len(paBytes) == 0 {
+			continue
+		}
+
+		var pa PropertyAd
+		err = json.Unmarshal(paBytes, &pa)
+		if err != nil {
+			fmt.Println("SearchPropertyAds: Could not unmarshal property ad "+key+" ", err)
+			return nil, err
+		}
+
+		if matchesPropertyAd(pa, query) {
+			ads = append(ads, pa)
+		}
+	}
+
+	sort.Sort(propertyAdSorter{ads, sortBy, strings.ToLower(query.SortOrder) == "desc"})
+
+	result := PropertyAdSearchResult{len(ads), query.Offset, query.Limit, []PropertyAd{}}
+	if query.Offset < len(ads) {
+		end := query.Offset + query.Limit
+		if end > len(ads) {
+			end = len(ads)
+		}
+		result.PropertyAds = ads[query.Offset:end]
+	}
+
+	bytes, err := json.Marshal(&result)
+	if err != nil {
+		fmt.Println("SearchPropertyAds: Could not marshal search result ", err)
+		return nil, err
+	}
+
+	return bytes, nil
+}
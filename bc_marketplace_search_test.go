@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestMatchesPropertyAdAddress(t *testing.T) {
+	pa := PropertyAd{ID: "pa1", Address: "12 Main Street, Springfield", ListedPrice: WholeUnits(300000, "USD")}
+
+	cases := []struct {
+		address string
+		want    bool
+	}{
+		{"", true},
+		{"main street", true},
+		{"MAIN", true},
+		{"springfield, 12", true},
+		{"main avenue", false},
+		{"mai", false},
+		{"13 main street", false},
+	}
+
+	for _, c := range cases {
+		if got := matchesPropertyAd(pa, PropertyAdSearchSchema{Address: c.address}); got != c.want {
+			t.Errorf("address %q: got %v, want %v", c.address, got, c.want)
+		}
+	}
+}
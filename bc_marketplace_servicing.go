@@ -0,0 +1,552 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//Delinquency buckets by days past due
+const BUCKET_CURRENT string = "Current"
+const BUCKET_1_29 string = "1-29"
+const BUCKET_30_59 string = "30-59"
+const BUCKET_60_89 string = "60-89"
+const BUCKET_90_PLUS string = "90+"
+
+//An installment still unpaid this many days after its due date is charged a late fee
+const LATE_FEE_GRACE_DAYS int = 15
+
+//Late fee as basis points of the scheduled installment
+const LATE_FEE_BPS int = 500
+
+type LoanPayment struct {
+	Sequence                  int    `json:"sequence"`
+	Amount                    Money  `json:"amount"`
+	Fees                      Money  `json:"fees"`
+	Interest                  Money  `json:"interest"`
+	Principal                 Money  `json:"principal"`
+	OutstandingPrincipalAfter Money  `json:"outstandingPrincipalAfter"`
+	DaysPastDue               int    `json:"daysPastDue"`
+	ReceivedAt                string `json:"receivedAt"`
+	RecordedBy                string `json:"recordedBy"`
+	Note                      string `json:"note"`
+}
+
+type LoanPaymentSchema struct {
+	Amount Money  `json:"amount"`
+	Note   string `json:"note"`
+}
+
+type LoanPaymentHistory struct {
+	LoanId                string        `json:"loanId"`
+	MortgageApplicationId string        `json:"mortgageApplicationId"`
+	BuyerId               string        `json:"buyerId"`
+	DaysPastDue           int           `json:"daysPastDue"`
+	DelinquencyBucket     string        `json:"delinquencyBucket"`
+	Payments              []LoanPayment `json:"payments"`
+}
+
+/**
+Returns the delinquency bucket for a number of days past due
+**/
+func DelinquencyBucket(daysPastDue int) string {
+	if daysPastDue <= 0 {
+		return BUCKET_CURRENT
+	} else if daysPastDue < 30 {
+		return BUCKET_1_29
+	} else if daysPastDue < 60 {
+		return BUCKET_30_59
+	} else if daysPastDue < 90 {
+		return BUCKET_60_89
+	}
+	return BUCKET_90_PLUS
+}
+
+/**
+Whole days from one date to another, ignoring the time of day
+**/
+func daysBetween(from time.Time, to time.Time) int {
+	from = time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, time.UTC)
+	to = time.Date(to.Year(), to.Month(), to.Day(), 0, 0, 0, 0, time.UTC)
+	return int(to.Sub(from).Hours() / 24)
+}
+
+/**
+Days from one date to another on the 30/360 basis the payment schedule uses. The last
+day of a month counts as the 30th, so every schedule period, including those ending on a
+shortened month end, is exactly 30 days
+**/
+func days360(from time.Time, to time.Time) int {
+	return 360*(to.Year()-from.Year()) + 30*(int(to.Month())-int(from.Month())) + day360(to) - day360(from)
+}
+
+/**
+Day of the month on the 30/360 basis
+**/
+func day360(date time.Time) int {
+	if date.Day() >= 30 || date.AddDate(0, 0, 1).Day() == 1 {
+		return 30
+	}
+	return date.Day()
+}
+
+/**
+Charges a late fee for every installment which is still unpaid past the grace period.
+Each installment is only charged once
+**/
+func assessLateFees(loan *Loan, schedule []ScheduleEntry, txTime time.Time) (Money, error) {
+	fees := Money{0, loan.Principal.Currency}
+
+	i := loan.LateFeesAssessed
+	if i < loan.InstallmentsPaid {
+		i = loan.InstallmentsPaid
+	}
+	for ; i < len(schedule); i++ {
+		due, err := time.Parse(loanDateLayout, schedule[i].DueDate)
+		if err != nil {
+			return fees, err
+		}
+		if daysBetween(due, txTime) <= LATE_FEE_GRACE_DAYS {
+			break
+		}
+		fees.Amount += lateFee(schedule[i].Payment.Amount)
+		loan.LateFeesAssessed = i + 1
+	}
+
+	loan.FeesOutstanding = Money{loan.FeesOutstanding.Amount + fees.Amount, loan.Principal.Currency}
+	return fees, nil
+}
+
+/**
+Late fee for one installment, rounded to the nearest minor unit
+**/
+func lateFee(installment int64) int64 {
+	return (installment*int64(LATE_FEE_BPS) + 5000) / 10000
+}
+
+/**
+Sets days past due and the delinquency bucket from the oldest unpaid installment
+**/
+func updateDelinquency(loan *Loan, schedule []ScheduleEntry, txTime time.Time) error {
+	loan.DaysPastDue = 0
+	if loan.InstallmentsPaid < len(schedule) {
+		due, err := time.Parse(loanDateLayout, schedule[loan.InstallmentsPaid].DueDate)
+		if err != nil {
+			return err
+		}
+		if days := daysBetween(due, txTime); days > 0 {
+			loan.DaysPastDue = days
+		}
+	}
+	loan.DelinquencyBucket = DelinquencyBucket(loan.DaysPastDue)
+	return nil
+}
+
+/**
+Interest accrued on the outstanding principal from the due date of the last paid
+installment to a date, less what was already paid towards the current installment's interest.
+Days are counted 30/360 like the schedule
+**/
+func accruedInterest(loan Loan, schedule []ScheduleEntry, asOf time.Time) (int64, error) {
+	from := loan.StartDate
+	if loan.InstallmentsPaid > 0 && loan.InstallmentsPaid <= len(schedule) {
+		from = schedule[loan.InstallmentsPaid-1].DueDate
+	}
+	since, err := time.Parse(loanDateLayout, from)
+	if err != nil {
+		return 0, err
+	}
+
+	days := days360(since, asOf)
+	if days <= 0 {
+		return 0, nil
+	}
+	interest := roundRat(big.NewRat(loan.OutstandingPrincipal.Amount*int64(loan.AnnualRateBps)*int64(days), 10000*360))
+
+	if loan.InstallmentsPaid < len(schedule) {
+		paid := loan.InstallmentProgress.Amount
+		if paid > schedule[loan.InstallmentsPaid].Interest.Amount {
+			paid = schedule[loan.InstallmentsPaid].Interest.Amount
+		}
+		interest -= paid
+	}
+	if interest < 0 {
+		interest = 0
+	}
+	return interest, nil
+}
+
+/**
+Applies a payment to outstanding fees first, then to the installments which are due and
+the next one, paying each installment's interest before its principal. Whatever is left
+prepays principal and shortens the schedule. A payment covering the outstanding principal
+and the interest accrued on it pays the loan off
+**/
+func allocateLoanPayment(loan *Loan, schedule []ScheduleEntry, amount int64, txTime time.Time) (int64, int64, int64, error) {
+	var fees, interest, principal int64
+	currency := loan.Principal.Currency
+
+	fees = loan.FeesOutstanding.Amount
+	if fees > amount {
+		fees = amount
+	}
+	amount -= fees
+	loan.FeesOutstanding.Amount -= fees
+
+	accrued, err := accruedInterest(*loan, schedule, txTime)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if amount > 0 && amount >= accrued+loan.OutstandingPrincipal.Amount {
+		if amount > accrued+loan.OutstandingPrincipal.Amount {
+			return 0, 0, 0, errors.New("Payment exceeds the payoff amount of loan " + loan.ID + " by " + Money{amount - accrued - loan.OutstandingPrincipal.Amount, currency}.String())
+		}
+		//The scheduled balance before the current installment is cleared, so the schedule ends here
+		if loan.InstallmentsPaid < len(schedule) {
+			entry := schedule[loan.InstallmentsPaid]
+			loan.Curtailments = append(loan.Curtailments, Curtailment{loan.InstallmentsPaid, Money{entry.Balance.Amount + entry.Principal.Amount, currency}, txTime.Format(dateLayout)})
+		}
+		interest = accrued
+		principal = loan.OutstandingPrincipal.Amount
+		loan.InstallmentProgress = Money{0, currency}
+		loan.OutstandingPrincipal = Money{0, currency}
+		return fees, interest, principal, nil
+	}
+
+	//Installments past their due date are paid, and the next one which is not
+	due := loan.InstallmentsPaid
+	for due < len(schedule) {
+		dueDate, err := time.Parse(loanDateLayout, schedule[due].DueDate)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		due++
+		if dueDate.After(txTime) {
+			break
+		}
+	}
+
+	progress := loan.InstallmentProgress.Amount
+	for amount > 0 && loan.InstallmentsPaid < due {
+		entry := schedule[loan.InstallmentsPaid]
+
+		apply := entry.Payment.Amount - progress
+		if apply > amount {
+			apply = amount
+		}
+
+		interestDue := entry.Interest.Amount - progress
+		if interestDue < 0 {
+			interestDue = 0
+		}
+		if interestDue > apply {
+			interestDue = apply
+		}
+		interest += interestDue
+		principal += apply - interestDue
+
+		progress += apply
+		amount -= apply
+		if progress == entry.Payment.Amount {
+			loan.InstallmentsPaid++
+			progress = 0
+		}
+	}
+
+	if amount > 0 {
+		if amount > loan.OutstandingPrincipal.Amount-principal {
+			return 0, 0, 0, errors.New("Payment exceeds the amount owed on loan " + loan.ID + " by " + Money{amount - loan.OutstandingPrincipal.Amount + principal, currency}.String())
+		}
+		loan.Curtailments = append(loan.Curtailments, Curtailment{loan.InstallmentsPaid, Money{amount, currency}, txTime.Format(dateLayout)})
+		principal += amount
+	}
+
+	loan.InstallmentProgress = Money{progress, currency}
+	loan.OutstandingPrincipal.Amount -= principal
+
+	return fees, interest, principal, nil
+}
+
+/**
+Brings late fees and delinquency up to date as of the transaction time
+**/
+func refreshLoanStatus(loan *Loan, schedule []ScheduleEntry, txTime time.Time) (Money, error) {
+	fees, err := assessLateFees(loan, schedule, txTime)
+	if err != nil {
+		return fees, err
+	}
+	err = updateDelinquency(loan, schedule, txTime)
+	return fees, err
+}
+
+/**
+Records a borrower payment against a loan. Only the servicing bank can record payments.
+The payment is allocated to fees, interest and principal and the loan's delinquency is
+computed from the transaction timestamp.
+args[0] is the loan id and args[1] a LoanPaymentSchema json string
+**/
+func RecordPayment(stub *shim.ChaincodeStub, callerId string, callerAffiliation int, args []string) ([]byte, error) {
+	fmt.Println("Entering RecordPayment")
+
+	if len(args) < 2 {
+		fmt.Println("RecordPayment: expected two arguments")
+		return nil, errors.New("Could not record payment. Invalid input")
+	}
+
+	loan, err := LoadLoan(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	err = Authorize(stub, callerId, callerAffiliation, LOAN, OP_UPDATE, loan)
+	if err != nil {
+		return nil, err
+	}
+
+	if loan.Status != LOAN_ACTIVE {
+		return nil, errors.New("Loan " + loan.ID + " is " + loan.Status)
+	}
+
+	var input LoanPaymentSchema
+	err = json.Unmarshal([]byte(args[1]), &input)
+	if err != nil {
+		fmt.Println("RecordPayment: Could not unmarshal input ", err)
+		return nil, err
+	}
+
+	if input.Amount.Amount <= 0 {
+		return nil, errors.New("Payment amount must be greater than zero")
+	}
+
+	err = SameCurrency(input.Amount, loan.Principal)
+	if err != nil {
+		return nil, errors.New("Payments on loan " + loan.ID + " must be in " + loan.Principal.Currency)
+	}
+
+	schedule, err := GenerateAmortizationSchedule(loan)
+	if err != nil {
+		return nil, err
+	}
+
+	txTime, err := GetTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	now := txTime.Format(dateLayout)
+
+	lateFees, err := refreshLoanStatus(&loan, schedule, txTime)
+	if err != nil {
+		return nil, err
+	}
+	daysPastDue := loan.DaysPastDue
+
+	curtailments := len(loan.Curtailments)
+	fees, interest, principal, err := allocateLoanPayment(&loan, schedule, input.Amount.Amount, txTime)
+	if err != nil {
+		return nil, err
+	}
+
+	//A prepayment changes the installments still to pay
+	schedule, err = GenerateAmortizationSchedule(loan)
+	if err != nil {
+		return nil, err
+	}
+
+	err = updateDelinquency(&loan, schedule, txTime)
+	if err != nil {
+		return nil, err
+	}
+
+	currency := loan.Principal.Currency
+	payment := LoanPayment{len(loan.Payments) + 1, input.Amount, Money{fees, currency}, Money{interest, currency}, Money{principal, currency}, loan.OutstandingPrincipal, daysPastDue, now, callerId, input.Note}
+	loan.Payments = append(loan.Payments, payment)
+
+	if loan.OutstandingPrincipal.IsZero() && loan.FeesOutstanding.IsZero() {
+		loan.Status = LOAN_PAID_OFF
+	}
+	loan.LastModifiedDate = now
+
+	bytes, err := SaveLoan(stub, loan)
+	if err != nil {
+		return nil, err
+	}
+
+	if !lateFees.IsZero() {
+		AppendMALog(stub, "RecordPayment", "Late fees of "+lateFees.String()+" assessed", loan.Status, loan.ID)
+	}
+	msg := callerId + " recorded payment of " + input.Amount.String() + " from " + loan.BuyerId + ": fees " + payment.Fees.String() + ", interest " + payment.Interest.String() + ", principal " + payment.Principal.String() + ". Outstanding principal " + loan.OutstandingPrincipal.String() + ", " + strconv.Itoa(loan.DaysPastDue) + " days past due"
+	AppendMALog(stub, "RecordPayment", msg, loan.Status, loan.ID)
+	AppendMALog(stub, "RecordPayment", msg, loan.Status, loan.MortgageApplicationId)
+	if len(loan.Curtailments) > curtailments && loan.Status == LOAN_ACTIVE {
+		AppendMALog(stub, "RecordPayment", "Principal of "+loan.Curtailments[curtailments].Amount.String()+" prepaid, "+strconv.Itoa(len(schedule)-loan.InstallmentsPaid)+" installments remain", loan.Status, loan.ID)
+	}
+
+	return bytes, nil
+}
+
+/**
+Recomputes late fees and delinquency for a loan without a payment, e.g. at the end of
+a servicing day. Only the servicing bank can refresh a loan.
+args[0] is the loan id
+**/
+func RefreshLoanDelinquency(stub *shim.ChaincodeStub, callerId string, callerAffiliation int, args []string) ([]byte, error) {
+	fmt.Println("Entering RefreshLoanDelinquency")
+
+	if len(args) < 1 {
+		fmt.Println("RefreshLoanDelinquency: expected 1 argument")
+		return nil, errors.New("Could not refresh loan. Invalid input")
+	}
+
+	loan, err := LoadLoan(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	err = Authorize(stub, callerId, callerAffiliation, LOAN, OP_UPDATE, loan)
+	if err != nil {
+		return nil, err
+	}
+
+	if loan.Status != LOAN_ACTIVE {
+		return nil, errors.New("Loan " + loan.ID + " is " + loan.Status)
+	}
+
+	schedule, err := GenerateAmortizationSchedule(loan)
+	if err != nil {
+		return nil, err
+	}
+
+	txTime, err := GetTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	previousBucket := loan.DelinquencyBucket
+	lateFees, err := refreshLoanStatus(&loan, schedule, txTime)
+	if err != nil {
+		return nil, err
+	}
+	loan.LastModifiedDate = txTime.Format(dateLayout)
+
+	bytes, err := SaveLoan(stub, loan)
+	if err != nil {
+		return nil, err
+	}
+
+	if !lateFees.IsZero() {
+		AppendMALog(stub, "RefreshLoanDelinquency", "Late fees of "+lateFees.String()+" assessed", loan.Status, loan.ID)
+	}
+	if previousBucket != loan.DelinquencyBucket {
+		AppendMALog(stub, "RefreshLoanDelinquency", "Delinquency changed from "+previousBucket+" to "+loan.DelinquencyBucket+", "+strconv.Itoa(loan.DaysPastDue)+" days past due", loan.Status, loan.ID)
+	}
+
+	return bytes, nil
+}
+
+/**
+Returns the amount which pays a loan off on a date: the outstanding principal, the
+interest accrued on it and any fees, including late fees due by then.
+args[0] is the loan id and args[1] the payoff date
+**/
+func GetLoanPayoff(stub *shim.ChaincodeStub, callerId string, callerAffiliation int, args []string) ([]byte, error) {
+	fmt.Println("Entering GetLoanPayoff")
+
+	if len(args) < 2 {
+		fmt.Println("GetLoanPayoff: expected two arguments")
+		return nil, errors.New("Could not get loan payoff. Invalid input")
+	}
+
+	loan, _, err := GetLoan(stub, callerId, callerAffiliation, args)
+	if err != nil {
+		return nil, err
+	}
+
+	payoffDate, err := time.Parse(loanDateLayout, strings.TrimSpace(args[1]))
+	if err != nil {
+		return nil, errors.New("Invalid payoff date " + args[1] + ". Expected " + loanDateLayout)
+	}
+
+	schedule, err := GenerateAmortizationSchedule(loan)
+	if err != nil {
+		return nil, err
+	}
+
+	currency := loan.Principal.Currency
+	var result LoanPayoffResult
+	result.LoanId = loan.ID
+	result.PayoffDate = payoffDate.Format(loanDateLayout)
+	result.OutstandingPrincipal = loan.OutstandingPrincipal
+	result.AccruedInterest = Money{0, currency}
+
+	if loan.Status == LOAN_ACTIVE {
+		_, err = assessLateFees(&loan, schedule, payoffDate)
+		if err != nil {
+			return nil, err
+		}
+		accrued, err := accruedInterest(loan, schedule, payoffDate)
+		if err != nil {
+			return nil, err
+		}
+		result.AccruedInterest.Amount = accrued
+	}
+	result.FeesOutstanding = loan.FeesOutstanding
+	result.PayoffAmount = Money{result.OutstandingPrincipal.Amount + result.AccruedInterest.Amount + result.FeesOutstanding.Amount, currency}
+
+	bytes, err := json.Marshal(&result)
+	if err != nil {
+		fmt.Println("GetLoanPayoff: Could not marshal payoff ", err)
+		return nil, err
+	}
+
+	return bytes, nil
+}
+
+/**
+Returns payment history. With a loan id, the history of that loan. Without, the
+history of every loan of the calling buyer or bank
+**/
+func GetLoanPayments(stub *shim.ChaincodeStub, callerId string, callerAffiliation int, args []string) ([]byte, error) {
+	fmt.Println("Entering GetLoanPayments")
+
+	var loans []Loan
+
+	if len(args) > 0 && len(strings.TrimSpace(args[0])) > 0 {
+		loan, _, err := GetLoan(stub, callerId, callerAffiliation, args)
+		if err != nil {
+			return nil, err
+		}
+		loans = append(loans, loan)
+	} else {
+		bytes, err := GetLoans(stub, callerId, callerAffiliation, args)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(bytes, &loans)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	history := []LoanPaymentHistory{}
+	for _, loan := range loans {
+		payments := loan.Payments
+		if payments == nil {
+			payments = []LoanPayment{}
+		}
+		history = append(history, LoanPaymentHistory{loan.ID, loan.MortgageApplicationId, loan.BuyerId, loan.DaysPastDue, loan.DelinquencyBucket, payments})
+	}
+
+	bytes, err := json.Marshal(&history)
+	if err != nil {
+		fmt.Println("GetLoanPayments: Could not marshal payment history ", err)
+		return nil, err
+	}
+
+	return bytes, nil
+}
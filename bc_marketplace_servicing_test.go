@@ -0,0 +1,165 @@
+package main
+
+import (
+	"math/big"
+	"testing"
+	"time"
+)
+
+func testDate(t *testing.T, date string) time.Time {
+	d, err := time.Parse(loanDateLayout, date)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func testLoan(t *testing.T, startDate string) (Loan, []ScheduleEntry) {
+	loan := Loan{
+		ID:            "loan1",
+		Principal:     Money{30000000, "USD"},
+		AnnualRateBps: 650,
+		TermMonths:    12,
+		StartDate:     startDate,
+		Status:        LOAN_ACTIVE,
+	}
+	loan.MonthlyPayment = Money{MonthlyPayment(loan.Principal.Amount, loan.AnnualRateBps, loan.TermMonths), "USD"}
+	loan.OutstandingPrincipal = loan.Principal
+	loan.InstallmentProgress = Money{0, "USD"}
+	loan.FeesOutstanding = Money{0, "USD"}
+
+	schedule, err := GenerateAmortizationSchedule(loan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loan, schedule
+}
+
+func TestDays360(t *testing.T) {
+	cases := []struct {
+		from string
+		to   string
+		want int
+	}{
+		{"2026-01-15", "2026-02-15", 30},
+		{"2026-01-31", "2026-02-28", 30},
+		{"2026-02-28", "2026-03-31", 30},
+		{"2028-02-28", "2028-02-29", 2},
+		{"2026-01-15", "2026-01-20", 5},
+		{"2026-03-31", "2026-04-15", 15},
+		{"2026-01-15", "2027-01-15", 360},
+		{"2026-02-15", "2026-02-10", -5},
+	}
+
+	for _, c := range cases {
+		got := days360(testDate(t, c.from), testDate(t, c.to))
+		if got != c.want {
+			t.Errorf("days360(%s, %s) is %d, want %d", c.from, c.to, got, c.want)
+		}
+	}
+}
+
+func TestAccruedInterestMatchesSchedule(t *testing.T) {
+	for _, start := range []string{"2026-01-15", "2026-01-31", "2026-01-30"} {
+		loan, schedule := testLoan(t, start)
+		for i, entry := range schedule {
+			loan.InstallmentsPaid = i
+			loan.OutstandingPrincipal = Money{entry.Balance.Amount + entry.Principal.Amount, "USD"}
+			accrued, err := accruedInterest(loan, schedule, testDate(t, entry.DueDate))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if accrued != entry.Interest.Amount {
+				t.Errorf("start %s installment %d: accrued %d, scheduled %d", start, entry.Number, accrued, entry.Interest.Amount)
+			}
+		}
+	}
+}
+
+func TestAllocateLoanPayment(t *testing.T) {
+	_, s := testLoan(t, "2026-01-15")
+	principal := int64(30000000)
+	payoff := principal + s[0].Interest.Amount
+
+	cases := []struct {
+		name          string
+		fees          int64
+		amount        int64
+		date          string
+		wantFees      int64
+		wantInterest  int64
+		wantPrincipal int64
+		wantPaid      int
+		wantErr       bool
+	}{
+		{"fees before installments", 5000, 5000 + s[0].Interest.Amount, "2026-02-15", 5000, s[0].Interest.Amount, 0, 0, false},
+		{"installment on its due date", 0, s[0].Payment.Amount, "2026-02-15", 0, s[0].Interest.Amount, s[0].Principal.Amount, 1, false},
+		{"installment paid early", 0, s[0].Payment.Amount, "2026-02-01", 0, s[0].Interest.Amount, s[0].Principal.Amount, 1, false},
+		{"partial payment pays interest first", 0, s[0].Interest.Amount / 2, "2026-02-15", 0, s[0].Interest.Amount / 2, 0, 0, false},
+		{"two overdue installments", 0, s[0].Payment.Amount + s[1].Payment.Amount, "2026-03-20", 0, s[0].Interest.Amount + s[1].Interest.Amount, s[0].Principal.Amount + s[1].Principal.Amount, 2, false},
+		{"extra prepays principal", 0, s[0].Payment.Amount + s[1].Payment.Amount + 1000000, "2026-02-15", 0, s[0].Interest.Amount + s[1].Interest.Amount, s[0].Principal.Amount + s[1].Principal.Amount + 1000000, 2, false},
+		{"payoff", 0, payoff, "2026-02-15", 0, s[0].Interest.Amount, principal, 0, false},
+		{"more than the payoff", 0, payoff + 1, "2026-02-15", 0, 0, 0, 0, true},
+	}
+
+	for _, c := range cases {
+		loan, schedule := testLoan(t, "2026-01-15")
+		loan.FeesOutstanding = Money{c.fees, "USD"}
+
+		fees, interest, paid, err := allocateLoanPayment(&loan, schedule, c.amount, testDate(t, c.date))
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected an error", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", c.name, err)
+			continue
+		}
+		if fees != c.wantFees || interest != c.wantInterest || paid != c.wantPrincipal {
+			t.Errorf("%s: allocated fees %d interest %d principal %d, want %d %d %d", c.name, fees, interest, paid, c.wantFees, c.wantInterest, c.wantPrincipal)
+		}
+		if fees+interest+paid != c.amount {
+			t.Errorf("%s: allocated %d of %d", c.name, fees+interest+paid, c.amount)
+		}
+		if loan.OutstandingPrincipal.Amount != principal-c.wantPrincipal {
+			t.Errorf("%s: outstanding principal is %d, want %d", c.name, loan.OutstandingPrincipal.Amount, principal-c.wantPrincipal)
+		}
+		if loan.OutstandingPrincipal.Amount > 0 && loan.InstallmentsPaid != c.wantPaid {
+			t.Errorf("%s: %d installments paid, want %d", c.name, loan.InstallmentsPaid, c.wantPaid)
+		}
+	}
+}
+
+func TestPayoffAccruedInterest(t *testing.T) {
+	loan, schedule := testLoan(t, "2026-01-15")
+	loan.InstallmentsPaid = 1
+	loan.OutstandingPrincipal = schedule[0].Balance
+	full := schedule[1].Interest.Amount
+
+	cases := []struct {
+		name     string
+		progress int64
+		date     string
+		want     int64
+	}{
+		{"on the last due date", 0, "2026-02-15", 0},
+		{"before the last due date", 0, "2026-02-10", 0},
+		{"16 days into the period", 0, "2026-03-01", roundRat(big.NewRat(loan.OutstandingPrincipal.Amount*int64(loan.AnnualRateBps)*16, 3600000))},
+		{"on the next due date", 0, "2026-03-15", full},
+		{"interest partly paid", 1000, "2026-03-15", full - 1000},
+		{"interest paid in full", full + 500, "2026-03-15", 0},
+	}
+
+	for _, c := range cases {
+		loan.InstallmentProgress = Money{c.progress, "USD"}
+		got, err := accruedInterest(loan, schedule, testDate(t, c.date))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != c.want {
+			t.Errorf("%s: accrued %d, want %d", c.name, got, c.want)
+		}
+	}
+}
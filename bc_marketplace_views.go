@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//Views of a mortgage application
+const VIEW_NONE string = ""
+const VIEW_FULL string = "full"
+const VIEW_AUDITOR string = "auditor"
+const VIEW_APPRAISER string = "appraiser"
+
+//Hours an auditor sees unmasked contact details after requesting it
+const UNMASK_GRANT_HOURS int = 24
+
+/**
+An auditor's request to see the contact details of a mortgage application unmasked
+**/
+type UnmaskGrant struct {
+	AuditorId string `json:"auditorId"`
+	Reason    string `json:"reason"`
+	GrantedAt string `json:"grantedAt"`
+	ExpiresAt string `json:"expiresAt"`
+}
+
+/**
+Returns true if the auditor has an unmask grant on the application which has not expired
+**/
+func HasActiveUnmaskGrant(ma MortgageApplication, auditorId string, now time.Time) bool {
+	for _, grant := range ma.UnmaskGrants {
+		if grant.AuditorId != auditorId {
+			continue
+		}
+		expires, err := time.Parse(dateLayout, grant.ExpiresAt)
+		if err == nil && now.Before(expires) {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+Returns the projection of a mortgage application for a caller's relationships to it.
+Applicants and the reviewing bank see everything, auditors see contact details masked
+unless they hold an unmask grant and the appraiser on the linked appraiser application
+sees the property and the amounts. Whether the caller may read the application at all is
+decided by Authorize, this only picks what they see
+**/
+func mortgageApplicationView(callerAffiliation int, relationships []string, unmasked bool) string {
+	if containsString(relationships, REL_APPLICANT) || containsString(relationships, REL_REVIEWER) {
+		return VIEW_FULL
+	}
+	if callerAffiliation == AUDITOR_A {
+		if unmasked {
+			return VIEW_FULL
+		}
+		return VIEW_AUDITOR
+	}
+	if containsString(relationships, REL_APPRAISER) {
+		return VIEW_APPRAISER
+	}
+	return VIEW_NONE
+}
+
+/**
+Returns the view of a mortgage application for a caller Authorize has let read it
+**/
+func MortgageApplicationView(stub *shim.ChaincodeStub, ma MortgageApplication, callerId string, callerAffiliation int) string {
+	_, relationships := callerRelationships(stub, callerId, ma)
+
+	unmasked := false
+	if callerAffiliation == AUDITOR_A {
+		txTime, err := GetTxTime(stub)
+		unmasked = err == nil && HasActiveUnmaskGrant(ma, callerId, txTime)
+	}
+	return mortgageApplicationView(callerAffiliation, relationships, unmasked)
+}
+
+/**
+Keeps the last keep characters of a value and masks the rest
+**/
+func maskValue(value string, keep int) string {
+	if len(value) <= keep {
+		return strings.Repeat("*", len(value))
+	}
+	return strings.Repeat("*", len(value)-keep) + value[len(value)-keep:]
+}
+
+/**
+Masks the local part of an email address except its first character
+**/
+func maskEmail(email string) string {
+	at := strings.LastIndex(email, "@")
+	if at < 1 {
+		return maskValue(email, 0)
+	}
+	return email[:1] + strings.Repeat("*", at-1) + email[at:]
+}
+
+func maskContactDetails(info PersonalInfo) PersonalInfo {
+	info.Phone = maskValue(info.Phone, 4)
+	info.Mobile = maskValue(info.Mobile, 4)
+	info.Email = maskEmail(info.Email)
+	return info
+}
+
+/**
+Returns a copy of the mortgage application reduced to the given view. The application
+passed in is not modified
+**/
+func ProjectMortgageApplication(ma MortgageApplication, view string) MortgageApplication {
+	switch view {
+	case VIEW_FULL:
+		return ma
+	case VIEW_AUDITOR:
+		masked := ma
+		masked.PersonalInfo = maskContactDetails(ma.PersonalInfo)
+		masked.CoApplicants = make([]CoApplicant, len(ma.CoApplicants))
+		for i, co := range ma.CoApplicants {
+			co.PersonalInfo = maskContactDetails(co.PersonalInfo)
+			masked.CoApplicants[i] = co
+		}
+		return masked
+	case VIEW_APPRAISER:
+		//The property to appraise, the amount requested against it and the value appraised
+		var reduced MortgageApplication
+		reduced.ID = ma.ID
+		reduced.PropertyId = ma.PropertyId
+		reduced.LandId = ma.LandId
+		reduced.PermitId = ma.PermitId
+		reduced.AppraisalApplicationId = ma.AppraisalApplicationId
+		reduced.Status = ma.Status
+		reduced.RequestedAmount = ma.RequestedAmount
+		reduced.FairMarketValue = ma.FairMarketValue
+		reduced.ReviewerId = ma.ReviewerId
+		reduced.LastModifiedDate = ma.LastModifiedDate
+		return reduced
+	}
+	return MortgageApplication{}
+}
+
+/**
+Marshals the view of a mortgage application the caller is entitled to
+**/
+func MortgageApplicationViewBytes(stub *shim.ChaincodeStub, ma MortgageApplication, callerId string, callerAffiliation int) ([]byte, error) {
+	err := Authorize(stub, callerId, callerAffiliation, MORTGAGEAPPLICATION, OP_READ, ma)
+	if err != nil {
+		return nil, err
+	}
+
+	view := MortgageApplicationView(stub, ma, callerId, callerAffiliation)
+	if view == VIEW_NONE {
+		return nil, errors.New("User " + callerId + " does not have rights to access mortgageApplication with id " + ma.ID)
+	}
+	projected := ProjectMortgageApplication(ma, view)
+	return json.Marshal(&projected)
+}
+
+/**
+An auditor requests to see the contact details of a mortgage application unmasked. The
+reason is written to the application's log and the grant expires after UNMASK_GRANT_HOURS.
+args[0] is the mortgage application id and args[1] the reason
+**/
+func UnmaskMortgageApplication(stub *shim.ChaincodeStub, callerId string, callerAffiliation int, args []string) ([]byte, error) {
+	fmt.Println("Entering UnmaskMortgageApplication")
+
+	if len(args) < 2 {
+		fmt.Println("UnmaskMortgageApplication: expected two arguments")
+		return nil, errors.New("Could not unmask mortgage application. Invalid input")
+	}
+
+	reason := strings.TrimSpace(args[1])
+	if len(reason) == 0 {
+		return nil, errors.New("A reason is required to unmask a mortgage application")
+	}
+
+	ma, _, err := GetMortgageApplication(stub, callerId, callerAffiliation, []string{args[0]})
+	if err != nil {
+		return nil, err
+	}
+
+	err = Authorize(stub, callerId, callerAffiliation, MORTGAGEAPPLICATION, OP_UNMASK, ma)
+	if err != nil {
+		return nil, err
+	}
+
+	txTime, err := GetTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	grant := UnmaskGrant{callerId, reason, txTime.Format(dateLayout), txTime.Add(time.Duration(UNMASK_GRANT_HOURS) * time.Hour).Format(dateLayout)}
+	ma.UnmaskGrants = append(ma.UnmaskGrants, grant)
+
+	_, err = SaveMortgageApplication(stub, ma, ma.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	AppendMALog(stub, "UnmaskMortgageApplication", callerId+" unmasked contact details for "+strconv.Itoa(UNMASK_GRANT_HOURS)+" hours until "+grant.ExpiresAt+". Reason: "+reason, ma.Status, ma.ID)
+
+	bytes, err := json.Marshal(&grant)
+	if err != nil {
+		return nil, err
+	}
+	return bytes, nil
+}
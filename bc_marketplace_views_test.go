@@ -0,0 +1,70 @@
+package main
+
+import "testing"
+
+func TestProjectMortgageApplication(t *testing.T) {
+	info := PersonalInfo{Firstname: "Ann", Lastname: "Lee", DOB: "1980-01-01", Phone: "5551234567", Mobile: "5559876543", Email: "ann@example.com"}
+	ma := MortgageApplication{
+		ID:              "ma1",
+		PropertyId:      "property1",
+		BuyerId:         "buyer1",
+		ReviewerId:      "bank1",
+		Status:          "Submitted",
+		PersonalInfo:    info,
+		FinancialInfo:   FinancialInfo{MonthlySalary: Money{500000, "USD"}},
+		CoApplicants:    []CoApplicant{{BuyerId: "buyer2", PersonalInfo: info}},
+		RequestedAmount: Money{30000000, "USD"},
+	}
+
+	full := ProjectMortgageApplication(ma, VIEW_FULL)
+	if full.PersonalInfo != info || full.FinancialInfo != ma.FinancialInfo {
+		t.Errorf("full view changed the application")
+	}
+
+	masked := PersonalInfo{Firstname: "Ann", Lastname: "Lee", DOB: "1980-01-01", Phone: "******4567", Mobile: "******6543", Email: "a**@example.com"}
+	auditor := ProjectMortgageApplication(ma, VIEW_AUDITOR)
+	if auditor.PersonalInfo != masked {
+		t.Errorf("auditor view shows %v, want %v", auditor.PersonalInfo, masked)
+	}
+	if len(auditor.CoApplicants) != 1 || auditor.CoApplicants[0].PersonalInfo != masked {
+		t.Errorf("auditor view shows co-applicants %v", auditor.CoApplicants)
+	}
+	if auditor.FinancialInfo != ma.FinancialInfo {
+		t.Errorf("auditor view changed the financial info")
+	}
+	if ma.PersonalInfo != info || ma.CoApplicants[0].PersonalInfo != info {
+		t.Errorf("auditor view modified the application passed in")
+	}
+
+	appraiser := ProjectMortgageApplication(ma, VIEW_APPRAISER)
+	if appraiser.ID != ma.ID || appraiser.PropertyId != ma.PropertyId || appraiser.RequestedAmount != ma.RequestedAmount {
+		t.Errorf("appraiser view is missing the property or amount %v", appraiser)
+	}
+	if appraiser.PersonalInfo != (PersonalInfo{}) || appraiser.FinancialInfo != (FinancialInfo{}) || appraiser.BuyerId != "" || len(appraiser.CoApplicants) != 0 {
+		t.Errorf("appraiser view shows applicant data %v", appraiser)
+	}
+
+	none := ProjectMortgageApplication(ma, VIEW_NONE)
+	if none.ID != "" || none.PersonalInfo != (PersonalInfo{}) {
+		t.Errorf("no view shows %v", none)
+	}
+}
+
+func TestMaskEmail(t *testing.T) {
+	cases := []struct {
+		email string
+		want  string
+	}{
+		{"ann@example.com", "a**@example.com"},
+		{"a@example.com", "a@example.com"},
+		{"not-an-email", "************"},
+		{"", ""},
+	}
+
+	for _, c := range cases {
+		got := maskEmail(c.email)
+		if got != c.want {
+			t.Errorf("maskEmail(%s) is %s, want %s", c.email, got, c.want)
+		}
+	}
+}